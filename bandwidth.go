@@ -0,0 +1,235 @@
+package dmsg
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+// BandwidthLimit limits the rates in which a server relays data of a client, in bytes per second.
+// Ingress is data sent by the client, and egress is data sent to the client. Zero imposes no limit.
+type BandwidthLimit struct {
+	Ingress int `json:"ingress"`
+	Egress  int `json:"egress"`
+}
+
+// BandwidthStats contains the bandwidth usage of a client at a server.
+type BandwidthStats struct {
+	IngressBytes     uint64 `json:"ingress_bytes"`     // Total bytes relayed from the client.
+	EgressBytes      uint64 `json:"egress_bytes"`      // Total bytes relayed to the client.
+	IngressThrottled uint64 `json:"ingress_throttled"` // Number of times relaying from the client is delayed.
+	EgressThrottled  uint64 `json:"egress_throttled"`  // Number of times relaying to the client is delayed.
+}
+
+// clientBandwidth shapes and records the bandwidth of a single client.
+type clientBandwidth struct {
+	in, out *netutil.TokenBucket // guarded by mx
+	mx      sync.RWMutex
+	sched   *egressScheduler // schedules data relayed to the client across source clients (if egress is limited)
+	stats   BandwidthStats   // atomic
+	refs    int              // number of relayed streams, guarded by bandwidthLimiter.mx
+}
+
+func newClientBandwidth(limit BandwidthLimit) *clientBandwidth {
+	cb := &clientBandwidth{sched: newEgressScheduler(egressMaxTurn)}
+	cb.setLimit(limit)
+	return cb
+}
+
+// setLimit replaces the buckets of the client, so that data relayed from now on is shaped by the given limit.
+func (cb *clientBandwidth) setLimit(limit BandwidthLimit) {
+	cb.mx.Lock()
+	cb.in = netutil.NewTokenBucket(limit.Ingress, 0)
+	cb.out = netutil.NewTokenBucket(limit.Egress, 0)
+	cb.mx.Unlock()
+}
+
+func (cb *clientBandwidth) ingress() *netutil.TokenBucket {
+	cb.mx.RLock()
+	defer cb.mx.RUnlock()
+	return cb.in
+}
+
+func (cb *clientBandwidth) egress() *netutil.TokenBucket {
+	cb.mx.RLock()
+	defer cb.mx.RUnlock()
+	return cb.out
+}
+
+func (cb *clientBandwidth) getStats() BandwidthStats {
+	return BandwidthStats{
+		IngressBytes:     atomic.LoadUint64(&cb.stats.IngressBytes),
+		EgressBytes:      atomic.LoadUint64(&cb.stats.EgressBytes),
+		IngressThrottled: atomic.LoadUint64(&cb.stats.IngressThrottled),
+		EgressThrottled:  atomic.LoadUint64(&cb.stats.EgressThrottled),
+	}
+}
+
+// bandwidthLimiter keeps the bandwidth of clients which have relayed streams.
+type bandwidthLimiter struct {
+	def       BandwidthLimit
+	overrides map[cipher.PubKey]BandwidthLimit
+
+	clients map[cipher.PubKey]*clientBandwidth
+	mx      sync.Mutex
+}
+
+func newBandwidthLimiter(def BandwidthLimit, overrides map[cipher.PubKey]BandwidthLimit) *bandwidthLimiter {
+	bl := &bandwidthLimiter{
+		def:       def,
+		overrides: make(map[cipher.PubKey]BandwidthLimit, len(overrides)),
+		clients:   make(map[cipher.PubKey]*clientBandwidth),
+	}
+	for pk, limit := range overrides {
+		bl.overrides[pk] = limit
+	}
+	return bl
+}
+
+// limit returns the limit of the given client.
+func (bl *bandwidthLimiter) limit(pk cipher.PubKey) BandwidthLimit {
+	if limit, ok := bl.overrides[pk]; ok {
+		return limit
+	}
+	return bl.def
+}
+
+// setDefault sets the limit of clients without an override, including those with relayed streams.
+func (bl *bandwidthLimiter) setDefault(limit BandwidthLimit) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	bl.def = limit
+	for pk, cb := range bl.clients {
+		if _, ok := bl.overrides[pk]; !ok {
+			cb.setLimit(limit)
+		}
+	}
+}
+
+// setOverride sets the limit of the given client, or removes it's override if limit is nil.
+func (bl *bandwidthLimiter) setOverride(pk cipher.PubKey, limit *BandwidthLimit) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	if limit != nil {
+		bl.overrides[pk] = *limit
+	} else {
+		delete(bl.overrides, pk)
+	}
+	if cb, ok := bl.clients[pk]; ok {
+		cb.setLimit(bl.limit(pk))
+	}
+}
+
+// acquire returns the bandwidth of the client, which is shared by all the client's relayed streams.
+// The returned function releases it once the stream is closed, and is safe to call multiple times.
+func (bl *bandwidthLimiter) acquire(pk cipher.PubKey) (cb *clientBandwidth, release func()) {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	cb, ok := bl.clients[pk]
+	if !ok {
+		cb = newClientBandwidth(bl.limit(pk))
+		bl.clients[pk] = cb
+	}
+	cb.refs++
+
+	var once sync.Once
+	return cb, func() {
+		once.Do(func() {
+			bl.mx.Lock()
+			if cb.refs--; cb.refs <= 0 {
+				delete(bl.clients, pk)
+			}
+			bl.mx.Unlock()
+		})
+	}
+}
+
+// all returns the stats of all clients with relayed streams.
+func (bl *bandwidthLimiter) all() map[cipher.PubKey]BandwidthStats {
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+
+	out := make(map[cipher.PubKey]BandwidthStats, len(bl.clients))
+	for pk, cb := range bl.clients {
+		out[pk] = cb.getStats()
+	}
+	return out
+}
+
+// throttledConn shapes the data relayed over a client's stream by delaying it (data is never dropped).
+// Reads are data from the client (ingress), and writes are data to the client (egress). Writes are scheduled fairly
+// across the peers which relay data to the client (see egressScheduler).
+type throttledConn struct {
+	io.ReadWriteCloser
+	cb     *clientBandwidth
+	peer   cipher.PubKey // client on the other side of the stream
+	onRead func(n int)   // records data read from the client
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newThrottledConn(rwc io.ReadWriteCloser, cb *clientBandwidth, peer cipher.PubKey,
+	onRead func(n int)) *throttledConn {
+	return &throttledConn{ReadWriteCloser: rwc, cb: cb, peer: peer, onRead: onRead, done: make(chan struct{})}
+}
+
+func (tc *throttledConn) Read(p []byte) (int, error) {
+	n, err := tc.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&tc.cb.stats.IngressBytes, uint64(n))
+		tc.onRead(n)
+		tc.wait(tc.cb.ingress().Reserve(n), &tc.cb.stats.IngressThrottled)
+	}
+	return n, err
+}
+
+func (tc *throttledConn) Write(p []byte) (int, error) {
+	out := tc.cb.egress()
+	if out == nil {
+		// Writes to a client without an egress limit are not scheduled, as the egress is not shared out. Otherwise, a
+		// write blocked on the flow control window of it's stream would hold up the writes of other streams.
+		n, err := tc.ReadWriteCloser.Write(p)
+		atomic.AddUint64(&tc.cb.stats.EgressBytes, uint64(n))
+		return n, err
+	}
+
+	// The turn is held while the write is delayed, so that the egress is reserved in the order of the schedule.
+	turn := tc.cb.sched.acquire(tc.peer, PriorityNormal, len(p), tc.done)
+	defer turn.release()
+	tc.wait(out.Reserve(len(p)), &tc.cb.stats.EgressThrottled)
+
+	t := time.AfterFunc(tc.cb.sched.maxTurn, turn.release)
+	defer t.Stop()
+	n, err := tc.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&tc.cb.stats.EgressBytes, uint64(n))
+	return n, err
+}
+
+func (tc *throttledConn) Close() error {
+	tc.once.Do(func() { close(tc.done) })
+	return tc.ReadWriteCloser.Close()
+}
+
+// wait delays for the duration (or until the conn is closed), counting the delay as a throttle event.
+func (tc *throttledConn) wait(d time.Duration, throttled *uint64) {
+	if d <= 0 {
+		return
+	}
+	atomic.AddUint64(throttled, 1)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-tc.done:
+	}
+}
@@ -0,0 +1,46 @@
+package dmsg
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingWriter is an io.ReadWriteCloser of which writes block until it is closed.
+type blockingWriter struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (w *blockingWriter) Read([]byte) (int, error)  { <-w.closed; return 0, io.EOF }
+func (w *blockingWriter) Write([]byte) (int, error) { <-w.closed; return 0, io.ErrClosedPipe }
+func (w *blockingWriter) Close() error              { w.once.Do(func() { close(w.closed) }); return nil }
+
+func TestThrottledConn_Unscheduled(t *testing.T) {
+	pkX, _ := GenKeyPair(t, "x")
+	pkY, _ := GenKeyPair(t, "y")
+
+	// The egress of a client without a limit is not scheduled, so a write which blocks (i.e. on the flow control
+	// window of it's stream) does not hold up the writes of other streams to the client.
+	cb := newClientBandwidth(BandwidthLimit{})
+	blocked := &blockingWriter{closed: make(chan struct{})}
+	tcX := newThrottledConn(blocked, cb, pkX, func(int) {})
+	defer func() { require.NoError(t, tcX.Close()) }()
+	go tcX.Write([]byte("x")) //nolint:errcheck
+	time.Sleep(time.Millisecond * 10)
+
+	var buf bytes.Buffer
+	tcY := newThrottledConn(nopCloser{&buf}, cb, pkY, func(int) {})
+	start := time.Now()
+	_, err := tcY.Write([]byte("y"))
+	require.NoError(t, err)
+	require.Less(t, int64(time.Since(start)), int64(egressMaxTurn/2))
+	require.Equal(t, "y", buf.String())
+}
+
+// nopCloser is an io.ReadWriteCloser of a buffer.
+type nopCloser struct{ *bytes.Buffer }
@@ -2,22 +2,26 @@ package dmsg
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/skycoin/skycoin/src/util/logging"
 
 	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
 	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/discmetrics"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/netutil"
 )
 
-// TODO(evanlinjin): We should implement exponential backoff at some point.
-const serveWait = time.Second
-
 // SessionDialCallback is triggered BEFORE a session is dialed to.
 // If a non-nil error is returned, the session dial is instantly terminated.
 type SessionDialCallback func(network, addr string) (err error)
@@ -25,10 +29,52 @@ type SessionDialCallback func(network, addr string) (err error)
 // SessionDisconnectCallback triggers after a session is closed.
 type SessionDisconnectCallback func(network, addr string, err error)
 
+// DialErrorCallback triggers once for each failed dial of a stream to the remote client of the given public key, with
+// the error which the dial returns (see ClassifyDialError for it's cause).
+type DialErrorCallback func(remote cipher.PubKey, err error)
+
+// EntryUpdatedCallback triggers after the client's discovery entry is successfully posted or updated.
+// 'servers' contains the delegated servers advertised in the entry.
+// Calls are made in order of publication from a dedicated goroutine, so the callback may use the client (i.e. call
+// SessionCount), but a slow callback delays the following calls. It is not called once the client is closed, so the
+// entry without delegated servers which Close publishes (see Config.KeepEntryOnClose) is not reported.
+type EntryUpdatedCallback func(servers []cipher.PubKey)
+
+// EntryExpiringCallback triggers when the client's discovery entry fails to refresh close to it's expiry.
+// 'expiry' is the time in which the entry is assumed to expire in discovery.
+type EntryExpiringCallback func(expiry time.Time, err error)
+
+// EntryBuilder customizes the client's discovery entry before it is signed and published.
+// It receives the base entry (with the delegated servers already set) and returns the entry to be published.
+// The returned entry must keep the static public key, version and client field. The sequence may only be changed
+// for new entries, as the sequence of updated entries is managed by discovery.
+type EntryBuilder func(base *disc.Entry) (*disc.Entry, error)
+
+// ServerFilter decides whether a dmsg server (represented by it's discovery entry) is preferred.
+type ServerFilter func(entry *disc.Entry) bool
+
+// AddressResolver translates the address of a dmsg server (as advertised in discovery) into the address which is
+// dialed, i.e. when the advertised address is not reachable from the client (split-horizon DNS, NAT hairpinning).
+type AddressResolver func(srvPK cipher.PubKey, discoveredAddr string) string
+
+// ServerLabelFilter returns a ServerFilter which prefers servers of which entry contains the given metadata label.
+func ServerLabelFilter(key, value string) ServerFilter {
+	return func(entry *disc.Entry) bool {
+		if entry.Server == nil {
+			return false
+		}
+		v, ok := entry.Server.Metadata[key]
+		return ok && v == value
+	}
+}
+
 // ClientCallbacks contains callbacks which a Client uses.
 type ClientCallbacks struct {
 	OnSessionDial       SessionDialCallback
 	OnSessionDisconnect SessionDisconnectCallback
+	OnEntryUpdated      EntryUpdatedCallback
+	OnEntryExpiring     EntryExpiringCallback
+	OnDialError         DialErrorCallback
 }
 
 func (sc *ClientCallbacks) ensure() {
@@ -38,13 +84,131 @@ func (sc *ClientCallbacks) ensure() {
 	if sc.OnSessionDisconnect == nil {
 		sc.OnSessionDisconnect = func(network, addr string, err error) {}
 	}
+	if sc.OnEntryUpdated == nil {
+		sc.OnEntryUpdated = func(servers []cipher.PubKey) {}
+	}
+	if sc.OnEntryExpiring == nil {
+		sc.OnEntryExpiring = func(expiry time.Time, err error) {}
+	}
+	if sc.OnDialError == nil {
+		sc.OnDialError = func(remote cipher.PubKey, err error) {}
+	}
 }
 
 // Config configures a dmsg client entity.
 type Config struct {
-	MinSessions    int
-	UpdateInterval time.Duration // Duration between discovery entry updates.
-	Callbacks      *ClientCallbacks
+	MinSessions int
+	// Duration between discovery entry updates.
+	UpdateInterval time.Duration
+	// Timeout of a single discovery call attempt.
+	DiscTimeout time.Duration
+	// Maximum attempts of a discovery call which fails with a transient error.
+	DiscTries int
+	// Timeout of a whole discovery operation (including retries).
+	DiscOpTimeout time.Duration
+	// Duration between discovery polls of watched entries.
+	WatchInterval time.Duration
+	// Duration in which cached server entries are considered fresh.
+	EntryCacheTTL time.Duration
+	// Duration after which cached entries are evicted, rather than used while discovery is unavailable
+	// (negative to disable).
+	EntryCacheMaxAge time.Duration
+	// Maximum number of cached server and client entries (each), the least recently used are evicted
+	// (negative to disable).
+	EntryCacheSize int
+	// Assumed lifetime of the client entry in discovery (negative to disable).
+	EntryTTL time.Duration
+	// Duration in which changes of sessions are coalesced into one entry publication (negative to disable).
+	EntryDebounce time.Duration
+	// Duration without received data after which a session is probed.
+	IdleTimeout time.Duration
+	// Duration to wait for a probe response before closing an idle session.
+	ProbeTimeout time.Duration
+	// Duration in which a server is skipped after failed session dials (negative to disable).
+	FailureCooldown time.Duration
+	// Number of consecutive failed session dials after which a server is skipped.
+	FailureThreshold int
+	// Duration between checks of connected servers' addresses in discovery (negative to disable).
+	AddrCheckInterval time.Duration
+	// Minimum duration between address-driven session migrations of a server.
+	MinAddrMigrateInterval time.Duration
+	// Backoff between retries of discovering servers and establishing sessions.
+	Backoff netutil.BackoffConfig
+	// Optional hook to customize the published discovery entry.
+	EntryBuilder EntryBuilder
+	// Optional filter of preferred servers.
+	ServerFilter ServerFilter
+	// Optional translation of server addresses before dialing.
+	AddressResolver AddressResolver
+	// Maximum number of (randomly sampled) servers requested per discovery, 0 for all.
+	ServerSample int
+	// Maximum number of open sessions and streams combined, 0 for unlimited.
+	MaxConns int
+	// Feature flags advertised in the client's discovery entry (in addition to the stream protocol's, see
+	// FeatureRekey).
+	Features []string
+	// Optional metrics of discovery interactions.
+	DiscMetrics discmetrics.Metrics
+	// Optional metrics of session and stream handshakes.
+	HandshakeMetrics handshakemetrics.Metrics
+	// Optional metrics of sessions, streams and traffic (not collected if nil).
+	Metrics clientmetrics.Metrics
+	// Name of the expvar map of the client's counters (not published if empty).
+	ExpvarPrefix string
+	// Duration after which a handshake is logged as slow (negative to disable).
+	SlowHandshake time.Duration
+	Callbacks     *ClientCallbacks
+
+	// TLSConfig configures the TLS connections to servers at tls:// addresses. If it is nil, certificates are not
+	// verified, as the session handshake authenticates servers by their public keys regardless.
+	TLSConfig *tls.Config
+
+	// Signer optionally signs the client's discovery entries in place of the secret key (i.e. to keep the key in a
+	// HSM). Its public key must match the client's. The secret key is still required for noise handshakes, which
+	// perform Diffie-Hellman with it.
+	Signer disc.Signer
+
+	// KeepEntryOnClose keeps the delegated servers advertised in discovery after the client is closed.
+	// By default, the delegated servers are cleared on close.
+	KeepEntryOnClose bool
+
+	// RefreshOnDialFailure refreshes the remote's entry from discovery once (and retries the dial if it's delegated
+	// servers changed) when all delegated servers reject the stream, as the remote is not connected to them (i.e. it
+	// just moved to other servers). By default, the entry is only refreshed if no delegated server can be connected to.
+	RefreshOnDialFailure bool
+
+	// StrictStreamSequence makes reads of streams fail once a frame is received out of sequence (lost or reordered,
+	// i.e. across a migration of the underlying session), instead of delivering the data which follows a gap.
+	// Only the receiving side checks the sequence, so this does not need to be supported by the remote client.
+	StrictStreamSequence bool
+
+	// AddressFamily is the preferred IP family of server addresses which resolve to IPs of both families (such as host
+	// names with A and AAAA records). Addresses which resolve to IPs of the other family only are dialed regardless.
+	// By default (AddrFamilyAuto), addresses are dialed as they resolve.
+	AddressFamily AddressFamily
+
+	// StreamBufferSize bounds the data received on a stream which is buffered until it is read, in bytes. Once the
+	// buffer is full, the remote is held back by the flow control of the stream (it's writes block), rather than the
+	// buffer growing. Zero selects DefaultStreamBufferSize, and smaller values than MinStreamBufferSize are raised to it.
+	StreamBufferSize int
+
+	// DialP2PWidth is the maximum number of servers which DialP2P dials through concurrently.
+	DialP2PWidth int
+
+	// AcceptPolicy determines the handling of incoming streams while the accept queue of their listener (of
+	// AcceptBufferSize streams) is full. By default, the incoming stream is closed (see AcceptDropNewest).
+	AcceptPolicy AcceptPolicy
+
+	// DisableAutoReconnect stops Serve from re-establishing sessions once the initial MinSessions sessions are
+	// established: a lost session is only removed, so that the loss surfaces as errors of it's streams (and of dials
+	// through it's server), and sessions of servers which change their address or send GOAWAY notices are not moved.
+	// As the delegated servers of the client's entry are it's sessions, the entry shrinks as sessions are lost, and the
+	// client is unreachable once none remain, until the caller establishes sessions (see EnsureSessions).
+	DisableAutoReconnect bool
+
+	// Register adds the client to the process-wide registry of clients (see Clients) until it is closed, so that
+	// processes which run multiple clients can enumerate them.
+	Register bool
 }
 
 // Ensure ensures all config values are set.
@@ -55,6 +219,67 @@ func (c *Config) Ensure() {
 	if c.UpdateInterval == 0 {
 		c.UpdateInterval = DefaultUpdateInterval
 	}
+	if c.DiscTimeout == 0 {
+		c.DiscTimeout = DefaultDiscTimeout
+	}
+	if c.DiscTries == 0 {
+		c.DiscTries = DefaultDiscTries
+	}
+	if c.DiscOpTimeout == 0 {
+		c.DiscOpTimeout = DefaultDiscOpTimeout
+	}
+	if c.WatchInterval == 0 {
+		c.WatchInterval = DefaultWatchInterval
+	}
+	if c.EntryCacheTTL == 0 {
+		c.EntryCacheTTL = DefaultEntryCacheTTL
+	}
+	if c.EntryCacheMaxAge == 0 {
+		c.EntryCacheMaxAge = DefaultEntryCacheMaxAge
+	}
+	if c.EntryCacheSize == 0 {
+		c.EntryCacheSize = DefaultEntryCacheSize
+	}
+	if c.EntryTTL == 0 {
+		c.EntryTTL = DefaultEntryTTL
+	}
+	if c.EntryDebounce == 0 {
+		c.EntryDebounce = DefaultEntryDebounce
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	if c.ProbeTimeout == 0 {
+		c.ProbeTimeout = DefaultProbeTimeout
+	}
+	if c.FailureCooldown == 0 {
+		c.FailureCooldown = DefaultFailureCooldown
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.AddrCheckInterval == 0 {
+		c.AddrCheckInterval = DefaultAddrCheckInterval
+	}
+	if c.MinAddrMigrateInterval == 0 {
+		c.MinAddrMigrateInterval = DefaultMinAddrMigrateInterval
+	}
+	if c.SlowHandshake == 0 {
+		c.SlowHandshake = DefaultSlowHandshake
+	}
+	if c.DialP2PWidth == 0 {
+		c.DialP2PWidth = DefaultDialP2PWidth
+	}
+	if c.Backoff == (netutil.BackoffConfig{}) {
+		c.Backoff = DefaultBackoffConfig()
+	}
+	c.Backoff.Ensure()
+	if c.DiscMetrics == nil {
+		c.DiscMetrics = discmetrics.NewEmpty()
+	}
+	if c.HandshakeMetrics == nil {
+		c.HandshakeMetrics = handshakemetrics.NewEmpty()
+	}
 	if c.Callbacks == nil {
 		c.Callbacks = new(ClientCallbacks)
 	}
@@ -64,12 +289,40 @@ func (c *Config) Ensure() {
 // DefaultConfig returns the default configuration for a dmsg client entity.
 func DefaultConfig() *Config {
 	conf := &Config{
-		MinSessions:    DefaultMinSessions,
-		UpdateInterval: DefaultUpdateInterval,
+		MinSessions:            DefaultMinSessions,
+		UpdateInterval:         DefaultUpdateInterval,
+		DiscTimeout:            DefaultDiscTimeout,
+		DiscTries:              DefaultDiscTries,
+		DiscOpTimeout:          DefaultDiscOpTimeout,
+		WatchInterval:          DefaultWatchInterval,
+		EntryCacheTTL:          DefaultEntryCacheTTL,
+		EntryCacheMaxAge:       DefaultEntryCacheMaxAge,
+		EntryCacheSize:         DefaultEntryCacheSize,
+		EntryTTL:               DefaultEntryTTL,
+		EntryDebounce:          DefaultEntryDebounce,
+		IdleTimeout:            DefaultIdleTimeout,
+		ProbeTimeout:           DefaultProbeTimeout,
+		FailureCooldown:        DefaultFailureCooldown,
+		FailureThreshold:       DefaultFailureThreshold,
+		AddrCheckInterval:      DefaultAddrCheckInterval,
+		MinAddrMigrateInterval: DefaultMinAddrMigrateInterval,
+		SlowHandshake:          DefaultSlowHandshake,
+		Backoff:                DefaultBackoffConfig(),
+		DialP2PWidth:           DefaultDialP2PWidth,
 	}
 	return conf
 }
 
+// DefaultBackoffConfig returns the default backoff of a dmsg client entity.
+func DefaultBackoffConfig() netutil.BackoffConfig {
+	return netutil.BackoffConfig{
+		Initial: DefaultBackoffInitial,
+		Max:     DefaultBackoffMax,
+		Factor:  netutil.DefaultFactor,
+		Jitter:  netutil.DefaultJitter,
+	}
+}
+
 // Client represents a dmsg client entity.
 type Client struct {
 	ready     chan struct{}
@@ -79,10 +332,36 @@ type Client struct {
 	conf   *Config
 	porter *netutil.Porter
 
-	errCh chan error
-	done  chan struct{}
-	once  sync.Once
-	sesMx sync.Mutex
+	errCh    chan sessionError
+	entryCh  chan struct{}        // triggers publication of the discovery entry
+	updates  chan []cipher.PubKey // delegated servers of published entries, to be passed to OnEntryUpdated
+	done     chan struct{}
+	once     sync.Once
+	sesMx    sync.Mutex
+	ensureMx sync.Mutex // serializes EnsureSessions calls
+
+	drained   map[cipher.PubKey]struct{} // servers which are drained, and are not to be reconnected to
+	drainedMx sync.RWMutex
+
+	failed   map[cipher.PubKey]time.Time // servers in failure cooldown, and when their cooldown started
+	failures map[cipher.PubKey]int       // consecutive failed session dials of servers which are not in cooldown
+	failedMx sync.Mutex
+
+	allowed *peerAllowlist // peers allowed to initiate streams to the client
+
+	migrated   map[cipher.PubKey]time.Time // servers of which the session was last migrated to a new address, and when
+	migratedMx sync.Mutex
+
+	srvEntries    *entryCache // cached server entries
+	clientEntries *entryCache // cached client entries (used when discovery is unavailable, and for capabilities of peers)
+	staleDisc     int32       // 1 if the last discovery lookup fell back to stale cached data
+	discHealth    *discHealth // tracks whether discovery is reachable
+}
+
+// sessionError is the error of a session which stopped, as reported to the serve loop.
+type sessionError struct {
+	srvPK cipher.PubKey
+	err   error
 }
 
 // NewClient creates a dmsg client entity.
@@ -90,8 +369,15 @@ func NewClient(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, conf *Conf
 	c := new(Client)
 	c.ready = make(chan struct{})
 	c.porter = netutil.NewPorter(netutil.PorterMinEphemeral)
-	c.errCh = make(chan error, 10)
+	c.errCh = make(chan sessionError, 10)
+	c.entryCh = make(chan struct{}, 1)
+	c.updates = make(chan []cipher.PubKey, entryUpdatesBuffer)
 	c.done = make(chan struct{})
+	c.drained = make(map[cipher.PubKey]struct{})
+	c.failed = make(map[cipher.PubKey]time.Time)
+	c.failures = make(map[cipher.PubKey]int)
+	c.allowed = newPeerAllowlist()
+	c.migrated = make(map[cipher.PubKey]time.Time)
 
 	log := logging.MustGetLogger("dmsg_client")
 
@@ -101,31 +387,128 @@ func NewClient(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, conf *Conf
 	}
 	conf.Ensure()
 	c.conf = conf
+	c.srvEntries = newEntryCache(conf.EntryCacheTTL, conf.EntryCacheMaxAge, conf.EntryCacheSize)
+	c.clientEntries = newEntryCache(conf.EntryCacheTTL, conf.EntryCacheMaxAge, conf.EntryCacheSize)
+	c.EntityCommon.peerEntries = c.clientEntries
 
 	// Init common fields.
-	c.EntityCommon.init(pk, sk, dc, log, conf.UpdateInterval)
-
-	// Init callback: on set session.
-	c.EntityCommon.setSessionCallback = func(ctx context.Context, sessionCount int) error {
-		if err := c.EntityCommon.updateClientEntry(ctx, c.done); err != nil {
-			return err
+	dc = disc.NewRetrying(dc, disc.RetryConfig{
+		Timeout:   conf.DiscTimeout,
+		Tries:     conf.DiscTries,
+		OpTimeout: conf.DiscOpTimeout,
+	})
+	dc = disc.NewInstrumented(dc, conf.DiscMetrics)
+	c.discHealth = newDiscHealth(dc, func(healthy bool, err error) {
+		if healthy {
+			c.log.Info("Discovery is available again.")
+			return
 		}
+		c.log.WithError(err).Warn("Discovery is unavailable, peers are dialed by their cached entries until it recovers.")
+	})
+	dc = c.discHealth
+	c.EntityCommon.init(pk, sk, dc, log, conf.UpdateInterval)
+	c.EntityCommon.entryBuilder = conf.EntryBuilder
+	c.EntityCommon.entryTTL = conf.EntryTTL
+	c.EntityCommon.entryDebounce = conf.EntryDebounce
+	c.EntityCommon.minSessions = conf.MinSessions
+	c.EntityCommon.signer = conf.Signer
+	c.EntityCommon.hsMetrics = conf.HandshakeMetrics
+	c.EntityCommon.limiter = newConnLimiter(conf.MaxConns)
+	c.EntityCommon.slowHandshake = conf.SlowHandshake
+	c.EntityCommon.strictSeq = conf.StrictStreamSequence
+	c.EntityCommon.cm = conf.Metrics
+	if conf.ExpvarPrefix != "" {
+		counters := &clientCounters{m: conf.Metrics}
+		c.EntityCommon.cm = counters
+		c.publishVars(conf.ExpvarPrefix, counters)
+	}
+	c.EntityCommon.streamWindow = streamWindow(conf.StreamBufferSize)
+	c.EntityCommon.caps = &disc.Capabilities{
+		ProtocolVersion: ProtocolVersion,
+		Features:        append([]string{FeatureRekey, FeatureCloseCode}, conf.Features...),
+	}
 
+	// Init callback: on entry updated.
+	// This is called while publishing the entry, so OnEntryUpdated is called from notifyEntryUpdates instead.
+	c.EntityCommon.entryUpdatedCallback = func(srvPKs []cipher.PubKey) {
 		// Client is 'ready' once we have successfully updated the discovery entry
 		// with at least one delegated server.
-		c.readyOnce.Do(func() { close(c.ready) })
-		return nil
+		if len(srvPKs) > 0 {
+			c.readyOnce.Do(func() { close(c.ready) })
+		}
+		if isClosed(c.done) {
+			return
+		}
+		select {
+		case c.updates <- srvPKs:
+		case <-c.done:
+		}
 	}
+	go c.notifyEntryUpdates(conf.Callbacks.OnEntryUpdated)
 
-	// Init callback: on delete session.
+	// Init callback: on entry expiring.
+	c.EntityCommon.entryExpiringCallback = func(expiry time.Time, err error) {
+		conf.DiscMetrics.RecordExpiryAlarm()
+		conf.Callbacks.OnEntryExpiring(expiry, err)
+	}
+
+	// Init callbacks: on set/delete session.
+	// Entry publications are funneled through a single worker (updateClientEntryLoop) which coalesces rapid
+	// successive changes (within EntryDebounce) into one publication of the final set of sessions, so that publications
+	// are never reordered.
+	c.EntityCommon.setSessionCallback = func(ctx context.Context, sessionCount int) error {
+		if c.EntityCommon.cm != nil {
+			c.EntityCommon.cm.SetServers(sessionCount)
+		}
+		c.requestEntryUpdate()
+		return nil
+	}
 	c.EntityCommon.delSessionCallback = func(ctx context.Context, sessionCount int) error {
-		err := c.EntityCommon.updateClientEntry(ctx, c.done)
-		return err
+		if c.EntityCommon.cm != nil {
+			c.EntityCommon.cm.SetServers(sessionCount)
+		}
+		c.requestEntryUpdate()
+		return nil
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.done
+		cancel()
+	}()
+	go c.EntityCommon.updateClientEntryLoop(ctx, c.done, c.entryCh)
+
+	if conf.Register {
+		registry.add(c)
+	}
 	return c
 }
 
+// notifyEntryUpdates calls 'fn' with the delegated servers of each published entry, in order, until the client is
+// closed.
+func (ce *Client) notifyEntryUpdates(fn EntryUpdatedCallback) {
+	for {
+		select {
+		case <-ce.done:
+			return
+		case srvPKs := <-ce.updates:
+			if isClosed(ce.done) {
+				return
+			}
+			fn(srvPKs)
+		}
+	}
+}
+
+// requestEntryUpdate triggers a publication of the client's discovery entry.
+// Requests made while a publication is pending are coalesced.
+func (ce *Client) requestEntryUpdate() {
+	select {
+	case ce.entryCh <- struct{}{}:
+	default:
+	}
+}
+
 // Type returns the client's type (should always be "dmsg").
 func (*Client) Type() string {
 	return Type
@@ -149,8 +532,12 @@ func (ce *Client) Serve(ctx context.Context) {
 		}
 	}(cancellabelCtx)
 
-	// Ensure we start updateClientEntryLoop once only.
-	updateEntryLoopOnce := new(sync.Once)
+	if ce.conf.AddrCheckInterval > 0 && !ce.conf.DisableAutoReconnect {
+		go ce.watchServerAddrs(cancellabelCtx)
+	}
+
+	// Backoff between failed attempts, so that clients do not retry in sync after a common outage.
+	bo := netutil.NewBackoff(ce.conf.Backoff)
 
 	for {
 		if isClosed(ce.done) {
@@ -164,12 +551,16 @@ func (ce *Client) Serve(ctx context.Context) {
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
-			time.Sleep(time.Second) // TODO(evanlinjin): Implement exponential back off.
+			if bo.Wait(cancellabelCtx) != nil {
+				return
+			}
 			continue
 		}
 		if len(entries) == 0 {
-			ce.log.Warnf("No entries found. Retrying after %s...", serveWait.String())
-			time.Sleep(serveWait)
+			ce.log.Warn("No entries found. Retrying...")
+			if bo.Wait(cancellabelCtx) != nil {
+				return
+			}
 		}
 
 		for _, entry := range entries {
@@ -179,14 +570,21 @@ func (ce *Client) Serve(ctx context.Context) {
 
 			// If we have enough sessions, we wait for error or done signal.
 			if ce.SessionCount() >= ce.conf.MinSessions {
+				if ce.conf.DisableAutoReconnect {
+					ce.awaitSessionErrs()
+					return
+				}
 				select {
 				case <-ce.done:
 					return
-				case err := <-ce.errCh:
-					ce.log.WithError(err).Info("Session stopped.")
+				case sErr := <-ce.errCh:
+					ce.log.WithField("remote_pk", sErr.srvPK).WithError(sErr.err).Info("Session stopped.")
 					if isClosed(ce.done) {
 						return
 					}
+					if ce.cm != nil {
+						ce.cm.RecordReconnect()
+					}
 				}
 			}
 
@@ -195,11 +593,26 @@ func (ce *Client) Serve(ctx context.Context) {
 				if err == context.Canceled || err == context.DeadlineExceeded {
 					return
 				}
-				time.Sleep(serveWait)
+				if bo.Wait(cancellabelCtx) != nil {
+					return
+				}
+				continue
 			}
+			bo.Reset()
+		}
+	}
+}
 
-			// Only start the update entry loop once we have at least one session established.
-			updateEntryLoopOnce.Do(func() { go ce.updateClientEntryLoop(cancellabelCtx, ce.done) })
+// awaitSessionErrs logs stopped sessions without re-establishing them (see Config.DisableAutoReconnect), until the
+// client is closed.
+func (ce *Client) awaitSessionErrs() {
+	ce.log.Info("Established initial sessions, automatic reconnection is disabled.")
+	for {
+		select {
+		case <-ce.done:
+			return
+		case sErr := <-ce.errCh:
+			ce.log.WithField("remote_pk", sErr.srvPK).WithError(sErr.err).Info("Session stopped, not reconnecting.")
 		}
 	}
 }
@@ -211,14 +624,92 @@ func (ce *Client) Ready() <-chan struct{} {
 }
 
 func (ce *Client) discoverServers(ctx context.Context) (entries []*disc.Entry, err error) {
-	err = netutil.NewDefaultRetrier(ce.log.WithField("func", "discoverServers")).Do(ctx, func() error {
-		entries, err = ce.dc.AvailableServers(ctx)
-		return err
+	log := ce.log.WithField("func", "discoverServers")
+	err = netutil.NewBackoffRetrier(log, ce.conf.Backoff, 0).Do(ctx, func() error {
+		if entries, err = disc.SampleServers(ctx, ce.dc, ce.serverSample()); err != nil {
+			// Fall back to previously seen servers if discovery is unavailable.
+			if cached := ce.srvEntries.all(); len(cached) > 0 && disc.Classify(err) == disc.ErrKindTransient {
+				log.WithError(err).Warn("Failed to discover servers, using previously seen servers.")
+				ce.setStaleDisc(true)
+				entries = cached
+				return nil
+			}
+			return err
+		}
+		ce.srvEntries.put(entries...)
+		ce.setStaleDisc(false)
+		return nil
+	})
+	return ce.filterServers(entries), err
+}
+
+// serverSample returns the number of servers to sample per discovery (0 for all).
+func (ce *Client) serverSample() int {
+	// A server filter selects among all available servers, so only sample servers without one.
+	if ce.conf.ServerFilter != nil {
+		return 0
+	}
+	return ce.conf.ServerSample
+}
+
+// TryInitiateSessions establishes the initial sessions of the client (up to MinSessions) from a single listing of
+// servers. Unlike Serve, which retries discovering servers with backoff until some are available, it fails fast with
+// ErrNoServersAvailable (wrapping the cause, if discovery failed) on a failed or empty listing, so that callers can
+// apply their own retry policy. Serve maintains the sessions once it succeeds.
+func (ce *Client) TryInitiateSessions(ctx context.Context) error {
+	return ce.ensureSessions(ctx, ce.conf.MinSessions, func(ctx context.Context) ([]*disc.Entry, error) {
+		entries, err := disc.SampleServers(ctx, ce.dc, ce.serverSample())
+		if err != nil {
+			return nil, ErrNoServersAvailable.Wrap(err)
+		}
+		ce.srvEntries.put(entries...)
+		if entries = ce.filterServers(entries); len(entries) == 0 {
+			return nil, ErrNoServersAvailable
+		}
+		return entries, nil
 	})
-	return entries, err
+}
+
+// filterServers removes drained servers and servers in failure cooldown, and applies the server filter to the given
+// server entries.
+// If the server filter eliminates all entries, the entries are returned without the server filter applied.
+func (ce *Client) filterServers(entries []*disc.Entry) []*disc.Entry {
+	entries = ce.withoutUnavailable(entries)
+	if ce.conf.ServerFilter == nil {
+		return entries
+	}
+	out := make([]*disc.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if ce.conf.ServerFilter(entry) {
+			out = append(out, entry)
+		}
+	}
+	if len(out) == 0 {
+		return entries
+	}
+	return out
+}
+
+// orderServers returns the given server entries with the servers preferred by the server filter first.
+func (ce *Client) orderServers(entries []*disc.Entry) []*disc.Entry {
+	if ce.conf.ServerFilter == nil {
+		return entries
+	}
+	out := make([]*disc.Entry, 0, len(entries))
+	var rest []*disc.Entry
+	for _, entry := range entries {
+		if ce.conf.ServerFilter(entry) {
+			out = append(out, entry)
+			continue
+		}
+		rest = append(rest, entry)
+	}
+	return append(out, rest...)
 }
 
 // Close closes the dmsg client entity.
+// Once Close begins, dials, listens and session establishment return ErrEntityClosed, and in-flight dials are aborted
+// (sessions and streams which they establish regardless are closed).
 // TODO(evanlinjin): Have waitgroup.
 func (ce *Client) Close() error {
 	if ce == nil {
@@ -227,10 +718,7 @@ func (ce *Client) Close() error {
 
 	ce.once.Do(func() {
 		close(ce.done)
-
-		ce.sesMx.Lock()
-		close(ce.errCh)
-		ce.sesMx.Unlock()
+		registry.remove(ce)
 
 		ce.sessionsMx.Lock()
 		for _, dSes := range ce.sessions {
@@ -242,55 +730,516 @@ func (ce *Client) Close() error {
 		ce.log.Info("All sessions closed.")
 		ce.sessionsMx.Unlock()
 
+		if !ce.conf.KeepEntryOnClose {
+			ce.clearEntry()
+		}
+
 		ce.porter.CloseAll(ce.log)
 	})
 
 	return nil
 }
 
+// PublishedEntry returns a copy of the client entry which was last published to discovery (as it was written, including
+// the delegated servers and sequence), or false if no entry has been published yet.
+func (ce *Client) PublishedEntry() (*disc.Entry, bool) {
+	ce.publishedEntryMx.Lock()
+	defer ce.publishedEntryMx.Unlock()
+
+	if ce.publishedEntry == nil {
+		return nil, false
+	}
+	entry := new(disc.Entry)
+	disc.Copy(entry, ce.publishedEntry)
+	return entry, true
+}
+
+// clearEntry publishes a final client entry without delegated servers (so that peers stop dialing us).
+// This is best-effort and bounded by a short timeout, so that closing is not blocked by a slow discovery.
+// It should be called once no sessions remain, and is not reported to OnEntryUpdated.
+func (ce *Client) clearEntry() {
+	if atomic.LoadInt64(&ce.entryPublished) == 0 {
+		return // entry was never published
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeEntryTimeout)
+	defer cancel()
+
+	if err := ce.updateClientEntry(ctx, nil); err != nil {
+		ce.log.WithError(err).Warn("Failed to clear delegated servers of discovery entry.")
+		return
+	}
+	ce.log.Info("Cleared delegated servers of discovery entry.")
+}
+
 // Listen listens on a given dmsg port.
 func (ce *Client) Listen(port uint16) (*Listener, error) {
-	lis := newListener(ce.porter, Addr{PK: ce.pk, Port: port})
+	if isClosed(ce.done) {
+		return nil, ErrEntityClosed
+	}
+	lis := newListener(ce.porter, Addr{PK: ce.pk, Port: port}, ce.conf.AcceptPolicy)
 	ok, doneFn := ce.porter.Reserve(port, lis)
 	if !ok {
 		lis.close()
 		return nil, ErrPortOccupied
 	}
 	lis.addCloseCallback(doneFn)
+	// Close closes the listeners reserved before it, so only listeners reserved after it are closed here. A listener
+	// which Close closes before the callback is added does not free the port, so it is freed here.
+	if isClosed(ce.done) {
+		lis.close()
+		doneFn()
+		return nil, ErrEntityClosed
+	}
 	return lis, nil
 }
 
+// DialOption configures a single dial.
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	noRefresh bool
+}
+
+// WithoutEntryRefresh makes the dial fail immediately when all delegated servers of the remote fail, instead of
+// refreshing the remote's entry from discovery and retrying. This is intended for latency-critical dials.
+func WithoutEntryRefresh() DialOption {
+	return func(o *dialOptions) { o.noRefresh = true }
+}
+
 // Dial wraps DialStream to output net.Conn instead of *Stream.
-func (ce *Client) Dial(ctx context.Context, addr Addr) (net.Conn, error) {
-	return ce.DialStream(ctx, addr)
+func (ce *Client) Dial(ctx context.Context, addr Addr, opts ...DialOption) (net.Conn, error) {
+	return ce.DialStream(ctx, addr, opts...)
 }
 
 // DialStream dials to a remote client entity with the given address.
-func (ce *Client) DialStream(ctx context.Context, addr Addr) (*Stream, error) {
-	entry, err := getClientEntry(ctx, ce.dc, addr.PK)
+// If all delegated servers of the remote fail, the remote's entry is refreshed from discovery once, and the dial is
+// retried if the delegated servers changed (see WithoutEntryRefresh and Config.RefreshOnDialFailure).
+// Parameters of the established stream can be obtained via (*Stream).Info.
+func (ce *Client) DialStream(ctx context.Context, addr Addr, opts ...DialOption) (*Stream, error) {
+	start := time.Now()
+	dStr, err := ce.dialRemote(ctx, addr, opts)
+	if err != nil {
+		ce.conf.Callbacks.OnDialError(addr.PK, err)
+	} else if ce.cm != nil {
+		ce.cm.RecordDial(clientmetrics.KindStream, time.Since(start))
+	}
+	return dStr, err
+}
+
+// dialRemote dials a stream as DialStream does, without triggering the dial error callback.
+func (ce *Client) dialRemote(ctx context.Context, addr Addr, opts []DialOption) (*Stream, error) {
+	if isClosed(ce.done) {
+		return nil, ErrEntityClosed
+	}
+	var o dialOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	entry, stale, err := ce.lookupEntry(ctx, ce.clientEntries, addr.PK, getClientEntry)
 	if err != nil {
 		return nil, err
 	}
 
-	// Range client's delegated servers.
-	// See if we are already connected to a delegated server.
+	dStr, err := ce.dialStream(ctx, entry, addr)
+	refresh := errors.Is(err, ErrCannotConnectToDelegated) || (ce.conf.RefreshOnDialFailure && isNotDelegatedErr(err))
+	if refresh && !o.noRefresh {
+		if newEntry, ok := ce.refreshClientEntry(ctx, entry); ok {
+			entry, stale = newEntry, false
+			dStr, err = ce.dialStream(ctx, entry, addr)
+		}
+	}
+	if err != nil {
+		return nil, ce.closedErr(err)
+	}
+	if err := ce.abortIfClosed(dStr); err != nil {
+		return nil, err
+	}
+	dStr.staleEntry = stale
+	dStr.setRemoteCaps(entry.Client.Capabilities)
+	return dStr, nil
+}
+
+// RedialPeer dials a new stream to the remote address of the given stream (which the client dialed), once it dies.
+// The remote's entry is not looked up in discovery: the stream is dialed via the server which relayed the old stream,
+// as long as the client still has a session to it. Otherwise, or if the remote is no longer connected to the server,
+// the stream is dialed as DialStream does. The old stream is closed (if it is not already).
+func (ce *Client) RedialPeer(ctx context.Context, old *Stream) (*Stream, error) {
+	if !old.initiator {
+		return nil, errors.New("stream is not dialed by the client, and cannot be redialed")
+	}
+	addr, srvPK := old.RawRemoteAddr(), old.ServerPK()
+	if err := old.Close(); err != nil {
+		old.log.WithError(err).Debug("Failed to close stream to be redialed.")
+	}
+	if isClosed(ce.done) {
+		return nil, ErrEntityClosed
+	}
+
+	dSes, ok := ce.clientSession(ce.porter, srvPK)
+	if !ok {
+		return ce.DialStream(ctx, addr)
+	}
+	start := time.Now()
+	dStr, err := dSes.DialStream(ctx, addr)
+	switch {
+	case err == nil:
+		if err := ce.abortIfClosed(dStr); err != nil {
+			return nil, err
+		}
+		if ce.cm != nil {
+			ce.cm.RecordDial(clientmetrics.KindStream, time.Since(start))
+		}
+		return dStr, nil
+	case ctx.Err() != nil || (isRejectionErr(err) && !isNotDelegatedErr(err)):
+		err = ce.closedErr(err)
+		ce.conf.Callbacks.OnDialError(addr.PK, err)
+		return nil, err
+	default:
+		dSes.log.WithError(err).
+			WithField("dst_pk", addr.PK).
+			WithField("dst_port", addr.Port).
+			Debug("Failed to redial via the server of the old stream, dialing via discovery.")
+		return ce.DialStream(ctx, addr)
+	}
+}
+
+// closedErr returns ErrEntityClosed in place of the given dial error if the client is closed (as closing aborts
+// in-flight dials).
+func (ce *Client) closedErr(err error) error {
+	if isClosed(ce.done) {
+		return ErrEntityClosed
+	}
+	return err
+}
+
+// abortIfClosed closes the given stream, which is dialed concurrently with Close, and returns ErrEntityClosed.
+// Close closes the streams of the sessions which exist by then, so only streams which are established past it are
+// closed here.
+func (ce *Client) abortIfClosed(dStr *Stream) error {
+	if !isClosed(ce.done) {
+		return nil
+	}
+	dStr.log.WithError(dStr.Close()).Debug("Closed stream which was dialed as the client closed.")
+	return ErrEntityClosed
+}
+
+// DialP2P dials to a remote client entity with the given address, racing stream handshakes through the delegated
+// servers of the remote which the client is connected to (at most Config.DialP2PWidth at once). The first stream to
+// be established is returned, and the others are closed. This minimizes dial latency at the cost of extra transient
+// handshakes. If the client is not connected to any delegated server of the remote, DialStream is used instead.
+func (ce *Client) DialP2P(ctx context.Context, addr Addr, opts ...DialOption) (*Stream, error) {
+	dStr, err := ce.dialP2P(ctx, addr, opts)
+	if err != nil {
+		ce.conf.Callbacks.OnDialError(addr.PK, err)
+	}
+	return dStr, err
+}
+
+// dialP2P dials a stream as DialP2P does, without triggering the dial error callback.
+func (ce *Client) dialP2P(ctx context.Context, addr Addr, opts []DialOption) (*Stream, error) {
+	if isClosed(ce.done) {
+		return nil, ErrEntityClosed
+	}
+	entry, stale, err := ce.lookupEntry(ctx, ce.clientEntries, addr.PK, getClientEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []ClientSession
 	for _, srvPK := range entry.Client.DelegatedServers {
+		if len(sessions) == ce.conf.DialP2PWidth {
+			break
+		}
 		if dSes, ok := ce.clientSession(ce.porter, srvPK); ok {
-			return dSes.DialStream(addr)
+			sessions = append(sessions, dSes)
+		}
+	}
+	if len(sessions) == 0 {
+		return ce.dialRemote(ctx, addr, opts)
+	}
+
+	dStr, err := ce.raceStreams(ctx, sessions, addr)
+	if err != nil {
+		return nil, ce.closedErr(err)
+	}
+	if err := ce.abortIfClosed(dStr); err != nil {
+		return nil, err
+	}
+	dStr.staleEntry = stale
+	dStr.setRemoteCaps(entry.Client.Capabilities)
+	return dStr, nil
+}
+
+// raceStreams dials streams via the given sessions concurrently. The first stream to be established is returned, and
+// the other dials are aborted (streams which are established regardless are closed).
+// If all dials fail, the error of the last one is returned.
+func (ce *Client) raceStreams(ctx context.Context, sessions []ClientSession, addr Addr) (*Stream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		dStr *Stream
+		err  error
+	}
+	results := make(chan result, len(sessions))
+	for _, dSes := range sessions {
+		go func(dSes ClientSession) {
+			dStr, err := dSes.DialStream(ctx, addr)
+			results <- result{dStr: dStr, err: err}
+		}(dSes)
+	}
+
+	var err error
+	for i := range sessions {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
 		}
+
+		// Close the streams of the remaining dials.
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if res := <-results; res.err == nil {
+					res.dStr.log.WithError(res.dStr.Close()).Debug("Closed stream which lost the dial race.")
+				}
+			}
+		}(len(sessions) - i - 1)
+
+		res.dStr.log.Debug("Stream won the dial race.")
+		return res.dStr, nil
+	}
+	return nil, err
+}
+
+// ProbePeerServers reports which delegated servers of the remote client are reachable from this client: each server
+// maps to nil if it is reachable, or to the reason if it is not. Servers are reached via existing sessions, or via
+// sessions which are established as by DialStream (and kept afterwards). Each session is pinged (within
+// Config.ProbeTimeout), and no streams are opened. An error is returned if the remote's entry cannot be obtained.
+func (ce *Client) ProbePeerServers(ctx context.Context, remote cipher.PubKey) (map[cipher.PubKey]error, error) {
+	if isClosed(ce.done) {
+		return nil, ErrEntityClosed
+	}
+	entry, _, err := ce.lookupEntry(ctx, ce.clientEntries, remote, getClientEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[cipher.PubKey]error, len(entry.Client.DelegatedServers))
+	var sessions []ClientSession
+	var unconnected []cipher.PubKey
+	for _, srvPK := range entry.Client.DelegatedServers {
+		if dSes, ok := ce.clientSession(ce.porter, srvPK); ok {
+			sessions = append(sessions, dSes)
+		} else {
+			unconnected = append(unconnected, srvPK)
+		}
+	}
+	srvEntries, entrySkips := ce.delegatedServerEntries(ctx, unconnected)
+	for _, skip := range entrySkips {
+		out[skip.ServerPK] = skip.Err
+	}
+	for _, srvEntry := range srvEntries {
+		dSes, err := ce.ensureAndObtainSession(ctx, srvEntry)
+		if err != nil {
+			out[srvEntry.Static] = err
+			continue
+		}
+		sessions = append(sessions, dSes)
+	}
+
+	timeout := ce.conf.ProbeTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	var mx sync.Mutex
+	var wg sync.WaitGroup
+	for _, dSes := range sessions {
+		wg.Add(1)
+		go func(dSes ClientSession) {
+			defer wg.Done()
+			err := dSes.probe(timeout)
+			mx.Lock()
+			out[dSes.RemotePK()] = err
+			mx.Unlock()
+		}(dSes)
+	}
+	wg.Wait()
+	return out, nil
+}
+
+// refreshClientEntry fetches the entry of the remote client from discovery, bypassing the cache.
+// It returns false if the entry cannot be fetched, or if it's delegated servers are unchanged.
+func (ce *Client) refreshClientEntry(ctx context.Context, entry *disc.Entry) (*disc.Entry, bool) {
+	log := ce.log.WithField("func", "refreshClientEntry").WithField("remote_pk", entry.Static)
+
+	newEntry, err := getClientEntry(ctx, ce.dc, entry.Static)
+	if err != nil {
+		log.WithError(err).Debug("Failed to refresh entry.")
+		return nil, false
+	}
+	ce.clientEntries.put(newEntry)
+	ce.setStaleDisc(false)
+
+	if samePKs(entry.Client.DelegatedServers, newEntry.Client.DelegatedServers) {
+		log.Debug("Delegated servers are unchanged.")
+		return nil, false
+	}
+	log.Info("Delegated servers changed, retrying dial.")
+	return newEntry, true
+}
+
+// dialStream dials a stream via the delegated servers of the given remote client entry.
+// Delegated servers which the remote is not connected to are skipped. If all of them are skipped, the error of the
+// last server is returned.
+func (ce *Client) dialStream(ctx context.Context, entry *disc.Entry, addr Addr) (*Stream, error) {
+	var lastErr error
+	var skipped []ServerSkip
+	dial := func(dSes ClientSession) (*Stream, bool, error) {
+		dStr, err := dSes.DialStream(ctx, addr)
+		if isNotDelegatedErr(err) && ctx.Err() == nil {
+			dSes.log.WithError(err).
+				WithField("dst_pk", addr.PK).
+				Debug("Remote is not connected to delegated server, trying next.")
+			lastErr = err
+			skipped = append(skipped, ServerSkip{ServerPK: dSes.RemotePK(), Err: err})
+			return nil, false, err
+		}
+		return dStr, true, err
 	}
 
 	// Range client's delegated servers.
-	// Attempt to connect to a delegated server.
+	// See if we are already connected to a delegated server.
+	var unconnected []cipher.PubKey
 	for _, srvPK := range entry.Client.DelegatedServers {
-		dSes, err := ce.EnsureAndObtainSession(ctx, srvPK)
+		dSes, ok := ce.clientSession(ce.porter, srvPK)
+		if !ok {
+			unconnected = append(unconnected, srvPK)
+			continue
+		}
+		if dStr, done, err := dial(dSes); done {
+			return dStr, err
+		}
+	}
+
+	// Range client's delegated servers.
+	// Attempt to connect to a delegated server, preferring servers which pass the server filter.
+	srvEntries, entrySkips := ce.delegatedServerEntries(ctx, unconnected)
+	skipped = append(skipped, entrySkips...)
+	for _, srvEntry := range ce.orderServers(srvEntries) {
+		dSes, err := ce.ensureAndObtainSession(ctx, srvEntry)
 		if err != nil {
+			skipped = append(skipped, ServerSkip{ServerPK: srvEntry.Static, Err: err})
 			continue
 		}
-		return dSes.DialStream(addr)
+		if dStr, done, err := dial(dSes); done {
+			return dStr, err
+		}
 	}
 
-	return nil, ErrCannotConnectToDelegated
+	if lastErr == nil {
+		lastErr = ErrCannotConnectToDelegated
+	}
+	return nil, &DialError{Err: lastErr, Skipped: skipped}
+}
+
+// isNotDelegatedErr returns whether the stream dial error indicates that the remote is not connected to the server.
+// Servers which do not reject such streams close them without a response instead.
+func isNotDelegatedErr(err error) bool {
+	return errors.Is(err, ErrReqNoNextSession) || errors.Is(err, io.EOF)
+}
+
+// delegatedServerEntries obtains the discovery entries of the given servers.
+// Cached entries are used where available, and the rest are fetched concurrently (with bounded fan-out).
+// Servers of which entries cannot be obtained are skipped (and returned with the reasons).
+func (ce *Client) delegatedServerEntries(ctx context.Context, srvPKs []cipher.PubKey) ([]*disc.Entry, []ServerSkip) {
+	results := make([]*disc.Entry, len(srvPKs))
+	errs := make([]error, len(srvPKs))
+	sem := make(chan struct{}, maxEntryFetches)
+	var wg sync.WaitGroup
+
+	for i, srvPK := range srvPKs {
+		srvEntry, ok := ce.srvEntries.get(srvPK)
+		ce.conf.DiscMetrics.RecordCacheLookup(ok)
+		if ok {
+			results[i] = srvEntry
+			continue
+		}
+		wg.Add(1)
+		go func(i int, srvPK cipher.PubKey) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			srvEntry, _, err := ce.lookupEntry(ctx, ce.srvEntries, srvPK, getServerEntry)
+			if err != nil {
+				ce.log.WithField("remote_pk", srvPK).WithError(err).Debug("Failed to obtain server entry.")
+				errs[i] = err
+				return
+			}
+			results[i] = srvEntry
+		}(i, srvPK)
+	}
+	wg.Wait()
+
+	entries := make([]*disc.Entry, 0, len(results))
+	var skipped []ServerSkip
+	for i, srvEntry := range results {
+		if srvEntry != nil {
+			entries = append(entries, srvEntry)
+			continue
+		}
+		skipped = append(skipped, ServerSkip{ServerPK: srvPKs[i], Err: errs[i]})
+	}
+	return entries, skipped
+}
+
+// lookupEntry obtains an entry from discovery with the given lookup function, and caches it.
+// If discovery is unavailable, a previously cached (possibly stale) entry is used instead, and 'stale' is true.
+func (ce *Client) lookupEntry(ctx context.Context, cache *entryCache, pk cipher.PubKey,
+	lookup func(context.Context, disc.APIClient, cipher.PubKey) (*disc.Entry, error),
+) (entry *disc.Entry, stale bool, err error) {
+	entry, err = lookup(ctx, ce.dc, pk)
+	if err == nil {
+		cache.put(entry)
+		ce.setStaleDisc(false)
+		return entry, false, nil
+	}
+	if !isDiscUnavailable(err) {
+		cache.remove(pk)
+		return nil, false, err
+	}
+	entry, ok := cache.getStale(pk)
+	if !ok {
+		return nil, false, err
+	}
+	ce.log.WithField("remote_pk", pk).WithError(err).Warn("Discovery is unavailable, using stale entry.")
+	ce.setStaleDisc(true)
+	return entry, true, nil
+}
+
+func (ce *Client) setStaleDisc(stale bool) {
+	var v int32
+	if stale {
+		v = 1
+	}
+	atomic.StoreInt32(&ce.staleDisc, v)
+	ce.conf.DiscMetrics.SetStale(stale)
+}
+
+// UsingStaleDiscovery returns true if the client is operating on stale discovery data, as the last discovery lookup
+// failed and was served from cache.
+func (ce *Client) UsingStaleDiscovery() bool {
+	return atomic.LoadInt32(&ce.staleDisc) == 1
+}
+
+// DiscoveryHealthy returns false while discovery is unavailable, as the last call to it failed to reach it.
+// Meanwhile, the client keeps serving it's sessions and streams, and dials peers (and servers) by their cached
+// entries. Only dials of peers which have no cached entry fail (with ErrDiscUnavailable). Publications of the client's
+// entry are retried until discovery recovers.
+func (ce *Client) DiscoveryHealthy() bool {
+	return ce.discHealth.healthy()
 }
 
 // Session obtains an established session.
@@ -319,6 +1268,9 @@ func (ce *Client) ConnectedServers() []string {
 // If the session does not exist, we will attempt to establish one.
 // It returns an error if the session does not exist AND cannot be established.
 func (ce *Client) EnsureAndObtainSession(ctx context.Context, srvPK cipher.PubKey) (ClientSession, error) {
+	if isClosed(ce.done) {
+		return ClientSession{}, ErrEntityClosed
+	}
 	ce.sesMx.Lock()
 	defer ce.sesMx.Unlock()
 
@@ -334,6 +1286,72 @@ func (ce *Client) EnsureAndObtainSession(ctx context.Context, srvPK cipher.PubKe
 	return ce.dialSession(ctx, srvEntry)
 }
 
+// ensureAndObtainSession is similar to EnsureAndObtainSession, but uses the given server entry instead of looking it
+// up in discovery.
+func (ce *Client) ensureAndObtainSession(ctx context.Context, srvEntry *disc.Entry) (ClientSession, error) {
+	ce.sesMx.Lock()
+	defer ce.sesMx.Unlock()
+
+	if dSes, ok := ce.clientSession(ce.porter, srvEntry.Static); ok {
+		return dSes, nil
+	}
+
+	return ce.dialSession(ctx, srvEntry)
+}
+
+// EnsureSessions ensures that the client has at least 'n' sessions, dialing sessions to discovered servers which the
+// client is not yet connected to.
+// It is safe to call repeatedly and concurrently. Calls are serialized, and each call only tops up the missing
+// sessions, so repeated calls converge toward 'n' sessions.
+func (ce *Client) EnsureSessions(ctx context.Context, n int) error {
+	return ce.ensureSessions(ctx, n, func(ctx context.Context) ([]*disc.Entry, error) {
+		entries, err := ce.dc.AvailableServers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return ce.filterServers(entries), nil
+	})
+}
+
+// ensureSessions ensures that the client has at least 'n' sessions, dialing sessions to the servers which the given
+// function lists (see EnsureSessions).
+func (ce *Client) ensureSessions(ctx context.Context, n int, list func(context.Context) ([]*disc.Entry, error)) error {
+	if isClosed(ce.done) {
+		return ErrEntityClosed
+	}
+	ce.ensureMx.Lock()
+	defer ce.ensureMx.Unlock()
+
+	if ce.SessionCount() >= n {
+		return nil
+	}
+
+	entries, err := list(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if isClosed(ce.done) {
+			return ErrEntityClosed
+		}
+		if ce.SessionCount() >= n {
+			return nil
+		}
+		if err := ce.ensureSession(ctx, entry); err != nil {
+			ce.log.WithField("remote_pk", entry.Static).WithError(err).Warn("Failed to establish session.")
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return err
+			}
+		}
+	}
+
+	if ce.SessionCount() < n {
+		return ErrNotEnoughSessions
+	}
+	return nil
+}
+
 // ensureSession ensures the existence of a session.
 // It returns an error if the session does not exist AND cannot be established.
 func (ce *Client) ensureSession(ctx context.Context, entry *disc.Entry) error {
@@ -350,6 +1368,62 @@ func (ce *Client) ensureSession(ctx context.Context, entry *disc.Entry) error {
 	return err
 }
 
+// AddServerConn establishes a session with the server of the given public key over an already-established connection
+// (i.e. a tunnel, a unix socket or an in-memory pipe), instead of dialing the server's advertised TCP address.
+// The session handshake is performed over the connection (bounded by the context deadline), and the session is then
+// served as dialed sessions are. The connection is closed on failure, and ErrSessionExists is returned if a session
+// with the server already exists.
+func (ce *Client) AddServerConn(ctx context.Context, srvPK cipher.PubKey, conn net.Conn) (err error) {
+	defer func() {
+		if err != nil {
+			_ = conn.Close() //nolint:errcheck
+		}
+	}()
+
+	if isClosed(ce.done) {
+		return ErrEntityClosed
+	}
+
+	ce.sesMx.Lock()
+	defer ce.sesMx.Unlock()
+
+	if _, ok := ce.clientSession(ce.porter, srvPK); ok {
+		return ErrSessionExists
+	}
+
+	release, ok := ce.limiter.acquire()
+	if !ok {
+		return ErrResourceLimit
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	if d, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(d); err != nil {
+			return err
+		}
+	}
+	dSes, err := makeClientSession(&ce.EntityCommon, ce.porter, ce.allowed, conn, srvPK)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	dSes.dialAddr = conn.RemoteAddr().String()
+	dSes.release = release
+
+	if err := ce.addSession(ctx, dSes); err != nil {
+		return err
+	}
+	dSes.log.WithField("remote_addr", dSes.dialAddr).Info("Established session over provided connection.")
+	ce.serveSession(dSes)
+	return nil
+}
+
 // It is expected that the session is created and served before the context cancels, otherwise an error will be returned.
 // NOTE: This should not be called directly as it may lead to session duplicates.
 // Only `ensureSession` or `EnsureAndObtainSession` should call this function.
@@ -369,36 +1443,323 @@ func (ce *Client) dialSession(ctx context.Context, entry *disc.Entry) (cs Client
 		}
 	}()
 
-	conn, err := net.Dial(network, entry.Server.Address)
+	if ce.isDrained(entry.Static) {
+		return ClientSession{}, ErrServerDrained
+	}
+	if ce.inCooldown(entry.Static) {
+		return ClientSession{}, ErrServerCooldown
+	}
+
+	dSes, err := ce.connectSession(ctx, entry)
 	if err != nil {
 		return ClientSession{}, err
 	}
 
-	dSes, err := makeClientSession(&ce.EntityCommon, ce.porter, conn, entry.Static)
-	if err != nil {
+	if err := ce.addSession(ctx, dSes); err != nil {
 		return ClientSession{}, err
 	}
+	ce.serveSession(dSes)
+
+	return dSes, nil
+}
+
+// addSession sets the given established session, unless a session to the server already exists or the client is
+// closed (in which case the session is closed). As Close clears the sessions with 'sessionsMx' locked (after closing
+// 'done'), sessions which are established concurrently with Close are never left behind.
+func (ce *Client) addSession(ctx context.Context, dSes ClientSession) error {
+	ce.sessionsMx.Lock()
+	var err error
+	if isClosed(ce.done) {
+		err = ErrEntityClosed
+	} else if !ce.setSessionLocked(ctx, dSes.SessionCommon) {
+		err = ErrSessionExists
+	}
+	ce.sessionsMx.Unlock()
 
-	if !ce.setSession(ctx, dSes.SessionCommon) {
+	if err != nil {
 		_ = dSes.Close() //nolint:errcheck
-		return ClientSession{}, errors.New("session already exists")
 	}
+	return err
+}
+
+// connectSession dials the server of the given entry, and performs the session handshake. The advertised address is
+// dialed first, followed by the alternative addresses in order. Dialing each address is bounded by sessionDialTimeout
+// (or the context, if done earlier).
+func (ce *Client) connectSession(ctx context.Context, entry *disc.Entry) (ClientSession, error) {
+	release, ok := ce.limiter.acquire()
+	if !ok {
+		return ClientSession{}, ErrResourceLimit
+	}
+
+	start := time.Now()
+	addrs := append([]string{entry.Server.Address}, entry.Server.AltAddresses...)
+	var err error
+	for _, addr := range addrs {
+		var dSes ClientSession
+		if dSes, err = ce.connectSessionAddr(ctx, entry.Static, addr); err != nil {
+			ce.log.
+				WithError(err).
+				WithField("remote_pk", entry.Static).
+				WithField("addr", addr).
+				Debug("Failed to connect session.")
+			continue
+		}
+		dSes.dialAddr = addr
+		dSes.release = release
+		ce.ClearServerFailure(entry.Static)
+		if ce.cm != nil {
+			ce.cm.RecordDial(clientmetrics.KindSession, time.Since(start))
+		}
+		return dSes, nil
+	}
+	release()
+	if ctx.Err() == nil {
+		ce.recordServerFailure(entry.Static)
+	}
+	return ClientSession{}, err
+}
+
+// connectSessionAddr dials the server at the given (advertised) address, and performs the session handshake.
+func (ce *Client) connectSessionAddr(ctx context.Context, srvPK cipher.PubKey, addr string) (ClientSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, sessionDialTimeout)
+	defer cancel()
+
+	conn, err := dialServer(ctx, ce.resolveAddr(srvPK, addr), ce.conf.TLSConfig, ce.conf.AddressFamily)
+	if err != nil {
+		return ClientSession{}, err
+	}
+	dSes, err := makeClientSession(&ce.EntityCommon, ce.porter, ce.allowed, conn, srvPK)
+	if err != nil {
+		_ = conn.Close() //nolint:errcheck
+		return ClientSession{}, err
+	}
+	return dSes, nil
+}
+
+// resolveAddr returns the address to dial the server of the given public key by, which is the given (advertised)
+// address unless it is translated by the configured AddressResolver.
+func (ce *Client) resolveAddr(srvPK cipher.PubKey, addr string) string {
+	if ce.conf.AddressResolver == nil {
+		return addr
+	}
+	if resolved := ce.conf.AddressResolver(srvPK, addr); resolved != addr {
+		ce.log.
+			WithField("remote_pk", srvPK).
+			WithField("discovered_addr", addr).
+			WithField("resolved_addr", resolved).
+			Debug("Resolved server address.")
+		addr = resolved
+	}
+	return addr
+}
+
+// serveSession serves the given session in the background.
+func (ce *Client) serveSession(dSes ClientSession) {
+	const network = "tcp"
 
 	go func() {
-		ce.log.WithField("remote_pk", dSes.RemotePK()).Info("Serving session.")
+		dSes.log.Info("Serving session.")
 		err := dSes.serve()
-		if !isClosed(ce.done) {
-			// We should only report an error when client is not closed.
-			// Also, when the client is closed, it will automatically delete all sessions.
-			ce.errCh <- fmt.Errorf("failed to serve dialed session to %s: %v", dSes.RemotePK(), err)
-			ce.delSession(ctx, dSes.RemotePK())
+		// We should only report an error when client is not closed.
+		// Also, when the client is closed, it will automatically delete all sessions.
+		// The session is deleted before the error is reported, so that the serve loop does not see the dead
+		// session when attempting to replace it.
+		// Sessions which were replaced (see migrateSession) are no longer current, and are not reported.
+		if !isClosed(ce.done) && ce.delSessionIfCurrent(context.Background(), dSes.SessionCommon) {
+			select {
+			case ce.errCh <- sessionError{srvPK: dSes.RemotePK(), err: err}:
+			case <-ce.done:
+			}
 		}
 
 		// Trigger disconnect callback.
-		ce.conf.Callbacks.OnSessionDisconnect(network, entry.Server.Address, err)
+		ce.conf.Callbacks.OnSessionDisconnect(network, dSes.dialAddr, err)
 	}()
+	go dSes.probeIdle(ce.conf.IdleTimeout, ce.conf.ProbeTimeout)
+	go ce.awaitGoAway(dSes)
+}
 
-	return dSes, nil
+// DrainServer gracefully migrates away from the dmsg server of the given public key.
+// New streams are no longer routed through the server, and the server is removed from the delegated servers
+// advertised in discovery. Existing streams relayed by the server are waited on until they close (or the context is
+// done), after which the session to the server is closed. The client does not reconnect to drained servers, until
+// they are undrained with UndrainServer.
+// The session is closed regardless, but the context error is returned if the context is done before all streams
+// relayed by the server close. ErrSessionNotFound is returned (and the server is not drained) if there is no session
+// to the server.
+func (ce *Client) DrainServer(ctx context.Context, srvPK cipher.PubKey) error {
+	ce.sessionsMx.Lock()
+	dSes, ok := ce.sessions[srvPK]
+	ce.sessionsMx.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	ce.drainedMx.Lock()
+	ce.drained[srvPK] = struct{}{}
+	ce.drainedMx.Unlock()
+
+	log := dSes.log.WithField("func", "DrainServer")
+	log.Info("Draining server...")
+
+	// Removing the session from the sessions map stops new streams from being routed through the server, and triggers
+	// an update of the discovery entry. Existing streams keep their reference to the session.
+	ce.delSession(ctx, srvPK)
+
+	err := ce.waitServerStreams(ctx, srvPK)
+	if err != nil {
+		log.WithError(err).Warn("Streams did not close before drain deadline.")
+	}
+	log.WithError(dSes.Close()).Info("Server drained.")
+	return err
+}
+
+// waitServerStreams blocks until there are no streams relayed by the given server, or the context is done.
+func (ce *Client) waitServerStreams(ctx context.Context, srvPK cipher.PubKey) error {
+	return ce.waitStreams(ctx, func(dStr *Stream) bool { return dStr.ServerPK() == srvPK })
+}
+
+// waitStreams waits until all streams which match the given function are closed.
+func (ce *Client) waitStreams(ctx context.Context, match func(dStr *Stream) bool) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+
+	for {
+		n := 0
+		for _, dStr := range ce.AllStreams() {
+			if match(dStr) {
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ce.done:
+			return ErrEntityClosed
+		case <-t.C:
+		}
+	}
+}
+
+// isDrained returns true if the server of the given public key is drained.
+func (ce *Client) isDrained(srvPK cipher.PubKey) bool {
+	ce.drainedMx.RLock()
+	_, ok := ce.drained[srvPK]
+	ce.drainedMx.RUnlock()
+	return ok
+}
+
+// UndrainServer allows the client to reconnect to the dmsg server of the given public key, after it was drained with
+// DrainServer. A drain which is in progress still closes the session to the server once it completes.
+func (ce *Client) UndrainServer(srvPK cipher.PubKey) {
+	ce.drainedMx.Lock()
+	delete(ce.drained, srvPK)
+	ce.drainedMx.Unlock()
+}
+
+// withoutUnavailable returns the given server entries without entries of drained servers and servers in failure
+// cooldown.
+func (ce *Client) withoutUnavailable(entries []*disc.Entry) []*disc.Entry {
+	out := make([]*disc.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !ce.isDrained(entry.Static) && !ce.inCooldown(entry.Static) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// recordServerFailure records a failed session dial to the server of the given public key. The server is put in
+// failure cooldown once it's consecutive failed dials reach the failure threshold, so that a single transient failure
+// does not take a server out of rotation.
+func (ce *Client) recordServerFailure(srvPK cipher.PubKey) {
+	if ce.conf.FailureCooldown < 0 {
+		return
+	}
+	ce.failedMx.Lock()
+	defer ce.failedMx.Unlock()
+
+	ce.failures[srvPK]++
+	if ce.failures[srvPK] >= ce.conf.FailureThreshold {
+		delete(ce.failures, srvPK)
+		ce.failed[srvPK] = time.Now()
+	}
+}
+
+// cooldownServer puts the server of the given public key in failure cooldown immediately (i.e. once it notifies the
+// client that it does not accept sessions).
+func (ce *Client) cooldownServer(srvPK cipher.PubKey) {
+	if ce.conf.FailureCooldown < 0 {
+		return
+	}
+	ce.failedMx.Lock()
+	delete(ce.failures, srvPK)
+	ce.failed[srvPK] = time.Now()
+	ce.failedMx.Unlock()
+}
+
+// inCooldown returns true if the last session dial to the server of the given public key failed within the failure
+// cooldown.
+func (ce *Client) inCooldown(srvPK cipher.PubKey) bool {
+	ce.failedMx.Lock()
+	defer ce.failedMx.Unlock()
+
+	t, ok := ce.failed[srvPK]
+	if ok && time.Since(t) >= ce.conf.FailureCooldown {
+		delete(ce.failed, srvPK)
+		return false
+	}
+	return ok
+}
+
+// FailedServers returns the servers which are currently in failure cooldown, and when their cooldown started.
+// Servers in cooldown are skipped until the cooldown passes (see Config.FailureCooldown).
+func (ce *Client) FailedServers() map[cipher.PubKey]time.Time {
+	ce.failedMx.Lock()
+	defer ce.failedMx.Unlock()
+
+	out := make(map[cipher.PubKey]time.Time, len(ce.failed))
+	for pk, t := range ce.failed {
+		if time.Since(t) >= ce.conf.FailureCooldown {
+			delete(ce.failed, pk)
+			continue
+		}
+		out[pk] = t
+	}
+	return out
+}
+
+// SetAllowedPeers sets the peers which are allowed to initiate streams to the client, replacing previously allowed
+// peers. Streams from other peers are rejected with ErrReqUnauthorized before the stream handshake is completed.
+// By default, all peers are allowed.
+func (ce *Client) SetAllowedPeers(pks []cipher.PubKey) { ce.allowed.set(pks) }
+
+// AllowPeers adds the given peers to the allowed peers.
+// If all peers were allowed, only the given peers are allowed afterwards.
+func (ce *Client) AllowPeers(pks ...cipher.PubKey) { ce.allowed.add(pks) }
+
+// DisallowPeers removes the given peers from the allowed peers.
+// It has no effect if all peers are allowed.
+func (ce *Client) DisallowPeers(pks ...cipher.PubKey) { ce.allowed.remove(pks) }
+
+// AllowAllPeers allows all peers to initiate streams to the client.
+func (ce *Client) AllowAllPeers() { ce.allowed.allowAll() }
+
+// AllowedPeers returns the peers which are allowed to initiate streams to the client, and whether all peers are
+// allowed.
+func (ce *Client) AllowedPeers() (pks []cipher.PubKey, all bool) { return ce.allowed.list() }
+
+// ClearServerFailure removes the server of the given public key from failure cooldown (and resets it's count of
+// failed dials), so that it is retried immediately.
+func (ce *Client) ClearServerFailure(srvPK cipher.PubKey) {
+	ce.failedMx.Lock()
+	delete(ce.failed, srvPK)
+	delete(ce.failures, srvPK)
+	ce.failedMx.Unlock()
 }
 
 // AllStreams returns all the streams of the current client.
@@ -421,6 +1782,19 @@ func (ce *Client) AllStreams() (out []*Stream) {
 	return out
 }
 
+// ServerStreams returns the info of the streams relayed by the server of the given public key (ordered by ID), to
+// troubleshoot a single server link. This includes streams of a session which is being drained.
+func (ce *Client) ServerStreams(srvPK cipher.PubKey) []StreamInfo {
+	out := make([]StreamInfo, 0)
+	for _, dStr := range ce.AllStreams() {
+		if dStr.ServerPK() == srvPK {
+			out = append(out, dStr.Info())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
 // ConnectionsSummary associates connected clients, and the servers that connect such clients.
 // Key: Client PK, Value: Slice of Server PKs
 type ConnectionsSummary map[cipher.PubKey][]cipher.PubKey
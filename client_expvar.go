@@ -0,0 +1,165 @@
+package dmsg
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/skycoin/dmsg/clientmetrics"
+)
+
+// Counters published via expvar, by prefix (see publishVars). They are guarded by publishMx, as expvar.Publish
+// panics on duplicate names.
+var (
+	published = make(map[string]*publishedVars)
+	publishMx sync.Mutex
+)
+
+// clientCounters counts the core usage of a client, to be published via expvar (see Config.ExpvarPrefix). It records
+// the events of the client's metrics, and passes them on to the configured metrics (if any), so that the published
+// counters and the metrics collected by prometheus are of the same events.
+type clientCounters struct {
+	m clientmetrics.Metrics // configured metrics (nil if not collected)
+
+	servers  int64  // atomic
+	streams  int64  // atomic
+	bytesIn  uint64 // atomic
+	bytesOut uint64 // atomic
+}
+
+func (c *clientCounters) Collectors() []prometheus.Collector {
+	if c.m == nil {
+		return nil
+	}
+	return c.m.Collectors()
+}
+
+func (c *clientCounters) SetServers(n int) {
+	atomic.StoreInt64(&c.servers, int64(n))
+	if c.m != nil {
+		c.m.SetServers(n)
+	}
+}
+
+func (c *clientCounters) RecordStreamOpened(kind string) {
+	atomic.AddInt64(&c.streams, 1)
+	if c.m != nil {
+		c.m.RecordStreamOpened(kind)
+	}
+}
+
+func (c *clientCounters) RecordStreamClosed() {
+	atomic.AddInt64(&c.streams, -1)
+	if c.m != nil {
+		c.m.RecordStreamClosed()
+	}
+}
+
+func (c *clientCounters) RecordStreamFailed(kind, reason string) {
+	if c.m != nil {
+		c.m.RecordStreamFailed(kind, reason)
+	}
+}
+
+func (c *clientCounters) RecordTraffic(direction string, bytes, frames int) {
+	if direction == clientmetrics.DirectionIn {
+		atomic.AddUint64(&c.bytesIn, uint64(bytes))
+	} else {
+		atomic.AddUint64(&c.bytesOut, uint64(bytes))
+	}
+	if c.m != nil {
+		c.m.RecordTraffic(direction, bytes, frames)
+	}
+}
+
+func (c *clientCounters) RecordDial(kind string, duration time.Duration) {
+	if c.m != nil {
+		c.m.RecordDial(kind, duration)
+	}
+}
+
+func (c *clientCounters) RecordHandshake(kind string, duration time.Duration) {
+	if c.m != nil {
+		c.m.RecordHandshake(kind, duration)
+	}
+}
+
+func (c *clientCounters) RecordReconnect() {
+	if c.m != nil {
+		c.m.RecordReconnect()
+	}
+}
+
+// publishVars publishes the counters of the client via expvar, as an expvar.Map named by the prefix with the counters:
+//   - servers: number of servers which the client has sessions with
+//   - streams: number of open streams
+//   - bytes_in, bytes_out: bytes read from and written to servers
+//   - accept_backlog: number of streams which are queued by listeners to be accepted
+//   - entry_published: time in which the client's discovery entry was last published
+//
+// As expvar variables are global (and cannot be removed), the map of a prefix is published once, and reads the
+// counters of the latest client created with the prefix. Nothing is published if a variable of the prefix's name is
+// published by other means.
+func (ce *Client) publishVars(prefix string, counters *clientCounters) {
+	publishMx.Lock()
+	defer publishMx.Unlock()
+
+	pv, ok := published[prefix]
+	if !ok {
+		if expvar.Get(prefix) != nil {
+			ce.log.WithField("expvar", prefix).Warn("Expvar variable is already published, not publishing counters.")
+			return
+		}
+		pv = new(publishedVars)
+		expvar.Publish(prefix, pv.makeMap())
+		published[prefix] = pv
+	}
+	pv.src.Store(&varsSource{ce: ce, counters: counters})
+}
+
+// publishedVars are the counters published via expvar under a prefix, of the client which is stored in 'src'.
+type publishedVars struct {
+	src atomic.Value // *varsSource
+}
+
+type varsSource struct {
+	ce       *Client
+	counters *clientCounters
+}
+
+func (pv *publishedVars) makeMap() *expvar.Map {
+	vars := map[string]func(s *varsSource) interface{}{
+		"servers":        func(s *varsSource) interface{} { return atomic.LoadInt64(&s.counters.servers) },
+		"streams":        func(s *varsSource) interface{} { return atomic.LoadInt64(&s.counters.streams) },
+		"bytes_in":       func(s *varsSource) interface{} { return atomic.LoadUint64(&s.counters.bytesIn) },
+		"bytes_out":      func(s *varsSource) interface{} { return atomic.LoadUint64(&s.counters.bytesOut) },
+		"accept_backlog": func(s *varsSource) interface{} { return s.ce.acceptBacklog() },
+		"entry_published": func(s *varsSource) interface{} {
+			if published := atomic.LoadInt64(&s.ce.entryPublished); published != 0 {
+				return time.Unix(0, published)
+			}
+			return time.Time{}
+		},
+	}
+	m := new(expvar.Map).Init()
+	for name, fn := range vars {
+		fn := fn
+		m.Set(name, expvar.Func(func() interface{} { return fn(pv.src.Load().(*varsSource)) }))
+	}
+	return m
+}
+
+// acceptBacklog returns the number of streams which are queued by the client's listeners to be accepted.
+func (ce *Client) acceptBacklog() int {
+	var n int
+	ce.porter.RangePortValues(func(_ uint16, v interface{}) bool {
+		if lis, ok := v.(*Listener); ok {
+			n += len(lis.accept)
+		}
+		return true
+	})
+	return n
+}
@@ -0,0 +1,100 @@
+package dmsg
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/clientmetrics"
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestClient_Expvar(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, DefaultServerConfig(), nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients. Client B publishes it's counters via expvar, along with collecting metrics.
+	newClient := func(name string, conf *Config) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	// Expvar variables are global, so the prefix is unique to the run.
+	prefix := fmt.Sprintf("dmsg_test_expvar_%d", time.Now().UnixNano())
+	reg := prometheus.NewPedanticRegistry()
+	m := clientmetrics.New("dmsg")
+	require.NoError(t, clientmetrics.Register(reg, m))
+	confB := DefaultConfig()
+	confB.Metrics = m
+	confB.ExpvarPrefix = prefix
+	clientA := newClient("client A", DefaultConfig())
+	clientB := newClient("client B", confB)
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	value := func(name string) string {
+		vars, ok := expvar.Get(prefix).(*expvar.Map)
+		require.True(t, ok)
+		v := vars.Get(name)
+		require.NotNil(t, v, name)
+		return v.String()
+	}
+	require.Equal(t, "1", value("servers"))
+	require.Equal(t, "0", value("streams"))
+	require.NotEqual(t, `"0001-01-01T00:00:00Z"`, value("entry_published"))
+
+	// Client A dials a stream to client B, which is queued until client B accepts it.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool { return value("accept_backlog") == "1" })
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	require.Equal(t, "0", value("accept_backlog"))
+	require.Equal(t, "1", value("streams"))
+
+	// The published counters agree with the metrics.
+	_, err = strA.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strB, make([]byte, 5))
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool {
+		values := gatherMetrics(t, reg)
+		return value("bytes_in") == fmt.Sprint(values["dmsg_client_bytes_total/in"]) &&
+			value("bytes_out") == fmt.Sprint(values["dmsg_client_bytes_total/out"])
+	})
+	require.NotEqual(t, "0", value("bytes_in"))
+
+	// A client with the same prefix takes over the published counters (rather than panicking).
+	clientC := newClient("client C", &Config{ExpvarPrefix: prefix})
+	require.Equal(t, "0", value("streams"))
+	require.NoError(t, strB.Close())
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
@@ -0,0 +1,156 @@
+package dmsg
+
+import (
+	"context"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+// watchServerAddrs periodically re-fetches the discovery entries of the servers which the client has sessions with,
+// and migrates sessions of servers which advertise a new address (see migrateSession).
+func (ce *Client) watchServerAddrs(ctx context.Context) {
+	t := time.NewTimer(netutil.Jitter(ce.conf.AddrCheckInterval, watchJitter))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ce.done:
+			return
+		case <-t.C:
+		}
+		ce.checkServerAddrs(ctx)
+		t.Reset(netutil.Jitter(ce.conf.AddrCheckInterval, watchJitter))
+	}
+}
+
+// checkServerAddrs migrates sessions of servers which no longer advertise the dialed address (as their address or one
+// of their alternative addresses).
+func (ce *Client) checkServerAddrs(ctx context.Context) {
+	for _, dSes := range ce.allClientSessions(ce.porter) {
+		srvPK := dSes.RemotePK()
+		if ce.isDrained(srvPK) {
+			continue
+		}
+		log := dSes.log.WithField("func", "checkServerAddrs")
+
+		entry, err := getServerEntry(ctx, ce.dc, srvPK)
+		if err != nil {
+			log.WithError(err).Debug("Failed to obtain server entry.")
+			continue
+		}
+		ce.srvEntries.put(entry)
+
+		if advertisesAddr(entry, dSes.dialAddr) {
+			continue
+		}
+		if !ce.addrMigrationAllowed(srvPK) {
+			log.Debug("Server address changed, but the server was migrated recently.")
+			continue
+		}
+
+		log = log.WithField("old_addr", dSes.dialAddr).WithField("new_addr", entry.Server.Address)
+		log.Info("Server address changed, migrating session...")
+		if err := ce.migrateSession(ctx, entry); err != nil {
+			log.WithError(err).Warn("Failed to migrate session.")
+		}
+	}
+}
+
+// advertisesAddr returns true if the given server entry advertises the address, as it's address or an alternative one.
+func advertisesAddr(entry *disc.Entry, addr string) bool {
+	if entry.Server.Address == addr {
+		return true
+	}
+	for _, alt := range entry.Server.AltAddresses {
+		if alt == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// addrMigrationAllowed returns true if the session to the given server was not migrated within the minimum interval
+// between migrations, and records the migration attempt if so.
+func (ce *Client) addrMigrationAllowed(srvPK cipher.PubKey) bool {
+	ce.migratedMx.Lock()
+	defer ce.migratedMx.Unlock()
+
+	if t, ok := ce.migrated[srvPK]; ok && time.Since(t) < ce.conf.MinAddrMigrateInterval {
+		return false
+	}
+	ce.migrated[srvPK] = time.Now()
+	return true
+}
+
+// migrateSession establishes a session to the new address of the server of the given entry, and replaces the
+// current session with it. New streams use the new session, while the old session is closed once the streams it
+// relays are closed (or after migrateTimeout).
+// The new address is dialed without holding 'sesMx', so that dialing does not hold up sessions to other servers.
+// The session is replaced atomically, and is not replaced if it is removed in the meantime.
+func (ce *Client) migrateSession(ctx context.Context, entry *disc.Entry) error {
+	if _, ok := ce.session(entry.Static); !ok {
+		return ErrSessionNotFound
+	}
+
+	dSes, err := ce.connectSession(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	old, ok := ce.replaceSession(dSes.SessionCommon)
+	if !ok {
+		_ = dSes.Close() //nolint:errcheck
+		return ErrSessionNotFound
+	}
+	ce.serveSession(dSes)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+
+		err := ce.waitStreams(ctx, func(dStr *Stream) bool { return dStr.ses.SessionCommon == old })
+		old.log.
+			WithField("wait_error", err).
+			WithError(old.Close()).
+			Info("Closed session of old server address.")
+	}()
+	return nil
+}
+
+// awaitGoAway waits for a GOAWAY notice on the given session, and moves away from the server once it is received.
+// New streams are no longer routed through the server, a replacement session is established by the serve loop, and
+// the session is closed once the streams it relays are closed (or after migrateTimeout).
+func (ce *Client) awaitGoAway(dSes ClientSession) {
+	select {
+	case <-dSes.goAway:
+	case <-dSes.ys.CloseChan():
+		return
+	}
+
+	srvPK := dSes.RemotePK()
+	log := dSes.log.WithField("func", "awaitGoAway").WithField("reason", dSes.goAwayErr)
+	log.Info("Server sent GOAWAY notice, moving to other servers...")
+
+	// The server does not accept sessions, so it is not redialed until the cooldown passes.
+	ce.cooldownServer(srvPK)
+
+	if ce.delSessionIfCurrent(context.Background(), dSes.SessionCommon) && !isClosed(ce.done) {
+		select {
+		case ce.errCh <- sessionError{srvPK: srvPK, err: dSes.goAwayErr}:
+		case <-ce.done:
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	err := ce.waitStreams(ctx, func(dStr *Stream) bool { return dStr.ses.SessionCommon == dSes.SessionCommon })
+	log.WithField("wait_error", err).
+		WithError(dSes.Close()).
+		Info("Closed session of server which sent GOAWAY notice.")
+}
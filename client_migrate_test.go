@@ -0,0 +1,118 @@
+package dmsg
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestClient_AddrMigration(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// The proxy acts as the new address of the server.
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := &freezableProxy{lis: lisProxy, target: lisSrv.Addr().String()}
+	go proxy.serve()
+	defer func() { require.NoError(t, proxy.close()) }()
+
+	conf := DefaultConfig()
+	conf.AddrCheckInterval = -1 // addresses are checked manually
+	conf.MinAddrMigrateInterval = time.Hour
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	c.SetLogger(logging.MustGetLogger("client"))
+
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+	require.NoError(t, c.ensureSession(context.TODO(), entry))
+	old, ok := c.session(pkSrv)
+	require.True(t, ok)
+	require.Equal(t, lisSrv.Addr().String(), old.dialAddr)
+
+	// Wait for the server to advertise the session, so that it's entry updates do not race with ours.
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkSrv)
+		return err == nil && entry.Server.AvailableSessions == srv.maxSessions-1
+	})
+
+	setAddr := func(addr string) {
+		entry, err := dc.Entry(context.TODO(), pkSrv)
+		require.NoError(t, err)
+		entry.Server.Address = addr
+		require.NoError(t, dc.PutEntry(context.TODO(), skSrv, entry))
+	}
+
+	// Unchanged addresses do not trigger a migration.
+	c.checkServerAddrs(context.TODO())
+	dSes, ok := c.session(pkSrv)
+	require.True(t, ok)
+	require.True(t, dSes == old)
+
+	// The session is migrated to the new address, and the old session is closed as it relays no streams.
+	setAddr(lisProxy.Addr().String())
+	c.checkServerAddrs(context.TODO())
+	dSes, ok = c.session(pkSrv)
+	require.True(t, ok)
+	require.False(t, dSes == old)
+	require.Equal(t, lisProxy.Addr().String(), dSes.dialAddr)
+	waitFor(t, time.Second*5, old.ys.IsClosed)
+
+	// The server keeps the new session after the old one is closed.
+	require.Equal(t, 1, c.SessionCount())
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 1 })
+
+	// Flapping addresses do not trigger another migration within the minimum interval.
+	setAddr(lisSrv.Addr().String())
+	c.checkServerAddrs(context.TODO())
+	dSes, ok = c.session(pkSrv)
+	require.True(t, ok)
+	require.Equal(t, lisProxy.Addr().String(), dSes.dialAddr)
+
+	// Dialing a new address does not hold up obtaining sessions, and is bounded by the context.
+	lisStall, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lisStall.Close()) }()
+	go func() {
+		for {
+			conn, err := lisStall.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() //nolint:errcheck
+		}
+	}()
+	stalled := *entry
+	stalled.Server = &disc.Server{Address: tlsScheme + lisStall.Addr().String()}
+	ctx, cancel := context.WithCancel(context.TODO())
+	migrated := make(chan error, 1)
+	go func() { migrated <- c.migrateSession(ctx, &stalled) }()
+	time.Sleep(time.Millisecond * 100)
+	obtained, err := c.EnsureAndObtainSession(context.TODO(), pkSrv)
+	require.NoError(t, err)
+	require.True(t, obtained.SessionCommon == dSes)
+	cancel()
+	require.Error(t, <-migrated)
+	cur, ok := c.session(pkSrv)
+	require.True(t, ok)
+	require.True(t, cur == dSes)
+
+	require.NoError(t, c.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
@@ -0,0 +1,44 @@
+package dmsg
+
+import "sync"
+
+// registry is the process-wide registry of clients which opt into it (see Config.Register).
+var registry clientRegistry
+
+// clientRegistry contains clients, in the order they were created.
+type clientRegistry struct {
+	clients []*Client
+	mx      sync.Mutex
+}
+
+func (r *clientRegistry) add(c *Client) {
+	r.mx.Lock()
+	r.clients = append(r.clients, c)
+	r.mx.Unlock()
+}
+
+// remove removes the given client, if it is registered.
+func (r *clientRegistry) remove(c *Client) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for i, rc := range r.clients {
+		if rc == c {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *clientRegistry) list() []*Client {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return append([]*Client(nil), r.clients...)
+}
+
+// Clients returns the clients of the process which are registered (see Config.Register), in the order they were
+// created (for introspection, such as a debug endpoint). Clients are deregistered once they are closed.
+func Clients() []*Client {
+	return registry.list()
+}
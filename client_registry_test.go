@@ -0,0 +1,57 @@
+package dmsg
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestClients_Registry(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	newClient := func(name string, register bool) *Client {
+		pk, sk := GenKeyPair(t, name)
+		conf := DefaultConfig()
+		conf.Register = register
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		return c
+	}
+
+	// Only clients which opt in are registered, in the order they are created.
+	var registered []*Client
+	for i := 0; i < 3; i++ {
+		registered = append(registered, newClient(fmt.Sprintf("client_%d", i), true))
+	}
+	unregistered := newClient("client_unregistered", false)
+	require.Equal(t, registered, Clients())
+
+	// Closed clients are deregistered (once), and closing unregistered clients has no effect.
+	require.NoError(t, registered[1].Close())
+	require.NoError(t, registered[1].Close())
+	require.NoError(t, unregistered.Close())
+	require.Equal(t, []*Client{registered[0], registered[2]}, Clients())
+
+	// Clients which are created and closed concurrently leave nothing behind.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := newClient(fmt.Sprintf("client_concurrent_%d", i), true)
+			require.Contains(t, Clients(), c)
+			require.NoError(t, c.Close())
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, []*Client{registered[0], registered[2]}, Clients())
+
+	require.NoError(t, registered[0].Close())
+	require.NoError(t, registered[2].Close())
+	require.Empty(t, Clients())
+}
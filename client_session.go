@@ -1,54 +1,89 @@
 package dmsg
 
 import (
+	"context"
 	"net"
 	"time"
 
 	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/netutil"
 )
 
 // ClientSession represents a session from the perspective of a dmsg client.
 type ClientSession struct {
 	*SessionCommon
-	porter *netutil.Porter
+	porter  *netutil.Porter
+	allowed *peerAllowlist // peers allowed to initiate streams
 }
 
-func makeClientSession(entity *EntityCommon, porter *netutil.Porter, conn net.Conn, rPK cipher.PubKey) (ClientSession, error) {
+func makeClientSession(entity *EntityCommon, porter *netutil.Porter, allowed *peerAllowlist, conn net.Conn,
+	rPK cipher.PubKey) (ClientSession, error) {
 	var cSes ClientSession
 	cSes.SessionCommon = new(SessionCommon)
 	if err := cSes.SessionCommon.initClient(entity, conn, rPK); err != nil {
 		return cSes, err
 	}
 	cSes.porter = porter
+	cSes.allowed = allowed
 	return cSes, nil
 }
 
 // DialStream attempts to dial a stream to a remote client via the dmsg server that this session is connected to.
-func (cs *ClientSession) DialStream(dst Addr) (dStr *Stream, err error) {
-	log := cs.log.
-		WithField("func", "ClientSession.DialStream").
-		WithField("dst_addr", dst)
-
+// The handshake is bounded by HandshakeTimeout (or the context deadline if earlier), after which ErrHandshakeTimeout
+// is returned. The stream (and the resources it holds) is released on failure.
+func (cs *ClientSession) DialStream(ctx context.Context, dst Addr) (dStr *Stream, err error) {
 	if dStr, err = newInitiatingStream(cs); err != nil {
 		return nil, err
 	}
+	log := dStr.log.
+		WithField("func", "ClientSession.DialStream").
+		WithField("remote_pk", dst.PK).
+		WithField("remote_port", dst.Port)
 
-	// Close stream on failure.
+	// Close stream on failure (the returned stream is nil by then).
+	str := dStr
 	defer func() {
 		if err != nil {
+			str.recordFailed(clientmetrics.StreamDialed, err)
 			log.WithError(err).
-				WithField("close_error", dStr.Close()).
+				WithField("close_error", str.Close()).
 				Debug("Stream closed on failure.")
+			return
 		}
+		str.recordOpened(clientmetrics.StreamDialed)
 	}()
 
+	if err = dStr.acquireSlot(); err != nil {
+		return nil, err
+	}
+
 	// Prepare deadline.
-	if err = dStr.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+	deadline := time.Now().Add(HandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = dStr.SetDeadline(deadline); err != nil {
 		return nil, err
 	}
 
+	// Abort the handshake once the context is done.
+	stopAbort := dStr.abortOnDone(ctx)
+	defer stopAbort()
+	defer func() {
+		if err == nil {
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			err = ctx.Err()
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = ErrHandshakeTimeout
+		}
+	}()
+
 	// Do stream handshake.
+	start := time.Now()
 	req, err := dStr.writeRequest(dst)
 	if err != nil {
 		return nil, err
@@ -57,6 +92,8 @@ func (cs *ClientSession) DialStream(dst Addr) (dStr *Stream, err error) {
 	if err := dStr.readResponse(req); err != nil {
 		return nil, err
 	}
+	cs.entity.recordHandshake(log, handshakemetrics.KindStream, start)
+	stopAbort()
 
 	// Clear deadline.
 	if err = dStr.SetDeadline(time.Time{}); err != nil {
@@ -93,11 +130,18 @@ func (cs *ClientSession) acceptStream() (dStr *Stream, err error) {
 		return nil, err
 	}
 
-	// Close stream on failure.
+	// Close stream on failure (the returned stream is nil by then). Notices of the server are not streams.
+	str, notice := dStr, false
 	defer func() {
+		if err == nil && !notice {
+			str.recordOpened(clientmetrics.StreamAccepted)
+		}
 		if err != nil {
-			if scErr := dStr.Close(); scErr != nil {
-				cs.log.WithError(scErr).
+			if !notice {
+				str.recordFailed(clientmetrics.StreamAccepted, err)
+			}
+			if scErr := str.Close(); scErr != nil {
+				str.log.WithError(scErr).
 					Debug("On (*ClientSession).acceptStream() failure, close stream resulted in error.")
 			}
 		}
@@ -109,13 +153,40 @@ func (cs *ClientSession) acceptStream() (dStr *Stream, err error) {
 	}
 
 	// Do stream handshake.
+	start := time.Now()
 	req, err := dStr.readRequest()
+	if err == nil {
+		err = dStr.acquireSlot()
+	}
+	if err == ErrPeerDisconnected || err == ErrStreamIdle || err == ErrStreamFramesDropped {
+		notice = true
+		// The notice is acknowledged by closing it's stream.
+		if err := dStr.Close(); err != nil {
+			dStr.log.WithError(err).Debug("Failed to acknowledge peer disconnection notice.")
+		}
+		return nil, nil
+	}
+	if err == ErrServerGoAway || err == ErrServerFull || err == ErrServerDraining || err == ErrClientTooSlow ||
+		err == ErrClientOverBudget || err == ErrAccessDenied || err == ErrProtocolViolation ||
+		err == ErrStreamBufferOverflow {
+		notice = true
+		cs.setGoAway(err)
+		return nil, err
+	}
+	if rErr, ok := err.(Error); ok && (rErr == ErrReqUnauthorized || rErr == ErrResourceLimit) {
+		dStr.log.WithField("remote_pk", req.SrcAddr.PK).WithError(err).Debug("Rejected stream.")
+		if wErr := dStr.writeRejection(req.raw.Hash(), rErr); wErr != nil {
+			return nil, wErr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 	if err = dStr.writeResponse(req.raw.Hash()); err != nil {
 		return nil, err
 	}
+	cs.entity.recordHandshake(dStr.log, handshakemetrics.KindStream, start)
+	dStr.resolveRemoteCaps()
 
 	// Clear deadline.
 	if err = dStr.SetDeadline(time.Time{}); err != nil {
@@ -0,0 +1,2890 @@
+package dmsg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/discmetrics"
+	"github.com/skycoin/dmsg/handshakemetrics"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+func TestClient_OnEntryUpdated(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg servers.
+	srvPKs := make([]cipher.PubKey, 2)
+	for i := range srvPKs {
+		pkSrv, skSrv := GenKeyPair(t, fmt.Sprintf("server %d", i))
+		srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(fmt.Sprintf("server_%d", i)))
+		lisSrv, err := net.Listen("tcp", "")
+		require.NoError(t, err)
+		chSrv := make(chan error, 1)
+		go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+		<-srv.Ready()
+		defer func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-chSrv)
+		}()
+		srvPKs[i] = pkSrv
+	}
+
+	// Prepare dmsg client with callback, which uses the client (this deadlocks if it is called with sessionsMx held).
+	type update struct {
+		servers  []cipher.PubKey
+		sessions int
+	}
+	updates := make(chan update, 10)
+	var clientA *Client
+	conf := DefaultConfig()
+	conf.Callbacks = &ClientCallbacks{
+		OnEntryUpdated: func(servers []cipher.PubKey) { updates <- update{servers, clientA.SessionCount()} },
+	}
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA = NewClient(pkA, skA, dc, conf)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+
+	nextUpdate := func() update {
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for entry update callback")
+			return update{}
+		}
+	}
+
+	// The first publication reports the first server.
+	_, err := clientA.EnsureAndObtainSession(context.TODO(), srvPKs[0])
+	require.NoError(t, err)
+	u := nextUpdate()
+	require.Equal(t, srvPKs[:1], u.servers)
+	require.Equal(t, 1, u.sessions)
+
+	// A later change of sessions reports the new set of servers.
+	_, err = clientA.EnsureAndObtainSession(context.TODO(), srvPKs[1])
+	require.NoError(t, err)
+	u = nextUpdate()
+	require.ElementsMatch(t, srvPKs, u.servers)
+	require.Equal(t, 2, u.sessions)
+
+	// The entry which Close publishes is not reported.
+	require.NoError(t, clientA.Close())
+	select {
+	case u := <-updates:
+		t.Fatalf("unexpected entry update callback after close: %v", u.servers)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestClient_EntryDebounce(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg servers.
+	srvPKs := make([]cipher.PubKey, 3)
+	for i := range srvPKs {
+		pkSrv, skSrv := GenKeyPair(t, fmt.Sprintf("server %d", i))
+		srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(fmt.Sprintf("server_%d", i)))
+		lisSrv, err := net.Listen("tcp", "")
+		require.NoError(t, err)
+		chSrv := make(chan error, 1)
+		go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+		<-srv.Ready()
+		defer func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-chSrv)
+		}()
+		srvPKs[i] = pkSrv
+	}
+
+	// Prepare dmsg client with callback.
+	updates := make(chan []cipher.PubKey, 10)
+	conf := DefaultConfig()
+	conf.EntryDebounce = time.Millisecond * 500
+	conf.Callbacks = &ClientCallbacks{
+		OnEntryUpdated: func(servers []cipher.PubKey) { updates <- servers },
+	}
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, conf)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+
+	// The first entry is published at once.
+	_, err := clientA.EnsureAndObtainSession(context.TODO(), srvPKs[0])
+	require.NoError(t, err)
+	select {
+	case servers := <-updates:
+		require.Equal(t, srvPKs[:1], servers)
+	case <-time.After(conf.EntryDebounce):
+		t.Fatal("timed out waiting for entry update callback")
+	}
+
+	// Rapidly add sessions to the other servers, and remove the first.
+	for _, pkSrv := range srvPKs[1:] {
+		_, err := clientA.EnsureAndObtainSession(context.TODO(), pkSrv)
+		require.NoError(t, err)
+	}
+	ses, ok := clientA.Session(srvPKs[0])
+	require.True(t, ok)
+	require.NoError(t, ses.Close())
+	waitFor(t, time.Second*5, func() bool { _, ok := clientA.Session(srvPKs[0]); return !ok })
+
+	// A single update publishes the final set.
+	select {
+	case servers := <-updates:
+		require.ElementsMatch(t, srvPKs[1:], servers)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for entry update callback")
+	}
+	select {
+	case servers := <-updates:
+		t.Fatalf("unexpected entry update: %v", servers)
+	case <-time.After(conf.EntryDebounce * 2):
+	}
+	entry, err := dc.Entry(context.TODO(), pkA)
+	require.NoError(t, err)
+	require.ElementsMatch(t, srvPKs[1:], entry.Client.DelegatedServers)
+
+	// The first entry of a client which needs more sessions is debounced, so that it is published with all of them.
+	conf.MinSessions = 2
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, conf)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	for _, pkSrv := range srvPKs[:2] {
+		_, err := clientB.EnsureAndObtainSession(context.TODO(), pkSrv)
+		require.NoError(t, err)
+	}
+	select {
+	case servers := <-updates:
+		require.ElementsMatch(t, srvPKs[:2], servers)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for entry update callback")
+	}
+
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+}
+
+func TestClient_EntryBuilder(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	const capKey, capVal = "capabilities", "compression"
+
+	conf := DefaultConfig()
+	conf.EntryBuilder = func(base *disc.Entry) (*disc.Entry, error) {
+		base.Client.Metadata = map[string]string{capKey: capVal}
+		return base, nil
+	}
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, conf)
+	defer func() { require.NoError(t, clientA.Close()) }()
+
+	publish := func() {
+		require.NoError(t, clientA.updateClientEntry(context.TODO(), clientA.done))
+	}
+
+	// Both new and updated entries are customized and signed after customization.
+	for i := 0; i < 2; i++ {
+		publish()
+		entry, err := dc.Entry(context.TODO(), pkA)
+		require.NoError(t, err)
+		require.Equal(t, capVal, entry.Client.Metadata[capKey])
+		require.NoError(t, entry.VerifySignature())
+		require.Equal(t, uint64(i), entry.Sequence)
+
+		atomic.StoreInt64(&clientA.lastUpdate, 0) // ensure update is due
+	}
+
+	// Invalid entries are rejected.
+	clientA.entryBuilder = func(base *disc.Entry) (*disc.Entry, error) {
+		base.Sequence += 10
+		return base, nil
+	}
+	err := clientA.updateClientEntry(context.TODO(), clientA.done)
+	require.Error(t, err)
+}
+
+func TestClient_ServerFilter(t *testing.T) {
+	makeEntry := func(seed, region string) *disc.Entry {
+		pk, _ := GenKeyPair(t, seed)
+		entry := disc.NewServerEntry(pk, 0, "127.0.0.1:8080", 10)
+		if region != "" {
+			entry.Server.Metadata = map[string]string{"region": region}
+		}
+		return entry
+	}
+	eu1, us1, eu2, none := makeEntry("1", "eu"), makeEntry("2", "us"), makeEntry("3", "eu"), makeEntry("4", "")
+	entries := []*disc.Entry{eu1, us1, eu2, none}
+
+	conf := DefaultConfig()
+	conf.ServerFilter = ServerLabelFilter("region", "eu")
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, disc.NewMock(0), conf)
+	defer func() { require.NoError(t, clientA.Close()) }()
+
+	require.Equal(t, []*disc.Entry{eu1, eu2}, clientA.filterServers(entries))
+	require.Equal(t, []*disc.Entry{eu1, eu2, us1, none}, clientA.orderServers(entries))
+
+	// Fall back to the unfiltered list when the filter eliminates everything.
+	require.Equal(t, []*disc.Entry{us1, none}, clientA.filterServers([]*disc.Entry{us1, none}))
+}
+
+func TestClient_Capabilities(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	conf := DefaultConfig()
+	conf.Features = []string{"feature_a"}
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, conf)
+	defer func() { require.NoError(t, clientA.Close()) }()
+
+	// Capabilities are advertised in the published entry.
+	require.NoError(t, clientA.updateClientEntry(context.TODO(), clientA.done))
+
+	entry, err := dc.Entry(context.TODO(), pkA)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersion, entry.Client.Capabilities.ProtocolVersion)
+	require.True(t, entry.Client.Capabilities.HasFeature("feature_a"))
+	require.True(t, entry.Client.Capabilities.HasFeature(FeatureRekey))
+
+	// Remote entries with and without compatible capabilities.
+	srvPK, _ := GenKeyPair(t, "server")
+	post := func(seed string, caps *disc.Capabilities) cipher.PubKey {
+		pk, sk := GenKeyPair(t, seed)
+		entry := disc.NewClientEntry(pk, 0, []cipher.PubKey{srvPK})
+		entry.Client.Capabilities = caps
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+		return pk
+	}
+	baseline := post("baseline", nil)
+	compatible := post("compatible", &disc.Capabilities{ProtocolVersion: ProtocolVersion + ".1"})
+	incompatible := post("incompatible", &disc.Capabilities{ProtocolVersion: "999.0"})
+
+	_, err = getClientEntry(context.TODO(), dc, baseline)
+	require.NoError(t, err)
+	_, err = getClientEntry(context.TODO(), dc, compatible)
+	require.NoError(t, err)
+	_, err = getClientEntry(context.TODO(), dc, incompatible)
+	require.Equal(t, ErrDiscEntryIncompatible, err)
+
+	// Dialing an incompatible client fails fast.
+	_, err = clientA.DialStream(context.TODO(), Addr{PK: incompatible, Port: 1})
+	require.Equal(t, ErrDiscEntryIncompatible, err)
+}
+
+func TestClient_StaticDiscovery(t *testing.T) {
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dc := disc.NewStatic(
+		map[cipher.PubKey]string{pkSrv: lisSrv.Addr().String()},
+		map[cipher.PubKey][]cipher.PubKey{pkA: {pkSrv}, pkB: {pkSrv}},
+	)
+
+	// Prepare and serve dmsg server.
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+
+	// Prepare and serve dmsg clients.
+	clientA := NewClient(pkA, skA, dc, nil)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	clientB := NewClient(pkB, skB, dc, nil)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	// Ensure the server has registered both sessions before dialing.
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// Dial entirely from static config.
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+	require.Equal(t, pkSrv, connA.ServerPK())
+	require.Equal(t, pkSrv, connB.ServerPK())
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// failingEntryClient is a disc.APIClient of which Entry calls fail with the given error.
+type failingEntryClient struct {
+	disc.APIClient
+	err   error
+	posts int
+}
+
+func (c *failingEntryClient) Entry(context.Context, cipher.PubKey) (*disc.Entry, error) {
+	return nil, c.err
+}
+func (c *failingEntryClient) PostEntry(ctx context.Context, e *disc.Entry) error {
+	c.posts++
+	return c.APIClient.PostEntry(ctx, e)
+}
+
+// recordingEntryClient is a disc.APIClient which records the last entry written to discovery.
+type recordingEntryClient struct {
+	disc.APIClient
+	last *disc.Entry
+	mx   sync.Mutex
+}
+
+func (c *recordingEntryClient) record(e *disc.Entry) {
+	c.mx.Lock()
+	c.last = new(disc.Entry)
+	disc.Copy(c.last, e)
+	c.mx.Unlock()
+}
+
+func (c *recordingEntryClient) lastEntry() *disc.Entry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.last
+}
+
+func (c *recordingEntryClient) PostEntry(ctx context.Context, e *disc.Entry) error {
+	err := c.APIClient.PostEntry(ctx, e)
+	if err == nil {
+		c.record(e)
+	}
+	return err
+}
+
+func (c *recordingEntryClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *disc.Entry) error {
+	err := c.APIClient.PutEntry(ctx, sk, e)
+	if err == nil {
+		c.record(e)
+	}
+	return err
+}
+
+func TestClient_PublishedEntry(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	pkA, skA := GenKeyPair(t, "client A")
+	rdc := &recordingEntryClient{APIClient: dc}
+	clientA := NewClient(pkA, skA, rdc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+
+	// Nothing is published before the client is served.
+	_, ok := clientA.PublishedEntry()
+	require.False(t, ok)
+
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	// The published entry is exactly what was written to discovery.
+	waitFor(t, time.Second*5, func() bool {
+		entry, ok := clientA.PublishedEntry()
+		return ok && len(entry.Client.DelegatedServers) == 1
+	})
+	entry, ok := clientA.PublishedEntry()
+	require.True(t, ok)
+	require.Equal(t, rdc.lastEntry(), entry)
+	require.Equal(t, []cipher.PubKey{pkSrv}, entry.Client.DelegatedServers)
+	got, err := dc.Entry(context.TODO(), pkA)
+	require.NoError(t, err)
+	require.Equal(t, got.Sequence, entry.Sequence)
+
+	// The returned entry is a copy.
+	entry.Client.DelegatedServers[0] = pkA
+	entry, ok = clientA.PublishedEntry()
+	require.True(t, ok)
+	require.Equal(t, []cipher.PubKey{pkSrv}, entry.Client.DelegatedServers)
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_UpdateClientEntryMerge(t *testing.T) {
+	pkA, skA := GenKeyPair(t, "client A")
+	srvPK, _ := GenKeyPair(t, "server")
+
+	publish := func(c *Client) error {
+		return c.updateClientEntry(context.TODO(), c.done)
+	}
+
+	t.Run("preserves_server_section", func(t *testing.T) {
+		dc := disc.NewMock(0)
+
+		// Existing entry has both client and server sections.
+		entry := disc.NewServerEntry(pkA, 0, "127.0.0.1:8080", 10)
+		entry.Client = &disc.Client{Metadata: map[string]string{"k": "v"}}
+		require.NoError(t, entry.Sign(skA))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+
+		clientA := NewClient(pkA, skA, dc, nil)
+		defer func() { require.NoError(t, clientA.Close()) }()
+		clientA.sessions[srvPK] = new(SessionCommon)
+		require.NoError(t, publish(clientA))
+		delete(clientA.sessions, srvPK) // fake session cannot be closed
+
+		got, err := dc.Entry(context.TODO(), pkA)
+		require.NoError(t, err)
+		require.Equal(t, []cipher.PubKey{srvPK}, got.Client.DelegatedServers)
+		require.Equal(t, "v", got.Client.Metadata["k"])
+		require.Equal(t, *entry.Server, *got.Server)
+		require.Equal(t, entry.Sequence+1, got.Sequence)
+	})
+
+	t.Run("server_only_entry", func(t *testing.T) {
+		dc := disc.NewMock(0)
+
+		entry := disc.NewServerEntry(pkA, 0, "127.0.0.1:8080", 10)
+		require.NoError(t, entry.Sign(skA))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+
+		clientA := NewClient(pkA, skA, dc, nil)
+		defer func() { require.NoError(t, clientA.Close()) }()
+		require.NoError(t, publish(clientA))
+
+		got, err := dc.Entry(context.TODO(), pkA)
+		require.NoError(t, err)
+		require.NotNil(t, got.Client)
+		require.Equal(t, *entry.Server, *got.Server)
+	})
+
+	t.Run("transient_fetch_error", func(t *testing.T) {
+		dc := &failingEntryClient{APIClient: disc.NewMock(0), err: disc.ErrUnexpected}
+
+		conf := DefaultConfig()
+		conf.DiscTries = 1
+		clientA := NewClient(pkA, skA, dc, conf)
+		defer func() { require.NoError(t, clientA.Close()) }()
+
+		// A new entry must not be created on transient failures.
+		require.Equal(t, disc.ErrUnexpected, publish(clientA))
+		require.Equal(t, 0, dc.posts)
+
+		// A new entry is created when the entry is genuinely not found.
+		dc.err = disc.ErrKeyNotFound
+		require.NoError(t, publish(clientA))
+		require.Equal(t, 1, dc.posts)
+	})
+}
+
+// signerFunc is a disc.Signer which delegates signing to a function.
+type signerFunc struct {
+	pk   cipher.PubKey
+	sign func(data []byte) (cipher.Sig, error)
+}
+
+func (s signerFunc) PubKey() cipher.PubKey                { return s.pk }
+func (s signerFunc) Sign(data []byte) (cipher.Sig, error) { return s.sign(data) }
+
+func TestClient_Signer(t *testing.T) {
+	pk, sk := GenKeyPair(t, "client")
+	srvPK, _ := GenKeyPair(t, "server")
+
+	var signs int
+	conf := DefaultConfig()
+	conf.Signer = signerFunc{pk: pk, sign: func(data []byte) (cipher.Sig, error) {
+		signs++
+		return cipher.SignPayload(data, sk)
+	}}
+
+	dc := disc.NewMockClient(0)
+	dc.SetVerification(disc.MockVerifyAll)
+
+	c := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	publish := func() {
+		require.NoError(t, c.updateClientEntry(context.TODO(), c.done))
+	}
+
+	// Both the initial entry and updates are signed by the signer.
+	publish()
+	require.Equal(t, 1, signs)
+
+	c.sessions[srvPK] = new(SessionCommon)
+	publish()
+	delete(c.sessions, srvPK) // fake session cannot be closed
+	require.Equal(t, 2, signs)
+
+	got, err := dc.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+	require.NoError(t, got.VerifySignature())
+	require.Equal(t, []cipher.PubKey{srvPK}, got.Client.DelegatedServers)
+}
+
+func TestClient_ServerSample(t *testing.T) {
+	const nSrvs = 6
+	const sample = 2
+
+	dc := disc.NewMock(0)
+	for i := 0; i < nSrvs; i++ {
+		pk, sk := GenKeyPair(t, fmt.Sprintf("server %d", i))
+		entry := disc.NewServerEntry(pk, 0, fmt.Sprintf("127.0.0.1:%d", 8080+i), 10)
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+	}
+
+	pk, sk := GenKeyPair(t, "client")
+
+	// Only a sample of servers is requested.
+	conf := DefaultConfig()
+	conf.ServerSample = sample
+	c := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	entries, err := c.discoverServers(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, entries, sample)
+
+	// A server filter selects among all servers.
+	conf = DefaultConfig()
+	conf.ServerSample = sample
+	conf.ServerFilter = func(*disc.Entry) bool { return true }
+	c2 := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c2.Close()) }()
+
+	entries, err = c2.discoverServers(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, entries, nSrvs)
+}
+
+func TestClient_FailureCooldown(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Reserve an address of which the server is not up yet.
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lisSrv.Addr().String()
+	require.NoError(t, lisSrv.Close())
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	entry := disc.NewServerEntry(pkSrv, 0, addr, 10)
+
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	conf.FailureThreshold = 2
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	// A single failed dial does not put the server in cooldown.
+	require.Error(t, c.ensureSession(context.TODO(), entry))
+	require.Empty(t, c.FailedServers())
+
+	// Consecutive failed dials reaching the threshold put the server in cooldown.
+	require.Error(t, c.ensureSession(context.TODO(), entry))
+	failed := c.FailedServers()
+	require.Len(t, failed, 1)
+	require.Contains(t, failed, pkSrv)
+
+	// Servers in cooldown are skipped.
+	require.Equal(t, ErrServerCooldown, c.ensureSession(context.TODO(), entry))
+	require.Empty(t, c.filterServers([]*disc.Entry{entry}))
+
+	// Bring the server up.
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Once cleared, the server is retried immediately.
+	c.ClearServerFailure(pkSrv)
+	require.Empty(t, c.FailedServers())
+	require.NoError(t, c.ensureSession(context.TODO(), entry))
+	require.Equal(t, 1, c.SessionCount())
+
+	require.NoError(t, c.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// slowEntryClient is a disc.APIClient of which Entry calls are delayed and counted.
+type slowEntryClient struct {
+	disc.APIClient
+	delay time.Duration
+	calls int64
+}
+
+func (c *slowEntryClient) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	atomic.AddInt64(&c.calls, 1)
+	time.Sleep(c.delay)
+	return c.APIClient.Entry(ctx, pk)
+}
+
+func TestClient_DelegatedServerEntries(t *testing.T) {
+	const nSrvs = 4
+	const delay = time.Millisecond * 200
+
+	mock := disc.NewMock(0)
+	srvPKs := make([]cipher.PubKey, 0, nSrvs+1)
+	for i := 0; i < nSrvs; i++ {
+		pk, sk := GenKeyPair(t, fmt.Sprintf("server %d", i))
+		entry := disc.NewServerEntry(pk, 0, fmt.Sprintf("127.0.0.1:%d", 8080+i), 10)
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, mock.PostEntry(context.TODO(), entry))
+		srvPKs = append(srvPKs, pk)
+	}
+
+	// The first server is not registered in discovery, and should be skipped.
+	missingPK, _ := GenKeyPair(t, "missing server")
+	srvPKs = append([]cipher.PubKey{missingPK}, srvPKs...)
+
+	dc := &slowEntryClient{APIClient: mock, delay: delay}
+	m := &cacheMetrics{Metrics: discmetrics.NewEmpty()}
+	conf := DefaultConfig()
+	conf.DiscTries = 1
+	conf.DiscMetrics = m
+
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	start := time.Now()
+	entries, skipped := c.delegatedServerEntries(context.TODO(), srvPKs)
+	require.Less(t, int64(time.Since(start)), int64(delay*nSrvs), "lookups should be concurrent")
+	require.Len(t, entries, nSrvs)
+	require.Len(t, skipped, 1)
+	require.Equal(t, srvPKs[0], skipped[0].ServerPK)
+	require.Error(t, skipped[0].Err)
+	for i, entry := range entries {
+		require.Equal(t, srvPKs[i+1], entry.Static)
+	}
+	require.Equal(t, int64(nSrvs+1), atomic.LoadInt64(&dc.calls))
+	require.Equal(t, int64(0), atomic.LoadInt64(&m.hits))
+	require.Equal(t, int64(nSrvs+1), atomic.LoadInt64(&m.misses))
+
+	// Subsequent lookups are served from cache (except for the missing server).
+	entries, _ = c.delegatedServerEntries(context.TODO(), srvPKs)
+	require.Len(t, entries, nSrvs)
+	require.Equal(t, int64(nSrvs+2), atomic.LoadInt64(&dc.calls))
+	require.Equal(t, int64(nSrvs), atomic.LoadInt64(&m.hits))
+	require.Equal(t, int64(nSrvs+2), atomic.LoadInt64(&m.misses))
+}
+
+// cacheMetrics is a discmetrics.Metrics which counts entry cache lookups.
+type cacheMetrics struct {
+	discmetrics.Metrics
+	hits, misses int64
+}
+
+func (m *cacheMetrics) RecordCacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&m.hits, 1)
+	} else {
+		atomic.AddInt64(&m.misses, 1)
+	}
+}
+
+func TestClient_DiscOpTimeout(t *testing.T) {
+	const opTimeout = time.Millisecond * 200
+
+	conf := DefaultConfig()
+	conf.DiscOpTimeout = opTimeout
+
+	pk, sk := GenKeyPair(t, "client")
+	// Discovery calls block until the context is done.
+	dc := disc.NewMockClient(0)
+	dc.SetLatency(time.Hour)
+
+	c := NewClient(pk, sk, dc, conf)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	remotePK, _ := GenKeyPair(t, "remote")
+
+	// The caller's context is long-lived, so only the operation timeout can fail the dial.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.DialStream(ctx, Addr{PK: remotePK, Port: 1})
+	require.Error(t, err)
+	dmsgErr, ok := err.(Error)
+	require.True(t, ok, err)
+	require.Equal(t, ErrDiscUnavailable.code, dmsgErr.code, err)
+	require.Less(t, int64(time.Since(start)), int64(opTimeout*5))
+}
+
+func TestClient_StaleDiscovery(t *testing.T) {
+	dc := disc.NewMockClient(0)
+
+	conf := DefaultConfig()
+	conf.DiscTries = 1
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, conf)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, conf)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	dial := func() (stale bool) {
+		connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+		require.NoError(t, err)
+		connA, err := lis.AcceptStream()
+		require.NoError(t, err)
+		require.NoError(t, connA.Close())
+		require.NoError(t, connB.Close())
+		return connB.Info().StaleDiscovery
+	}
+
+	// Dialing while discovery is up populates the cache.
+	require.False(t, dial())
+	require.False(t, clientB.UsingStaleDiscovery())
+
+	// Dialing while discovery is down uses the cached entry.
+	dc.SetError(disc.ErrUnexpected)
+	require.True(t, dial())
+	require.True(t, clientB.UsingStaleDiscovery())
+
+	// Server discovery falls back to previously seen servers.
+	entries, err := clientB.discoverServers(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, pkSrv, entries[0].Static)
+
+	// Recovery of discovery clears the stale flag.
+	dc.SetError(nil)
+	require.False(t, dial())
+	require.False(t, clientB.UsingStaleDiscovery())
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_DiscoveryOutage(t *testing.T) {
+	dc := disc.NewMockClient(0)
+
+	conf := DefaultConfig()
+	conf.DiscTries = 1
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients, of which client A and C listen.
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient("client A")
+	clientB := newClient("client B")
+	clientC := newClient("client C")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 3 })
+	lisA, err := clientA.Listen(80)
+	require.NoError(t, err)
+	lisC, err := clientC.Listen(80)
+	require.NoError(t, err)
+
+	dial := func(lis *Listener, pk cipher.PubKey) (*Stream, *Stream, error) {
+		strB, err := clientB.DialStream(context.TODO(), Addr{PK: pk, Port: 80})
+		if err != nil {
+			return nil, nil, err
+		}
+		str, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return strB, str, nil
+	}
+	echo := func(strB, str *Stream) {
+		_, err := strB.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(str, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+	}
+
+	// Client B dials client A while discovery is up, which caches the entry of client A.
+	strBA, strA, err := dial(lisA, clientA.LocalPK())
+	require.NoError(t, err)
+	require.True(t, clientB.DiscoveryHealthy())
+
+	// Discovery goes down. The stream and sessions which are established are still served.
+	dc.SetError(disc.ErrUnexpected)
+	echo(strBA, strA)
+	require.Equal(t, 1, clientB.SessionCount())
+
+	// Client C has no cached entry, so it cannot be dialed.
+	_, _, err = dial(lisC, clientC.LocalPK())
+	require.Error(t, err)
+	dmsgErr, ok := err.(Error)
+	require.True(t, ok, err)
+	require.Equal(t, ErrDiscUnavailable.code, dmsgErr.code, err)
+	require.False(t, clientB.DiscoveryHealthy())
+
+	// Client A is dialed by it's cached entry.
+	strBA2, strA2, err := dial(lisA, clientA.LocalPK())
+	require.NoError(t, err)
+	require.True(t, strBA2.Info().StaleDiscovery)
+	echo(strBA2, strA2)
+	require.False(t, clientB.DiscoveryHealthy())
+
+	// Once discovery recovers, client C is dialed.
+	dc.SetError(nil)
+	strBC, strC, err := dial(lisC, clientC.LocalPK())
+	require.NoError(t, err)
+	echo(strBC, strC)
+	require.True(t, clientB.DiscoveryHealthy())
+
+	// Closing logic.
+	for _, str := range []*Stream{strBA, strA, strBA2, strA2, strBC, strC} {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// waitFor polls the condition until it is satisfied, failing the test after the timeout.
+// It is used instead of require.Eventually, which (as of the vendored testify v1.4.0) evaluates the condition in a new
+// goroutine on every tick, and closes the channel which these report on once it returns. Conditions which are still
+// pending by then panic with a send on the closed channel, and conditions may run concurrently with each other.
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not satisfied within %s", timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// freezableProxy relays TCP connections to 'target'. Once frozen, all relayed data is dropped.
+type freezableProxy struct {
+	lis    net.Listener
+	target string
+	frozen int32
+	conns  []net.Conn
+	closed bool
+	mx     sync.Mutex
+}
+
+func (p *freezableProxy) serve() {
+	for {
+		conn, err := p.lis.Accept()
+		if err != nil {
+			return
+		}
+		tConn, err := net.Dial("tcp", p.target)
+		if err != nil {
+			_ = conn.Close() //nolint:errcheck
+			continue
+		}
+		p.mx.Lock()
+		if p.closed {
+			p.mx.Unlock()
+			_ = conn.Close()  //nolint:errcheck
+			_ = tConn.Close() //nolint:errcheck
+			return
+		}
+		p.conns = append(p.conns, conn, tConn)
+		p.mx.Unlock()
+		go p.relay(conn, tConn)
+		go p.relay(tConn, conn)
+	}
+}
+
+// close closes the proxy and all relayed connections.
+func (p *freezableProxy) close() error {
+	err := p.lis.Close()
+	p.mx.Lock()
+	p.closed = true
+	for _, conn := range p.conns {
+		_ = conn.Close() //nolint:errcheck
+	}
+	p.mx.Unlock()
+	return err
+}
+
+func (p *freezableProxy) relay(dst, src net.Conn) {
+	defer func() { _ = dst.Close() }() //nolint:errcheck
+	b := make([]byte, 4096)
+	for {
+		n, err := src.Read(b)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&p.frozen) == 1 {
+			continue
+		}
+		if _, err := dst.Write(b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestClient_IdleProbe(t *testing.T) {
+	const idleTimeout = time.Millisecond * 200
+
+	dc := disc.NewMock(0)
+
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := &freezableProxy{lis: lisProxy, target: lisSrv.Addr().String()}
+	go proxy.serve()
+
+	// Prepare and serve dmsg server (which advertises the proxy address).
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, lisProxy.Addr().String()) }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg client.
+	disconnected := make(chan error, 1)
+	conf := DefaultConfig()
+	conf.IdleTimeout = idleTimeout
+	conf.ProbeTimeout = idleTimeout
+	conf.Callbacks = &ClientCallbacks{
+		OnSessionDisconnect: func(_, _ string, err error) {
+			select {
+			case disconnected <- err:
+			default:
+			}
+		},
+	}
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	c.SetLogger(logging.MustGetLogger("client"))
+	go c.Serve(context.Background())
+	<-c.Ready()
+
+	// Idle sessions which respond to probes are kept.
+	time.Sleep(idleTimeout * 5)
+	require.Equal(t, 1, c.SessionCount())
+	select {
+	case err := <-disconnected:
+		t.Fatalf("session unexpectedly disconnected: %v", err)
+	default:
+	}
+
+	// Idle sessions which do not respond to probes are closed.
+	atomic.StoreInt32(&proxy.frozen, 1)
+	select {
+	case <-disconnected:
+	case <-time.After(idleTimeout * 10):
+		t.Fatal("dead session was not detected")
+	}
+
+	// Closing logic.
+	// The proxy is closed first, as the server would otherwise wait on session handshakes stuck behind it.
+	require.NoError(t, c.Close())
+	require.NoError(t, proxy.close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_EntryExpiry(t *testing.T) {
+	const entryTTL = time.Millisecond * 600
+
+	dc := disc.NewMockClient(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg client of which entry updates are driven by the entry's expiry.
+	var updates int64
+	expiring := make(chan time.Time, 1)
+	conf := DefaultConfig()
+	conf.UpdateInterval = time.Hour
+	conf.EntryTTL = entryTTL
+	conf.DiscTries = 1
+	conf.Callbacks = &ClientCallbacks{
+		OnEntryUpdated: func([]cipher.PubKey) { atomic.AddInt64(&updates, 1) },
+		OnEntryExpiring: func(expiry time.Time, _ error) {
+			select {
+			case expiring <- expiry:
+			default:
+			}
+		},
+	}
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	c.SetLogger(logging.MustGetLogger("client"))
+	go c.Serve(context.Background())
+	<-c.Ready()
+
+	// The entry is refreshed before it expires.
+	n := atomic.LoadInt64(&updates)
+	time.Sleep(entryTTL * 2)
+	require.GreaterOrEqual(t, atomic.LoadInt64(&updates)-n, int64(2))
+
+	// Failing to refresh close to expiry triggers the alarm.
+	dc.SetError(disc.ErrUnexpected)
+	select {
+	case expiry := <-expiring:
+		require.Less(t, int64(time.Until(expiry)), int64(entryTTL/3))
+	case <-time.After(entryTTL * 2):
+		t.Fatal("expiry alarm was not triggered")
+	}
+	dc.SetError(nil)
+
+	// Closing logic.
+	require.NoError(t, c.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_ClearEntryOnClose(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	serveClient := func(name string, conf *Config) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	delegatedServers := func(pk cipher.PubKey) []cipher.PubKey {
+		entry, err := dc.Entry(context.TODO(), pk)
+		require.NoError(t, err)
+		return entry.Client.DelegatedServers
+	}
+
+	t.Run("clears_by_default", func(t *testing.T) {
+		c := serveClient("client A", nil)
+		require.Equal(t, []cipher.PubKey{pkSrv}, delegatedServers(c.LocalPK()))
+		require.NoError(t, c.Close())
+		require.Empty(t, delegatedServers(c.LocalPK()))
+	})
+
+	t.Run("keep_entry_on_close", func(t *testing.T) {
+		conf := DefaultConfig()
+		conf.KeepEntryOnClose = true
+		c := serveClient("client B", conf)
+		require.NoError(t, c.Close())
+		require.Equal(t, []cipher.PubKey{pkSrv}, delegatedServers(c.LocalPK()))
+	})
+
+	// Closing logic.
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// outdatedEntryClient is a disc.APIClient which serves an outdated entry for the first lookup of it's public key.
+type outdatedEntryClient struct {
+	disc.APIClient
+	entry  *disc.Entry
+	served int32
+	calls  int32
+}
+
+func (c *outdatedEntryClient) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	if pk == c.entry.Static {
+		atomic.AddInt32(&c.calls, 1)
+		if atomic.CompareAndSwapInt32(&c.served, 0, 1) {
+			return c.entry, nil
+		}
+	}
+	return c.APIClient.Entry(ctx, pk)
+}
+
+func TestClient_DialRefreshesEntry(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// A server which has gone away.
+	lisGone, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, lisGone.Close())
+	pkGone, skGone := GenKeyPair(t, "gone server")
+	goneEntry := disc.NewServerEntry(pkGone, 0, lisGone.Addr().String(), 10)
+	require.NoError(t, goneEntry.Sign(skGone))
+	require.NoError(t, dc.PostEntry(context.TODO(), goneEntry))
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// Client B first obtains an entry of A which only delegates the server which has gone away.
+	outdated := disc.NewClientEntry(pkA, 0, []cipher.PubKey{pkGone})
+	odc := &outdatedEntryClient{APIClient: dc, entry: outdated}
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, odc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	// Without refresh, the dial fails on the outdated entry.
+	_, err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80}, WithoutEntryRefresh())
+	require.True(t, errors.Is(err, ErrCannotConnectToDelegated), err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&odc.calls))
+
+	// With refresh, the entry is fetched again and the dial succeeds via the new delegated server.
+	atomic.StoreInt32(&odc.served, 0)
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(&odc.calls))
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_DialErrorDetails(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server, which the remote is not connected to.
+	pkUp, skUp := GenKeyPair(t, "server up")
+	srv := NewServer(pkUp, skUp, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare servers which are unavailable for various reasons.
+	postEntry := func(name, addr string) cipher.PubKey {
+		pk, sk := GenKeyPair(t, name)
+		entry := disc.NewServerEntry(pk, 0, addr, 10)
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+		return pk
+	}
+	pkMissing, _ := GenKeyPair(t, "server missing")
+	const rejectedAddr = "127.0.0.1:2"
+	pkRejected := postEntry("server rejected", rejectedAddr)
+	pkCooldown := postEntry("server cooldown", "127.0.0.1:1")
+
+	// The remote delegates all of them.
+	pkA, _ := GenKeyPair(t, "client A")
+	entryA := disc.NewClientEntry(pkA, 0, []cipher.PubKey{pkMissing, pkRejected, pkCooldown, pkUp})
+	odc := &outdatedEntryClient{APIClient: dc, entry: entryA}
+
+	pkB, skB := GenKeyPair(t, "client B")
+	confB := DefaultConfig()
+	confB.FailureCooldown = time.Hour
+	confB.FailureThreshold = 1
+	confB.Callbacks = &ClientCallbacks{
+		OnSessionDial: func(network, addr string) error {
+			if addr == rejectedAddr {
+				return errors.New("rejected by policy")
+			}
+			return nil
+		},
+	}
+	clientB := NewClient(pkB, skB, odc, confB)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	cooldownEntry, err := dc.Entry(context.TODO(), pkCooldown)
+	require.NoError(t, err)
+	require.Error(t, clientB.ensureSession(context.TODO(), cooldownEntry))
+	_, err = clientB.EnsureAndObtainSession(context.TODO(), pkUp)
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pkB); return ok })
+
+	// The dial error details why each server was skipped.
+	_, err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80}, WithoutEntryRefresh())
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrReqNoNextSession), err)
+	var dErr *DialError
+	require.True(t, errors.As(err, &dErr), err)
+	require.Len(t, dErr.Skipped, 4)
+	require.Error(t, dErr.SkipReason(pkMissing))
+	require.Contains(t, dErr.SkipReason(pkRejected).Error(), "rejected by policy")
+	require.Equal(t, ErrServerCooldown, dErr.SkipReason(pkCooldown))
+	require.Equal(t, ErrReqNoNextSession, dErr.SkipReason(pkUp))
+	require.NoError(t, dErr.SkipReason(pkB))
+	require.Contains(t, err.Error(), pkCooldown.String()[:8])
+
+	// Closing logic.
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// handshakeRecorder is a handshakemetrics.Metrics which records observed handshake durations.
+type handshakeRecorder struct {
+	handshakemetrics.Metrics
+	durations map[string][]time.Duration
+	mx        sync.Mutex
+}
+
+func (r *handshakeRecorder) RecordHandshake(kind string, d time.Duration) {
+	r.mx.Lock()
+	r.durations[kind] = append(r.durations[kind], d)
+	r.mx.Unlock()
+}
+
+func (r *handshakeRecorder) observed(kind string) []time.Duration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]time.Duration(nil), r.durations[kind]...)
+}
+
+// warnHook is a logrus.Hook which records the fields of warnings.
+type warnHook struct {
+	warnings []logrus.Fields
+	mx       sync.Mutex
+}
+
+func (h *warnHook) Levels() []logrus.Level { return []logrus.Level{logrus.WarnLevel} }
+
+func (h *warnHook) Fire(e *logrus.Entry) error {
+	h.mx.Lock()
+	h.warnings = append(h.warnings, e.Data)
+	h.mx.Unlock()
+	return nil
+}
+
+// slowHandshakes returns the kinds of handshakes which were warned of as slow.
+func (h *warnHook) slowHandshakes() []string {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	var kinds []string
+	for _, fields := range h.warnings {
+		if kind, ok := fields["handshake"].(string); ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// serveDelayedProxy relays TCP connections accepted by 'lis' to 'target', after delaying each connection.
+func serveDelayedProxy(lis net.Listener, target string, delay time.Duration) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			time.Sleep(delay)
+			tConn, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close() //nolint:errcheck
+				return
+			}
+			go func() {
+				_, _ = io.Copy(tConn, conn) //nolint:errcheck
+				_ = tConn.Close()           //nolint:errcheck
+			}()
+			_, _ = io.Copy(conn, tConn) //nolint:errcheck
+			_ = conn.Close()            //nolint:errcheck
+		}()
+	}
+}
+
+func TestClient_SlowHandshake(t *testing.T) {
+	const delay = time.Millisecond * 500
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server, which is advertised via a proxy which delays sessions.
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go serveDelayedProxy(lisProxy, lisSrv.Addr().String(), delay)
+	defer func() { require.NoError(t, lisProxy.Close()) }()
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, lisProxy.Addr().String()) }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	hook := new(warnHook)
+	logA := logrus.New()
+	logA.SetOutput(ioutil.Discard)
+	logA.AddHook(hook)
+	metricsA := &handshakeRecorder{Metrics: handshakemetrics.NewEmpty(), durations: make(map[string][]time.Duration)}
+
+	confA := DefaultConfig()
+	confA.SlowHandshake = delay / 2
+	confA.HandshakeMetrics = metricsA
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, confA)
+	clientA.SetLogger(logA)
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	// The delayed session handshake is observed and warned of.
+	sesDurations := metricsA.observed(handshakemetrics.KindSession)
+	require.Len(t, sesDurations, 1)
+	require.True(t, sesDurations[0] >= delay)
+	require.Contains(t, hook.slowHandshakes(), handshakemetrics.KindSession)
+
+	// Stream handshakes are observed.
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	connA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	require.NoError(t, err)
+	connB, err := lis.AcceptStream()
+	require.NoError(t, err)
+	require.Len(t, metricsA.observed(handshakemetrics.KindStream), 1)
+
+	// Closing logic.
+	require.NoError(t, connB.Close())
+	require.NoError(t, connA.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_ConnLimit(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Client A may hold its session and a single stream.
+	confA := DefaultConfig()
+	confA.MaxConns = 2
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, confA)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+	require.Equal(t, 1, clientA.limiter.count())
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	lisA, err := clientA.Listen(80)
+	require.NoError(t, err)
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+
+	// The first stream saturates the limit.
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	connA, err := lisA.AcceptStream()
+	require.NoError(t, err)
+	require.Equal(t, 2, clientA.limiter.count())
+
+	// Further accepts are rejected, and the rejection reaches the initiator.
+	_, err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.Equal(t, ErrResourceLimit, err)
+
+	// Further dials are rejected.
+	_, err = clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	require.Equal(t, ErrResourceLimit, err)
+	require.Equal(t, 2, clientA.limiter.count())
+
+	// Closing a stream frees it's slot.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.Equal(t, 1, clientA.limiter.count())
+	connA, err = clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	require.NoError(t, err)
+	connB, err = lisB.AcceptStream()
+	require.NoError(t, err)
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, lisA.Close())
+	require.NoError(t, lisB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.Equal(t, 0, clientA.limiter.count())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_HandshakeTimeout(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	srvEntry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	// Client B has a session which is never served, so it never answers stream requests.
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	sesB, err := clientB.connectSession(context.TODO(), srvEntry)
+	require.NoError(t, err)
+	entryB := disc.NewClientEntry(pkB, 0, []cipher.PubKey{pkSrv})
+	require.NoError(t, entryB.Sign(skB))
+	require.NoError(t, dc.PostEntry(context.TODO(), entryB))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 1 })
+
+	confA := DefaultConfig()
+	confA.MaxConns = 2
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, confA)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	require.NoError(t, clientA.ensureSession(context.TODO(), srvEntry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	dial := func(ctx context.Context) (time.Duration, error) {
+		start := time.Now()
+		_, err := clientA.DialStream(ctx, Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+		return time.Since(start), err
+	}
+
+	// The handshake is bounded by the handshake timeout, and the stream is released.
+	defer func(timeout time.Duration) { HandshakeTimeout = timeout }(HandshakeTimeout)
+	HandshakeTimeout = time.Millisecond * 300
+	d, err := dial(context.Background())
+	require.Equal(t, ErrHandshakeTimeout, err)
+	require.True(t, d < time.Second*2, d)
+	require.Empty(t, clientA.AllStreams())
+	require.Equal(t, 1, clientA.limiter.count())
+
+	// The handshake is bounded by the context deadline.
+	HandshakeTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	d, err = dial(ctx)
+	require.Equal(t, ErrHandshakeTimeout, err)
+	require.True(t, d < time.Second*2, d)
+	require.Empty(t, clientA.AllStreams())
+	require.Equal(t, 1, clientA.limiter.count())
+
+	// Cancelling the context aborts the handshake.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*300, cancel)
+	d, err = dial(ctx)
+	require.Equal(t, context.Canceled, err)
+	require.True(t, d < time.Second*2, d)
+	require.Empty(t, clientA.AllStreams())
+	require.Equal(t, 1, clientA.limiter.count())
+
+	// Closing logic.
+	require.NoError(t, sesB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestClient_RefreshOnDialFailure(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// serve prepares and serves a dmsg server.
+	serve := func(name string) (*Server, func()) {
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		return srv, func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-ch)
+		}
+	}
+
+	// Client A is only connected to the new server.
+	srvNew, closeNew := serve("new server")
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// Dialing clients first obtain an entry of A which only delegates the old server (that A has moved away from).
+	srvOld, closeOld := serve("old server")
+	outdated := disc.NewClientEntry(pkA, 0, []cipher.PubKey{srvOld.LocalPK()})
+
+	newClient := func(name string, refresh bool) (*Client, *outdatedEntryClient) {
+		conf := DefaultConfig()
+		conf.RefreshOnDialFailure = refresh
+		odc := &outdatedEntryClient{APIClient: dc, entry: outdated}
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, odc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+
+		// Ensure that the old server serves the session before dialing via it.
+		_, err := c.EnsureAndObtainSession(context.TODO(), srvOld.LocalPK())
+		require.NoError(t, err)
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srvOld.serverSession(pk)
+			return ok
+		})
+		return c, odc
+	}
+
+	// By default, the dial fails as the old server rejects the stream.
+	clientB, odcB := newClient("client_B", false)
+	_, err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.True(t, errors.Is(err, ErrReqNoNextSession), err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&odcB.calls))
+
+	// With RefreshOnDialFailure, the entry (which is updated in the meantime) is fetched again, and the dial succeeds
+	// via the new server.
+	clientC, odcC := newClient("client_C", true)
+	connC, err := clientC.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&odcC.calls))
+	require.Equal(t, srvNew.LocalPK(), connC.ServerPK())
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+	require.NoError(t, connA.Close())
+	require.NoError(t, connC.Close())
+
+	// The refresh is skipped when the dial opts out of it.
+	atomic.StoreInt32(&odcC.served, 0)
+	_, err = clientC.DialStream(context.TODO(), Addr{PK: pkA, Port: 80}, WithoutEntryRefresh())
+	require.True(t, errors.Is(err, ErrReqNoNextSession), err)
+	require.EqualValues(t, 3, atomic.LoadInt32(&odcC.calls))
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	closeOld()
+	closeNew()
+}
+
+func TestClient_AddServerConn(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Client A connects to the server over an in-memory pipe.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	connA, connSrv := net.Pipe()
+	go srv.handleSession(connSrv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, clientA.AddServerConn(ctx, pkSrv, connA))
+	require.Equal(t, 1, clientA.SessionCount())
+	waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pkA); return ok })
+
+	// A second connection to the same server is refused.
+	connA2, connSrv2 := net.Pipe()
+	require.True(t, errors.Is(clientA.AddServerConn(ctx, pkSrv, connA2), ErrSessionExists))
+	_, err = connSrv2.Write([]byte{0})
+	require.Error(t, err, "refused connection should be closed")
+
+	// Client B connects over TCP, and dials client A via the server.
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	_, err = clientB.EnsureAndObtainSession(context.TODO(), pkSrv)
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pkB); return ok })
+
+	strB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	strA, err := lis.Accept()
+	require.NoError(t, err)
+	_, err = strB.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(strA, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestClient_LinkWriteError(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients A and B.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// Client B dials multiple streams over it's single session.
+	const n = 3
+	streams := make([]*Stream, n)
+	for i := range streams {
+		streams[i], err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+		require.NoError(t, err)
+		_, err = lis.Accept()
+		require.NoError(t, err)
+	}
+
+	// All but the first stream are blocked in reads.
+	readErrs := make(chan error, n-1)
+	for _, str := range streams[1:] {
+		go func(str *Stream) {
+			_, err := str.Read(make([]byte, 1))
+			readErrs <- err
+		}(str)
+	}
+
+	// Writes to the session's connection fail from now on (reads do not).
+	ses, ok := clientB.Session(pkSrv)
+	require.True(t, ok)
+	require.NoError(t, ses.GetConn().SetWriteDeadline(time.Now()))
+
+	// The stream which triggers the write, and all other streams of the session, fail with the link error.
+	_, err = streams[0].Write([]byte("hello"))
+	require.Equal(t, ErrLinkError, err)
+	for i := 0; i < n-1; i++ {
+		select {
+		case err := <-readErrs:
+			require.Equal(t, ErrLinkError, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("blocked read did not return after link error")
+		}
+	}
+	_, err = streams[1].Write([]byte("hello"))
+	require.Equal(t, ErrLinkError, err)
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// serveSlowProxy relays TCP connections accepted by 'lis' to 'target', where data towards the accepting side is
+// relayed in chunks of 'chunk' bytes every 'interval'.
+func serveSlowProxy(lis net.Listener, target string, chunk int, interval time.Duration) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			tConn, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close() //nolint:errcheck
+				return
+			}
+			go func() {
+				_, _ = io.Copy(tConn, conn) //nolint:errcheck
+				_ = tConn.Close()           //nolint:errcheck
+			}()
+			b := make([]byte, chunk)
+			for {
+				n, err := tConn.Read(b)
+				if err != nil {
+					break
+				}
+				if _, err := conn.Write(b[:n]); err != nil {
+					break
+				}
+				time.Sleep(interval)
+			}
+			_ = conn.Close() //nolint:errcheck
+		}()
+	}
+}
+
+func TestClient_DialP2P(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// serve prepares and serves a dmsg server, which is optionally advertised via a proxy which is slow towards clients.
+	serve := func(name string, slow bool) (*Server, func()) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := lis.Addr().String()
+		var lisProxy net.Listener
+		if slow {
+			lisProxy, err = net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			go serveSlowProxy(lisProxy, addr, 16, time.Millisecond*20)
+			addr = lisProxy.Addr().String()
+		}
+
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, addr) }() //nolint:errcheck
+		<-srv.Ready()
+		return srv, func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-ch)
+			if lisProxy != nil {
+				require.NoError(t, lisProxy.Close())
+			}
+		}
+	}
+	srvFast, closeFast := serve("fast server", false)
+	srvSlow, closeSlow := serve("slow server", true)
+
+	// Prepare and serve dmsg clients, which are both connected to both servers.
+	newClient := func(name string) *Client {
+		conf := DefaultConfig()
+		conf.MinSessions = 2
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		waitFor(t, time.Second*10, func() bool {
+			_, okFast := srvFast.serverSession(pk)
+			_, okSlow := srvSlow.serverSession(pk)
+			return okFast && okSlow
+		})
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+	waitFor(t, time.Second*10, func() bool {
+		entry, err := dc.Entry(context.TODO(), clientA.LocalPK())
+		return err == nil && len(entry.Client.DelegatedServers) == 2
+	})
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// The stream via the fast server wins the race.
+	connB, err := clientB.DialP2P(context.TODO(), Addr{PK: clientA.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	require.Equal(t, srvFast.LocalPK(), connB.ServerPK())
+
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+	require.Equal(t, srvFast.LocalPK(), connA.ServerPK())
+	_, err = connB.Write([]byte("hello"))
+	require.NoError(t, err)
+	msg := make([]byte, 5)
+	_, err = io.ReadFull(connA, msg)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(msg))
+
+	// The stream via the slow server is closed.
+	sesSlow, ok := clientB.Session(srvSlow.LocalPK())
+	require.True(t, ok)
+	waitFor(t, time.Second*10, func() bool {
+		return sesSlow.ys.NumStreams() == 0 && len(srvSlow.ClientStreams()) == 0
+	})
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	closeSlow()
+	closeFast()
+}
+
+func TestClient_ServerStreams(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	serve := func(name string) (*Server, func()) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		return srv, func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-ch)
+		}
+	}
+	srv1, closeSrv1 := serve("server_1")
+	srv2, closeSrv2 := serve("server_2")
+
+	// Prepare and serve dmsg clients, which are both connected to both servers.
+	newClient := func(name string) *Client {
+		conf := DefaultConfig()
+		conf.MinSessions = 2
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		waitFor(t, time.Second*10, func() bool {
+			_, ok1 := srv1.serverSession(pk)
+			_, ok2 := srv2.serverSession(pk)
+			return ok1 && ok2
+		})
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// Spread streams across both server links: two via server 1 and one via server 2.
+	dial := func(srv *Server) (*Stream, *Stream) {
+		ses, ok := clientB.Session(srv.LocalPK())
+		require.True(t, ok)
+		connB, err := ses.DialStream(context.TODO(), Addr{PK: clientA.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		connA, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return connA, connB
+	}
+	a1, b1 := dial(srv1)
+	a2, b2 := dial(srv1)
+	a3, b3 := dial(srv2)
+
+	_, err = b1.Write([]byte("hello"))
+	require.NoError(t, err)
+	msg := make([]byte, 5)
+	_, err = io.ReadFull(a1, msg)
+	require.NoError(t, err)
+
+	infos1 := clientB.ServerStreams(srv1.LocalPK())
+	require.Len(t, infos1, 2)
+	require.Less(t, infos1[0].ID, infos1[1].ID)
+	for i, dStr := range []*Stream{b1, b2} {
+		require.Equal(t, dStr.StreamID(), infos1[i].ID)
+		require.Equal(t, srv1.LocalPK(), infos1[i].ServerPK)
+		require.Equal(t, clientB.LocalPK(), infos1[i].LocalAddr.PK)
+		require.Equal(t, clientA.LocalPK(), infos1[i].RemoteAddr.PK)
+	}
+	require.Equal(t, uint64(5), infos1[0].BytesWritten)
+	require.Equal(t, uint64(0), infos1[1].BytesWritten)
+
+	infos2 := clientB.ServerStreams(srv2.LocalPK())
+	require.Len(t, infos2, 1)
+	require.Equal(t, b3.StreamID(), infos2[0].ID)
+	require.Equal(t, srv2.LocalPK(), infos2[0].ServerPK)
+
+	// The accepting side reports the same split with the bytes read.
+	infosA := clientA.ServerStreams(srv1.LocalPK())
+	require.Len(t, infosA, 2)
+	var read uint64
+	for _, info := range infosA {
+		read += info.BytesRead
+	}
+	require.Equal(t, uint64(5), read)
+	require.Len(t, clientA.ServerStreams(srv2.LocalPK()), 1)
+
+	// Closed streams are no longer listed.
+	require.NoError(t, b2.Close())
+	require.Len(t, clientB.ServerStreams(srv1.LocalPK()), 1)
+
+	// Closing logic.
+	for _, dStr := range []*Stream{a1, a2, a3, b1, b3} {
+		require.NoError(t, dStr.Close())
+	}
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	closeSrv2()
+	closeSrv1()
+}
+
+func TestClient_AddressResolver(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// The server advertises an address which is not reachable by the client.
+	const advertisedAddr = "127.0.0.1:1"
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srvPK, srvSK := GenKeyPair(t, "server")
+	srv := NewServer(srvPK, srvSK, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	srvCh := make(chan error, 1)
+	go func() { srvCh <- srv.Serve(lis, advertisedAddr) }() //nolint:errcheck
+	<-srv.Ready()
+
+	// The resolver rewrites the advertised address into the listening address.
+	var resolvedMx sync.Mutex
+	var resolved []string
+	conf := DefaultConfig()
+	conf.AddressResolver = func(pk cipher.PubKey, addr string) string {
+		if pk != srvPK {
+			return addr
+		}
+		resolvedMx.Lock()
+		defer resolvedMx.Unlock()
+		resolved = append(resolved, addr)
+		return lis.Addr().String()
+	}
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	c.SetLogger(logging.MustGetLogger("client"))
+	go c.Serve(context.Background())
+
+	waitFor(t, time.Second*10, func() bool {
+		_, ok := srv.serverSession(pk)
+		return ok
+	})
+	resolvedMx.Lock()
+	require.NotEmpty(t, resolved)
+	require.Equal(t, advertisedAddr, resolved[0])
+	resolvedMx.Unlock()
+
+	// The session keeps the advertised address, so that it is not migrated by address checks.
+	dSes, ok := c.Session(srvPK)
+	require.True(t, ok)
+	require.Equal(t, advertisedAddr, dSes.dialAddr)
+
+	// Closing logic.
+	require.NoError(t, c.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-srvCh)
+}
+
+func TestClient_ConnectSessionContext(t *testing.T) {
+	// The listener accepts connections, but never completes the TLS handshake.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lis.Close()) }()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() //nolint:errcheck
+		}
+	}()
+
+	srvPK, _ := GenKeyPair(t, "server")
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, disc.NewMock(0), DefaultConfig())
+	c.SetLogger(logging.MustGetLogger("client"))
+	entry := &disc.Entry{Static: srvPK, Server: &disc.Server{Address: tlsScheme + lis.Addr().String()}}
+
+	// Dialing the server is bounded by the context.
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	_, err = c.connectSession(ctx, entry)
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second*2))
+
+	// The server is not put in failure cooldown, as the dial was abandoned by the caller.
+	require.NotContains(t, c.FailedServers(), srvPK)
+	require.NoError(t, c.Close())
+}
+
+func TestClient_ProbePeerServers(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	serve := func(name string) *Server {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		t.Cleanup(func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-ch)
+		})
+		return srv
+	}
+	srv1 := serve("server_1")
+	srv2 := serve("server_2")
+
+	// A server of which the advertised address is down, and a server without an entry.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	pkDown, skDown := GenKeyPair(t, "server_down")
+	downEntry := disc.NewServerEntry(pkDown, 0, addr, 10)
+	require.NoError(t, downEntry.Sign(skDown))
+	require.NoError(t, dc.PostEntry(context.TODO(), downEntry))
+	pkMissing, _ := GenKeyPair(t, "server_missing")
+
+	// The peer delegates to all four servers.
+	pkB, skB := GenKeyPair(t, "client_B")
+	entryB := disc.NewClientEntry(pkB, 0, []cipher.PubKey{srv1.LocalPK(), srv2.LocalPK(), pkDown, pkMissing})
+	require.NoError(t, entryB.Sign(skB))
+	require.NoError(t, dc.PostEntry(context.TODO(), entryB))
+
+	pkA, skA := GenKeyPair(t, "client_A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	defer func() { require.NoError(t, clientA.Close()) }()
+	<-clientA.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	res, err := clientA.ProbePeerServers(ctx, pkB)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	require.NoError(t, res[srv1.LocalPK()])
+	require.NoError(t, res[srv2.LocalPK()])
+	require.Error(t, res[pkDown])
+	require.Error(t, res[pkMissing])
+
+	// Links to the reachable servers are kept, and no streams are left behind.
+	_, ok1 := clientA.Session(srv1.LocalPK())
+	_, ok2 := clientA.Session(srv2.LocalPK())
+	require.True(t, ok1 && ok2)
+	require.Empty(t, clientA.AllStreams())
+
+	// Probing a peer without an entry fails.
+	pkC, _ := GenKeyPair(t, "client_C")
+	_, err = clientA.ProbePeerServers(ctx, pkC)
+	require.Error(t, err)
+}
+
+func TestClient_DialDuringClose(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	serve := func(name string) *Server {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		t.Cleanup(func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-ch)
+		})
+		return srv
+	}
+	srv1 := serve("server_1")
+	srv2 := serve("server_2")
+
+	// The responding client is connected to both servers, so that dials go through either.
+	confB := DefaultConfig()
+	confB.MinSessions = 2
+	pkB, skB := GenKeyPair(t, "client_B")
+	clientB := NewClient(pkB, skB, dc, confB)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	defer func() { require.NoError(t, clientB.Close()) }()
+	<-clientB.Ready()
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	go func() {
+		for {
+			dStr, err := lisB.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, dStr) //nolint:errcheck
+				_ = dStr.Close()                     //nolint:errcheck
+			}()
+		}
+	}()
+
+	// Interleave dials, listens and session establishment with Close.
+	for round := 0; round < 5; round++ {
+		pkA, skA := GenKeyPair(t, fmt.Sprintf("client_A_%d", round))
+		clientA := NewClient(pkA, skA, dc, DefaultConfig())
+		clientA.SetLogger(logging.MustGetLogger("client_A"))
+		go clientA.Serve(context.Background())
+		<-clientA.Ready()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 100)
+		for i := 0; i < 4; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				for {
+					dStr, err := clientA.DialStream(context.Background(), Addr{PK: pkB, Port: 80})
+					if err != nil {
+						errs <- err
+						return
+					}
+					_ = dStr.Close() //nolint:errcheck
+				}
+			}()
+			go func(port uint16) {
+				defer wg.Done()
+				for {
+					lis, err := clientA.Listen(port)
+					if err != nil {
+						errs <- err
+						return
+					}
+					_ = lis.Close() //nolint:errcheck
+				}
+			}(uint16(100 + i))
+			go func() {
+				defer wg.Done()
+				for {
+					if err := clientA.EnsureSessions(context.Background(), 2); err == ErrEntityClosed {
+						errs <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond * time.Duration(10*round))
+		require.NoError(t, clientA.Close())
+		wg.Wait()
+		close(errs)
+
+		// All calls stop with ErrEntityClosed, and nothing is left behind.
+		for err := range errs {
+			require.Equal(t, ErrEntityClosed, err)
+		}
+		_, err := clientA.DialStream(context.Background(), Addr{PK: pkB, Port: 80})
+		require.Equal(t, ErrEntityClosed, err)
+		_, err = clientA.Listen(80)
+		require.Equal(t, ErrEntityClosed, err)
+		require.Zero(t, clientA.SessionCount())
+		ports := 0
+		clientA.porter.RangePortValuesAndChildren(func(port uint16, _ netutil.PorterValue) bool {
+			if port != 0 { // port 0 is reserved by the porter itself
+				ports++
+			}
+			return true
+		})
+		require.Zero(t, ports)
+		waitFor(t, time.Second*10, func() bool {
+			_, ok1 := srv1.serverSession(pkA)
+			_, ok2 := srv2.serverSession(pkA)
+			return !ok1 && !ok2
+		})
+	}
+}
+
+func TestClient_DisableAutoReconnect(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve two dmsg servers, so that there is a server to reconnect to.
+	var srvs []*Server
+	for i := 0; i < 2; i++ {
+		pk, sk := GenKeyPair(t, fmt.Sprintf("server %d", i))
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(fmt.Sprintf("server_%d", i)))
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() { _ = srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		defer func() { require.NoError(t, srv.Close()) }()
+		srvs = append(srvs, srv)
+	}
+
+	var dials int32
+	conf := DefaultConfig()
+	conf.MinSessions = 1
+	conf.FailureCooldown = -1
+	conf.DisableAutoReconnect = true
+	conf.Callbacks = &ClientCallbacks{
+		OnSessionDial: func(string, string) error {
+			atomic.AddInt32(&dials, 1)
+			return nil
+		},
+	}
+	pk, sk := GenKeyPair(t, "client")
+	c := NewClient(pk, sk, dc, conf)
+	c.SetLogger(logging.MustGetLogger("client"))
+	go c.Serve(context.Background())
+	defer func() { require.NoError(t, c.Close()) }()
+	<-c.Ready()
+	require.Equal(t, 1, c.SessionCount())
+	require.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	// The server drops the session, which is removed but not re-established.
+	var srvSes ServerSession
+	waitFor(t, time.Second*5, func() bool {
+		for _, srv := range srvs {
+			if ses, ok := srv.serverSession(pk); ok {
+				srvSes = ses
+				return true
+			}
+		}
+		return false
+	})
+	require.NoError(t, srvSes.Close())
+	waitFor(t, time.Second*5, func() bool { return c.SessionCount() == 0 })
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pk)
+		return err == nil && len(entry.Client.DelegatedServers) == 0
+	})
+	time.Sleep(time.Millisecond * 500)
+	require.Equal(t, 0, c.SessionCount())
+	require.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	// Sessions are still established on demand.
+	require.NoError(t, c.EnsureSessions(context.TODO(), 1))
+	require.Equal(t, 1, c.SessionCount())
+}
+
+func TestClient_OnDialError(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	srvEntry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	// Client A records failed dials.
+	type dialErr struct {
+		remote cipher.PubKey
+		err    error
+	}
+	var mx sync.Mutex
+	var dialErrs []dialErr
+	confA := DefaultConfig()
+	confA.Callbacks = &ClientCallbacks{
+		OnDialError: func(remote cipher.PubKey, err error) {
+			mx.Lock()
+			dialErrs = append(dialErrs, dialErr{remote: remote, err: err})
+			mx.Unlock()
+		},
+	}
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, confA)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	require.NoError(t, clientA.ensureSession(context.TODO(), srvEntry))
+
+	// Client B has a session which is never served, so it never answers stream requests.
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	sesB, err := clientB.connectSession(context.TODO(), srvEntry)
+	require.NoError(t, err)
+	entryB := disc.NewClientEntry(pkB, 0, []cipher.PubKey{pkSrv})
+	require.NoError(t, entryB.Sign(skB))
+	require.NoError(t, dc.PostEntry(context.TODO(), entryB))
+
+	// Client C is served, but does not allow client A.
+	pkC, skC := GenKeyPair(t, "client C")
+	clientC := NewClient(pkC, skC, dc, DefaultConfig())
+	clientC.SetLogger(logging.MustGetLogger("client_C"))
+	clientC.SetAllowedPeers([]cipher.PubKey{})
+	require.NoError(t, clientC.ensureSession(context.TODO(), srvEntry))
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkC)
+		return err == nil && len(entry.Client.DelegatedServers) == 1
+	})
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 3 })
+
+	// Client D has no entry. Client E advertises a server which does not exist, and client F advertises the server
+	// without being connected to it.
+	pkD, _ := GenKeyPair(t, "client D")
+	advertise := func(name string, srvPK cipher.PubKey) cipher.PubKey {
+		pk, sk := GenKeyPair(t, name)
+		entry := disc.NewClientEntry(pk, 0, []cipher.PubKey{srvPK})
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, dc.PostEntry(context.TODO(), entry))
+		return pk
+	}
+	pkNoSrv, _ := GenKeyPair(t, "no server")
+	pkE := advertise("client E", pkNoSrv)
+	pkF := advertise("client F", pkSrv)
+
+	defer func(timeout time.Duration) { HandshakeTimeout = timeout }(HandshakeTimeout)
+
+	cases := []struct {
+		name   string
+		remote cipher.PubKey
+		p2p    bool
+		kind   DialErrorKind
+	}{
+		{name: "no servers", remote: pkD, kind: DialErrNoServers},
+		{name: "unreachable server", remote: pkE, kind: DialErrUnreachable},
+		{name: "unreachable server p2p", remote: pkE, p2p: true, kind: DialErrUnreachable},
+		{name: "unreachable remote", remote: pkF, kind: DialErrUnreachable},
+		{name: "unreachable remote p2p", remote: pkF, p2p: true, kind: DialErrUnreachable},
+		{name: "handshake timeout", remote: pkB, kind: DialErrTimeout},
+		{name: "rejected", remote: pkC, kind: DialErrRejected},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			HandshakeTimeout = time.Second * 5
+			if tc.kind == DialErrTimeout {
+				HandshakeTimeout = time.Millisecond * 300
+			}
+			dial := clientA.DialStream
+			if tc.p2p {
+				dial = clientA.DialP2P
+			}
+			_, err := dial(context.TODO(), Addr{PK: tc.remote, Port: 80}, WithoutEntryRefresh())
+			require.Error(t, err)
+			require.Equal(t, tc.kind, ClassifyDialError(err), err)
+
+			// The callback is triggered once, with the returned error.
+			mx.Lock()
+			defer mx.Unlock()
+			require.Len(t, dialErrs, i+1)
+			require.Equal(t, tc.remote, dialErrs[i].remote)
+			require.Equal(t, err, dialErrs[i].err)
+		})
+	}
+
+	// Successful dials do not trigger the callback.
+	clientC.AllowAllPeers()
+	lisC, err := clientC.Listen(80)
+	require.NoError(t, err)
+	str, err := clientA.DialStream(context.TODO(), Addr{PK: pkC, Port: 80})
+	require.NoError(t, err)
+	mx.Lock()
+	require.Len(t, dialErrs, len(cases))
+	mx.Unlock()
+
+	// Closing logic.
+	require.NoError(t, str.Close())
+	require.NoError(t, lisC.Close())
+	require.NoError(t, sesB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// gatherMetrics returns the values of the metrics of the registry by their names and label values. Histograms are
+// represented by their sample count.
+func gatherMetrics(t *testing.T, reg prometheus.Gatherer) map[string]float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range metric.GetLabel() {
+				name += "/" + l.GetValue()
+			}
+			values[name] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue() +
+				float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	return values
+}
+
+func TestClient_Metrics(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, DefaultServerConfig(), nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients, each with metrics registered to it's own registry.
+	newClient := func(name string) (*Client, prometheus.Gatherer) {
+		reg := prometheus.NewPedanticRegistry()
+		m := clientmetrics.New("dmsg")
+		require.NoError(t, clientmetrics.Register(reg, m))
+
+		pk, sk := GenKeyPair(t, name)
+		conf := DefaultConfig()
+		conf.Metrics = m
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c, reg
+	}
+	clientA, regA := newClient("client A")
+	clientB, regB := newClient("client B")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// Client A dials a stream to client B.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	_, err = strA.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strB, make([]byte, 5))
+	require.NoError(t, err)
+
+	// Client A dials a stream which client B rejects, and one which times out (client B does not listen on the port).
+	clientB.SetAllowedPeers(nil)
+	_, err = clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80}, WithoutEntryRefresh())
+	require.Error(t, err)
+	clientB.AllowAllPeers()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = clientA.DialStream(ctx, Addr{PK: clientB.LocalPK(), Port: 81}, WithoutEntryRefresh())
+	require.Error(t, err)
+
+	valuesA, valuesB := gatherMetrics(t, regA), gatherMetrics(t, regB)
+	for name, want := range map[string]float64{
+		"dmsg_client_connected_servers_count":            1,
+		"dmsg_client_active_streams_count":               1,
+		"dmsg_client_stream_total/dialed":                1,
+		"dmsg_client_stream_fail_total/dialed/rejected":  1,
+		"dmsg_client_stream_fail_total/dialed/timeout":   1,
+		"dmsg_client_dial_duration_seconds/session":      1,
+		"dmsg_client_dial_duration_seconds/stream":       1,
+		"dmsg_client_handshake_duration_seconds/session": 1,
+		"dmsg_client_handshake_duration_seconds/stream":  1,
+		"dmsg_client_reconnect_total":                    0,
+	} {
+		require.Equal(t, want, valuesA[name], name)
+	}
+	for name, want := range map[string]float64{
+		"dmsg_client_connected_servers_count":             1,
+		"dmsg_client_active_streams_count":                1,
+		"dmsg_client_stream_total/accepted":               1,
+		"dmsg_client_stream_fail_total/accepted/rejected": 2,
+		"dmsg_client_handshake_duration_seconds/stream":   1,
+	} {
+		require.Equal(t, want, valuesB[name], name)
+	}
+	for _, values := range []map[string]float64{valuesA, valuesB} {
+		for _, name := range []string{"bytes_total/in", "bytes_total/out", "frames_total/in", "frames_total/out"} {
+			require.Greater(t, values["dmsg_client_"+name], float64(0), name)
+		}
+	}
+
+	// Once the streams are closed, they are no longer active.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.Zero(t, gatherMetrics(t, regA)["dmsg_client_active_streams_count"])
+	require.Zero(t, gatherMetrics(t, regB)["dmsg_client_active_streams_count"])
+
+	// Client A reconnects once the server closes it's session.
+	srvSesA, ok := srv.serverSession(clientA.LocalPK())
+	require.True(t, ok)
+	require.NoError(t, srvSesA.Close())
+	waitFor(t, time.Second*5, func() bool { return gatherMetrics(t, regA)["dmsg_client_reconnect_total"] == 1 })
+	waitFor(t, time.Second*5, func() bool { return clientA.SessionCount() == 1 })
+	require.Equal(t, float64(1), gatherMetrics(t, regA)["dmsg_client_connected_servers_count"])
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// countingServersClient is a disc.APIClient which counts listings of servers, and fails them with 'err' while
+// 'failing' is set.
+type countingServersClient struct {
+	disc.APIClient
+	err      error
+	failing  int32
+	listings int64
+}
+
+func (c *countingServersClient) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	atomic.AddInt64(&c.listings, 1)
+	if atomic.LoadInt32(&c.failing) == 1 {
+		return nil, c.err
+	}
+	return c.APIClient.AvailableServers(ctx)
+}
+
+func TestClient_TryInitiateSessions(t *testing.T) {
+	errDown := errors.New("discovery is down")
+	dc := &countingServersClient{APIClient: disc.NewMock(0), err: errDown, failing: 1}
+
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		conf := DefaultConfig()
+		conf.DiscTries = 1
+		conf.Backoff = netutil.BackoffConfig{Initial: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2}
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		return c
+	}
+	clientA := newClient("client_A")
+
+	// A failed listing fails fast, with the cause.
+	err := clientA.TryInitiateSessions(context.TODO())
+	require.True(t, errors.Is(err, ErrNoServersAvailable), err)
+	require.True(t, errors.Is(err, errDown), err)
+	require.EqualValues(t, 1, atomic.LoadInt64(&dc.listings))
+
+	// So does an empty listing.
+	atomic.StoreInt32(&dc.failing, 0)
+	require.Equal(t, ErrNoServersAvailable, clientA.TryInitiateSessions(context.TODO()))
+	require.EqualValues(t, 2, atomic.LoadInt64(&dc.listings))
+
+	// Serve keeps listing until servers are available.
+	clientB := newClient("client_B")
+	go clientB.Serve(context.Background())
+	waitFor(t, time.Second*5, func() bool { return atomic.LoadInt64(&dc.listings) >= 5 })
+	select {
+	case <-clientB.Ready():
+		t.Fatal("Client is ready without servers.")
+	default:
+	}
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+	<-clientB.Ready()
+
+	// Once servers are available, sessions are established.
+	require.NoError(t, clientA.TryInitiateSessions(context.TODO()))
+	require.Equal(t, 1, clientA.SessionCount())
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// countingEntryClient is a disc.APIClient which counts lookups of the entry of 'pk'.
+type countingEntryClient struct {
+	disc.APIClient
+	pk      cipher.PubKey
+	lookups int64
+}
+
+func (c *countingEntryClient) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	if pk == c.pk {
+		atomic.AddInt64(&c.lookups, 1)
+	}
+	return c.APIClient.Entry(ctx, pk)
+}
+
+func TestClient_RedialPeer(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg servers.
+	newServer := func(name string) (*Server, *disc.Entry, chan error) {
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, nil, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		chSrv := make(chan error, 1)
+		go func() { chSrv <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		entry, err := dc.Entry(context.TODO(), pk)
+		require.NoError(t, err)
+		return srv, entry, chSrv
+	}
+	srv1, entry1, chSrv1 := newServer("server 1")
+	srv2, entry2, chSrv2 := newServer("server 2")
+
+	// Client A has sessions with both servers, and client B with server 1 only.
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+	dcA := &countingEntryClient{APIClient: dc, pk: pkB}
+	clientA := NewClient(pkA, skA, dcA, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	require.NoError(t, clientA.ensureSession(context.TODO(), entry1))
+	require.NoError(t, clientA.ensureSession(context.TODO(), entry2))
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry1))
+	waitFor(t, time.Second*5, func() bool { _, ok := srv1.serverSession(pkB); return ok })
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkB)
+		return err == nil && len(entry.Client.DelegatedServers) == 1
+	})
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	dial := func(dial func() (*Stream, error)) (*Stream, *Stream) {
+		strA, err := dial()
+		require.NoError(t, err)
+		strB, err := lisB.AcceptStream()
+		require.NoError(t, err)
+		_, err = strA.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(strB, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+		return strA, strB
+	}
+	strA, strB := dial(func() (*Stream, error) {
+		return clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	})
+	require.Equal(t, entry1.Static, strA.ServerPK())
+	require.EqualValues(t, 1, atomic.LoadInt64(&dcA.lookups))
+
+	// Only dialed streams can be redialed.
+	_, err = clientB.RedialPeer(context.TODO(), strB)
+	require.Error(t, err)
+
+	// Once client B closes the stream, it is redialed via the same server, without looking up client B.
+	require.NoError(t, strB.Close())
+	strA, strB = dial(func() (*Stream, error) { return clientA.RedialPeer(context.TODO(), strA) })
+	require.Equal(t, entry1.Static, strA.ServerPK())
+	require.EqualValues(t, 1, atomic.LoadInt64(&dcA.lookups))
+
+	// Once client B moves to server 2, the stream is redialed via discovery.
+	sesB, ok := clientB.Session(entry1.Static)
+	require.True(t, ok)
+	require.NoError(t, sesB.Close())
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry2))
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkB)
+		return err == nil && len(entry.Client.DelegatedServers) == 1 && entry.Client.DelegatedServers[0] == entry2.Static
+	})
+	waitFor(t, time.Second*5, func() bool { _, ok := srv1.serverSession(pkB); return !ok })
+	strA, strB = dial(func() (*Stream, error) { return clientA.RedialPeer(context.TODO(), strA) })
+	require.Equal(t, entry2.Static, strA.ServerPK())
+	require.EqualValues(t, 2, atomic.LoadInt64(&dcA.lookups))
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	for _, srv := range []*Server{srv1, srv2} {
+		require.NoError(t, srv.Close())
+	}
+	require.NoError(t, <-chSrv1)
+	require.NoError(t, <-chSrv2)
+}
+
+func TestClient_HandshakeInfo(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, DefaultServerConfig(), nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient("client A")
+	clientB := newClient("client B")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// Sessions are established by XK handshakes, which clients initiate.
+	dSes, ok := clientA.Session(pkSrv)
+	require.True(t, ok)
+	require.Equal(t, HandshakeInfo{Pattern: "XK", Initiator: true}, dSes.HandshakeInfo())
+	for _, info := range srv.Clients() {
+		require.Equal(t, HandshakeInfo{Pattern: "XK", Initiator: false}, info.Handshake)
+	}
+
+	// Streams are established by KK handshakes, which the dialing clients initiate.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	require.Equal(t, HandshakeInfo{Pattern: "KK", Initiator: true}, strA.Info().Handshake)
+	require.Equal(t, HandshakeInfo{Pattern: "KK", Initiator: false}, strB.Info().Handshake)
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
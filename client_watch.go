@@ -0,0 +1,92 @@
+package dmsg
+
+import (
+	"context"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+// EntryUpdate is emitted by Client.WatchEntry whenever the watched discovery entry changes.
+type EntryUpdate struct {
+	PK    cipher.PubKey
+	Entry *disc.Entry
+}
+
+// DelegatedServers returns the delegated servers of the updated entry (if it is a client entry).
+func (u EntryUpdate) DelegatedServers() []cipher.PubKey {
+	if u.Entry == nil || u.Entry.Client == nil {
+		return nil
+	}
+	return u.Entry.Client.DelegatedServers
+}
+
+// WatchEntry polls discovery for the entry of the given public key, and emits an update whenever the relevant fields
+// (delegated servers, or server address) change. The current entry is emitted as the first update.
+// Discovery is polled every Config.WatchInterval (with jitter), and failed polls are skipped.
+// The returned chan is closed when the context is done or the client is closed.
+func (ce *Client) WatchEntry(ctx context.Context, pk cipher.PubKey) (<-chan EntryUpdate, error) {
+	entry, err := ce.dc.Entry(ctx, pk)
+	if err != nil {
+		return nil, discEntryErr(err)
+	}
+
+	updates := make(chan EntryUpdate, 1)
+	updates <- EntryUpdate{PK: pk, Entry: entry}
+
+	go func() {
+		defer close(updates)
+
+		log := ce.log.WithField("func", "WatchEntry").WithField("remote_pk", pk)
+
+		t := time.NewTimer(netutil.Jitter(ce.conf.WatchInterval, watchJitter))
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ce.done:
+				return
+			case <-t.C:
+			}
+			t.Reset(netutil.Jitter(ce.conf.WatchInterval, watchJitter))
+
+			newEntry, err := ce.dc.Entry(ctx, pk)
+			if err != nil {
+				log.WithError(err).Debug("Failed to poll entry.")
+				continue
+			}
+			if !entryChanged(entry, newEntry) {
+				continue
+			}
+			entry = newEntry
+
+			select {
+			case updates <- EntryUpdate{PK: pk, Entry: entry}:
+			case <-ctx.Done():
+				return
+			case <-ce.done:
+				return
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// entryChanged returns true if fields of the entry which are relevant to dialing differ.
+func entryChanged(old, new *disc.Entry) bool {
+	if (old.Client == nil) != (new.Client == nil) || (old.Server == nil) != (new.Server == nil) {
+		return true
+	}
+	if old.Client != nil && !cipher.SamePubKeys(old.Client.DelegatedServers, new.Client.DelegatedServers) {
+		return true
+	}
+	if old.Server != nil && old.Server.Address != new.Server.Address {
+		return true
+	}
+	return false
+}
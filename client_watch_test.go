@@ -0,0 +1,60 @@
+package dmsg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestClient_WatchEntry(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+	srv1, _ := GenKeyPair(t, "server 1")
+	srv2, _ := GenKeyPair(t, "server 2")
+
+	// Advertise client B with a single delegated server.
+	entryB := disc.NewClientEntry(pkB, 0, []cipher.PubKey{srv1})
+	require.NoError(t, entryB.Sign(skB))
+	require.NoError(t, dc.PostEntry(context.TODO(), entryB))
+
+	conf := DefaultConfig()
+	conf.WatchInterval = time.Millisecond * 50
+	clientA := NewClient(pkA, skA, dc, conf)
+	defer func() { require.NoError(t, clientA.Close()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := clientA.WatchEntry(ctx, pkB)
+	require.NoError(t, err)
+
+	// The current entry is emitted first.
+	u := <-updates
+	require.Equal(t, pkB, u.PK)
+	require.Equal(t, []cipher.PubKey{srv1}, u.DelegatedServers())
+
+	// An update is emitted once delegated servers change.
+	entryB.Client.DelegatedServers = []cipher.PubKey{srv1, srv2}
+	require.NoError(t, dc.PutEntry(context.TODO(), skB, entryB))
+
+	select {
+	case u = <-updates:
+		require.Equal(t, []cipher.PubKey{srv1, srv2}, u.DelegatedServers())
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for entry update")
+	}
+
+	// The chan is closed once the context is cancelled.
+	cancel()
+	for range updates {
+	}
+
+	// Watching an entry which does not exist fails.
+	_, err = clientA.WatchEntry(context.TODO(), srv2)
+	require.Equal(t, ErrDiscEntryNotFound, err)
+}
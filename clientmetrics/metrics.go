@@ -0,0 +1,206 @@
+package clientmetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of dials and handshakes.
+const (
+	KindSession = "session" // session between the client and a server
+	KindStream  = "stream"  // stream between two clients (via a server)
+)
+
+// Kinds of streams.
+const (
+	StreamDialed   = "dialed"   // stream dialed by the client
+	StreamAccepted = "accepted" // stream dialed by a remote client, and accepted by the client
+)
+
+// Reasons of failed streams.
+const (
+	ReasonRejected = "rejected" // stream request rejected by the remote client or the server
+	ReasonTimeout  = "timeout"  // stream handshake timed out
+	ReasonCanceled = "canceled" // dial cancelled by the caller
+	ReasonError    = "error"    // stream failed otherwise (i.e. as it's session failed)
+)
+
+// Directions of the traffic of sessions.
+const (
+	DirectionIn  = "in"  // read from servers
+	DirectionOut = "out" // written to servers
+)
+
+// Metrics collects metrics of a dmsg client for prometheus.
+type Metrics interface {
+	Collectors() []prometheus.Collector
+	SetServers(n int)
+	RecordStreamOpened(kind string)
+	RecordStreamClosed()
+	RecordStreamFailed(kind, reason string)
+	RecordTraffic(direction string, bytes, frames int)
+	RecordDial(kind string, duration time.Duration)
+	RecordHandshake(kind string, duration time.Duration)
+	RecordReconnect()
+}
+
+// New returns the default implementation of Metrics.
+func New(namespace string) Metrics {
+	servers := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "connected_servers_count",
+		Help:      "Current number of servers which the client has sessions with.",
+	})
+	activeStreams := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "active_streams_count",
+		Help:      "Current number of open streams.",
+	})
+	streams := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "stream_total",
+		Help:      "Total number of established streams.",
+	}, []string{"kind"})
+	failedStreams := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "stream_fail_total",
+		Help:      "Total number of streams which failed to be established.",
+	}, []string{"kind", "reason"})
+	bytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "bytes_total",
+		Help:      "Total number of bytes read from and written to servers.",
+	}, []string{"direction"})
+	frames := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "frames_total",
+		Help:      "Total number of frames read from and written to servers.",
+	}, []string{"direction"})
+	dials := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "dial_duration_seconds",
+		Help:      "Duration of successful dials of sessions and streams.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+	handshakes := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "handshake_duration_seconds",
+		Help:      "Duration of successful handshakes of sessions and streams.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+	reconnects := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "reconnect_total",
+		Help:      "Total number of lost sessions which the client reconnects for.",
+	})
+
+	return &metrics{
+		servers:       servers,
+		activeStreams: activeStreams,
+		streams:       streams,
+		failedStreams: failedStreams,
+		bytes:         bytes,
+		bytesIn:       bytes.WithLabelValues(DirectionIn),
+		bytesOut:      bytes.WithLabelValues(DirectionOut),
+		frames:        frames,
+		framesIn:      frames.WithLabelValues(DirectionIn),
+		framesOut:     frames.WithLabelValues(DirectionOut),
+		dials:         dials,
+		handshakes:    handshakes,
+		reconnects:    reconnects,
+	}
+}
+
+// Register registers the collectors of the metrics to the registerer (such as the registry which backs the hosting
+// binary's '/metrics' endpoint).
+func Register(reg prometheus.Registerer, m Metrics) error {
+	for _, c := range m.Collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type metrics struct {
+	servers       prometheus.Gauge
+	activeStreams prometheus.Gauge
+	streams       *prometheus.CounterVec
+	failedStreams *prometheus.CounterVec
+
+	// Counters of the directions are resolved once, as traffic is recorded on every read and write.
+	bytes     *prometheus.CounterVec
+	bytesIn   prometheus.Counter
+	bytesOut  prometheus.Counter
+	frames    *prometheus.CounterVec
+	framesIn  prometheus.Counter
+	framesOut prometheus.Counter
+
+	dials      *prometheus.HistogramVec
+	handshakes *prometheus.HistogramVec
+	reconnects prometheus.Counter
+}
+
+func (m *metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.servers,
+		m.activeStreams,
+		m.streams,
+		m.failedStreams,
+		m.bytes,
+		m.frames,
+		m.dials,
+		m.handshakes,
+		m.reconnects,
+	}
+}
+
+func (m *metrics) SetServers(n int) {
+	m.servers.Set(float64(n))
+}
+
+func (m *metrics) RecordStreamOpened(kind string) {
+	m.streams.WithLabelValues(kind).Inc()
+	m.activeStreams.Inc()
+}
+
+func (m *metrics) RecordStreamClosed() {
+	m.activeStreams.Dec()
+}
+
+func (m *metrics) RecordStreamFailed(kind, reason string) {
+	m.failedStreams.WithLabelValues(kind, reason).Inc()
+}
+
+func (m *metrics) RecordTraffic(direction string, bytes, frames int) {
+	switch direction {
+	case DirectionIn:
+		m.bytesIn.Add(float64(bytes))
+		m.framesIn.Add(float64(frames))
+	default:
+		m.bytesOut.Add(float64(bytes))
+		m.framesOut.Add(float64(frames))
+	}
+}
+
+func (m *metrics) RecordDial(kind string, duration time.Duration) {
+	m.dials.WithLabelValues(kind).Observe(duration.Seconds())
+}
+
+func (m *metrics) RecordHandshake(kind string, duration time.Duration) {
+	m.handshakes.WithLabelValues(kind).Observe(duration.Seconds())
+}
+
+func (m *metrics) RecordReconnect() {
+	m.reconnects.Inc()
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -171,9 +174,23 @@ func (a *API) setEntry() func(w http.ResponseWriter, r *http.Request) {
 // getAvailableServers returns all available server entries as an array of json codified entry objects
 // URI: /dmsg-discovery/available_servers
 // Method: GET
+// Args:
+//	limit: optional maximum number of (randomly sampled) entries to return
 func (a *API) getAvailableServers() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		entries, err := a.db.AvailableServers(r.Context(), maxGetAvailableServersResult)
+		limit := maxGetAvailableServersResult
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				a.handleError(w, r, disc.ErrBadInput)
+				return
+			}
+			if n < limit {
+				limit = n
+			}
+		}
+
+		entries, err := a.db.AvailableServers(r.Context(), limit)
 		if err != nil {
 			a.handleError(w, r, err)
 			return
@@ -201,10 +218,20 @@ func (a *API) health() http.HandlerFunc {
 }
 
 // isLoopbackAddr checks if string is loopback interface
+// The address is either a TCP address, or a ws:// or wss:// URL (of servers which accept sessions over WebSocket).
 func isLoopbackAddr(addr string) (bool, error) {
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return false, err
+	var host string
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return false, err
+		}
+		host = u.Hostname()
+	} else {
+		var err error
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			return false, err
+		}
 	}
 
 	if host == "" {
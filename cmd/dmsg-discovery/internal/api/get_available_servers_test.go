@@ -103,6 +103,23 @@ func TestGetAvailableServers(t *testing.T) {
 				Code:    http.StatusNotFound,
 			},
 		},
+		{
+			name:            "invalid limit",
+			endpoint:        "/dmsg-discovery/available_servers?limit=abc",
+			method:          http.MethodGet,
+			status:          http.StatusBadRequest,
+			responseIsError: true,
+			databaseAndEntries: func(t *testing.T) (store2.Storer, []*disc.Entry) {
+				db, err := store2.NewStore("mock", nil)
+				require.NoError(t, err)
+
+				return db, []*disc.Entry{}
+			},
+			errorMessage: disc.HTTPMessage{
+				Message: disc.ErrBadInput.Error(),
+				Code:    http.StatusBadRequest,
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -139,3 +156,30 @@ func TestGetAvailableServers(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAvailableServersLimit(t *testing.T) {
+	const nServers = 5
+	const limit = 2
+
+	db, err := store2.NewStore("mock", nil)
+	require.NoError(t, err)
+
+	for i := 0; i < nServers; i++ {
+		pk, sk := cipher.GenerateKeyPair()
+		entry := disc.NewServerEntry(pk, 0, "localhost:8080", 3)
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, db.SetEntry(context.Background(), entry, time.Duration(0)))
+	}
+
+	api := New(nil, db, true)
+	req, err := http.NewRequest(http.MethodGet, "/dmsg-discovery/available_servers?limit=2", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	api.Handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resEntries []*disc.Entry
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resEntries))
+	require.Len(t, resEntries, limit)
+}
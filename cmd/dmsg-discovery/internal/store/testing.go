@@ -103,6 +103,10 @@ func (ms *MockStore) AvailableServers(ctx context.Context, maxCount int) ([]*dis
 
 	servers := arrayFromMap(ms.servers)
 	for _, entryString := range servers {
+		if len(entries) >= maxCount {
+			break
+		}
+
 		var e disc.Entry
 
 		err := json.Unmarshal(entryString, &e)
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -19,6 +20,7 @@ import (
 	"github.com/skycoin/dmsg/cmdutil"
 	"github.com/skycoin/dmsg/disc"
 	"github.com/skycoin/dmsg/discord"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/promutil"
 	"github.com/skycoin/dmsg/servermetrics"
 )
@@ -54,27 +56,73 @@ var rootCmd = &cobra.Command{
 			log.WithError(err).Fatal()
 		}
 
-		m := prepareMetrics(log, sf.Tag, sf.MetricsAddr)
+		m, hsM := prepareMetrics(log, sf.Tag, sf.MetricsAddr)
 
-		lis, err := net.Listen("tcp", conf.LocalAddress)
-		if err != nil {
-			log.Fatalf("Error listening on %s: %v", conf.LocalAddress, err)
+		liss := make([]net.Listener, 0, 1+len(conf.ExtraLocalAddresses))
+		for _, addr := range append([]string{conf.LocalAddress}, conf.ExtraLocalAddresses...) {
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatalf("Error listening on %s: %v", addr, err)
+			}
+			liss = append(liss, lis)
 		}
 
 		srvConf := dmsg.ServerConfig{
 			MaxSessions:    conf.MaxSessions,
+			MaxClients:     conf.MaxClients,
 			UpdateInterval: conf.UpdateInterval,
+			Metadata:       conf.Metadata,
+			IdleTimeout:    conf.IdleTimeout,
+			ProbeTimeout:   conf.ProbeTimeout,
+
+			PublicAddress:           conf.PublicAddress,
+			AutoDetectPublicAddress: conf.AutoDetectPublicAddress,
+			SelfCheck:               conf.SelfCheck,
+
+			SlowClientTimeout: conf.SlowClientTimeout,
+			MaxFrameSize:      conf.MaxFrameSize,
+
+			MaxStreamsPerClient: conf.MaxStreamsPerClient,
+			Bandwidth:           conf.Bandwidth,
+			BandwidthOverrides:  conf.BandwidthOverrides,
+
+			MaxTrafficPairs:    conf.MaxTrafficPairs,
+			TrafficLogInterval: conf.TrafficLogInterval,
+			TrafficLogTopN:     conf.TrafficLogTopN,
+
+			ClientMemoryBudget: conf.ClientMemoryBudget,
+			TotalMemoryBudget:  conf.TotalMemoryBudget,
+
+			StreamLogSampling: conf.StreamLogSampling,
+
+			HandshakeMetrics: hsM,
+			SlowHandshake:    conf.SlowHandshake,
+		}
+		if conf.DisconnectOverBudget {
+			srvConf.MemoryPolicy = dmsg.MemoryDisconnect
+		}
+		dc, err := disc.NewHTTPFailover(strings.Split(conf.Discovery, ",")...)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid discovery addresses.")
 		}
-		srv := dmsg.NewServer(conf.PubKey, conf.SecKey, disc.NewHTTP(conf.Discovery), &srvConf, m)
+		srv := dmsg.NewServer(conf.PubKey, conf.SecKey, dc, &srvConf, m)
 		srv.SetLogger(log)
+		for _, pk := range conf.DebugLogClients {
+			srv.SetClientDebugLogging(pk, true)
+		}
 
-		defer func() { log.WithError(srv.Close()).Info("Closed server.") }()
+		// Shut down gracefully, so that clients move to other servers before the sessions are closed.
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			log.WithError(srv.Shutdown(ctx)).Info("Closed server.")
+		}()
 
 		ctx, cancel := cmdutil.SignalContext(context.Background(), log)
 		defer cancel()
 
 		go func() {
-			if err := srv.Serve(lis, conf.PublicAddress); err != nil {
+			if err := srv.ServeListeners(liss, ""); err != nil {
 				log.Errorf("Serve: %v", err)
 				cancel()
 			}
@@ -84,24 +132,63 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// shutdownTimeout bounds waiting for clients to move away from the server on shutdown.
+const shutdownTimeout = time.Second * 30
+
 // Config is a dmsg-server config
 type Config struct {
-	PubKey         cipher.PubKey `json:"public_key"`
-	SecKey         cipher.SecKey `json:"secret_key"`
-	Discovery      string        `json:"discovery"`
-	LocalAddress   string        `json:"local_address"`
-	PublicAddress  string        `json:"public_address"`
-	MaxSessions    int           `json:"max_sessions"`
-	UpdateInterval time.Duration `json:"update_interval"`
-	LogLevel       string        `json:"log_level"`
+	PubKey         cipher.PubKey     `json:"public_key"`
+	SecKey         cipher.SecKey     `json:"secret_key"`
+	Discovery      string            `json:"discovery"`
+	LocalAddress   string            `json:"local_address"`
+	PublicAddress  string            `json:"public_address"`
+	MaxSessions    int               `json:"max_sessions"`
+	MaxClients     int               `json:"max_clients,omitempty"`
+	UpdateInterval time.Duration     `json:"update_interval"`
+	LogLevel       string            `json:"log_level"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	SlowHandshake  time.Duration     `json:"slow_handshake,omitempty"`
+	IdleTimeout    time.Duration     `json:"idle_timeout,omitempty"`
+	ProbeTimeout   time.Duration     `json:"probe_timeout,omitempty"`
+
+	SlowClientTimeout time.Duration `json:"slow_client_timeout,omitempty"`
+	MaxFrameSize      int           `json:"max_frame_size,omitempty"`
+
+	// AutoDetectPublicAddress advertises a global unicast IP of the host's interfaces if PublicAddress is empty.
+	AutoDetectPublicAddress bool `json:"auto_detect_public_address,omitempty"`
+	// SelfCheck checks that the advertised address reaches the server on startup (disabled by default).
+	SelfCheck bool `json:"self_check,omitempty"`
+
+	// ExtraLocalAddresses are listened on in addition to LocalAddress (i.e. for dual-stack, or internal interfaces).
+	ExtraLocalAddresses []string `json:"extra_local_addresses,omitempty"`
+
+	MaxStreamsPerClient int                                   `json:"max_streams_per_client,omitempty"`
+	Bandwidth           dmsg.BandwidthLimit                   `json:"bandwidth,omitempty"`
+	BandwidthOverrides  map[cipher.PubKey]dmsg.BandwidthLimit `json:"bandwidth_overrides,omitempty"`
+
+	MaxTrafficPairs    int           `json:"max_traffic_pairs,omitempty"`
+	TrafficLogInterval time.Duration `json:"traffic_log_interval,omitempty"`
+	TrafficLogTopN     int           `json:"traffic_log_top_n,omitempty"`
+
+	// Memory budgets in bytes (zero for unlimited). Clients exceeding their budget are slowed down, or disconnected if
+	// DisconnectOverBudget is set.
+	ClientMemoryBudget   int64 `json:"client_memory_budget,omitempty"`
+	TotalMemoryBudget    int64 `json:"total_memory_budget,omitempty"`
+	DisconnectOverBudget bool  `json:"disconnect_over_budget,omitempty"`
+
+	// StreamLogSampling keeps debug logs of 1 in every StreamLogSampling relayed streams (negative to keep all).
+	StreamLogSampling int `json:"stream_log_sampling,omitempty"`
+	// DebugLogClients are clients of which sessions and streams are logged in full, regardless of the log level.
+	DebugLogClients []cipher.PubKey `json:"debug_log_clients,omitempty"`
 }
 
-func prepareMetrics(log logrus.FieldLogger, tag, addr string) servermetrics.Metrics {
+func prepareMetrics(log logrus.FieldLogger, tag, addr string) (servermetrics.Metrics, handshakemetrics.Metrics) {
 	if addr == "" {
-		return servermetrics.NewEmpty()
+		return servermetrics.NewEmpty(), handshakemetrics.NewEmpty()
 	}
 
 	m := servermetrics.New(tag)
+	hsM := handshakemetrics.New(tag)
 
 	r := chi.NewRouter()
 
@@ -110,12 +197,12 @@ func prepareMetrics(log logrus.FieldLogger, tag, addr string) servermetrics.Metr
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	promutil.AddMetricsHandle(r, m.Collectors()...)
+	promutil.AddMetricsHandle(r, append(m.Collectors(), hsM.Collectors()...)...)
 
 	log.WithField("addr", addr).Info("Serving metrics...")
 	go func() { log.Fatalln(http.ListenAndServe(addr, r)) }()
 
-	return m
+	return m, hsM
 }
 
 // Execute executes root CLI command.
@@ -8,6 +8,7 @@ import (
 	stdlog "log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -63,7 +64,7 @@ func init() {
 		"path of json whitelist file (if unspecified, a memory whitelist will be used)")
 
 	rootCmd.PersistentFlags().StringVar(&dmsgDisc, "dmsgdisc", dmsgDisc,
-		"dmsg discovery address")
+		"dmsg discovery address (comma-separated for failover)")
 
 	rootCmd.PersistentFlags().IntVar(&dmsgSessions, "dmsgsessions", dmsgSessions,
 		"minimum number of dmsg sessions to ensure")
@@ -192,8 +193,11 @@ var rootCmd = &cobra.Command{
 		pk, err := sk.PubKey()
 		cmdutil.CatchWithLog(log, "failed to derive public key from secret key", err)
 
+		dc, err := disc.NewHTTPFailover(strings.Split(dmsgDisc, ",")...)
+		cmdutil.CatchWithLog(log, "failed to prepare discovery client", err)
+
 		// Prepare and serve dmsg client and wait until ready.
-		dmsgC := dmsg.NewClient(pk, sk, disc.NewHTTP(dmsgDisc), &dmsg.Config{
+		dmsgC := dmsg.NewClient(pk, sk, dc, &dmsg.Config{
 			MinSessions: dmsgSessions,
 		})
 		go dmsgC.Serve(context.Background())
@@ -0,0 +1,48 @@
+package dmsg
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// connLimiter limits the total number of connections (sessions and streams) held open by an entity.
+// A nil connLimiter imposes no limit.
+type connLimiter struct {
+	n   int64 // atomic
+	max int64
+}
+
+// newConnLimiter returns a limiter of the given maximum, or nil if 'max' is not positive.
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: int64(max)}
+}
+
+// acquire acquires a slot, returning false if the limit is reached.
+// The returned function releases the slot, and is safe to call multiple times.
+func (l *connLimiter) acquire() (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	for {
+		n := atomic.LoadInt64(&l.n)
+		if n >= l.max {
+			return nil, false
+		}
+		if atomic.CompareAndSwapInt64(&l.n, n, n+1) {
+			break
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { atomic.AddInt64(&l.n, -1) }) }, true
+}
+
+// count returns the number of acquired slots.
+func (l *connLimiter) count() int {
+	if l == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.n))
+}
@@ -12,4 +12,112 @@ const (
 	DefaultUpdateInterval = time.Second * 15
 
 	DefaultMaxSessions = 100
+
+	DefaultDiscTimeout = time.Second * 5
+
+	DefaultDiscTries = 3
+
+	DefaultDiscOpTimeout = time.Second * 10
+
+	DefaultWatchInterval = time.Second * 30
+
+	DefaultEntryCacheTTL = time.Minute
+
+	// DefaultEntryCacheMaxAge bounds how long cached entries are used as a fallback while discovery is unavailable.
+	DefaultEntryCacheMaxAge = time.Hour
+	DefaultEntryCacheSize   = 1024
+
+	// DefaultEntryTTL matches the default lifetime of entries in dmsg-discovery.
+	DefaultEntryTTL = time.Minute
+
+	// DefaultEntryDebounce is short enough to not noticeably delay the first publication of a client entry.
+	DefaultEntryDebounce = time.Millisecond * 100
+
+	DefaultIdleTimeout  = time.Minute
+	DefaultProbeTimeout = time.Second * 10
+
+	DefaultFailureCooldown  = time.Second * 10
+	DefaultFailureThreshold = 3
+
+	DefaultAddrCheckInterval      = time.Minute
+	DefaultMinAddrMigrateInterval = time.Minute * 5
+
+	DefaultSlowHandshake = time.Second * 2
+
+	DefaultMaxStreamsPerClient = 2048
+	DefaultSlowClientTimeout   = time.Minute
+	DefaultCloseTimeout        = time.Second * 30
+
+	DefaultMaxPendingHandshakes    = 1024
+	DefaultSessionHandshakeTimeout = time.Second * 10
+
+	DefaultDialP2PWidth = 3
+
+	DefaultMaxTrafficPairs = 10000
+	DefaultTrafficLogTopN  = 10
+
+	DefaultStreamLogSampling = 100
+
+	// DefaultMaxFrameSize is the largest frame which can be encoded (the length prefix of frames is 2 bytes).
+	DefaultMaxFrameSize = 1<<16 - 1
+
+	DefaultMaxProtocolViolations = 10
+
+	// DefaultStreamBufferSize and MinStreamBufferSize are the receive window of yamux streams as they are opened.
+	DefaultStreamBufferSize = yamuxInitialWindow
+	MinStreamBufferSize     = yamuxInitialWindow
+
+	DefaultBackoffInitial = time.Second
+	DefaultBackoffMax     = time.Second * 10
+
+	// closeEntryTimeout bounds publishing the final client entry on close.
+	closeEntryTimeout = time.Second * 2
+
+	// entryUpdatesBuffer is the number of entry updates which are queued for OnEntryUpdated, before publishing the
+	// client entry waits for the callback.
+	entryUpdatesBuffer = 8
+
+	// drainPollInterval is the interval in which streams of a draining server are checked.
+	drainPollInterval = time.Millisecond * 100
+
+	// migrateTimeout bounds waiting for streams of a session to close, after the session is migrated to a new
+	// server address.
+	migrateTimeout = time.Second * 30
+
+	// replacedSessionTimeout bounds waiting for streams of a session which is replaced by a newer session of the same
+	// client to close, before the server closes it (it matches migrateTimeout of clients).
+	replacedSessionTimeout = migrateTimeout
+
+	// rejectTimeout bounds waiting for a client to close a session which is rejected as the server is full.
+	rejectTimeout = time.Second * 5
+
+	// sessionDialTimeout bounds dialing a single address of a server (excluding the session handshake).
+	sessionDialTimeout = time.Second * 10
+
+	// selfCheckTimeout bounds checking that the advertised address of a server reaches the server.
+	selfCheckTimeout = time.Second * 10
+
+	// slowClientGoAwayTimeout bounds waiting for a slow client to close it's session after being sent a GOAWAY notice.
+	slowClientGoAwayTimeout = time.Second
+
+	// slowClientPollInterval is the interval in which sessions check whether disconnecting slow clients is enabled,
+	// while it is disabled.
+	slowClientPollInterval = time.Second * 5
+
+	// egressMaxTurn bounds the duration in which a single write to a client (or of a client's stream to it's session)
+	// holds up the writes of other streams.
+	egressMaxTurn = time.Millisecond * 100
+
+	// watchJitter is the fraction of the watch interval which is randomized.
+	watchJitter = 0.2
+
+	// minRequestBucketSweep is the minimum number of request rate buckets at which refilled buckets are evicted.
+	minRequestBucketSweep = 64
+
+	// maxEntryFetches is the maximum number of concurrent discovery entry lookups of a single dial.
+	maxEntryFetches = 4
+
+	// maxViolationNotices is the maximum number of pending notices of dropped stream frames of a single session (further
+	// notices are skipped until these are sent).
+	maxViolationNotices = 16
 )
@@ -9,7 +9,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sync"
-	"time"
 
 	"github.com/skycoin/skycoin/src/util/logging"
 
@@ -151,38 +150,35 @@ func (c *httpClient) PutEntry(ctx context.Context, sk cipher.SecKey, entry *Entr
 	c.updateMux.Lock()
 	defer c.updateMux.Unlock()
 
-	entry.Sequence++
-	entry.Timestamp = time.Now().UnixNano()
+	return putEntry(ctx, c, entry, func(e *Entry) error { return e.Sign(sk) })
+}
 
-	for {
-		err := entry.Sign(sk)
-		if err != nil {
-			return err
-		}
-		err = c.PostEntry(ctx, entry)
-		if err == nil {
-			return nil
-		}
-		if err != ErrValidationWrongSequence {
-			entry.Sequence--
-			return err
-		}
-		rE, entryErr := c.Entry(ctx, entry.Static)
-		if entryErr != nil {
-			return err
-		}
-		if rE.Timestamp > entry.Timestamp { // If there is a more up to date entry drop update
-			entry.Sequence = rE.Sequence
-			return nil
-		}
-		entry.Sequence = rE.Sequence + 1
-	}
+// PutEntryWith implements SignerPutter.
+func (c *httpClient) PutEntryWith(ctx context.Context, s Signer, entry *Entry) error {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+
+	return putEntry(ctx, c, entry, func(e *Entry) error { return e.SignWith(s) })
 }
 
 // AvailableServers returns list of available servers.
 func (c *httpClient) AvailableServers(ctx context.Context) ([]*Entry, error) {
+	return c.availableServers(ctx, c.address+"/dmsg-discovery/available_servers")
+}
+
+// SampleServers returns up to 'n' randomly selected available servers.
+func (c *httpClient) SampleServers(ctx context.Context, n int) ([]*Entry, error) {
+	endpoint := fmt.Sprintf("%s/dmsg-discovery/available_servers?limit=%d", c.address, n)
+	entries, err := c.availableServers(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// Discovery services which do not support 'limit' return the full list.
+	return sampleEntries(entries, n), nil
+}
+
+func (c *httpClient) availableServers(ctx context.Context, endpoint string) ([]*Entry, error) {
 	var entries []*Entry
-	endpoint := c.address + "/dmsg-discovery/available_servers"
 
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
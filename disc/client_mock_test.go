@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -112,7 +113,7 @@ func TestNewMockEntriesEndpoint(t *testing.T) {
 
 	cases := []struct {
 		name            string
-		httpResponse    disc.HTTPMessage
+		err             error
 		publicKey       cipher.PubKey
 		responseIsEntry bool
 		entry           disc.Entry
@@ -137,7 +138,7 @@ func TestNewMockEntriesEndpoint(t *testing.T) {
 			name:            "get not valid entry",
 			publicKey:       pk,
 			responseIsEntry: false,
-			httpResponse:    disc.HTTPMessage{Code: http.StatusNotFound, Message: disc.ErrKeyNotFound.Error()},
+			err:             disc.ErrKeyNotFound,
 			entry:           baseEntry,
 		},
 	}
@@ -160,8 +161,7 @@ func TestNewMockEntriesEndpoint(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, &tc.entry, entry)
 			} else {
-				require.Error(t, err)
-				assert.Equal(t, tc.httpResponse.String(), err.Error())
+				assert.Equal(t, tc.err, err)
 			}
 
 		})
@@ -365,6 +365,97 @@ func TestNewMockUpdateEntrySequence(t *testing.T) {
 	assert.NotEqual(t, v1Entry.Sequence, v2Entry.Sequence)
 }
 
+func TestNewMockVerification(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	entry := newTestEntry(pk) // unsigned
+
+	// By default, only updates are verified.
+	mock := disc.NewMockClient(0)
+	require.NoError(t, mock.PostEntry(context.TODO(), &entry))
+
+	mock = disc.NewMockClient(0)
+	mock.SetVerification(disc.MockVerifyAll)
+	require.Error(t, mock.PostEntry(context.TODO(), &entry))
+
+	mock.SetVerification(disc.MockVerifyNone)
+	require.NoError(t, mock.PostEntry(context.TODO(), &entry))
+	entry.Sequence++
+	require.NoError(t, mock.PostEntry(context.TODO(), &entry))
+
+	// Sequences are validated regardless of the verification mode.
+	require.Equal(t, disc.ErrValidationWrongSequence, mock.PostEntry(context.TODO(), &entry))
+}
+
+func TestNewMockFaults(t *testing.T) {
+	const latency = time.Millisecond * 100
+
+	pk, sk := cipher.GenerateKeyPair()
+	entry := newTestEntry(pk)
+	require.NoError(t, entry.Sign(sk))
+
+	mock := disc.NewMockClient(0)
+	require.NoError(t, mock.PostEntry(context.TODO(), &entry))
+
+	// Injected errors fail all calls until cleared.
+	mock.SetError(disc.ErrUnexpected)
+	_, err := mock.Entry(context.TODO(), pk)
+	require.Equal(t, disc.ErrUnexpected, err)
+	_, err = mock.AvailableServers(context.TODO())
+	require.Equal(t, disc.ErrUnexpected, err)
+	require.Equal(t, disc.ErrUnexpected, mock.PutEntry(context.TODO(), sk, &entry))
+	mock.SetError(nil)
+	_, err = mock.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+
+	// Calls are delayed, but respect the context.
+	mock.SetLatency(latency)
+	start := time.Now()
+	_, err = mock.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= latency)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), latency/10)
+	defer cancel()
+	_, err = mock.Entry(ctx, pk)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNewMockConcurrentUpdates(t *testing.T) {
+	const rounds = 20
+
+	pk, sk := cipher.GenerateKeyPair()
+	mock := disc.NewMock(0)
+	entry := newTestEntry(pk)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, mock.PostEntry(context.TODO(), &entry))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, rounds)
+	for i := 0; i < rounds; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := mock.Entry(context.TODO(), pk)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- mock.PutEntry(context.TODO(), sk, e)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Every update either succeeded or was superseded, and the stored entry stays valid.
+	got, err := mock.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+	require.NoError(t, got.VerifySignature())
+	require.True(t, got.Sequence > entry.Sequence)
+}
+
 func newTestEntry(pk cipher.PubKey) disc.Entry {
 	baseEntry := disc.Entry{
 		Static:    pk,
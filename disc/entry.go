@@ -27,6 +27,8 @@ var (
 	ErrUnauthorized = errors.New("invalid signature")
 	// ErrBadInput occurs in case of bad input
 	ErrBadInput = errors.New("error bad input")
+	// ErrSignerMismatch occurs when an entry is to be signed by a Signer of another public key
+	ErrSignerMismatch = errors.New("signer public key does not match entry static public key")
 	// ErrValidationNonZeroSequence occurs in case when new entry has non-zero sequence
 	ErrValidationNonZeroSequence = NewEntryValidationError("new entry has non-zero sequence")
 	// ErrValidationNilEphemerals occurs in case when entry of client instance has nil ephemeral keys
@@ -145,6 +147,49 @@ func (e *Entry) String() string {
 type Client struct {
 	// DelegatedServers contains a list of delegated servers represented by their public keys.
 	DelegatedServers []cipher.PubKey `json:"delegated_servers"`
+
+	// Metadata contains optional application-defined key/value pairs.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Capabilities advertises the protocol version and features of the client.
+	// Entries without capabilities are of baseline-capability clients.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Capabilities contains the protocol version and feature flags supported by a client.
+type Capabilities struct {
+	ProtocolVersion string   `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// HasFeature returns true if the given feature is supported.
+// A nil Capabilities supports no features.
+func (c *Capabilities) HasFeature(feature string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if both capabilities are the same.
+func (c *Capabilities) Equal(c2 *Capabilities) bool {
+	if c == nil || c2 == nil {
+		return c == c2
+	}
+	if c.ProtocolVersion != c2.ProtocolVersion || len(c.Features) != len(c2.Features) {
+		return false
+	}
+	for i := range c.Features {
+		if c.Features[i] != c2.Features[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // String implements stringer
@@ -160,16 +205,27 @@ func (c *Client) String() string {
 
 // Server contains parameters for Server instances.
 type Server struct {
-	// IPv4 or IPv6 public address of the DMSG Server.
+	// IPv4 or IPv6 public address of the DMSG Server, or the ws:// or wss:// URL of it's WebSocket listener.
 	Address string `json:"address"`
 
+	// AltAddresses are alternative addresses of the server (of other listeners), which clients fall back to in order if
+	// Address is unreachable. The scheme of an address selects the transport: tls:// for TLS, ws:// or wss:// for
+	// WebSocket, and none for TCP.
+	AltAddresses []string `json:"alt_addresses,omitempty"`
+
 	// AvailableSessions is the number of available sessions that the server can currently accept.
 	AvailableSessions int `json:"availableSessions"`
+
+	// Metadata contains optional operator-defined labels (such as region).
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // String implements stringer
 func (s *Server) String() string {
 	res := fmt.Sprintf("\taddress: %s\n", s.Address)
+	if len(s.AltAddresses) > 0 {
+		res += fmt.Sprintf("\talternative addresses: %s\n", strings.Join(s.AltAddresses, ", "))
+	}
 	res += fmt.Sprintf("\tavailable sessions: %d\n", s.AvailableSessions)
 
 	return res
@@ -181,7 +237,7 @@ func NewClientEntry(pubkey cipher.PubKey, sequence uint64, delegatedServers []ci
 	return &Entry{
 		Version:   currentVersion,
 		Sequence:  sequence,
-		Client:    &Client{delegatedServers},
+		Client:    &Client{DelegatedServers: delegatedServers},
 		Static:    pubkey,
 		Timestamp: time.Now().UnixNano(),
 	}
@@ -223,6 +279,11 @@ func (e *Entry) VerifySignature() error {
 
 // Sign signs Entry with provided SecKey.
 func (e *Entry) Sign(sk cipher.SecKey) error {
+	return e.SignWith(&secKeySigner{sk: sk})
+}
+
+// SignWith signs the Entry with the given Signer.
+func (e *Entry) SignWith(s Signer) error {
 	// Clear previous signature, in case there was any
 	e.Signature = ""
 
@@ -231,7 +292,7 @@ func (e *Entry) Sign(sk cipher.SecKey) error {
 		return err
 	}
 
-	sig, err := cipher.SignPayload(entryJSON, sk)
+	sig, err := s.Sign(entryJSON)
 	if err != nil {
 		return err
 	}
@@ -313,11 +374,25 @@ func Copy(dst, src *Entry) {
 		dst.Server = nil
 	} else {
 		*dst.Server = *src.Server
+		if src.Server.AltAddresses != nil {
+			dst.Server.AltAddresses = append([]string{}, src.Server.AltAddresses...)
+		}
+		dst.Server.Metadata = copyMetadata(src.Server.Metadata)
 	}
 	if src.Client == nil {
 		dst.Client = nil
 	} else {
 		*dst.Client = *src.Client
+		if src.Client.DelegatedServers != nil {
+			dst.Client.DelegatedServers = append([]cipher.PubKey{}, src.Client.DelegatedServers...)
+		}
+		dst.Client.Metadata = copyMetadata(src.Client.Metadata)
+		if caps := src.Client.Capabilities; caps != nil {
+			dst.Client.Capabilities = &Capabilities{ProtocolVersion: caps.ProtocolVersion}
+			if caps.Features != nil {
+				dst.Client.Capabilities.Features = append([]string{}, caps.Features...)
+			}
+		}
 	}
 
 	dst.Static = src.Static
@@ -326,3 +401,14 @@ func Copy(dst, src *Entry) {
 	dst.Sequence = src.Sequence
 	dst.Timestamp = src.Timestamp
 }
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
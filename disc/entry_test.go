@@ -65,6 +65,28 @@ func TestNewClientEntryIsValid(t *testing.T) {
 	}
 }
 
+func TestCopyIsDeep(t *testing.T) {
+	pk, sk := cipher.GenerateKeyPair()
+	srvPK, _ := cipher.GenerateKeyPair()
+
+	entry := disc.NewClientEntry(pk, 1, []cipher.PubKey{srvPK})
+	entry.Client.Metadata = map[string]string{"region": "eu"}
+	entry.Client.Capabilities = &disc.Capabilities{ProtocolVersion: "1", Features: []string{"a"}}
+	require.NoError(t, entry.Sign(sk))
+
+	var cp disc.Entry
+	disc.Copy(&cp, entry)
+	require.Equal(t, *entry, cp)
+
+	// The copy does not share state with the entry.
+	cp.Client.DelegatedServers[0] = pk
+	cp.Client.Metadata["region"] = "us"
+	cp.Client.Capabilities.Features[0] = "b"
+	require.Equal(t, srvPK, entry.Client.DelegatedServers[0])
+	require.Equal(t, "eu", entry.Client.Metadata["region"])
+	require.Equal(t, "a", entry.Client.Capabilities.Features[0])
+}
+
 func TestVerifySignature(t *testing.T) {
 	// Arrange
 	// Create keys and signed entry
@@ -0,0 +1,258 @@
+package disc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// Default values for the failover circuit breaker.
+const (
+	DefaultFailoverThreshold = 3
+	DefaultFailoverCooldown  = time.Second * 30
+)
+
+// ErrNoEndpoints occurs when a failover client is constructed without any endpoints.
+var ErrNoEndpoints = errors.New("no discovery endpoints provided")
+
+// EndpointStats represents the health of a single discovery endpoint of a failover client.
+type EndpointStats struct {
+	Index     int       `json:"index"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`   // Consecutive failures.
+	OpenUntil time.Time `json:"open_until"` // The endpoint is skipped for reads until this time.
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// endpoint wraps an APIClient with a small circuit breaker.
+type endpoint struct {
+	APIClient
+
+	failures  int
+	openUntil time.Time
+	lastErr   error
+}
+
+// FailoverClient is an APIClient which spreads calls across multiple discovery endpoints.
+// Reads try the last-known-healthy endpoint first, followed by the remaining endpoints in order.
+// Writes go to all endpoints (best-effort) and succeed if at least one endpoint accepts.
+type FailoverClient struct {
+	eps  []*endpoint
+	last int // index of last-known-healthy endpoint
+	mx   sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+}
+
+// NewFailover constructs a new FailoverClient from the given APIClients.
+// It returns ErrNoEndpoints if no clients are provided.
+func NewFailover(clients ...APIClient) (*FailoverClient, error) {
+	if len(clients) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	eps := make([]*endpoint, len(clients))
+	for i, c := range clients {
+		eps[i] = &endpoint{APIClient: c}
+	}
+	return &FailoverClient{
+		eps:       eps,
+		threshold: DefaultFailoverThreshold,
+		cooldown:  DefaultFailoverCooldown,
+	}, nil
+}
+
+// NewHTTPFailover constructs a new FailoverClient with a http APIClient for each of the given addresses.
+// Empty addresses are ignored, and ErrNoEndpoints is returned if all of them are empty.
+func NewHTTPFailover(addrs ...string) (*FailoverClient, error) {
+	clients := make([]APIClient, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			clients = append(clients, NewHTTP(addr))
+		}
+	}
+	return NewFailover(clients...)
+}
+
+// SetBreaker sets the number of consecutive failures which marks an endpoint as unhealthy, and how long an
+// unhealthy endpoint is skipped for.
+// This should be called before the client is used.
+func (f *FailoverClient) SetBreaker(threshold int, cooldown time.Duration) {
+	f.mx.Lock()
+	f.threshold = threshold
+	f.cooldown = cooldown
+	f.mx.Unlock()
+}
+
+// Stats returns the health of each endpoint.
+func (f *FailoverClient) Stats() []EndpointStats {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	now := time.Now()
+	out := make([]EndpointStats, len(f.eps))
+	for i, ep := range f.eps {
+		out[i] = EndpointStats{
+			Index:     i,
+			Healthy:   !now.Before(ep.openUntil),
+			Failures:  ep.failures,
+			OpenUntil: ep.openUntil,
+		}
+		if ep.lastErr != nil {
+			out[i].LastError = ep.lastErr.Error()
+		}
+	}
+	return out
+}
+
+// order returns the endpoint indexes in the order reads should attempt them.
+// Healthy endpoints come first (starting from the last-known-healthy), followed by unhealthy ones.
+func (f *FailoverClient) order() []int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	now := time.Now()
+	healthy := make([]int, 0, len(f.eps))
+	var unhealthy []int
+	for i := range f.eps {
+		j := (f.last + i) % len(f.eps)
+		if now.Before(f.eps[j].openUntil) {
+			unhealthy = append(unhealthy, j)
+			continue
+		}
+		healthy = append(healthy, j)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// record records the result of a call to the endpoint of index i.
+func (f *FailoverClient) record(i int, err error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	ep := f.eps[i]
+	if !isEndpointFailure(err) {
+		ep.failures = 0
+		ep.openUntil = time.Time{}
+		ep.lastErr = nil
+		f.last = i
+		return
+	}
+	ep.failures++
+	ep.lastErr = err
+	if ep.failures >= f.threshold {
+		ep.openUntil = time.Now().Add(f.cooldown)
+	}
+}
+
+// read performs a read on endpoints until one succeeds.
+// If all endpoints fail, an error returned by a responsive endpoint (such as ErrKeyNotFound) is preferred.
+func (f *FailoverClient) read(fn func(c APIClient) error) error {
+	var respErr, lastErr error
+	for _, i := range f.order() {
+		err := fn(f.eps[i].APIClient)
+		f.record(i, err)
+		if err == nil {
+			return nil
+		}
+		if respErr == nil && !isEndpointFailure(err) {
+			respErr = err
+		}
+		lastErr = err
+	}
+	if respErr != nil {
+		return respErr
+	}
+	return lastErr
+}
+
+// write performs a write on all endpoints concurrently.
+// It succeeds if at least one endpoint succeeds, in which case 'ok' is the index of the first successful endpoint.
+func (f *FailoverClient) write(fn func(c APIClient, i int) error) (ok int, err error) {
+	errs := make([]error, len(f.eps))
+
+	var wg sync.WaitGroup
+	wg.Add(len(f.eps))
+	for i, ep := range f.eps {
+		go func(i int, c APIClient) {
+			errs[i] = fn(c, i)
+			f.record(i, errs[i])
+			wg.Done()
+		}(i, ep.APIClient)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			return i, nil
+		}
+	}
+	return -1, errs[0]
+}
+
+// Entry implements APIClient.
+func (f *FailoverClient) Entry(ctx context.Context, pk cipher.PubKey) (entry *Entry, err error) {
+	err = f.read(func(c APIClient) (err error) {
+		entry, err = c.Entry(ctx, pk)
+		return err
+	})
+	return entry, err
+}
+
+// AvailableServers implements APIClient.
+func (f *FailoverClient) AvailableServers(ctx context.Context) (entries []*Entry, err error) {
+	err = f.read(func(c APIClient) (err error) {
+		entries, err = c.AvailableServers(ctx)
+		return err
+	})
+	return entries, err
+}
+
+// PostEntry implements APIClient.
+func (f *FailoverClient) PostEntry(ctx context.Context, e *Entry) error {
+	_, err := f.write(func(c APIClient, _ int) error {
+		cp := new(Entry)
+		Copy(cp, e)
+		return c.PostEntry(ctx, cp)
+	})
+	return err
+}
+
+// PutEntry implements APIClient.
+// As PutEntry mutates the entry (sequence, timestamp and signature), each endpoint is given a copy of the entry, and
+// the result of the first successful endpoint is copied back into 'e'.
+func (f *FailoverClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) error {
+	return f.put(e, func(c APIClient, cp *Entry) error { return c.PutEntry(ctx, sk, cp) })
+}
+
+// PutEntryWith implements SignerPutter, as PutEntry does.
+func (f *FailoverClient) PutEntryWith(ctx context.Context, s Signer, e *Entry) error {
+	return f.put(e, func(c APIClient, cp *Entry) error { return PutEntryWith(ctx, c, s, cp) })
+}
+
+// put performs an update of the entry on all endpoints, each with it's own copy of the entry.
+func (f *FailoverClient) put(e *Entry, fn func(c APIClient, cp *Entry) error) error {
+	cps := make([]*Entry, len(f.eps))
+	for i := range cps {
+		cps[i] = new(Entry)
+		Copy(cps[i], e)
+	}
+	i, err := f.write(func(c APIClient, i int) error {
+		return fn(c, cps[i])
+	})
+	if err != nil {
+		return err
+	}
+	Copy(e, cps[i])
+	return nil
+}
+
+// isEndpointFailure returns true if the error indicates that the endpoint itself is unhealthy.
+// Errors returned as valid responses by discovery (such as not-found or validation errors) are not failures.
+func isEndpointFailure(err error) bool {
+	return Classify(err) == ErrKindTransient
+}
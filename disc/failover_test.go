@@ -0,0 +1,71 @@
+package disc_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+var errBroken error = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("broken endpoint")}
+
+// brokenClient is an APIClient that always fails.
+type brokenClient struct{}
+
+func (brokenClient) Entry(context.Context, cipher.PubKey) (*disc.Entry, error) { return nil, errBroken }
+func (brokenClient) PostEntry(context.Context, *disc.Entry) error              { return errBroken }
+func (brokenClient) PutEntry(context.Context, cipher.SecKey, *disc.Entry) error {
+	return errBroken
+}
+func (brokenClient) AvailableServers(context.Context) ([]*disc.Entry, error) { return nil, errBroken }
+
+func TestFailoverClient(t *testing.T) {
+	ctx := context.TODO()
+	pk, sk := cipher.GenerateKeyPair()
+
+	healthy := disc.NewMock(0)
+	fc, err := disc.NewFailover(brokenClient{}, healthy)
+	require.NoError(t, err)
+	fc.SetBreaker(1, disc.DefaultFailoverCooldown)
+
+	// Writes succeed if at least one endpoint accepts.
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, fc.PostEntry(ctx, entry))
+
+	// Reads fail over to the healthy endpoint.
+	got, err := fc.Entry(ctx, pk)
+	require.NoError(t, err)
+	require.Equal(t, entry.Sequence, got.Sequence)
+
+	// The broken endpoint should be reported as unhealthy.
+	stats := fc.Stats()
+	require.Len(t, stats, 2)
+	require.False(t, stats[0].Healthy)
+	require.Equal(t, errBroken.Error(), stats[0].LastError)
+	require.True(t, stats[1].Healthy)
+
+	// Updates are copied back from the successful endpoint.
+	require.NoError(t, fc.PutEntry(ctx, sk, got))
+	require.Equal(t, entry.Sequence+1, got.Sequence)
+
+	// All endpoints failing results in an error.
+	fc, err = disc.NewFailover(brokenClient{}, brokenClient{})
+	require.NoError(t, err)
+	_, err = fc.AvailableServers(ctx)
+	require.Equal(t, errBroken, err)
+}
+
+func TestNewHTTPFailover_NoEndpoints(t *testing.T) {
+	_, err := disc.NewHTTPFailover(strings.Split(" , ", ",")...)
+	require.Equal(t, disc.ErrNoEndpoints, err)
+
+	_, err = disc.NewFailover()
+	require.Equal(t, disc.ErrNoEndpoints, err)
+}
@@ -0,0 +1,69 @@
+package disc
+
+import (
+	"context"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/discmetrics"
+)
+
+// instrumentedClient wraps an APIClient so that every call is recorded in metrics.
+type instrumentedClient struct {
+	dc APIClient
+	m  discmetrics.Metrics
+}
+
+// NewInstrumented wraps an APIClient so that the count, duration and outcome of every call is recorded in the given
+// metrics. Wrapping the outermost APIClient makes it the single point through which all discovery calls are recorded.
+func NewInstrumented(dc APIClient, m discmetrics.Metrics) APIClient {
+	return &instrumentedClient{dc: dc, m: m}
+}
+
+func (c *instrumentedClient) record(call string, start time.Time, err error) {
+	outcome := discmetrics.OutcomeOK
+	switch Classify(err) {
+	case ErrKindNone:
+	case ErrKindNotFound:
+		outcome = discmetrics.OutcomeNotFound
+	default:
+		outcome = discmetrics.OutcomeError
+	}
+	c.m.RecordCall(call, outcome, time.Since(start))
+}
+
+// Entry implements APIClient.
+func (c *instrumentedClient) Entry(ctx context.Context, pk cipher.PubKey) (entry *Entry, err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallEntry, start, err) }(time.Now())
+	return c.dc.Entry(ctx, pk)
+}
+
+// PostEntry implements APIClient.
+func (c *instrumentedClient) PostEntry(ctx context.Context, e *Entry) (err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallPostEntry, start, err) }(time.Now())
+	return c.dc.PostEntry(ctx, e)
+}
+
+// PutEntry implements APIClient.
+func (c *instrumentedClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) (err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallPutEntry, start, err) }(time.Now())
+	return c.dc.PutEntry(ctx, sk, e)
+}
+
+// PutEntryWith implements SignerPutter.
+func (c *instrumentedClient) PutEntryWith(ctx context.Context, s Signer, e *Entry) (err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallPutEntry, start, err) }(time.Now())
+	return PutEntryWith(ctx, c.dc, s, e)
+}
+
+// AvailableServers implements APIClient.
+func (c *instrumentedClient) AvailableServers(ctx context.Context) (entries []*Entry, err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallAvailableServers, start, err) }(time.Now())
+	return c.dc.AvailableServers(ctx)
+}
+
+// SampleServers implements ServerSampler.
+func (c *instrumentedClient) SampleServers(ctx context.Context, n int) (entries []*Entry, err error) {
+	defer func(start time.Time) { c.record(discmetrics.CallSampleServers, start, err) }(time.Now())
+	return SampleServers(ctx, c.dc, n)
+}
@@ -0,0 +1,52 @@
+package disc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/discmetrics"
+)
+
+// recordingMetrics is a discmetrics.Metrics which counts recorded calls by call type and outcome.
+type recordingMetrics struct {
+	discmetrics.Metrics
+	calls map[[2]string]int
+}
+
+func (m *recordingMetrics) RecordCall(call, outcome string, _ time.Duration) {
+	m.calls[[2]string{call, outcome}]++
+}
+
+func TestNewInstrumented(t *testing.T) {
+	ctx := context.TODO()
+	pk, sk := cipher.GenerateKeyPair()
+	missingPK, _ := cipher.GenerateKeyPair()
+
+	m := &recordingMetrics{Metrics: discmetrics.NewEmpty(), calls: make(map[[2]string]int)}
+	dc := disc.NewInstrumented(disc.NewMock(0), m)
+
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, dc.PostEntry(ctx, entry))
+	require.NoError(t, dc.PutEntry(ctx, sk, entry))
+
+	_, err := dc.Entry(ctx, pk)
+	require.NoError(t, err)
+	_, err = dc.Entry(ctx, missingPK)
+	require.Error(t, err)
+	_, err = dc.AvailableServers(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, map[[2]string]int{
+		{discmetrics.CallPostEntry, discmetrics.OutcomeOK}:        1,
+		{discmetrics.CallPutEntry, discmetrics.OutcomeOK}:         1,
+		{discmetrics.CallEntry, discmetrics.OutcomeOK}:            1,
+		{discmetrics.CallEntry, discmetrics.OutcomeNotFound}:      1,
+		{discmetrics.CallAvailableServers, discmetrics.OutcomeOK}: 1,
+	}, m.calls)
+}
@@ -0,0 +1,203 @@
+package disc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+// ErrorKind classifies an error returned by an APIClient.
+type ErrorKind int
+
+// Error kinds.
+const (
+	ErrKindNone      ErrorKind = iota // No error.
+	ErrKindNotFound                   // The requested entry does not exist.
+	ErrKindTransient                  // The call may succeed if retried.
+	ErrKindPermanent                  // The call will not succeed if retried.
+)
+
+// String implements fmt.Stringer
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrKindNone:
+		return "none"
+	case ErrKindNotFound:
+		return "not_found"
+	case ErrKindTransient:
+		return "transient"
+	case ErrKindPermanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+// Classify returns the kind of the given error.
+// Only errors which report that discovery could not be reached (or failed unexpectedly) are transient. Other errors
+// (i.e. of invalid entries or responses) are permanent, as retrying them would not succeed.
+func Classify(err error) ErrorKind {
+	if err == nil {
+		return ErrKindNone
+	}
+	var nErr net.Error
+	switch {
+	case errors.Is(err, ErrKeyNotFound), errors.Is(err, ErrNoAvailableServers):
+		return ErrKindNotFound
+	case errors.Is(err, ErrUnexpected), errors.Is(err, context.DeadlineExceeded), errors.As(err, &nErr):
+		return ErrKindTransient
+	default:
+		return ErrKindPermanent
+	}
+}
+
+// IsNotFound returns true if the error reports that an entry does not exist.
+func IsNotFound(err error) bool {
+	return Classify(err) == ErrKindNotFound
+}
+
+// Default values for RetryConfig.
+const (
+	DefaultCallTimeout = time.Second * 5
+	DefaultCallTries   = 3
+	DefaultCallBackoff = time.Millisecond * 200
+	DefaultCallMaxBO   = time.Second * 2
+	DefaultCallOpTO    = time.Second * 10
+)
+
+// RetryConfig configures how a retrying APIClient performs calls.
+type RetryConfig struct {
+	Timeout     time.Duration // Timeout of a single call attempt.
+	Tries       int           // Maximum number of attempts of a call.
+	InitBackoff time.Duration // Backoff before the first retry.
+	MaxBackoff  time.Duration // Maximum backoff between retries.
+	OpTimeout   time.Duration // Timeout of a whole call, including all attempts and backoffs.
+}
+
+// DefaultRetryConfig returns the default RetryConfig.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Timeout:     DefaultCallTimeout,
+		Tries:       DefaultCallTries,
+		InitBackoff: DefaultCallBackoff,
+		MaxBackoff:  DefaultCallMaxBO,
+		OpTimeout:   DefaultCallOpTO,
+	}
+}
+
+// ensure ensures all config values are set.
+func (rc *RetryConfig) ensure() {
+	if rc.Timeout == 0 {
+		rc.Timeout = DefaultCallTimeout
+	}
+	if rc.Tries == 0 {
+		rc.Tries = DefaultCallTries
+	}
+	if rc.InitBackoff == 0 {
+		rc.InitBackoff = DefaultCallBackoff
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = DefaultCallMaxBO
+	}
+	if rc.OpTimeout == 0 {
+		rc.OpTimeout = DefaultCallOpTO
+	}
+}
+
+// retryingClient wraps an APIClient so that every call has a timeout, and transient failures are retried.
+type retryingClient struct {
+	dc   APIClient
+	conf RetryConfig
+}
+
+// NewRetrying wraps an APIClient so that each call attempt is bounded by a timeout, and transient failures are
+// retried a bounded number of times with jittered exponential backoff.
+// The whole call (all attempts and backoffs) is bounded by an independent operation timeout, so that a slow
+// discovery fails calls promptly regardless of the caller's context.
+// Not-found and permanent errors are never retried.
+func NewRetrying(dc APIClient, conf RetryConfig) APIClient {
+	conf.ensure()
+	return &retryingClient{dc: dc, conf: conf}
+}
+
+func (c *retryingClient) do(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.conf.OpTimeout)
+	defer cancel()
+
+	bo := netutil.NewBackoff(netutil.BackoffConfig{
+		Initial: c.conf.InitBackoff,
+		Max:     c.conf.MaxBackoff,
+		Factor:  2,
+		Jitter:  netutil.DefaultJitter,
+	})
+
+	for i := 0; i < c.conf.Tries; i++ {
+		if i > 0 {
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, c.conf.Timeout)
+		err = fn(callCtx)
+		cancel()
+
+		if Classify(err) != ErrKindTransient || ctx.Err() != nil {
+			return err
+		}
+		log.WithError(err).WithField("attempt", i+1).Debug("Discovery call failed.")
+	}
+	return err
+}
+
+// Entry implements APIClient.
+func (c *retryingClient) Entry(ctx context.Context, pk cipher.PubKey) (entry *Entry, err error) {
+	err = c.do(ctx, func(ctx context.Context) (err error) {
+		entry, err = c.dc.Entry(ctx, pk)
+		return err
+	})
+	return entry, err
+}
+
+// PostEntry implements APIClient.
+func (c *retryingClient) PostEntry(ctx context.Context, e *Entry) error {
+	return c.do(ctx, func(ctx context.Context) error {
+		return c.dc.PostEntry(ctx, e)
+	})
+}
+
+// PutEntry implements APIClient.
+func (c *retryingClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) error {
+	return c.do(ctx, func(ctx context.Context) error {
+		return c.dc.PutEntry(ctx, sk, e)
+	})
+}
+
+// PutEntryWith implements SignerPutter.
+func (c *retryingClient) PutEntryWith(ctx context.Context, s Signer, e *Entry) error {
+	return c.do(ctx, func(ctx context.Context) error {
+		return PutEntryWith(ctx, c.dc, s, e)
+	})
+}
+
+// AvailableServers implements APIClient.
+func (c *retryingClient) AvailableServers(ctx context.Context) (entries []*Entry, err error) {
+	err = c.do(ctx, func(ctx context.Context) (err error) {
+		entries, err = c.dc.AvailableServers(ctx)
+		return err
+	})
+	return entries, err
+}
+
+// SampleServers implements ServerSampler.
+func (c *retryingClient) SampleServers(ctx context.Context, n int) (entries []*Entry, err error) {
+	err = c.do(ctx, func(ctx context.Context) (err error) {
+		entries, err = SampleServers(ctx, c.dc, n)
+		return err
+	})
+	return entries, err
+}
@@ -0,0 +1,109 @@
+package disc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+// countingClient wraps an APIClient and fails the first 'fails' calls to Entry with 'err'.
+type countingClient struct {
+	disc.APIClient
+	fails int
+	err   error
+	calls int
+}
+
+func (c *countingClient) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	if c.calls++; c.calls <= c.fails {
+		return nil, c.err
+	}
+	return c.APIClient.Entry(ctx, pk)
+}
+
+// hangingClient is an APIClient of which calls block until the context is done.
+type hangingClient struct{ brokenClient }
+
+func (hangingClient) Entry(ctx context.Context, _ cipher.PubKey) (*disc.Entry, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClassify(t *testing.T) {
+	require.Equal(t, disc.ErrKindNone, disc.Classify(nil))
+	require.Equal(t, disc.ErrKindNotFound, disc.Classify(disc.ErrKeyNotFound))
+	require.Equal(t, disc.ErrKindPermanent, disc.Classify(disc.ErrValidationWrongSequence))
+	require.Equal(t, disc.ErrKindPermanent, disc.Classify(disc.ErrUnauthorized))
+	require.Equal(t, disc.ErrKindTransient, disc.Classify(disc.ErrUnexpected))
+	require.Equal(t, disc.ErrKindTransient, disc.Classify(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	require.Equal(t, disc.ErrKindTransient, disc.Classify(context.DeadlineExceeded))
+	require.Equal(t, disc.ErrKindNotFound, disc.Classify(fmt.Errorf("lookup: %w", disc.ErrKeyNotFound)))
+
+	// Unknown errors are not retried, nor do they report discovery as unreachable.
+	require.Equal(t, disc.ErrKindPermanent, disc.Classify(errors.New("invalid character in response")))
+	require.Equal(t, disc.ErrKindPermanent, disc.Classify(context.Canceled))
+}
+
+func TestNewRetrying(t *testing.T) {
+	ctx := context.TODO()
+	pk, sk := cipher.GenerateKeyPair()
+
+	mock := disc.NewMock(0)
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, mock.PostEntry(ctx, entry))
+
+	conf := disc.RetryConfig{
+		Timeout:     time.Millisecond * 100,
+		Tries:       3,
+		InitBackoff: time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	}
+
+	t.Run("retries_transient", func(t *testing.T) {
+		cc := &countingClient{APIClient: mock, fails: 2, err: disc.ErrUnexpected}
+		_, err := disc.NewRetrying(cc, conf).Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, 3, cc.calls)
+	})
+
+	t.Run("gives_up_after_tries", func(t *testing.T) {
+		cc := &countingClient{APIClient: mock, fails: 5, err: disc.ErrUnexpected}
+		_, err := disc.NewRetrying(cc, conf).Entry(ctx, pk)
+		require.Equal(t, disc.ErrUnexpected, err)
+		require.Equal(t, 3, cc.calls)
+	})
+
+	t.Run("does_not_retry_not_found", func(t *testing.T) {
+		cc := &countingClient{APIClient: mock, fails: 5, err: disc.ErrKeyNotFound}
+		_, err := disc.NewRetrying(cc, conf).Entry(ctx, pk)
+		require.Equal(t, disc.ErrKeyNotFound, err)
+		require.Equal(t, 1, cc.calls)
+	})
+
+	t.Run("applies_timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := disc.NewRetrying(hangingClient{}, conf).Entry(ctx, pk)
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	t.Run("applies_op_timeout", func(t *testing.T) {
+		conf := conf
+		conf.Timeout = time.Second * 5
+		conf.OpTimeout = time.Millisecond * 100
+
+		start := time.Now()
+		_, err := disc.NewRetrying(hangingClient{}, conf).Entry(ctx, pk)
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+}
@@ -0,0 +1,39 @@
+package disc
+
+import (
+	"context"
+	"math/rand"
+)
+
+// ServerSampler is an optional interface of APIClients which can return a random sample of the available servers,
+// so that callers which only need a few servers do not need to fetch all of them.
+type ServerSampler interface {
+	SampleServers(ctx context.Context, n int) ([]*Entry, error)
+}
+
+// SampleServers returns up to 'n' randomly selected available servers.
+// The APIClient's ServerSampler implementation is used if available, otherwise all available servers are fetched and
+// sampled locally. If 'n' <= 0, all available servers are returned as reported by AvailableServers.
+func SampleServers(ctx context.Context, dc APIClient, n int) ([]*Entry, error) {
+	if n <= 0 {
+		return dc.AvailableServers(ctx)
+	}
+	if s, ok := dc.(ServerSampler); ok {
+		return s.SampleServers(ctx, n)
+	}
+	entries, err := dc.AvailableServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sampleEntries(entries, n), nil
+}
+
+// sampleEntries shuffles the entries and returns the first 'n'.
+// The shuffle ensures that callers get a fair sample regardless of the order which entries are returned in.
+func sampleEntries(entries []*Entry, n int) []*Entry {
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
@@ -0,0 +1,56 @@
+package disc_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestSampleServers(t *testing.T) {
+	const nServers = 10
+	const n = 3
+
+	servers := make(map[cipher.PubKey]string, nServers)
+	for i := 0; i < nServers; i++ {
+		pk, _ := cipher.GenerateKeyPair()
+		servers[pk] = "127.0.0.1:8080"
+	}
+
+	// The static client does not implement ServerSampler, so servers are sampled locally.
+	dc := disc.NewStatic(servers, nil)
+	_, ok := dc.(disc.ServerSampler)
+	require.False(t, ok)
+
+	// Samples are bounded by 'n', and are not always the first entries.
+	seen := make(map[cipher.PubKey]struct{})
+	for i := 0; i < 20; i++ {
+		entries, err := disc.SampleServers(context.TODO(), dc, n)
+		require.NoError(t, err)
+		require.Len(t, entries, n)
+		for _, e := range entries {
+			seen[e.Static] = struct{}{}
+		}
+	}
+	require.True(t, len(seen) > n, "samples should be fair")
+
+	// Non-positive 'n' returns all servers.
+	entries, err := disc.SampleServers(context.TODO(), dc, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, nServers)
+
+	// Wrappers preserve sampling of the wrapped client.
+	mock := disc.NewMock(0)
+	for pk := range servers {
+		require.NoError(t, mock.PostEntry(context.TODO(), disc.NewServerEntry(pk, 0, "127.0.0.1:8080", 10)))
+	}
+	wrapped := disc.NewRetrying(mock, disc.DefaultRetryConfig())
+	_, ok = wrapped.(disc.ServerSampler)
+	require.True(t, ok)
+	entries, err = disc.SampleServers(context.TODO(), wrapped, n)
+	require.NoError(t, err)
+	require.Len(t, entries, n)
+}
@@ -0,0 +1,86 @@
+package disc
+
+import (
+	"context"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// Signer signs payloads on behalf of the owner of a public key.
+// Implementations may keep the secret key outside of the process (i.e. in a HSM or keyring).
+type Signer interface {
+	PubKey() cipher.PubKey
+	Sign(data []byte) (cipher.Sig, error)
+}
+
+// secKeySigner is a Signer which holds the raw secret key.
+type secKeySigner struct {
+	pk cipher.PubKey
+	sk cipher.SecKey
+}
+
+// NewSecKeySigner returns a Signer which signs with the given raw secret key.
+func NewSecKeySigner(sk cipher.SecKey) (Signer, error) {
+	pk, err := sk.PubKey()
+	if err != nil {
+		return nil, err
+	}
+	return &secKeySigner{pk: pk, sk: sk}, nil
+}
+
+// PubKey implements Signer.
+func (s *secKeySigner) PubKey() cipher.PubKey { return s.pk }
+
+// Sign implements Signer.
+func (s *secKeySigner) Sign(data []byte) (cipher.Sig, error) { return cipher.SignPayload(data, s.sk) }
+
+// SignerPutter is an optional interface of APIClients which can update entries which are signed with a Signer.
+type SignerPutter interface {
+	PutEntryWith(ctx context.Context, s Signer, e *Entry) error
+}
+
+// PutEntryWith updates the entry in discovery (as APIClient.PutEntry does), but signs the entry with the given Signer.
+// The APIClient's SignerPutter implementation is used if available, so that updates are serialized as those of
+// PutEntry are. ErrSignerMismatch is returned if the Signer is not of the entry's public key.
+func PutEntryWith(ctx context.Context, dc APIClient, s Signer, entry *Entry) error {
+	if s.PubKey() != entry.Static {
+		return ErrSignerMismatch
+	}
+	if p, ok := dc.(SignerPutter); ok {
+		return p.PutEntryWith(ctx, s, entry)
+	}
+	return putEntry(ctx, dc, entry, func(e *Entry) error { return e.SignWith(s) })
+}
+
+// putEntry updates the entry in discovery by posting it with the next sequence (signed with 'sign'). If the sequence
+// is outdated, the entry is re-posted with the sequence which follows the current entry in discovery (unless the
+// current entry is more recent, in which case the update is dropped).
+func putEntry(ctx context.Context, dc APIClient, entry *Entry, sign func(e *Entry) error) error {
+	entry.Sequence++
+	entry.Timestamp = time.Now().UnixNano()
+
+	for {
+		err := sign(entry)
+		if err != nil {
+			return err
+		}
+		err = dc.PostEntry(ctx, entry)
+		if err == nil {
+			return nil
+		}
+		if err != ErrValidationWrongSequence {
+			entry.Sequence--
+			return err
+		}
+		rE, entryErr := dc.Entry(ctx, entry.Static)
+		if entryErr != nil {
+			return err
+		}
+		if rE.Timestamp > entry.Timestamp { // If there is a more up to date entry drop update
+			entry.Sequence = rE.Sequence
+			return nil
+		}
+		entry.Sequence = rE.Sequence + 1
+	}
+}
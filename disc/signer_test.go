@@ -0,0 +1,90 @@
+package disc_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+// countingSigner is a disc.Signer which counts signatures.
+type countingSigner struct {
+	disc.Signer
+	n int64
+}
+
+func (s *countingSigner) Sign(data []byte) (cipher.Sig, error) {
+	atomic.AddInt64(&s.n, 1)
+	return s.Signer.Sign(data)
+}
+
+func TestSigner(t *testing.T) {
+	pk, sk := cipher.GenerateKeyPair()
+	skSigner, err := disc.NewSecKeySigner(sk)
+	require.NoError(t, err)
+	require.Equal(t, pk, skSigner.PubKey())
+
+	s := &countingSigner{Signer: skSigner}
+
+	// Entries signed with a signer are verifiable.
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.SignWith(s))
+	require.NoError(t, entry.VerifySignature())
+
+	// Entries can be updated with a signer.
+	dc := disc.NewMockClient(0)
+	dc.SetVerification(disc.MockVerifyAll)
+	require.NoError(t, dc.PostEntry(context.TODO(), entry))
+	require.NoError(t, disc.PutEntryWith(context.TODO(), dc, s, entry))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.n))
+
+	got, err := dc.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.Sequence)
+	require.NoError(t, got.VerifySignature())
+}
+
+// signerPutterClient is a disc.APIClient which records updates through disc.SignerPutter.
+type signerPutterClient struct {
+	disc.APIClient
+	n int64
+}
+
+func (c *signerPutterClient) PutEntryWith(ctx context.Context, s disc.Signer, e *disc.Entry) error {
+	atomic.AddInt64(&c.n, 1)
+	return disc.PutEntryWith(ctx, c.APIClient, s, e)
+}
+
+func TestPutEntryWith(t *testing.T) {
+	pk, sk := cipher.GenerateKeyPair()
+	s, err := disc.NewSecKeySigner(sk)
+	require.NoError(t, err)
+
+	mock := disc.NewMockClient(0)
+	mock.SetVerification(disc.MockVerifyAll)
+	sp := &signerPutterClient{APIClient: mock}
+	dc := disc.NewRetrying(sp, disc.DefaultRetryConfig())
+
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, dc.PostEntry(context.TODO(), entry))
+
+	// Updates are performed through the SignerPutter implementation of wrapped clients.
+	require.NoError(t, disc.PutEntryWith(context.TODO(), dc, s, entry))
+	require.Equal(t, int64(1), atomic.LoadInt64(&sp.n))
+
+	// Entries are not signed by signers of other public keys.
+	_, otherSK := cipher.GenerateKeyPair()
+	other, err := disc.NewSecKeySigner(otherSK)
+	require.NoError(t, err)
+	require.Equal(t, disc.ErrSignerMismatch, disc.PutEntryWith(context.TODO(), dc, other, entry))
+	require.Equal(t, uint64(1), entry.Sequence)
+
+	got, err := dc.Entry(context.TODO(), pk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.Sequence)
+}
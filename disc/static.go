@@ -0,0 +1,68 @@
+package disc
+
+import (
+	"context"
+	"sort"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// staticAvailableSessions is the number of available sessions reported for servers of a static client.
+const staticAvailableSessions = 1000
+
+// staticClient is an APIClient backed by a static table of entries.
+type staticClient struct {
+	servers map[cipher.PubKey]string          // server pk -> address
+	clients map[cipher.PubKey][]cipher.PubKey // client pk -> delegated servers
+}
+
+// NewStatic constructs an APIClient backed by a static table, for deployments without a live discovery.
+// 'servers' maps server public keys to their addresses, and 'clients' maps client public keys to their delegated
+// servers. Entries obtained from the static client are not signed.
+// PostEntry and PutEntry are no-ops, so that entities can publish entries without effect.
+func NewStatic(servers map[cipher.PubKey]string, clients map[cipher.PubKey][]cipher.PubKey) APIClient {
+	s := &staticClient{
+		servers: make(map[cipher.PubKey]string, len(servers)),
+		clients: make(map[cipher.PubKey][]cipher.PubKey, len(clients)),
+	}
+	for pk, addr := range servers {
+		s.servers[pk] = addr
+	}
+	for pk, srvPKs := range clients {
+		s.clients[pk] = append([]cipher.PubKey(nil), srvPKs...)
+	}
+	return s
+}
+
+// Entry implements APIClient.
+func (s *staticClient) Entry(_ context.Context, pk cipher.PubKey) (*Entry, error) {
+	if addr, ok := s.servers[pk]; ok {
+		return NewServerEntry(pk, 0, addr, staticAvailableSessions), nil
+	}
+	if srvPKs, ok := s.clients[pk]; ok {
+		return NewClientEntry(pk, 0, append([]cipher.PubKey(nil), srvPKs...)), nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// PostEntry implements APIClient.
+func (s *staticClient) PostEntry(context.Context, *Entry) error {
+	return nil
+}
+
+// PutEntry implements APIClient.
+func (s *staticClient) PutEntry(context.Context, cipher.SecKey, *Entry) error {
+	return nil
+}
+
+// AvailableServers implements APIClient.
+func (s *staticClient) AvailableServers(context.Context) ([]*Entry, error) {
+	entries := make([]*Entry, 0, len(s.servers))
+	for pk, addr := range s.servers {
+		entries = append(entries, NewServerEntry(pk, 0, addr, staticAvailableSessions))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Static.Big().Cmp(entries[j].Static.Big()) < 0
+	})
+	return entries, nil
+}
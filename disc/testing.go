@@ -2,67 +2,119 @@ package disc
 
 import (
 	"context"
-	"errors"
-	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/skycoin/dmsg/cipher"
 )
 
-// MockClient is an APIClient mock. The mock doesn't reply with the same errors as the
+// MockVerification determines which posted entries have their signatures verified by the mock APIClient.
+type MockVerification int
+
+// Signature verification modes of the mock APIClient.
+const (
+	MockVerifyUpdates MockVerification = iota // verify entries which replace an existing entry (default)
+	MockVerifyAll                             // verify all entries
+	MockVerifyNone                            // never verify entries
+)
+
+// MockClient is an APIClient mock which keeps entries in memory. The mock doesn't reply with the same errors as the
 // real client, and it mimics it's functionality not being 100% accurate.
-type mockClient struct {
+// It is safe for concurrent use, and can be shared by multiple entities to run a local dmsg network.
+type MockClient struct {
 	entries map[cipher.PubKey]Entry
+	verify  MockVerification
+	latency time.Duration
+	err     error
 	mx      sync.RWMutex
 
 	timeout time.Duration
 }
 
-// NewMock constructs  a new mock APIClient.
+// NewMock constructs a new mock APIClient.
+// If 'timeout' is non-zero, entries which are not updated within 'timeout' are dropped.
 func NewMock(timeout time.Duration) APIClient {
-	return &mockClient{
+	return NewMockClient(timeout)
+}
+
+// NewMockClient constructs a new mock APIClient, returning the concrete *MockClient so that it's behaviour can be
+// configured (see SetVerification, SetLatency and SetError).
+func NewMockClient(timeout time.Duration) *MockClient {
+	return &MockClient{
 		entries: make(map[cipher.PubKey]Entry),
 		timeout: timeout,
 	}
 }
 
-func (m *mockClient) entry(pk cipher.PubKey) (Entry, bool) {
-	m.mx.RLock()
-	defer m.mx.RUnlock()
+// SetVerification sets which posted entries have their signatures verified.
+func (m *MockClient) SetVerification(v MockVerification) {
+	m.mx.Lock()
+	m.verify = v
+	m.mx.Unlock()
+}
 
-	e, ok := m.entries[pk]
-	return e, ok
+// SetLatency sets an artificial delay applied to every call.
+func (m *MockClient) SetLatency(latency time.Duration) {
+	m.mx.Lock()
+	m.latency = latency
+	m.mx.Unlock()
 }
 
-func (m *mockClient) setEntry(entry Entry) {
+// SetError makes all calls fail with 'err' (after the artificial latency). A nil 'err' restores normal operation.
+func (m *MockClient) SetError(err error) {
 	m.mx.Lock()
-	defer m.mx.Unlock()
+	m.err = err
+	m.mx.Unlock()
+}
 
-	// timeout trigger
-	if m.timeout != 0 {
-		go func(pk cipher.PubKey) {
-			<-time.After(m.timeout)
+// call simulates the latency and injected error of a call.
+func (m *MockClient) call(ctx context.Context) error {
+	m.mx.RLock()
+	latency, err := m.latency, m.err
+	m.mx.RUnlock()
 
-			m.mx.Lock()
-			defer m.mx.Unlock()
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
 
-			if entry, ok := m.entries[pk]; ok {
-				if ts := time.Unix(0, entry.Timestamp); time.Since(ts) > m.timeout {
-					delete(m.entries, entry.Static)
-				}
-			}
-		}(entry.Static)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return err
+}
 
-	m.entries[entry.Static] = entry
+// expired returns true if the entry was not updated within the entry timeout.
+// Lock should be held by caller.
+func (m *MockClient) expired(entry Entry) bool {
+	return m.timeout != 0 && time.Since(time.Unix(0, entry.Timestamp)) > m.timeout
+}
+
+// entry returns the stored entry of 'pk'.
+// Lock should be held by caller.
+func (m *MockClient) entry(pk cipher.PubKey) (Entry, bool) {
+	e, ok := m.entries[pk]
+	if ok && m.expired(e) {
+		return Entry{}, false
+	}
+	return e, ok
 }
 
 // Entry returns the mock client static public key associated entry
-func (m *mockClient) Entry(_ context.Context, pk cipher.PubKey) (*Entry, error) {
+func (m *MockClient) Entry(ctx context.Context, pk cipher.PubKey) (*Entry, error) {
+	if err := m.call(ctx); err != nil {
+		return nil, err
+	}
+
+	m.mx.RLock()
 	entry, ok := m.entry(pk)
+	m.mx.RUnlock()
+
 	if !ok {
-		return nil, errors.New(HTTPMessage{ErrKeyNotFound.Error(), http.StatusNotFound}.String())
+		return nil, ErrKeyNotFound
 	}
 	res := &Entry{}
 	Copy(res, &entry)
@@ -70,25 +122,34 @@ func (m *mockClient) Entry(_ context.Context, pk cipher.PubKey) (*Entry, error)
 }
 
 // PostEntry sets an entry on the APIClient mock
-func (m *mockClient) PostEntry(_ context.Context, entry *Entry) error {
+func (m *MockClient) PostEntry(ctx context.Context, entry *Entry) error {
+	if err := m.call(ctx); err != nil {
+		return err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
 	previousEntry, ok := m.entry(entry.Static)
 	if ok {
-		err := previousEntry.ValidateIteration(entry)
-		if err != nil {
+		if err := previousEntry.ValidateIteration(entry); err != nil {
 			return err
 		}
-		err = entry.VerifySignature()
-		if err != nil {
+	}
+	if (ok && m.verify == MockVerifyUpdates) || m.verify == MockVerifyAll {
+		if err := entry.VerifySignature(); err != nil {
 			return err
 		}
 	}
 
-	m.setEntry(*entry)
+	var stored Entry
+	Copy(&stored, entry)
+	m.entries[entry.Static] = stored
 	return nil
 }
 
 // PutEntry updates a previously set entry
-func (m *mockClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) error {
+func (m *MockClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) error {
 	e.Sequence++
 	e.Timestamp = time.Now().UnixNano()
 
@@ -118,14 +179,34 @@ func (m *mockClient) PutEntry(ctx context.Context, sk cipher.SecKey, e *Entry) e
 }
 
 // AvailableServers returns all the servers that the APIClient mock has
-func (m *mockClient) AvailableServers(_ context.Context) ([]*Entry, error) {
+func (m *MockClient) AvailableServers(ctx context.Context) ([]*Entry, error) {
+	if err := m.call(ctx); err != nil {
+		return nil, err
+	}
+
 	m.mx.RLock()
 	defer m.mx.RUnlock()
+
 	list := make([]*Entry, 0, len(m.entries))
 	for _, e := range m.entries {
-		if e := e; e.Server != nil {
-			list = append(list, &e)
+		if e.Server == nil || m.expired(e) {
+			continue
 		}
+		res := &Entry{}
+		Copy(res, &e)
+		list = append(list, res)
 	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Static.Big().Cmp(list[j].Static.Big()) < 0
+	})
 	return list, nil
 }
+
+// SampleServers returns up to 'n' randomly selected servers that the APIClient mock has
+func (m *MockClient) SampleServers(ctx context.Context, n int) ([]*Entry, error) {
+	entries, err := m.AvailableServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sampleEntries(entries, n), nil
+}
@@ -0,0 +1,83 @@
+package dmsg
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+// discHealth wraps the APIClient of a client, to track whether discovery is reachable from the outcome of every call.
+// A call which fails with a transient error (see disc.Classify) marks discovery as unavailable, and any other call
+// (including one which fails with a not-found, rejection or unknown error) marks it as available again.
+type discHealth struct {
+	disc.APIClient
+	down     int32                         // atomic, 1 while discovery is unavailable
+	onChange func(healthy bool, err error) // called as the health of discovery changes (concurrent calls may race)
+}
+
+func newDiscHealth(dc disc.APIClient, onChange func(healthy bool, err error)) *discHealth {
+	return &discHealth{APIClient: dc, onChange: onChange}
+}
+
+// record updates the health of discovery from the result of a call.
+func (h *discHealth) record(err error) {
+	var down int32
+	switch {
+	case err == context.Canceled:
+		return // the call was abandoned by the caller, which tells nothing of discovery
+	case disc.Classify(err) == disc.ErrKindTransient:
+		down = 1
+	}
+	if atomic.SwapInt32(&h.down, down) != down && h.onChange != nil {
+		h.onChange(down == 0, err)
+	}
+}
+
+// healthy returns false if the last call to discovery failed as it could not be reached.
+func (h *discHealth) healthy() bool {
+	return atomic.LoadInt32(&h.down) == 0
+}
+
+// Entry implements disc.APIClient.
+func (h *discHealth) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	entry, err := h.APIClient.Entry(ctx, pk)
+	h.record(err)
+	return entry, err
+}
+
+// PostEntry implements disc.APIClient.
+func (h *discHealth) PostEntry(ctx context.Context, entry *disc.Entry) error {
+	err := h.APIClient.PostEntry(ctx, entry)
+	h.record(err)
+	return err
+}
+
+// PutEntry implements disc.APIClient.
+func (h *discHealth) PutEntry(ctx context.Context, sk cipher.SecKey, entry *disc.Entry) error {
+	err := h.APIClient.PutEntry(ctx, sk, entry)
+	h.record(err)
+	return err
+}
+
+// PutEntryWith implements disc.SignerPutter.
+func (h *discHealth) PutEntryWith(ctx context.Context, s disc.Signer, entry *disc.Entry) error {
+	err := disc.PutEntryWith(ctx, h.APIClient, s, entry)
+	h.record(err)
+	return err
+}
+
+// AvailableServers implements disc.APIClient.
+func (h *discHealth) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	entries, err := h.APIClient.AvailableServers(ctx)
+	h.record(err)
+	return entries, err
+}
+
+// SampleServers implements disc.ServerSampler.
+func (h *discHealth) SampleServers(ctx context.Context, n int) ([]*disc.Entry, error) {
+	entries, err := disc.SampleServers(ctx, h.APIClient, n)
+	h.record(err)
+	return entries, err
+}
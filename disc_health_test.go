@@ -0,0 +1,30 @@
+package dmsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestDiscHealth(t *testing.T) {
+	var changes []bool
+	h := newDiscHealth(disc.NewMock(0), func(healthy bool, _ error) { changes = append(changes, healthy) })
+
+	// Only transient errors mark discovery as unavailable.
+	h.record(disc.ErrUnexpected)
+	require.False(t, h.healthy())
+	h.record(context.Canceled)
+	require.False(t, h.healthy())
+	h.record(errors.New("invalid response"))
+	require.True(t, h.healthy())
+	h.record(&net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	require.False(t, h.healthy())
+	h.record(disc.ErrKeyNotFound)
+	require.True(t, h.healthy())
+	require.Equal(t, []bool{false, true, false, true}, changes)
+}
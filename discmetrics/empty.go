@@ -0,0 +1,20 @@
+package discmetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewEmpty implements Metrics, but does nothing.
+func NewEmpty() Metrics {
+	return empty{}
+}
+
+type empty struct{}
+
+func (empty) Collectors() []prometheus.Collector      { return nil }
+func (empty) RecordCall(_, _ string, _ time.Duration) {}
+func (empty) RecordCacheLookup(_ bool)                {}
+func (empty) SetStale(_ bool)                         {}
+func (empty) RecordExpiryAlarm()                      {}
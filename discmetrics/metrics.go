@@ -0,0 +1,123 @@
+package discmetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Discovery call types.
+const (
+	CallEntry            = "entry"
+	CallPostEntry        = "post_entry"
+	CallPutEntry         = "put_entry"
+	CallAvailableServers = "available_servers"
+	CallSampleServers    = "sample_servers"
+)
+
+// Discovery call outcomes.
+const (
+	OutcomeOK       = "ok"
+	OutcomeNotFound = "not_found"
+	OutcomeError    = "error"
+)
+
+// Metrics collects metrics of discovery interactions for prometheus.
+type Metrics interface {
+	Collectors() []prometheus.Collector
+	RecordCall(call, outcome string, duration time.Duration)
+	RecordCacheLookup(hit bool)
+	SetStale(stale bool)
+	RecordExpiryAlarm()
+}
+
+// New returns the default implementation of Metrics.
+func New(namespace string) Metrics {
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disc_call_total",
+		Help:      "Total number of discovery calls.",
+	}, []string{"call", "outcome"})
+	callDurations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "disc_call_duration_seconds",
+		Help:      "Duration of discovery calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "outcome"})
+	cacheHits := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disc_cache_hit_total",
+		Help:      "Total number of discovery entry cache hits.",
+	})
+	cacheMisses := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disc_cache_miss_total",
+		Help:      "Total number of discovery entry cache misses.",
+	})
+	expiryAlarms := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disc_entry_expiry_alarm_total",
+		Help:      "Total number of failed entry refreshes close to the entry's expiry.",
+	})
+	stale := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "disc_stale",
+		Help:      "Whether operating on stale discovery data (1) or not (0).",
+	})
+
+	return &metrics{
+		calls:         calls,
+		callDurations: callDurations,
+		cacheHits:     cacheHits,
+		cacheMisses:   cacheMisses,
+		expiryAlarms:  expiryAlarms,
+		stale:         stale,
+	}
+}
+
+type metrics struct {
+	calls         *prometheus.CounterVec
+	callDurations *prometheus.HistogramVec
+
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+
+	expiryAlarms prometheus.Counter
+	stale        prometheus.Gauge
+}
+
+func (m *metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.calls,
+		m.callDurations,
+		m.cacheHits,
+		m.cacheMisses,
+		m.expiryAlarms,
+		m.stale,
+	}
+}
+
+func (m *metrics) RecordCall(call, outcome string, duration time.Duration) {
+	m.calls.WithLabelValues(call, outcome).Inc()
+	m.callDurations.WithLabelValues(call, outcome).Observe(duration.Seconds())
+}
+
+func (m *metrics) RecordCacheLookup(hit bool) {
+	if hit {
+		m.cacheHits.Inc()
+	} else {
+		m.cacheMisses.Inc()
+	}
+}
+
+func (m *metrics) SetStale(stale bool) {
+	if stale {
+		m.stale.Set(1)
+	} else {
+		m.stale.Set(0)
+	}
+}
+
+func (m *metrics) RecordExpiryAlarm() {
+	m.expiryAlarms.Inc()
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -190,7 +191,11 @@ func parseOutputFile(name string, urlPath string) (*os.File, error) {
 }
 
 func (dg *DmsgGet) startDmsg(ctx context.Context, log logrus.FieldLogger, pk cipher.PubKey, sk cipher.SecKey) (dmsgC *dmsg.Client, stop func(), err error) {
-	dmsgC = dmsg.NewClient(pk, sk, disc.NewHTTP(dg.dmsgF.Disc), &dmsg.Config{MinSessions: dg.dmsgF.Sessions})
+	dc, err := disc.NewHTTPFailover(strings.Split(dg.dmsgF.Disc, ",")...)
+	if err != nil {
+		return nil, nil, err
+	}
+	dmsgC = dmsg.NewClient(pk, sk, dc, &dmsg.Config{MinSessions: dg.dmsgF.Sessions})
 	go dmsgC.Serve(context.Background())
 
 	stop = func() {
@@ -37,7 +37,8 @@ type dmsgFlags struct {
 func (f *dmsgFlags) Name() string { return "Dmsg" }
 
 func (f *dmsgFlags) Init(fs *flag.FlagSet) {
-	fs.StringVar(&f.Disc, "dmsg-disc", "http://dmsg.discovery.skywire.skycoin.com", "dmsg discovery `URL`")
+	fs.StringVar(&f.Disc, "dmsg-disc", "http://dmsg.discovery.skywire.skycoin.com",
+		"dmsg discovery `URL`s (comma-separated for failover)")
 	fs.IntVar(&f.Sessions, "dmsg-sessions", 1, "connect to `NUMBER` of dmsg servers")
 }
 
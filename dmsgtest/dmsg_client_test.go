@@ -214,3 +214,229 @@ func checkRemoteClients(t *testing.T, lc *dmsg.Client, expectedConnections int)
 	conns := lc.AllStreams()
 	require.Len(t, conns, expectedConnections)
 }
+
+func TestClient_EnsureSessions(t *testing.T) {
+	const servers = 3
+	const target = 2
+	const rounds = 5
+
+	env := NewEnv(t, DefaultTimeout)
+	require.NoError(t, env.Startup(0, servers, 0, nil))
+	t.Cleanup(env.Shutdown)
+
+	c, err := env.NewClient(&dmsg.Config{MinSessions: 1})
+	require.NoError(t, err)
+
+	// Concurrent calls should converge toward the target session count.
+	errs := make(chan error, rounds)
+	for i := 0; i < rounds; i++ {
+		go func() { errs <- c.EnsureSessions(context.TODO(), target) }()
+	}
+	for i := 0; i < rounds; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, target, c.SessionCount())
+
+	// Repeated calls should not add extra sessions.
+	require.NoError(t, c.EnsureSessions(context.TODO(), target))
+	require.Equal(t, target, c.SessionCount())
+
+	// Requesting more sessions than there are servers fails.
+	require.Equal(t, dmsg.ErrNotEnoughSessions, c.EnsureSessions(context.TODO(), servers+1))
+	require.Equal(t, servers, c.SessionCount())
+}
+
+func TestClient_EntryAfterServersDisconnect(t *testing.T) {
+	const servers = 3
+
+	env := NewEnv(t, DefaultTimeout)
+	require.NoError(t, env.Startup(0, servers, 0, nil))
+	t.Cleanup(env.Shutdown)
+
+	c, err := env.NewClient(&dmsg.Config{MinSessions: servers})
+	require.NoError(t, err)
+	require.NoError(t, c.EnsureSessions(context.TODO(), servers))
+
+	// Close two servers nearly simultaneously.
+	srvs := env.AllServers()
+	require.NoError(t, srvs[0].Close())
+	require.NoError(t, srvs[1].Close())
+	survivor := srvs[2].LocalPK()
+
+	// The final published entry should only contain the surviving server.
+	require.Eventually(t, func() bool {
+		entry, err := env.Discovery().Entry(context.TODO(), c.LocalPK())
+		if err != nil {
+			return false
+		}
+		ds := entry.Client.DelegatedServers
+		return len(ds) == 1 && ds[0] == survivor
+	}, time.Second*10, time.Millisecond*100)
+}
+
+func TestClient_DrainServer(t *testing.T) {
+	const port = uint16(80)
+
+	env := NewEnv(t, DefaultTimeout)
+	require.NoError(t, env.Startup(0, 2, 0, nil))
+	t.Cleanup(env.Shutdown)
+
+	cA, err := env.NewClient(&dmsg.Config{MinSessions: 2})
+	require.NoError(t, err)
+	cB, err := env.NewClient(&dmsg.Config{MinSessions: 2})
+	require.NoError(t, err)
+	require.NoError(t, cA.EnsureSessions(context.TODO(), 2))
+	require.NoError(t, cB.EnsureSessions(context.TODO(), 2))
+
+	lis, err := cB.Listen(port)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lis.Close()) }()
+
+	dial := func() (*dmsg.Stream, *dmsg.Stream) {
+		strA, err := cA.DialStream(context.TODO(), dmsg.Addr{PK: cB.LocalPK(), Port: port})
+		require.NoError(t, err)
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return strA, strB
+	}
+
+	// Drain the server relaying an active stream.
+	strA, strB := dial()
+	srvPK := strA.ServerPK()
+	drained := make(chan error, 1)
+	go func() { drained <- cA.DrainServer(context.TODO(), srvPK) }()
+
+	// While draining, the active stream is kept but new streams are routed through the other server.
+	time.Sleep(time.Millisecond * 300)
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned before the active stream closed: %v", err)
+	default:
+	}
+	_, err = strA.Write([]byte("still alive"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strB, make([]byte, len("still alive")))
+	require.NoError(t, err)
+
+	strA2, strB2 := dial()
+	require.NotEqual(t, srvPK, strA2.ServerPK())
+
+	// Drain completes once the active stream closes.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, <-drained)
+	_, ok := cA.Session(srvPK)
+	require.False(t, ok)
+
+	// The drained server is not reconnected to, nor advertised.
+	require.Equal(t, dmsg.ErrNotEnoughSessions, cA.EnsureSessions(context.TODO(), 2))
+	entry, err := env.Discovery().Entry(context.TODO(), cA.LocalPK())
+	require.NoError(t, err)
+	require.NotContains(t, entry.Client.DelegatedServers, srvPK)
+
+	// Draining is bounded by the context.
+	srvPK2 := strA2.ServerPK()
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*200)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, cA.DrainServer(ctx, srvPK2))
+	_, ok = cA.Session(srvPK2)
+	require.False(t, ok)
+	require.Equal(t, dmsg.ErrSessionNotFound, cA.DrainServer(context.TODO(), srvPK2))
+
+	// Undrained servers are reconnected to.
+	cA.UndrainServer(srvPK)
+	cA.UndrainServer(srvPK2)
+	require.NoError(t, cA.EnsureSessions(context.TODO(), 2))
+
+	// Servers without a session are not drained.
+	cC, err := env.NewClient(&dmsg.Config{MinSessions: 1})
+	require.NoError(t, err)
+	var srvPK3 cipher.PubKey
+	for _, pk := range []cipher.PubKey{srvPK, srvPK2} {
+		if _, ok := cC.Session(pk); !ok {
+			srvPK3 = pk
+		}
+	}
+	require.False(t, srvPK3.Null())
+	require.Equal(t, dmsg.ErrSessionNotFound, cC.DrainServer(context.TODO(), srvPK3))
+	require.NoError(t, cC.EnsureSessions(context.TODO(), 2))
+
+	// Closing logic.
+	require.NoError(t, strA2.Close())
+	require.NoError(t, strB2.Close())
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	const port = uint16(80)
+
+	env := NewEnv(t, DefaultTimeout)
+	require.NoError(t, env.Startup(0, 2, 0, nil))
+	t.Cleanup(env.Shutdown)
+
+	cA, err := env.NewClient(&dmsg.Config{MinSessions: 2})
+	require.NoError(t, err)
+	cB, err := env.NewClient(&dmsg.Config{MinSessions: 2})
+	require.NoError(t, err)
+	require.NoError(t, cA.EnsureSessions(context.TODO(), 2))
+	require.NoError(t, cB.EnsureSessions(context.TODO(), 2))
+
+	lis, err := cB.Listen(port)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lis.Close()) }()
+
+	dial := func() (*dmsg.Stream, *dmsg.Stream) {
+		strA, err := cA.DialStream(context.TODO(), dmsg.Addr{PK: cB.LocalPK(), Port: port})
+		require.NoError(t, err)
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return strA, strB
+	}
+
+	// Shut down the server relaying an active stream.
+	strA, strB := dial()
+	var srv *dmsg.Server
+	for _, s := range env.AllServers() {
+		if s.LocalPK() == strA.ServerPK() {
+			srv = s
+		}
+	}
+	require.NotNil(t, srv)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.TODO()) }()
+
+	// Clients move away from the server once notified, but keep the active stream.
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for !cond() {
+			require.True(t, time.Now().Before(deadline), "condition not satisfied in time")
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	for _, c := range []*dmsg.Client{cA, cB} {
+		c := c
+		waitFor(func() bool { _, ok := c.Session(srv.LocalPK()); return !ok })
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the active stream closed: %v", err)
+	default:
+	}
+	_, err = strA.Write([]byte("still alive"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strB, make([]byte, len("still alive")))
+	require.NoError(t, err)
+
+	// New streams are routed through the other server.
+	strA2, strB2 := dial()
+	require.NotEqual(t, srv.LocalPK(), strA2.ServerPK())
+
+	// Shutdown completes once the clients close their sessions.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, <-shutdown)
+	require.Equal(t, 0, srv.SessionCount())
+
+	// Closing logic.
+	require.NoError(t, strA2.Close())
+	require.NoError(t, strB2.Close())
+}
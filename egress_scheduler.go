@@ -0,0 +1,156 @@
+package dmsg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// egressScheduler schedules writes to a shared link across sources. Servers schedule the writes of data relayed to a
+// client, across the clients which the data is relayed from (only the egress of clients with a bandwidth limit is
+// scheduled, see throttledConn). Clients schedule the writes of their streams to a session, across the priority
+// classes of the streams (see Stream.SetPriority).
+// Under saturation (writes queue up for the link), queued writes are granted in start-time fair queuing order rather
+// than in order of arrival: each write is tagged with the virtual time at which it's source is due (the cost of the
+// bytes the source was granted so far, but no earlier than the write being served), and the write with the earliest tag
+// is granted next. Hence, each source with queued writes gets a share of bytes in inverse proportion to the cost of
+// it's priority (see Priority.cost), regardless of how fast (or over how many streams) it sends. No source is starved,
+// as the tags of the other sources advance with every write which they are granted.
+// A single write is in progress at a time, except that a write which blocks for longer than maxTurn (i.e. as the flow
+// control window of it's stream is exhausted) no longer holds up the writes of others.
+type egressScheduler struct {
+	maxTurn time.Duration
+
+	busy    bool                        // whether a turn is granted
+	vtime   uint64                      // start tag of the last granted write
+	seq     uint64                      // number of tagged writes (orders writes of equal tags by arrival)
+	sources map[egressKey]*egressSource // sources with queued writes, or which are ahead of vtime
+	mx      sync.Mutex
+}
+
+// egressKey identifies the source of writes: the client which data is relayed from (on servers), and the priority
+// class of the writes (on clients).
+type egressKey struct {
+	src  cipher.PubKey
+	prio Priority
+}
+
+// egressSource contains the queued writes of a single source.
+type egressSource struct {
+	finish uint64 // virtual time at which the last tagged write of the source finishes
+	turns  []*egressTurn
+}
+
+// egressTurn grants a single write.
+type egressTurn struct {
+	es    *egressScheduler
+	start uint64        // virtual time at which the write is due
+	seq   uint64        // order of arrival
+	ready chan struct{} // closed once granted, guarded by egressScheduler.mx
+	once  sync.Once
+}
+
+func newEgressScheduler(maxTurn time.Duration) *egressScheduler {
+	return &egressScheduler{
+		maxTurn: maxTurn,
+		sources: make(map[egressKey]*egressSource),
+	}
+}
+
+// acquire waits for the turn of a write of n bytes from the given source client with the given priority, or until done
+// is closed (in which case it returns nil). The returned turn is to be released once the write completes.
+func (es *egressScheduler) acquire(src cipher.PubKey, prio Priority, n int, done <-chan struct{}) *egressTurn {
+	key := egressKey{src: src, prio: prio}
+	es.mx.Lock()
+	s, ok := es.sources[key]
+	if !ok {
+		s = new(egressSource)
+		es.sources[key] = s
+	}
+	t := &egressTurn{es: es, start: s.finish, seq: es.seq, ready: make(chan struct{})}
+	if t.start < es.vtime {
+		t.start = es.vtime
+	}
+	s.finish = t.start + uint64(n)*prio.cost()
+	es.seq++
+
+	if !es.busy {
+		es.busy = true
+		es.grant(t)
+		es.mx.Unlock()
+		return t
+	}
+	s.turns = append(s.turns, t)
+	es.mx.Unlock()
+
+	select {
+	case <-t.ready:
+		return t
+	case <-done:
+	}
+
+	es.mx.Lock()
+	select {
+	case <-t.ready:
+		// Granted concurrently, pass the turn on.
+		es.mx.Unlock()
+		t.release()
+		return nil
+	default:
+	}
+	for i, st := range s.turns {
+		if st == t {
+			s.turns = append(s.turns[:i], s.turns[i+1:]...)
+			break
+		}
+	}
+	es.mx.Unlock()
+	return nil
+}
+
+// release passes the turn on to the next queued write. It is safe to call multiple times, and on a nil turn.
+func (t *egressTurn) release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		es := t.es
+		es.mx.Lock()
+		if next := es.pick(); next != nil {
+			es.grant(next)
+		} else {
+			es.busy = false
+		}
+		es.mx.Unlock()
+	})
+}
+
+func (es *egressScheduler) grant(t *egressTurn) {
+	es.vtime = t.start
+	close(t.ready)
+}
+
+// pick dequeues the queued write with the earliest tag (nil if there are no queued writes).
+// Sources without queued writes, which are not ahead of the virtual time, are forgotten.
+func (es *egressScheduler) pick() *egressTurn {
+	var next *egressSource
+	for src, s := range es.sources {
+		if len(s.turns) == 0 {
+			if s.finish <= es.vtime {
+				delete(es.sources, src)
+			}
+			continue
+		}
+		if next == nil || s.turns[0].start < next.turns[0].start ||
+			(s.turns[0].start == next.turns[0].start && s.turns[0].seq < next.turns[0].seq) {
+			next = s
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	t := next.turns[0]
+	next.turns = next.turns[1:]
+	return t
+}
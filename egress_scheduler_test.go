@@ -0,0 +1,119 @@
+package dmsg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+func TestEgressScheduler(t *testing.T) {
+	pkX, _ := GenKeyPair(t, "x")
+	pkY, _ := GenKeyPair(t, "y")
+	es := newEgressScheduler(time.Minute)
+
+	queued := func() int {
+		es.mx.Lock()
+		defer es.mx.Unlock()
+		n := 0
+		for _, s := range es.sources {
+			n += len(s.turns)
+		}
+		return n
+	}
+
+	order := make(chan cipher.PubKey, 8)
+	enqueue := func(src cipher.PubKey, n int) {
+		before := queued()
+		go func() {
+			turn := es.acquire(src, PriorityNormal, n, nil)
+			order <- src
+			turn.release()
+		}()
+		waitFor(t, time.Second, func() bool { return queued() == before+1 })
+	}
+	collect := func(n int) []cipher.PubKey {
+		var out []cipher.PubKey
+		for i := 0; i < n; i++ {
+			out = append(out, <-order)
+		}
+		return out
+	}
+
+	// A write without contention is granted immediately.
+	first := es.acquire(pkX, PriorityNormal, 100, nil)
+	require.NotNil(t, first)
+
+	// Queued writes are granted fairly across the sources, rather than in order of arrival.
+	for i := 0; i < 4; i++ {
+		enqueue(pkX, 100)
+	}
+	enqueue(pkY, 100)
+	enqueue(pkY, 100)
+	first.release()
+	require.Equal(t, []cipher.PubKey{pkY, pkX, pkY, pkX, pkX, pkX}, collect(6))
+
+	// Shares are in bytes, rather than in writes.
+	first = es.acquire(pkX, PriorityNormal, 100, nil)
+	enqueue(pkX, 300)
+	enqueue(pkX, 100)
+	enqueue(pkY, 100)
+	enqueue(pkY, 100)
+	enqueue(pkY, 100)
+	first.release()
+	require.Equal(t, []cipher.PubKey{pkY, pkX, pkY, pkY, pkX}, collect(5))
+
+	// Waiting for a turn is aborted once done.
+	first = es.acquire(pkX, PriorityNormal, 100, nil)
+	done := make(chan struct{})
+	close(done)
+	require.Nil(t, es.acquire(pkY, PriorityNormal, 100, done))
+	require.Zero(t, queued())
+	first.release()
+	require.NotNil(t, es.acquire(pkY, PriorityNormal, 100, done))
+}
+
+func TestEgressScheduler_Priority(t *testing.T) {
+	es := newEgressScheduler(time.Minute)
+
+	queued := func() int {
+		es.mx.Lock()
+		defer es.mx.Unlock()
+		n := 0
+		for _, s := range es.sources {
+			n += len(s.turns)
+		}
+		return n
+	}
+
+	order := make(chan Priority, 16)
+	enqueue := func(prio Priority, count int) {
+		for i := 0; i < count; i++ {
+			before := queued()
+			go func() {
+				turn := es.acquire(cipher.PubKey{}, prio, 100, nil)
+				order <- prio
+				turn.release()
+			}()
+			waitFor(t, time.Second, func() bool { return queued() == before+1 })
+		}
+	}
+
+	// Queued writes are granted in proportion to their priority (4:2:1 for high, normal and low priority), and writes
+	// of low priority are not starved by the writes of higher priority.
+	first := es.acquire(cipher.PubKey{}, PriorityNormal, 100, nil)
+	enqueue(PriorityHigh, 8)
+	enqueue(PriorityNormal, 4)
+	enqueue(PriorityLow, 2)
+	first.release()
+
+	h, n, l := PriorityHigh, PriorityNormal, PriorityLow
+	exp := []Priority{h, l, h, h, n, h, h, n, l, h, h, n, h, n}
+	got := make([]Priority, 0, len(exp))
+	for range exp {
+		got = append(got, <-order)
+	}
+	require.Equal(t, exp, got)
+}
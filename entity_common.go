@@ -3,6 +3,7 @@ package dmsg
 import (
 	"context"
 	"errors"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,14 +11,17 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
 	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/netutil"
 )
 
 // EntityCommon contains the common fields and methods for server and client entities.
 type EntityCommon struct {
 	// atomic requires 64-bit alignment for struct field access
-	lastUpdate int64 // Timestamp (in unix seconds) of last update.
+	lastUpdate     int64 // Timestamp (in unix seconds) of last update.
+	entryPublished int64 // Timestamp (in unix nano) of the last published client entry.
 
 	pk cipher.PubKey
 	sk cipher.SecKey
@@ -30,8 +34,32 @@ type EntityCommon struct {
 
 	log logrus.FieldLogger
 
-	setSessionCallback func(ctx context.Context, sessionCount int) error
-	delSessionCallback func(ctx context.Context, sessionCount int) error
+	setSessionCallback    func(ctx context.Context, sessionCount int) error
+	delSessionCallback    func(ctx context.Context, sessionCount int) error
+	entryUpdatedCallback  func(srvPKs []cipher.PubKey)
+	entryExpiringCallback func(expiry time.Time, err error)
+	entryBuilder          EntryBuilder
+	entryTTL              time.Duration      // assumed lifetime of the client entry in discovery
+	entryDebounce         time.Duration      // duration in which changes of sessions are coalesced into one publication
+	minSessions           int                // sessions with which the first client entry is published without debouncing
+	caps                  *disc.Capabilities // capabilities advertised in client entries
+	signer                disc.Signer        // optional signer of discovery entries (uses 'sk' if nil)
+
+	limiter       *connLimiter             // limits open sessions and streams (nil for no limit)
+	hsMetrics     handshakemetrics.Metrics // metrics of session and stream handshakes
+	slowHandshake time.Duration            // duration after which a handshake is logged as slow (disabled if <= 0)
+	strictSeq     bool                     // whether streams fail on frames received out of sequence
+	maxFrameSize  int                      // largest frame of signed objects read from remotes (no limit if <= 0)
+	maxViolations int                      // protocol violations tolerated per client (servers only, no limit if <= 0)
+	streamWindow  uint32                   // receive window of yamux streams (see streamWindow)
+	mem           *memoryBudget            // memory held per client (servers only)
+	cm            clientmetrics.Metrics    // metrics of the client (clients only, nil if not collected)
+	peerEntries   *entryCache              // cached client entries of peers (clients only)
+
+	publishedEntry   *disc.Entry // copy of the last published client entry
+	publishedEntryMx sync.Mutex
+
+	entryMx sync.Mutex // serializes publications of the client entry (which are not made with sessionsMx held)
 }
 
 func (c *EntityCommon) init(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, log logrus.FieldLogger, updateInterval time.Duration) {
@@ -45,6 +73,23 @@ func (c *EntityCommon) init(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClien
 	c.sessionsMx = new(sync.Mutex)
 	c.updateInterval = updateInterval
 	c.log = log
+	c.hsMetrics = handshakemetrics.NewEmpty()
+}
+
+// recordHandshake records the duration of a successful handshake which started at 'start', and logs a warning via
+// 'log' if the handshake is slow.
+func (c *EntityCommon) recordHandshake(log logrus.FieldLogger, kind string, start time.Time) {
+	d := time.Since(start)
+	c.hsMetrics.RecordHandshake(kind, d)
+	if c.cm != nil {
+		c.cm.RecordHandshake(kind, d)
+	}
+	if c.slowHandshake > 0 && d > c.slowHandshake {
+		log.WithField("handshake", kind).
+			WithField("duration", d).
+			WithField("threshold", c.slowHandshake).
+			Warn("Slow handshake.")
+	}
 }
 
 // LocalPK returns the local public key of the entity.
@@ -53,6 +98,22 @@ func (c *EntityCommon) LocalPK() cipher.PubKey { return c.pk }
 // LocalSK returns the local secret key of the entity.
 func (c *EntityCommon) LocalSK() cipher.SecKey { return c.sk }
 
+// signEntry signs the entry with the signer if set, or otherwise the secret key.
+func (c *EntityCommon) signEntry(entry *disc.Entry) error {
+	if c.signer != nil {
+		return entry.SignWith(c.signer)
+	}
+	return entry.Sign(c.sk)
+}
+
+// putEntry updates the entry in discovery, signing it with the signer if set, or otherwise the secret key.
+func (c *EntityCommon) putEntry(ctx context.Context, entry *disc.Entry) error {
+	if c.signer != nil {
+		return disc.PutEntryWith(ctx, c.dc, c.signer, entry)
+	}
+	return c.dc.PutEntry(ctx, c.sk, entry)
+}
+
 // Logger obtains the logger.
 func (c *EntityCommon) Logger() logrus.FieldLogger { return c.log }
 
@@ -89,6 +150,17 @@ func (c *EntityCommon) allClientSessions(porter *netutil.Porter) []ClientSession
 	return sessions
 }
 
+// sessionPKs returns a snapshot of the remote public keys of the sessions.
+func (c *EntityCommon) sessionPKs() []cipher.PubKey {
+	c.sessionsMx.Lock()
+	pks := make([]cipher.PubKey, 0, len(c.sessions))
+	for pk := range c.sessions {
+		pks = append(pks, pk)
+	}
+	c.sessionsMx.Unlock()
+	return pks
+}
+
 // SessionCount returns the number of sessions.
 func (c *EntityCommon) SessionCount() int {
 	c.sessionsMx.Lock()
@@ -100,7 +172,11 @@ func (c *EntityCommon) SessionCount() int {
 func (c *EntityCommon) setSession(ctx context.Context, dSes *SessionCommon) bool {
 	c.sessionsMx.Lock()
 	defer c.sessionsMx.Unlock()
+	return c.setSessionLocked(ctx, dSes)
+}
 
+// setSessionLocked is as setSession, but the lock should be held by the caller.
+func (c *EntityCommon) setSessionLocked(ctx context.Context, dSes *SessionCommon) bool {
 	if _, ok := c.sessions[dSes.RemotePK()]; ok {
 		return false
 	}
@@ -119,6 +195,13 @@ func (c *EntityCommon) setSession(ctx context.Context, dSes *SessionCommon) bool
 
 func (c *EntityCommon) delSession(ctx context.Context, pk cipher.PubKey) {
 	c.sessionsMx.Lock()
+	c.delSessionLocked(ctx, pk)
+	c.sessionsMx.Unlock()
+}
+
+// delSessionLocked deletes the session of the given remote.
+// Lock should be held by caller.
+func (c *EntityCommon) delSessionLocked(ctx context.Context, pk cipher.PubKey) {
 	delete(c.sessions, pk)
 	if c.delSessionCallback != nil {
 		if err := c.delSessionCallback(ctx, len(c.sessions)); err != nil {
@@ -128,12 +211,68 @@ func (c *EntityCommon) delSession(ctx context.Context, pk cipher.PubKey) {
 				Warn("Callback returned non-nil error.")
 		}
 	}
-	c.sessionsMx.Unlock()
+}
+
+// delSessionIfCurrent deletes the given session, only if it is still the current session to it's remote.
+// It returns true if the session is deleted.
+func (c *EntityCommon) delSessionIfCurrent(ctx context.Context, ses *SessionCommon) bool {
+	c.sessionsMx.Lock()
+	defer c.sessionsMx.Unlock()
+
+	if cur, ok := c.sessions[ses.RemotePK()]; !ok || cur != ses {
+		return false
+	}
+	c.delSessionLocked(ctx, ses.RemotePK())
+	return true
+}
+
+// setOrReplaceSession sets the given session, replacing the current session to the same remote if there is one.
+// Sessions to new remotes are only set while there are less than 'max' sessions (if 'max' is positive).
+// It returns the replaced session (nil if there is none), and whether the session is set.
+func (c *EntityCommon) setOrReplaceSession(ctx context.Context, ses *SessionCommon,
+	max int) (old *SessionCommon, ok bool) {
+	c.sessionsMx.Lock()
+	defer c.sessionsMx.Unlock()
+
+	if old, ok = c.sessions[ses.RemotePK()]; ok {
+		c.sessions[ses.RemotePK()] = ses
+		return old, true
+	}
+	if max > 0 && len(c.sessions) >= max {
+		return nil, false
+	}
+	c.sessions[ses.RemotePK()] = ses
+
+	if c.setSessionCallback != nil {
+		if err := c.setSessionCallback(ctx, len(c.sessions)); err != nil {
+			c.log.
+				WithField("func", "EntityCommon.setOrReplaceSession").
+				WithError(err).
+				Warn("Callback returned non-nil error.")
+		}
+	}
+	return nil, true
+}
+
+// replaceSession replaces the current session to the remote of the given session.
+// It returns the replaced session, or false if there is no current session.
+func (c *EntityCommon) replaceSession(ses *SessionCommon) (*SessionCommon, bool) {
+	c.sessionsMx.Lock()
+	defer c.sessionsMx.Unlock()
+
+	old, ok := c.sessions[ses.RemotePK()]
+	if !ok {
+		return nil, false
+	}
+	c.sessions[ses.RemotePK()] = ses
+	return old, true
 }
 
 // updateServerEntry updates the dmsg server's entry within dmsg discovery.
 // If 'addr' is an empty string, the Entry.addr field will not be updated in discovery.
-func (c *EntityCommon) updateServerEntry(ctx context.Context, addr string, maxSessions int) (err error) {
+// The number of sessions is read once, so 'sessionsMx' should not be held while discovery is called.
+func (c *EntityCommon) updateServerEntry(ctx context.Context, addr string, altAddrs []string, maxSessions int,
+	meta map[string]string) (err error) {
 	if addr == "" {
 		panic("updateServerEntry cannot accept empty 'addr' input") // this should never happen
 	}
@@ -145,12 +284,21 @@ func (c *EntityCommon) updateServerEntry(ctx context.Context, addr string, maxSe
 		}
 	}()
 
-	availableSessions := maxSessions - len(c.sessions)
+	availableSessions := maxSessions - c.SessionCount()
+	if availableSessions < 0 {
+		availableSessions = 0
+	}
 
 	entry, err := c.dc.Entry(ctx, c.pk)
 	if err != nil {
+		// Only create a new entry if the entry genuinely does not exist.
+		if !disc.IsNotFound(err) {
+			return err
+		}
 		entry = disc.NewServerEntry(c.pk, 0, addr, availableSessions)
-		if err := entry.Sign(c.sk); err != nil {
+		entry.Server.AltAddresses = altAddrs
+		entry.Server.Metadata = meta
+		if err := c.signEntry(entry); err != nil {
 			return err
 		}
 		return c.dc.PostEntry(ctx, entry)
@@ -162,9 +310,11 @@ func (c *EntityCommon) updateServerEntry(ctx context.Context, addr string, maxSe
 
 	sessionsDelta := entry.Server.AvailableSessions != availableSessions
 	addrDelta := entry.Server.Address != addr
+	altAddrsDelta := !sameStrings(entry.Server.AltAddresses, altAddrs)
+	metaDelta := !sameMetadata(entry.Server.Metadata, meta)
 
 	// No update needed if entry has no delta AND update is not due.
-	if _, due := c.updateIsDue(); !sessionsDelta && !addrDelta && !due {
+	if _, due := c.updateIsDue(); !sessionsDelta && !addrDelta && !altAddrsDelta && !metaDelta && !due {
 		return nil
 	}
 
@@ -177,41 +327,26 @@ func (c *EntityCommon) updateServerEntry(ctx context.Context, addr string, maxSe
 		entry.Server.Address = addr
 		log = log.WithField("addr", entry.Server.Address)
 	}
+	if altAddrsDelta {
+		entry.Server.AltAddresses = altAddrs
+		log = log.WithField("alt_addrs", entry.Server.AltAddresses)
+	}
+	if metaDelta {
+		entry.Server.Metadata = meta
+		log = log.WithField("metadata", entry.Server.Metadata)
+	}
 	log.Debug("Updating entry.")
 
-	return c.dc.PutEntry(ctx, c.sk, entry)
-}
-
-func (c *EntityCommon) updateServerEntryLoop(ctx context.Context, addr string, maxSessions int) {
-	t := time.NewTimer(c.updateInterval)
-	defer t.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-
-		case <-t.C:
-			if lastUpdate, due := c.updateIsDue(); !due {
-				t.Reset(c.updateInterval - time.Since(lastUpdate))
-				continue
-			}
-
-			c.sessionsMx.Lock()
-			err := c.updateServerEntry(ctx, addr, maxSessions)
-			c.sessionsMx.Unlock()
-
-			if err != nil {
-				c.log.WithError(err).Warn("Failed to update discovery entry.")
-			}
-
-			// Ensure we trigger another update within given 'updateInterval'.
-			t.Reset(c.updateInterval)
-		}
-	}
+	return c.putEntry(ctx, entry)
 }
 
+// updateClientEntry publishes the client entry with the current sessions as delegated servers, unless 'done' is closed.
+// The sessions are read once, so 'sessionsMx' should not be held while discovery is called. Publications are
+// serialized by 'entryMx' instead, so that they are not reordered.
 func (c *EntityCommon) updateClientEntry(ctx context.Context, done chan struct{}) (err error) {
+	c.entryMx.Lock()
+	defer c.entryMx.Unlock()
+
 	if isClosed(done) {
 		return nil
 	}
@@ -223,66 +358,237 @@ func (c *EntityCommon) updateClientEntry(ctx context.Context, done chan struct{}
 		}
 	}()
 
-	srvPKs := make([]cipher.PubKey, 0, len(c.sessions))
-	for pk := range c.sessions {
-		srvPKs = append(srvPKs, pk)
-	}
+	srvPKs := c.sessionPKs()
 
 	entry, err := c.dc.Entry(ctx, c.pk)
 	if err != nil {
+		// Only create a new entry if the entry genuinely does not exist.
+		// Otherwise, we may overwrite an existing entry because of a transient failure.
+		if !disc.IsNotFound(err) {
+			return err
+		}
 		entry = disc.NewClientEntry(c.pk, 0, srvPKs)
-		if err := entry.Sign(c.sk); err != nil {
+		entry.Client.Capabilities = c.caps
+		if entry, err = c.buildEntry(entry, false); err != nil {
 			return err
 		}
-		return c.dc.PostEntry(ctx, entry)
+		if err := c.signEntry(entry); err != nil {
+			return err
+		}
+		if err := c.dc.PostEntry(ctx, entry); err != nil {
+			return err
+		}
+		c.clientEntryUpdated(entry, srvPKs)
+		return nil
+	}
+
+	// The existing entry may not have a client section (i.e. if the same key pair runs a server).
+	// Changes are applied as targeted mutations so that all other fields are preserved.
+	if entry.Client == nil {
+		entry.Client = new(disc.Client)
 	}
 
 	// Whether the client's CURRENT delegated servers is the same as what would be advertised.
 	sameSrvPKs := cipher.SamePubKeys(srvPKs, entry.Client.DelegatedServers)
 
-	// No update is needed if delegated servers has no delta, and an entry update is not due.
-	if _, due := c.updateIsDue(); sameSrvPKs && !due {
+	// Whether the advertised capabilities are up to date.
+	sameCaps := c.caps.Equal(entry.Client.Capabilities)
+
+	// No update is needed if delegated servers and capabilities have no delta, and an entry update is not due.
+	if _, due := c.clientUpdateIsDue(); sameSrvPKs && sameCaps && !due {
 		return nil
 	}
 
 	entry.Client.DelegatedServers = srvPKs
+	entry.Client.Capabilities = c.caps
+	if entry, err = c.buildEntry(entry, true); err != nil {
+		return err
+	}
 	c.log.WithField("entry", entry).Debug("Updating entry.")
-	return c.dc.PutEntry(ctx, c.sk, entry)
+	if err := c.putEntry(ctx, entry); err != nil {
+		return err
+	}
+	c.clientEntryUpdated(entry, srvPKs)
+	return nil
+}
+
+// buildEntry applies the entry builder (if set) to the base entry, and checks that the resultant entry is still valid
+// for publication. Signing happens after this.
+func (c *EntityCommon) buildEntry(base *disc.Entry, update bool) (*disc.Entry, error) {
+	if c.entryBuilder == nil {
+		return base, nil
+	}
+	seq := base.Sequence
+	entry, err := c.entryBuilder(base)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case entry == nil, entry.Client == nil:
+		return nil, ErrEntryBuilderInvalid.Wrap(errors.New("entry has no client field"))
+	case entry.Static != c.pk:
+		return nil, ErrEntryBuilderInvalid.Wrap(errors.New("entry has unexpected static public key"))
+	case entry.Version == "":
+		return nil, ErrEntryBuilderInvalid.Wrap(errors.New("entry has no version"))
+	case update && entry.Sequence != seq:
+		// Sequence of updated entries is managed by PutEntry.
+		return nil, ErrEntryBuilderInvalid.Wrap(errors.New("sequence of updated entry was modified"))
+	}
+	return entry, nil
+}
+
+func (c *EntityCommon) clientEntryUpdated(entry *disc.Entry, srvPKs []cipher.PubKey) {
+	published := entry.Timestamp
+	if published == 0 {
+		published = time.Now().UnixNano()
+	}
+	atomic.StoreInt64(&c.entryPublished, published)
+
+	c.publishedEntryMx.Lock()
+	c.publishedEntry = new(disc.Entry)
+	disc.Copy(c.publishedEntry, entry)
+	c.publishedEntryMx.Unlock()
+
+	if c.entryUpdatedCallback != nil {
+		c.entryUpdatedCallback(srvPKs)
+	}
+}
+
+// entryExpiry returns the time in which the published client entry is assumed to expire in discovery.
+// A zero time is returned if no entry is published or entries are not assumed to expire.
+func (c *EntityCommon) entryExpiry() time.Time {
+	published := atomic.LoadInt64(&c.entryPublished)
+	if published == 0 || c.entryTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, published).Add(c.entryTTL)
+}
+
+// clientUpdateIsDue returns the time of the next due client entry update, and whether it is already due.
+// An update is due when 'updateInterval' elapses since the last update, or when 2/3 of the entry's assumed lifetime
+// elapses (whichever is first).
+func (c *EntityCommon) clientUpdateIsDue() (next time.Time, isDue bool) {
+	lastUpdate, _ := c.updateIsDue()
+	next = lastUpdate.Add(c.updateInterval)
+	if expiry := c.entryExpiry(); !expiry.IsZero() {
+		if refresh := expiry.Add(-c.entryTTL / 3); refresh.Before(next) {
+			next = refresh
+		}
+	}
+	return next, !time.Now().Before(next)
+}
+
+// checkEntryExpiry triggers the entry expiring callback if publishing the client entry failed while the entry is
+// close to expiry (within the last 1/3 of it's assumed lifetime).
+func (c *EntityCommon) checkEntryExpiry(err error) {
+	expiry := c.entryExpiry()
+	if expiry.IsZero() || time.Until(expiry) > c.entryTTL/3 {
+		return
+	}
+	c.log.WithError(err).WithField("expiry", expiry).Warn("Failed to refresh discovery entry close to expiry.")
+	if c.entryExpiringCallback != nil {
+		c.entryExpiringCallback(expiry, err)
+	}
+}
+
+// debounceEntryUpdate waits for 'entryDebounce' after an entry update is triggered, absorbing the triggers received
+// meanwhile, so that rapid successive changes of sessions are published once (with the final set of sessions).
+// The wait is not extended by further triggers, so that publications are not starved by a constant churn of sessions.
+// The first entry is published without waiting once the client has 'minSessions' sessions, so that the client is
+// reachable as soon as possible, but is not first advertised with only some of it's servers.
+// It returns false if the context is done.
+func (c *EntityCommon) debounceEntryUpdate(ctx context.Context, trigger <-chan struct{}) bool {
+	if c.entryDebounce <= 0 || (atomic.LoadInt64(&c.entryPublished) == 0 && c.SessionCount() >= c.minSessions) {
+		return true
+	}
+	t := time.NewTimer(c.entryDebounce)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-trigger:
+		case <-t.C:
+			return true
+		}
+	}
 }
 
-func (c *EntityCommon) updateClientEntryLoop(ctx context.Context, done chan struct{}) {
+// updateClientEntryLoop is the single worker which publishes the client entry.
+// A publication is performed on every signal of 'trigger' (signals received during a publication are coalesced), and
+// once the first trigger is received, whenever an update is due (see clientUpdateIsDue).
+func (c *EntityCommon) updateClientEntryLoop(ctx context.Context, done chan struct{}, trigger <-chan struct{}) {
 	t := time.NewTimer(c.updateInterval)
 	defer t.Stop()
 
+	// Periodic updates only start once the first trigger is received.
+	triggered := false
+
+	// Failed publications are retried after 'retryWait'.
+	retryWait := c.updateInterval
+	if c.entryTTL > 0 && c.entryTTL/6 < retryWait {
+		retryWait = c.entryTTL / 6
+	}
+
+	update := func() {
+		err := c.updateClientEntry(ctx, done)
+
+		wait := netutil.Jitter(retryWait, netutil.DefaultJitter)
+		if err != nil {
+			c.log.WithError(err).Warn("Failed to update discovery entry.")
+			c.checkEntryExpiry(err)
+		} else {
+			next, _ := c.clientUpdateIsDue()
+			wait = time.Until(next)
+		}
+
+		// Ensure we trigger another update when due.
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(wait)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
+		case <-trigger:
+			triggered = true
+			if !c.debounceEntryUpdate(ctx, trigger) {
+				return
+			}
+			update()
+
 		case <-t.C:
-			if lastUpdate, due := c.updateIsDue(); !due {
-				t.Reset(c.updateInterval - time.Since(lastUpdate))
+			if !triggered {
+				t.Reset(c.updateInterval)
 				continue
 			}
-
-			c.sessionsMx.Lock()
-			err := c.updateClientEntry(ctx, done)
-			c.sessionsMx.Unlock()
-
-			if err != nil {
-				c.log.WithError(err).Warn("Failed to update discovery entry.")
+			if next, due := c.clientUpdateIsDue(); !due {
+				t.Reset(time.Until(next))
+				continue
 			}
-
-			// Ensure we trigger another update within given 'updateInterval'.
-			t.Reset(c.updateInterval)
+			update()
 		}
 	}
 }
 
+// isDiscUnavailable returns true if the error reports that discovery could not be reached.
+func isDiscUnavailable(err error) bool {
+	dErr, ok := err.(Error)
+	return ok && dErr.code == ErrDiscUnavailable.code
+}
+
 func getServerEntry(ctx context.Context, dc disc.APIClient, srvPK cipher.PubKey) (*disc.Entry, error) {
 	entry, err := dc.Entry(ctx, srvPK)
 	if err != nil {
-		return nil, ErrDiscEntryNotFound
+		return nil, discEntryErr(err)
 	}
 	if entry.Server == nil {
 		return nil, ErrDiscEntryIsNotServer
@@ -293,7 +599,7 @@ func getServerEntry(ctx context.Context, dc disc.APIClient, srvPK cipher.PubKey)
 func getClientEntry(ctx context.Context, dc disc.APIClient, clientPK cipher.PubKey) (*disc.Entry, error) {
 	entry, err := dc.Entry(ctx, clientPK)
 	if err != nil {
-		return nil, ErrDiscEntryNotFound
+		return nil, discEntryErr(err)
 	}
 	if entry.Client == nil {
 		return nil, ErrDiscEntryIsNotClient
@@ -301,9 +607,33 @@ func getClientEntry(ctx context.Context, dc disc.APIClient, clientPK cipher.PubK
 	if len(entry.Client.DelegatedServers) == 0 {
 		return nil, ErrDiscEntryHasNoDelegated
 	}
+	if !compatibleCapabilities(entry.Client.Capabilities) {
+		return nil, ErrDiscEntryIncompatible
+	}
 	return entry, nil
 }
 
+// compatibleCapabilities returns true if a remote client with the given capabilities can be dialed.
+// Clients which do not advertise capabilities are treated as baseline-capability clients (which are compatible).
+func compatibleCapabilities(caps *disc.Capabilities) bool {
+	if caps == nil {
+		return true
+	}
+	return majorVersion(caps.ProtocolVersion) == majorVersion(ProtocolVersion)
+}
+
+func majorVersion(v string) string {
+	return strings.SplitN(v, ".", 2)[0]
+}
+
+// discEntryErr converts an error returned when fetching an entry from discovery.
+func discEntryErr(err error) error {
+	if disc.IsNotFound(err) {
+		return ErrDiscEntryNotFound
+	}
+	return ErrDiscUnavailable.Wrap(err)
+}
+
 /*
 	<<< Update interval helpers >>>
 */
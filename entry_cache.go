@@ -0,0 +1,135 @@
+package dmsg
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+// entryCache caches discovery entries.
+// Entries are considered fresh for the duration of 'ttl', but are kept until they are older than 'maxAge' so that they
+// can be used as a fallback when discovery is unavailable. The cache is bounded: once it holds 'max' entries, the least
+// recently used entry is evicted. A non-positive 'maxAge' or 'max' imposes no such bound.
+type entryCache struct {
+	ttl     time.Duration
+	maxAge  time.Duration
+	max     int
+	entries map[cipher.PubKey]*list.Element
+	lru     *list.List // of *cachedEntry, most recently used first
+	mx      sync.Mutex
+}
+
+type cachedEntry struct {
+	entry   *disc.Entry
+	fetched time.Time
+}
+
+func newEntryCache(ttl, maxAge time.Duration, max int) *entryCache {
+	return &entryCache{
+		ttl:     ttl,
+		maxAge:  maxAge,
+		max:     max,
+		entries: make(map[cipher.PubKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get obtains a cached entry of the given public key if it has not yet expired.
+func (c *entryCache) get(pk cipher.PubKey) (*disc.Entry, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	ce, ok := c.use(pk)
+	if !ok || time.Since(ce.fetched) > c.ttl {
+		return nil, false
+	}
+	return ce.entry, true
+}
+
+// getStale obtains a cached entry of the given public key regardless of it's age (unless it is evicted).
+func (c *entryCache) getStale(pk cipher.PubKey) (*disc.Entry, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	ce, ok := c.use(pk)
+	if !ok {
+		return nil, false
+	}
+	return ce.entry, true
+}
+
+// all obtains all cached entries regardless of their age (unless they are evicted).
+func (c *entryCache) all() []*disc.Entry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.evictOld()
+	entries := make([]*disc.Entry, 0, len(c.entries))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*cachedEntry).entry)
+	}
+	return entries
+}
+
+// put caches the given entries.
+func (c *entryCache) put(entries ...*disc.Entry) {
+	now := time.Now()
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, entry := range entries {
+		if elem, ok := c.entries[entry.Static]; ok {
+			elem.Value = &cachedEntry{entry: entry, fetched: now}
+			c.lru.MoveToFront(elem)
+			continue
+		}
+		c.entries[entry.Static] = c.lru.PushFront(&cachedEntry{entry: entry, fetched: now})
+		if c.max > 0 && len(c.entries) > c.max {
+			c.removeElem(c.lru.Back())
+		}
+	}
+}
+
+// remove removes the cached entry of the given public key.
+func (c *entryCache) remove(pk cipher.PubKey) {
+	c.mx.Lock()
+	if elem, ok := c.entries[pk]; ok {
+		c.removeElem(elem)
+	}
+	c.mx.Unlock()
+}
+
+// use returns the cached entry of the given public key, and marks it as the most recently used. An entry which is
+// older than the maximum age is evicted instead. It is called with mx locked.
+func (c *entryCache) use(pk cipher.PubKey) (*cachedEntry, bool) {
+	elem, ok := c.entries[pk]
+	if !ok {
+		return nil, false
+	}
+	ce := elem.Value.(*cachedEntry)
+	if c.maxAge > 0 && time.Since(ce.fetched) > c.maxAge {
+		c.removeElem(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return ce, true
+}
+
+// evictOld evicts the entries which are older than the maximum age. It is called with mx locked.
+func (c *entryCache) evictOld() {
+	if c.maxAge <= 0 {
+		return
+	}
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if time.Since(elem.Value.(*cachedEntry).fetched) > c.maxAge {
+			c.removeElem(elem)
+		}
+		elem = next
+	}
+}
+
+// removeElem removes the given element of the LRU list along with it's entry. It is called with mx locked.
+func (c *entryCache) removeElem(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cachedEntry).entry.Static)
+}
@@ -0,0 +1,52 @@
+package dmsg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestEntryCache(t *testing.T) {
+	entry := func(name string) *disc.Entry {
+		pk, _ := GenKeyPair(t, name)
+		return disc.NewClientEntry(pk, 0, nil)
+	}
+	a, b, c := entry("a"), entry("b"), entry("c")
+
+	// Once full, the least recently used entry is evicted.
+	cache := newEntryCache(time.Hour, time.Hour, 2)
+	cache.put(a, b)
+	_, ok := cache.get(a.Static)
+	require.True(t, ok)
+	cache.put(c)
+	_, ok = cache.getStale(b.Static)
+	require.False(t, ok)
+	require.ElementsMatch(t, []*disc.Entry{a, c}, cache.all())
+
+	// Entries are fresh within the TTL, and are used as a fallback until they exceed the maximum age.
+	cache = newEntryCache(time.Millisecond*50, time.Millisecond*200, 0)
+	cache.put(a, b, c)
+	time.Sleep(time.Millisecond * 100)
+	_, ok = cache.get(a.Static)
+	require.False(t, ok)
+	got, ok := cache.getStale(a.Static)
+	require.True(t, ok)
+	require.Equal(t, a, got)
+	time.Sleep(time.Millisecond * 150)
+	_, ok = cache.getStale(a.Static)
+	require.False(t, ok)
+	require.Empty(t, cache.all())
+	require.Empty(t, cache.entries)
+	require.Zero(t, cache.lru.Len())
+
+	// Without bounds, entries are kept.
+	cache = newEntryCache(time.Millisecond, -1, -1)
+	cache.put(a, b, c)
+	time.Sleep(time.Millisecond * 10)
+	require.Len(t, cache.all(), 3)
+	cache.remove(b.Static)
+	require.ElementsMatch(t, []*disc.Entry{a, c}, cache.all())
+}
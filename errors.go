@@ -1,8 +1,16 @@
 package dmsg
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"sync"
+
+	"github.com/skycoin/dmsg/cipher"
 )
 
 // Errors for dmsg discovery (1xx).
@@ -11,6 +19,13 @@ var (
 	ErrDiscEntryIsNotServer    = registerErr(Error{code: 101, msg: "entry is not of server in discovery"})
 	ErrDiscEntryIsNotClient    = registerErr(Error{code: 102, msg: "entry is not of client in discovery"})
 	ErrDiscEntryHasNoDelegated = registerErr(Error{code: 103, msg: "client entry in discovery has no delegated servers"})
+	ErrDiscUnavailable         = registerErr(Error{code: 104, msg: "discovery is unavailable", temp: true})
+	ErrDiscEntryIncompatible   = registerErr(Error{
+		code: 105, msg: "client entry in discovery advertises an incompatible protocol version",
+	})
+	ErrNoServersAvailable = registerErr(Error{
+		code: 106, msg: "no dmsg servers are available in discovery", temp: true,
+	})
 )
 
 // Entity Errors (2xx).
@@ -19,6 +34,52 @@ var (
 	ErrSessionClosed              = registerErr(Error{code: 201, msg: "local session closed"})
 	ErrCannotConnectToDelegated   = registerErr(Error{code: 202, msg: "cannot connect to delegated server"})
 	ErrSessionHandshakeExtraBytes = registerErr(Error{code: 203, msg: "extra bytes received during session handshake"})
+	ErrNotEnoughSessions          = registerErr(Error{
+		code: 204, msg: "not enough sessions could be established", temp: true,
+	})
+	ErrEntryBuilderInvalid = registerErr(Error{code: 205, msg: "entry builder returned an invalid entry"})
+	ErrSessionProbeTimeout = registerErr(Error{
+		code: 206, msg: "idle session did not respond to probe", timeout: true,
+	})
+	ErrServerDrained    = registerErr(Error{code: 207, msg: "server is drained"})
+	ErrSessionNotFound  = registerErr(Error{code: 208, msg: "session to server is not found"})
+	ErrServerCooldown   = registerErr(Error{code: 209, msg: "server is in failure cooldown", temp: true})
+	ErrResourceLimit    = registerErr(Error{code: 210, msg: "connection limit of client is reached", temp: true})
+	ErrServerGoAway     = registerErr(Error{code: 211, msg: "server is going away", temp: true})
+	ErrServerFull       = registerErr(Error{code: 212, msg: "server is full", temp: true})
+	ErrHandshakeTimeout = registerErr(Error{
+		code: 213, msg: "stream handshake timed out", timeout: true, temp: true,
+	})
+	ErrLinkError = registerErr(Error{
+		code: 214, msg: "link error: session connection failed on write", temp: true,
+	})
+	ErrClientTooSlow = registerErr(Error{
+		code: 215, msg: "client is too slow to receive relayed data", temp: true,
+	})
+	ErrPeerDisconnected = registerErr(Error{code: 216, msg: "remote client disconnected from server"})
+	ErrServerDraining   = registerErr(Error{code: 217, msg: "server is draining", temp: true})
+	ErrClientOverBudget = registerErr(Error{
+		code: 218, msg: "client exceeds it's memory budget at the server", temp: true,
+	})
+	ErrAccessDenied         = registerErr(Error{code: 219, msg: "client is denied access to the server"})
+	ErrCloseMessageTooLarge = registerErr(Error{code: 220, msg: "stream close message is too large"})
+	ErrStreamIdle           = registerErr(Error{code: 221, msg: "relayed stream is idle, closed by server"})
+	ErrCloseTimeout         = registerErr(Error{
+		code: 222, msg: "timed out waiting for sessions and listeners to stop on close", timeout: true,
+	})
+	ErrProtocolViolation = registerErr(Error{
+		code: 223, msg: "client violated the session protocol, disconnected by server",
+	})
+	ErrServerNotServing     = registerErr(Error{code: 224, msg: "server is not serving", temp: true})
+	ErrEntryStale           = registerErr(Error{code: 225, msg: "discovery entry of server is stale", temp: true})
+	ErrStreamBufferOverflow = registerErr(Error{
+		code: 226, msg: "client overflowed the receive buffer of a stream, disconnected by server",
+	})
+	ErrRekeyUnsupported    = registerErr(Error{code: 227, msg: "remote client does not support rekeying streams"})
+	ErrStreamFramesDropped = registerErr(Error{
+		code: 228, msg: "frames of stream violated the session protocol, dropped by server",
+	})
+	ErrSessionExists = registerErr(Error{code: 229, msg: "session to server already exists"})
 )
 
 // Errors for dial request/response (3xx).
@@ -30,7 +91,20 @@ var (
 	ErrReqInvalidSrcPort   = registerErr(Error{code: 304, msg: "request has invalid source port"})
 	ErrReqInvalidDstPort   = registerErr(Error{code: 305, msg: "request has invalid destination port"})
 	ErrReqNoListener       = registerErr(Error{code: 306, msg: "request has no associated listener", temp: true})
-	ErrReqNoNextSession    = registerErr(Error{code: 307, msg: "request cannot be forwarded because the next session is non-existent"})
+	ErrReqNoNextSession    = registerErr(Error{
+		code: 307, msg: "request cannot be forwarded because the next session is non-existent",
+	})
+	ErrReqUnauthorized   = registerErr(Error{code: 308, msg: "request initiator is not authorized", temp: true})
+	ErrReqTooManyStreams = registerErr(Error{
+		code: 309, msg: "request initiator has too many streams relayed by server", temp: true,
+	})
+	ErrFrameTooLarge   = registerErr(Error{code: 310, msg: "frame too large"})
+	ErrReqAccessDenied = registerErr(Error{
+		code: 311, msg: "request involves a client which is denied access to the server",
+	})
+	ErrReqRateLimited = registerErr(Error{
+		code: 312, msg: "request initiator exceeds it's rate limit of requests at server", temp: true,
+	})
 
 	ErrDialRespInvalidSig  = registerErr(Error{code: 350, msg: "response has invalid signature"})
 	ErrDialRespInvalidHash = registerErr(Error{code: 351, msg: "response has invalid hash of associated request"})
@@ -114,3 +188,143 @@ func (e Error) Wrap(err error) Error {
 	e.nxt = err
 	return e
 }
+
+// Unwrap returns the wrapped error (if any).
+func (e Error) Unwrap() error {
+	return e.nxt
+}
+
+// Is returns true if the target is the same dmsg error, regardless of the wrapped errors (see errors.Is).
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.code == e.code
+}
+
+// ServerSkip describes why a delegated server of a remote client was not used to dial a stream.
+type ServerSkip struct {
+	ServerPK cipher.PubKey
+	Err      error // I.e. ErrServerCooldown, ErrServerDrained, ErrReqNoNextSession, or why the session dial failed.
+}
+
+// DialError is returned when a stream cannot be dialed via any of the delegated servers of the remote client.
+// It unwraps to ErrCannotConnectToDelegated, or to the error of the last server which was not connected to the remote
+// (i.e. ErrReqNoNextSession), and details why each of the servers was skipped.
+type DialError struct {
+	Err     error
+	Skipped []ServerSkip
+}
+
+// Error implements error
+func (e *DialError) Error() string {
+	reasons := make([]string, len(e.Skipped))
+	for i, skip := range e.Skipped {
+		reasons[i] = fmt.Sprintf("%s: %v", skip.ServerPK.String()[:8], skip.Err)
+	}
+	return fmt.Sprintf("%v (skipped servers: [%s])", e.Err, strings.Join(reasons, ", "))
+}
+
+// Unwrap returns the underlying error.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// SkipReason returns why the server of the given public key was skipped, or nil if it was not.
+func (e *DialError) SkipReason(srvPK cipher.PubKey) error {
+	for _, skip := range e.Skipped {
+		if skip.ServerPK == srvPK {
+			return skip.Err
+		}
+	}
+	return nil
+}
+
+// MaxCloseMessageSize is the largest message of a stream close frame (see Stream.CloseWithCode).
+const MaxCloseMessageSize = 256
+
+// StreamCloseError is returned by reads and writes of a stream which the remote closed with Stream.CloseWithCode.
+type StreamCloseError struct {
+	Code uint16 // Application error code.
+	Msg  string // Application error message.
+}
+
+// Error implements error
+func (e *StreamCloseError) Error() string {
+	return fmt.Sprintf("stream closed by remote with code %d: %s", e.Code, e.Msg)
+}
+
+// decodeStreamCloseError decodes the payload of a stream close frame.
+func decodeStreamCloseError(payload []byte) *StreamCloseError {
+	if len(payload) < 2 {
+		return &StreamCloseError{}
+	}
+	return &StreamCloseError{
+		Code: binary.BigEndian.Uint16(payload),
+		Msg:  string(payload[2:]),
+	}
+}
+
+// DialErrorKind is the cause of a failed stream dial.
+type DialErrorKind int
+
+// Dial error kinds.
+const (
+	DialErrNone        DialErrorKind = iota // No error.
+	DialErrNoServers                        // The remote has no (dialable) entry with delegated servers in discovery.
+	DialErrUnreachable                      // No delegated server of the remote can be connected to, or relays to it.
+	DialErrTimeout                          // The stream handshake (or the dial's context) timed out.
+	DialErrRejected                         // The stream is rejected by the remote, or by the server relaying it.
+	DialErrOther                            // I.e. the dial is canceled, or the client is closed.
+)
+
+// String implements fmt.Stringer
+func (k DialErrorKind) String() string {
+	switch k {
+	case DialErrNone:
+		return "none"
+	case DialErrNoServers:
+		return "no_servers"
+	case DialErrUnreachable:
+		return "unreachable"
+	case DialErrTimeout:
+		return "timeout"
+	case DialErrRejected:
+		return "rejected"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyDialError returns the cause of the given error of a stream dial (see Client.DialStream).
+func ClassifyDialError(err error) DialErrorKind {
+	if err == nil {
+		return DialErrNone
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return DialErrTimeout
+	}
+	var dErr Error
+	if errors.As(err, &dErr) {
+		switch dErr.code {
+		case ErrDiscEntryNotFound.code, ErrDiscEntryIsNotClient.code, ErrDiscEntryHasNoDelegated.code,
+			ErrDiscEntryIncompatible.code:
+			return DialErrNoServers
+		case ErrDiscUnavailable.code, ErrCannotConnectToDelegated.code, ErrReqNoNextSession.code:
+			return DialErrUnreachable
+		case ErrHandshakeTimeout.code:
+			return DialErrTimeout
+		}
+		// Errors of dial requests and responses (3xx).
+		if dErr.code >= 300 && dErr.code < 400 {
+			return DialErrRejected
+		}
+		return DialErrOther
+	}
+	// Servers which do not reject streams to remotes which are not connected close them without a response.
+	if errors.Is(err, io.EOF) {
+		return DialErrUnreachable
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return DialErrTimeout
+	}
+	return DialErrOther
+}
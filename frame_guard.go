@@ -0,0 +1,284 @@
+package dmsg
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Kinds of protocol violations of clients, as detected by frameGuard.
+const (
+	violationDuplicateStream = "duplicate_stream" // client opened a stream with the ID of an open stream
+	violationUnknownStream   = "unknown_stream"   // client sent a frame of a stream which was never opened
+	violationBufferOverflow  = "buffer_overflow"  // client sent data beyond the receive window of a stream
+)
+
+// Flags of the directions in which a stream is half-closed (see frameGuard).
+const (
+	finIn  = 1 << 0 // closed by the client
+	finOut = 1 << 1 // closed by the server
+)
+
+// frameGuard guards the yamux session of a server against frames of a misbehaving client, which would otherwise
+// corrupt the state of it's streams. The streams which are open are tracked from the frames in both directions, and
+// frames read from the client are checked against them:
+//   - A frame which opens a stream with the ID of an open stream is dropped (along with it's body), which preserves the
+//     open stream. Yamux would otherwise terminate the whole session.
+//   - A frame of a stream which was never opened is dropped, rather than being answered by a reset from the server.
+//   - A data frame which exceeds the receive window of it's stream (as granted by the window updates of the server) is
+//     dropped. Yamux would otherwise terminate the whole session, without notifying the client why.
+//
+// The IDs of streams of which frames are dropped for being duplicate or unknown are sent on notices, for the server to
+// notify the client with a stream notice of ErrStreamFramesDropped. The notice is sent over yamux (rather than as a
+// reset frame written to the connection, which would race the writes of yamux). Each dropped frame counts as a
+// violation, and once the violations exceed the limit, exceeded is closed for the server to disconnect the client. As
+// data of the stream is lost, a frame which exceeds the receive window of it's stream closes exceeded regardless of the
+// limit.
+type frameGuard struct {
+	active map[uint32]uint8  // IDs of open streams, to the directions in which they are half-closed
+	window map[uint32]uint32 // IDs of open streams, to the data which the client may send (their receive windows)
+	maxID  [2]uint32         // highest ID of a stream opened so far, by parity of the ID
+	mx     sync.Mutex        // frames are read and written concurrently
+
+	violations uint64 // atomic
+	last       atomic.Value
+	limit      uint64 // violations which are tolerated (no limit if zero)
+	exceeded   chan struct{}
+	once       sync.Once
+	notices    chan uint32 // IDs of streams of which duplicate or unknown frames are dropped
+
+	// state of frames read from the client (frames may be split across calls of filter)
+	rHdr  [yamuxHeaderSize]byte
+	rHdrN int
+	rBody uint32
+	rDrop bool // whether the body of the current frame is dropped
+
+	// state of frames written to the client
+	wHdr  [yamuxHeaderSize]byte
+	wHdrN int
+	wBody uint32
+}
+
+// newFrameGuard creates a frameGuard which tolerates the given number of violations (no limit if <= 0).
+func newFrameGuard(limit int) *frameGuard {
+	g := &frameGuard{
+		active:   make(map[uint32]uint8),
+		window:   make(map[uint32]uint32),
+		exceeded: make(chan struct{}),
+		notices:  make(chan uint32, maxViolationNotices),
+	}
+	if limit > 0 {
+		g.limit = uint64(limit)
+	}
+	return g
+}
+
+// wrap returns the given net.Conn with the frames read from it filtered by the guard.
+func (g *frameGuard) wrap(conn net.Conn) net.Conn {
+	return &guardedConn{Conn: conn, g: g}
+}
+
+// filter appends the bytes of p which pass the guard to out, and returns the result.
+func (g *frameGuard) filter(p, out []byte) []byte {
+	for len(p) > 0 {
+		if g.rBody > 0 {
+			n := uint32(len(p))
+			if n > g.rBody {
+				n = g.rBody
+			}
+			if !g.rDrop {
+				out = append(out, p[:n]...)
+			}
+			g.rBody -= n
+			p = p[n:]
+			continue
+		}
+
+		n := copy(g.rHdr[g.rHdrN:], p)
+		g.rHdrN += n
+		p = p[n:]
+		if g.rHdrN < yamuxHeaderSize {
+			break
+		}
+		g.rHdrN = 0
+
+		typ, flags, id, length := parseYamuxHeader(g.rHdr[:])
+		g.rBody = 0
+		if typ == yamuxTypeData {
+			g.rBody = length
+		}
+		g.rDrop = !g.admit(typ, flags, id, length)
+		if !g.rDrop {
+			out = append(out, g.rHdr[:]...)
+		}
+	}
+	return out
+}
+
+// observe tracks the streams which the server opens and closes, from the bytes written to the client.
+func (g *frameGuard) observe(p []byte) {
+	for len(p) > 0 {
+		if g.wBody > 0 {
+			n := uint32(len(p))
+			if n > g.wBody {
+				n = g.wBody
+			}
+			g.wBody -= n
+			p = p[n:]
+			continue
+		}
+
+		n := copy(g.wHdr[g.wHdrN:], p)
+		g.wHdrN += n
+		p = p[n:]
+		if g.wHdrN < yamuxHeaderSize {
+			return
+		}
+		g.wHdrN = 0
+
+		typ, flags, id, length := parseYamuxHeader(g.wHdr[:])
+		if typ == yamuxTypeData {
+			g.wBody = length
+		}
+		if typ == yamuxTypeData || typ == yamuxTypeWindowUpdate {
+			g.mx.Lock()
+			g.track(flags, id, finOut)
+			if _, open := g.window[id]; open && typ == yamuxTypeWindowUpdate {
+				g.window[id] += length
+			}
+			g.mx.Unlock()
+		}
+	}
+}
+
+// admit returns true if a frame read from the client is passed on to yamux.
+func (g *frameGuard) admit(typ uint8, flags uint16, id, length uint32) bool {
+	if typ != yamuxTypeData && typ != yamuxTypeWindowUpdate {
+		return true // pings and GOAWAY frames are of the session
+	}
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	_, open := g.active[id]
+	switch {
+	case flags&yamuxFlagSYN != 0 && open:
+		g.violate(violationDuplicateStream)
+		g.notify(id)
+		return false
+	case flags&yamuxFlagSYN == 0 && !open && id > g.maxID[id%2]:
+		g.violate(violationUnknownStream)
+		g.notify(id)
+		return false
+	}
+	window, limited := g.window[id]
+	if flags&yamuxFlagSYN != 0 {
+		window, limited = yamuxInitialWindow, true
+	}
+	if typ == yamuxTypeData && limited && length > window {
+		g.violate(violationBufferOverflow)
+		g.once.Do(func() { close(g.exceeded) })
+		return false
+	}
+
+	g.track(flags, id, finIn)
+	if _, open := g.window[id]; open && typ == yamuxTypeData {
+		g.window[id] = window - length
+	}
+	return true
+}
+
+// track records the stream opened or closed by a frame, sent in the direction of fin. It is called with mx locked.
+func (g *frameGuard) track(flags uint16, id uint32, fin uint8) {
+	if flags&yamuxFlagSYN != 0 {
+		g.active[id] = 0
+		g.window[id] = yamuxInitialWindow
+		if id > g.maxID[id%2] {
+			g.maxID[id%2] = id
+		}
+	}
+	state, open := g.active[id]
+	switch {
+	case !open:
+	case flags&yamuxFlagRST != 0:
+		delete(g.active, id)
+		delete(g.window, id)
+	case flags&yamuxFlagFIN != 0:
+		if state |= fin; state == finIn|finOut {
+			delete(g.active, id)
+			delete(g.window, id)
+		} else {
+			g.active[id] = state
+		}
+	}
+}
+
+func (g *frameGuard) violate(kind string) {
+	g.last.Store(kind)
+	if n := atomic.AddUint64(&g.violations, 1); g.limit > 0 && n > g.limit {
+		g.once.Do(func() { close(g.exceeded) })
+	}
+}
+
+// notify queues a notice of dropped frames of the stream of the given ID, unless too many notices are pending.
+func (g *frameGuard) notify(id uint32) {
+	select {
+	case g.notices <- id:
+	default:
+	}
+}
+
+// count returns the number of violations so far, and the kind of the last one.
+func (g *frameGuard) count() (uint64, string) {
+	kind, _ := g.last.Load().(string) //nolint:errcheck
+	return atomic.LoadUint64(&g.violations), kind
+}
+
+// activeStreams returns the number of streams which the guard tracks as open.
+func (g *frameGuard) activeStreams() int {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	return len(g.active)
+}
+
+// parseYamuxHeader returns the type, flags, stream ID and length of a yamux frame header.
+func parseYamuxHeader(hdr []byte) (typ uint8, flags uint16, id uint32, length uint32) {
+	return hdr[1], binary.BigEndian.Uint16(hdr[2:4]), binary.BigEndian.Uint32(hdr[4:8]), binary.BigEndian.Uint32(hdr[8:12])
+}
+
+// guardedConn filters the frames read from a net.Conn with a frameGuard, and lets it observe the frames written.
+type guardedConn struct {
+	net.Conn
+	g *frameGuard
+
+	buf     []byte // bytes read from the net.Conn
+	out     []byte // bytes which passed the guard
+	pending []byte // remainder of out which is not yet read
+	rErr    error  // error of the last read, returned once pending is drained
+}
+
+func (c *guardedConn) Read(b []byte) (int, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, 32*1024)
+	}
+	for len(c.pending) == 0 {
+		if err := c.rErr; err != nil {
+			c.rErr = nil
+			return 0, err
+		}
+		n, err := c.Conn.Read(c.buf)
+		c.out = c.g.filter(c.buf[:n], c.out[:0])
+		c.pending = c.out
+		c.rErr = err
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *guardedConn) Write(b []byte) (int, error) {
+	// Streams are tracked before the frames are written, as the client may respond right after.
+	c.g.observe(b)
+	return c.Conn.Write(b)
+}
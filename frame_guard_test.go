@@ -0,0 +1,153 @@
+package dmsg
+
+import (
+	"encoding/binary"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// yamuxFrame returns a yamux frame of the given header fields and body.
+func yamuxFrame(typ uint8, flags uint16, id uint32, body []byte) []byte {
+	hdr := make([]byte, yamuxHeaderSize)
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:4], flags)
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	if typ == yamuxTypeData {
+		binary.BigEndian.PutUint32(hdr[8:12], uint32(len(body)))
+	}
+	return append(hdr, body...)
+}
+
+// TestFrameGuard_Random feeds frame guards with random sequences of frames, and checks the frames which pass, the
+// violations and the tracked streams against a model of the protocol.
+func TestFrameGuard_Random(t *testing.T) {
+	const rounds = 200
+	types := []uint8{yamuxTypeData, yamuxTypeWindowUpdate, yamuxTypePing}
+	flags := []uint16{0, 0, yamuxFlagSYN, yamuxFlagACK, yamuxFlagFIN, yamuxFlagRST, yamuxFlagSYN | yamuxFlagFIN}
+
+	for seed := int64(0); seed < rounds; seed++ {
+		rnd := mrand.New(mrand.NewSource(seed))
+		g := newFrameGuard(0)
+
+		// Model of the streams: open IDs to the directions in which they are closed, and the highest IDs by parity.
+		open := make(map[uint32]uint8)
+		var maxID [2]uint32
+		var violations uint64
+		track := func(flags uint16, id uint32, fin uint8) {
+			if flags&yamuxFlagSYN != 0 {
+				open[id] = 0
+				if id > maxID[id%2] {
+					maxID[id%2] = id
+				}
+			}
+			if _, ok := open[id]; !ok {
+				return
+			}
+			if flags&yamuxFlagRST != 0 || (flags&yamuxFlagFIN != 0 && open[id]|fin == finIn|finOut) {
+				delete(open, id)
+			} else if flags&yamuxFlagFIN != 0 {
+				open[id] |= fin
+			}
+		}
+
+		// Frames read from the client may be split at any point.
+		var in, want, out []byte
+		flush := func() {
+			for len(in) > 0 {
+				n := 1 + rnd.Intn(40)
+				if n > len(in) {
+					n = len(in)
+				}
+				out = g.filter(in[:n], out)
+				in = in[n:]
+			}
+		}
+		for i := 0; i < 100; i++ {
+			typ, fl, id := types[rnd.Intn(len(types))], flags[rnd.Intn(len(flags))], uint32(1+rnd.Intn(8))
+			if typ == yamuxTypePing {
+				id = 0
+			}
+			var body []byte
+			if typ == yamuxTypeData {
+				body = make([]byte, rnd.Intn(20))
+				rnd.Read(body) //nolint:errcheck,gosec
+			}
+			frame := yamuxFrame(typ, fl, id, body)
+
+			// Frames written by the server are only observed.
+			if typ != yamuxTypePing && rnd.Intn(3) == 0 {
+				flush()
+				g.observe(frame)
+				track(fl, id, finOut)
+				continue
+			}
+			in = append(in, frame...)
+			_, isOpen := open[id]
+			switch {
+			case typ == yamuxTypePing:
+			case fl&yamuxFlagSYN != 0 && isOpen, fl&yamuxFlagSYN == 0 && !isOpen && id > maxID[id%2]:
+				violations++
+				continue
+			default:
+				track(fl, id, finIn)
+			}
+			want = append(want, frame...)
+		}
+
+		flush()
+		require.Equal(t, want, out, seed)
+		n, _ := g.count()
+		require.Equal(t, violations, n, seed)
+		// Each violation queues a notice, unless too many are pending.
+		notices := int(violations)
+		if notices > maxViolationNotices {
+			notices = maxViolationNotices
+		}
+		require.Len(t, g.notices, notices, seed)
+		require.Len(t, g.active, len(open), seed)
+		for id, state := range open {
+			require.Equal(t, state, g.active[id], seed)
+		}
+		require.Equal(t, maxID, g.maxID, seed)
+	}
+}
+
+func TestFrameGuard_BufferOverflow(t *testing.T) {
+	g := newFrameGuard(-1)
+	windowUpdate := func(flags uint16, id, delta uint32) []byte {
+		frame := yamuxFrame(yamuxTypeWindowUpdate, flags, id, nil)
+		binary.BigEndian.PutUint32(frame[8:12], delta)
+		return frame
+	}
+	data := func(id uint32, n int) []byte {
+		return yamuxFrame(yamuxTypeData, 0, id, make([]byte, n))
+	}
+
+	// The client may fill the initial receive window of a stream.
+	in := append(windowUpdate(yamuxFlagSYN, 1, 0), data(1, yamuxInitialWindow-10)...)
+	require.Equal(t, in, g.filter(in, nil))
+	require.Equal(t, data(1, 10), g.filter(data(1, 10), nil))
+
+	// Window updates of the server grant more data.
+	g.observe(windowUpdate(0, 1, 100))
+	require.Equal(t, data(1, 100), g.filter(data(1, 100), nil))
+	n, _ := g.count()
+	require.Zero(t, n)
+
+	// Data beyond the window is dropped, and exceeds the (unlimited) violations.
+	require.Empty(t, g.filter(data(1, 1), nil))
+	n, kind := g.count()
+	require.EqualValues(t, 1, n)
+	require.Equal(t, violationBufferOverflow, kind)
+	select {
+	case <-g.exceeded:
+	default:
+		t.Fatal("exceeded is not closed")
+	}
+
+	// Windows of other streams are unaffected.
+	in = append(windowUpdate(yamuxFlagSYN, 3, 0), data(3, yamuxInitialWindow)...)
+	require.Equal(t, in, g.filter(in, nil))
+}
@@ -0,0 +1,111 @@
+package dmsg
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Header fields of yamux frames (see github.com/skycoin/yamux).
+const (
+	yamuxHeaderSize = 12
+
+	yamuxTypeData         = 0
+	yamuxTypeWindowUpdate = 1
+	yamuxTypePing         = 2
+	yamuxTypeGoAway       = 3
+
+	yamuxFlagSYN = 1 << 0
+	yamuxFlagACK = 1 << 1
+	yamuxFlagFIN = 1 << 2
+	yamuxFlagRST = 1 << 3
+
+	// yamuxInitialWindow is the receive window of a yamux stream as it is opened, before window updates.
+	yamuxInitialWindow = 256 * 1024
+)
+
+// FrameStats contains the frames of a session, counted by type. This tells a link which is busy with data apart from
+// one which thrashes on control frames.
+type FrameStats struct {
+	Read    FrameCounts `json:"read"`    // Frames received from the remote.
+	Written FrameCounts `json:"written"` // Frames sent to the remote.
+}
+
+// FrameCounts counts the frames of a session by type.
+type FrameCounts struct {
+	Request uint64 `json:"request"` // Frames which open streams, or acknowledge opened streams.
+	Data    uint64 `json:"data"`    // Frames which carry data of streams (including their stream requests and responses).
+	Close   uint64 `json:"close"`   // Frames which close or reset streams.
+	Ping    uint64 `json:"ping"`    // Pings and their responses.
+	Window  uint64 `json:"window"`  // Flow control window updates.
+	GoAway  uint64 `json:"go_away"` // Notices that the session is terminated.
+}
+
+// frameCounter counts the frames of a byte stream of yamux frames (the data read from, or written to, the net.Conn of a
+// session). Frames may be split across calls of count, which are not to be concurrent.
+type frameCounter struct {
+	counts FrameCounts // atomic
+
+	hdr  [yamuxHeaderSize]byte
+	hdrN int    // bytes of the current header obtained so far
+	body uint32 // bytes of the body of the current data frame which remain
+}
+
+// count counts the frames of p, and returns the number of frames of which the headers are completed by p.
+func (fc *frameCounter) count(p []byte) (frames int) {
+	for len(p) > 0 {
+		if fc.body > 0 {
+			n := uint32(len(p))
+			if n > fc.body {
+				n = fc.body
+			}
+			fc.body -= n
+			p = p[n:]
+			continue
+		}
+
+		n := copy(fc.hdr[fc.hdrN:], p)
+		fc.hdrN += n
+		p = p[n:]
+		if fc.hdrN < yamuxHeaderSize {
+			return frames
+		}
+		fc.hdrN = 0
+
+		typ, flags := fc.hdr[1], binary.BigEndian.Uint16(fc.hdr[2:4])
+		if typ == yamuxTypeData {
+			fc.body = binary.BigEndian.Uint32(fc.hdr[8:12])
+		}
+		atomic.AddUint64(fc.counter(typ, flags), 1)
+		frames++
+	}
+	return frames
+}
+
+// counter returns the counter of frames of the given type and flags.
+func (fc *frameCounter) counter(typ uint8, flags uint16) *uint64 {
+	switch {
+	case typ == yamuxTypePing:
+		return &fc.counts.Ping
+	case typ == yamuxTypeGoAway:
+		return &fc.counts.GoAway
+	case flags&(yamuxFlagSYN|yamuxFlagACK) != 0:
+		return &fc.counts.Request
+	case flags&(yamuxFlagFIN|yamuxFlagRST) != 0:
+		return &fc.counts.Close
+	case typ == yamuxTypeData:
+		return &fc.counts.Data
+	default:
+		return &fc.counts.Window
+	}
+}
+
+func (fc *frameCounter) get() FrameCounts {
+	return FrameCounts{
+		Request: atomic.LoadUint64(&fc.counts.Request),
+		Data:    atomic.LoadUint64(&fc.counts.Data),
+		Close:   atomic.LoadUint64(&fc.counts.Close),
+		Ping:    atomic.LoadUint64(&fc.counts.Ping),
+		Window:  atomic.LoadUint64(&fc.counts.Window),
+		GoAway:  atomic.LoadUint64(&fc.counts.GoAway),
+	}
+}
@@ -0,0 +1,40 @@
+package dmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameCounter(t *testing.T) {
+	frame := func(typ uint8, flags uint16, body []byte) []byte {
+		hdr := make([]byte, yamuxHeaderSize)
+		hdr[1] = typ
+		binary.BigEndian.PutUint16(hdr[2:4], flags)
+		binary.BigEndian.PutUint32(hdr[8:12], uint32(len(body)))
+		return append(hdr, body...)
+	}
+	var stream []byte
+	stream = append(stream, frame(yamuxTypeWindowUpdate, yamuxFlagSYN, nil)...)
+	stream = append(stream, frame(yamuxTypeData, 0, bytes.Repeat([]byte{yamuxTypePing}, 100))...)
+	stream = append(stream, frame(yamuxTypeWindowUpdate, 0, nil)...)
+	stream = append(stream, frame(yamuxTypePing, yamuxFlagSYN, nil)...)
+	stream = append(stream, frame(yamuxTypeWindowUpdate, yamuxFlagFIN, nil)...)
+	stream = append(stream, frame(yamuxTypeGoAway, 0, nil)...)
+
+	// Frames are counted regardless of how the stream is split.
+	for _, chunk := range []int{1, 5, 12, 13, len(stream)} {
+		var fc frameCounter
+		for p := stream; len(p) > 0; {
+			n := chunk
+			if n > len(p) {
+				n = len(p)
+			}
+			fc.count(p[:n])
+			p = p[n:]
+		}
+		require.Equal(t, FrameCounts{Request: 1, Data: 1, Close: 1, Ping: 1, Window: 1, GoAway: 1}, fc.get(), chunk)
+	}
+}
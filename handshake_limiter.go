@@ -0,0 +1,82 @@
+package dmsg
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// errHandshakeEvicted is returned for session handshakes which are dropped in favour of newer connections.
+var errHandshakeEvicted = errors.New("session handshake dropped in favour of a newer connection")
+
+// handshakeLimiter bounds the connections which are in the session handshake, before their clients are
+// authenticated. Once the limit is reached, the oldest pending handshake is dropped in favour of the new connection,
+// so that connections which stall their handshakes cannot keep legitimate clients out.
+type handshakeLimiter struct {
+	dropped uint64     // atomic, total number of connections dropped during their handshakes (evicted or timed out)
+	max     int        // no limit if <= 0
+	pending *list.List // of *pendingHandshake, oldest first
+	mx      sync.Mutex
+}
+
+// pendingHandshake is a connection in the session handshake.
+type pendingHandshake struct {
+	conn    net.Conn
+	elem    *list.Element
+	evicted bool // whether the connection is dropped in favour of a newer one (protected by the limiter's mx)
+}
+
+func newHandshakeLimiter(max int) *handshakeLimiter {
+	return &handshakeLimiter{max: max, pending: list.New()}
+}
+
+// begin records that the given connection starts the session handshake, and closes the connection of the oldest
+// pending handshake if the limit is exceeded.
+func (hl *handshakeLimiter) begin(conn net.Conn) *pendingHandshake {
+	ph := &pendingHandshake{conn: conn}
+
+	hl.mx.Lock()
+	ph.elem = hl.pending.PushBack(ph)
+	var oldest *pendingHandshake
+	if hl.max > 0 && hl.pending.Len() > hl.max {
+		oldest = hl.pending.Remove(hl.pending.Front()).(*pendingHandshake)
+		oldest.evicted = true
+	}
+	hl.mx.Unlock()
+
+	if oldest != nil {
+		_ = oldest.conn.Close() //nolint:errcheck
+	}
+	return ph
+}
+
+// end records that the handshake of the given connection is over, and returns whether the connection was dropped in
+// favour of a newer one.
+func (hl *handshakeLimiter) end(ph *pendingHandshake) (evicted bool) {
+	hl.mx.Lock()
+	defer hl.mx.Unlock()
+
+	if !ph.evicted {
+		hl.pending.Remove(ph.elem)
+	}
+	return ph.evicted
+}
+
+// drop counts a connection which is dropped during it's handshake.
+func (hl *handshakeLimiter) drop() {
+	atomic.AddUint64(&hl.dropped, 1)
+}
+
+// droppedCount returns the total number of connections dropped during their handshakes.
+func (hl *handshakeLimiter) droppedCount() uint64 {
+	return atomic.LoadUint64(&hl.dropped)
+}
+
+// count returns the number of pending handshakes.
+func (hl *handshakeLimiter) count() int {
+	hl.mx.Lock()
+	defer hl.mx.Unlock()
+	return hl.pending.Len()
+}
@@ -0,0 +1,47 @@
+package handshakemetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handshake kinds.
+const (
+	KindSession = "session" // noise handshake of a session between a client and a server
+	KindStream  = "stream"  // handshake of a stream between two clients (via a server)
+)
+
+// Metrics collects metrics of handshakes for prometheus.
+type Metrics interface {
+	Collectors() []prometheus.Collector
+	RecordHandshake(kind string, duration time.Duration)
+}
+
+// New returns the default implementation of Metrics.
+func New(namespace string) Metrics {
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handshake_duration_seconds",
+		Help:      "Duration of successful handshakes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	return &metrics{
+		durations: durations,
+	}
+}
+
+type metrics struct {
+	durations *prometheus.HistogramVec
+}
+
+func (m *metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.durations,
+	}
+}
+
+func (m *metrics) RecordHandshake(kind string, duration time.Duration) {
+	m.durations.WithLabelValues(kind).Observe(duration.Seconds())
+}
@@ -1,6 +1,7 @@
 package dmsg
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -9,10 +10,43 @@ import (
 	"github.com/skycoin/dmsg/netutil"
 )
 
+// AcceptPolicy determines the handling of remote-initiated streams while the accept queue of their listener is full
+// (i.e. as the application stopped calling Accept).
+type AcceptPolicy int
+
+const (
+	// AcceptDropNewest closes the incoming stream once it is established (the default).
+	AcceptDropNewest AcceptPolicy = iota
+	// AcceptDropOldest closes the longest pending stream of the queue to make room for the incoming stream.
+	AcceptDropOldest
+	// AcceptBlock waits for room in the queue. Incoming streams of the same session (to any listener) are not
+	// accepted in the meantime.
+	AcceptBlock
+	// AcceptReject rejects the incoming stream with ErrAcceptChanMaxed during it's handshake, so that the dial fails.
+	AcceptReject
+)
+
+// String implements fmt.Stringer
+func (p AcceptPolicy) String() string {
+	switch p {
+	case AcceptDropNewest:
+		return "drop-newest"
+	case AcceptDropOldest:
+		return "drop-oldest"
+	case AcceptBlock:
+		return "block"
+	case AcceptReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("AcceptPolicy(%d)", int(p))
+	}
+}
+
 // Listener listens for remote-initiated streams.
 type Listener struct {
 	porter *netutil.Porter
 	addr   Addr // local listening address
+	policy AcceptPolicy
 
 	accept chan *Stream
 	mx     sync.Mutex // protects 'accept'
@@ -22,10 +56,11 @@ type Listener struct {
 	once     sync.Once
 }
 
-func newListener(porter *netutil.Porter, addr Addr) *Listener {
+func newListener(porter *netutil.Porter, addr Addr, policy AcceptPolicy) *Listener {
 	return &Listener{
 		porter: porter,
 		addr:   addr,
+		policy: policy,
 		accept: make(chan *Stream, AcceptBufferSize),
 		done:   make(chan struct{}),
 	}
@@ -52,15 +87,42 @@ func (l *Listener) introduceStream(tp *Stream) error {
 	select {
 	case l.accept <- tp:
 		return nil
-
 	case <-l.done:
 		_ = tp.Close() //nolint:errcheck
 		return ErrEntityClosed
-
 	default:
-		_ = tp.Close() //nolint:errcheck
-		return ErrAcceptChanMaxed
 	}
+
+	// The accept queue is full.
+	switch l.policy {
+	case AcceptBlock:
+		select {
+		case l.accept <- tp:
+			return nil
+		case <-l.done:
+			_ = tp.Close() //nolint:errcheck
+			return ErrEntityClosed
+		}
+
+	case AcceptDropOldest:
+		select {
+		case old := <-l.accept:
+			_ = old.Close() //nolint:errcheck
+		default:
+		}
+		select {
+		case l.accept <- tp:
+			return nil
+		default:
+		}
+	}
+	_ = tp.Close() //nolint:errcheck
+	return ErrAcceptChanMaxed
+}
+
+// rejects returns true if an incoming stream is to be rejected during it's handshake (see AcceptReject).
+func (l *Listener) rejects() bool {
+	return l.policy == AcceptReject && len(l.accept) == cap(l.accept)
 }
 
 // Accept accepts a connection.
@@ -75,16 +137,59 @@ func (l *Listener) AcceptStream() (*Stream, error) {
 		if !ok {
 			return nil, ErrEntityClosed
 		}
+		return l.reserveStream(tp), nil
 
-		if ok, closeFn := l.porter.ReserveChild(tp.lAddr.Port, tp.rAddr.Port, tp); ok {
-			tp.close = closeFn
-		}
+	case <-l.done:
+		return nil, ErrEntityClosed
+	}
+}
 
-		return tp, nil
+// AcceptBatch accepts up to 'max' stream connections in one call.
+// It blocks until at least one stream is pending (or the context is done), and then drains further pending streams
+// without blocking.
+func (l *Listener) AcceptBatch(ctx context.Context, max int) ([]*Stream, error) {
+	if max < 1 {
+		max = 1
+	}
+
+	var tp *Stream
+	select {
+	case s, ok := <-l.accept:
+		if !ok {
+			return nil, ErrEntityClosed
+		}
+		tp = s
 
 	case <-l.done:
 		return nil, ErrEntityClosed
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	tps := make([]*Stream, 0, max)
+	tps = append(tps, l.reserveStream(tp))
+
+	for len(tps) < max {
+		select {
+		case tp, ok := <-l.accept:
+			if !ok {
+				return tps, nil
+			}
+			tps = append(tps, l.reserveStream(tp))
+		default:
+			return tps, nil
+		}
+	}
+	return tps, nil
+}
+
+// reserveStream reserves the local port of an accepted stream.
+func (l *Listener) reserveStream(tp *Stream) *Stream {
+	if ok, closeFn := l.porter.ReserveChild(tp.lAddr.Port, tp.rAddr.Port, tp); ok {
+		tp.setClose(closeFn)
 	}
+	return tp
 }
 
 // Close closes the listener.
@@ -104,13 +209,16 @@ func (l *Listener) close() (closed bool) {
 			doneFunc()
 		}
 
+		// Closing 'done' first releases introduceStream calls blocked on a full queue (see AcceptBlock).
+		close(l.done)
+
 		l.mx.Lock()
 		defer l.mx.Unlock()
 
-		close(l.done)
 		for {
 			select {
-			case <-l.accept:
+			case tp := <-l.accept:
+				_ = tp.Close() //nolint:errcheck
 			default:
 				close(l.accept)
 				return
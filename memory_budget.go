@@ -0,0 +1,224 @@
+package dmsg
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// MemoryPolicy determines the handling of a client which exceeds it's memory budget at a server (see
+// ServerConfig.ClientMemoryBudget).
+type MemoryPolicy int
+
+const (
+	// MemoryBackpressure delays reading frames from the client, and relaying data to the client, until memory held for
+	// the client is released (the default). Relayed streams of the client's peers are paused in the meantime, so a
+	// stream which the client does not read may hold up it's other streams (until it is detected as a slow client).
+	MemoryBackpressure MemoryPolicy = iota
+	// MemoryDisconnect disconnects the client with a GOAWAY notice of ErrClientOverBudget.
+	MemoryDisconnect
+)
+
+// String implements fmt.Stringer
+func (p MemoryPolicy) String() string {
+	switch p {
+	case MemoryBackpressure:
+		return "backpressure"
+	case MemoryDisconnect:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("MemoryPolicy(%d)", int(p))
+	}
+}
+
+// MemoryStats contains the memory held by a server for it's clients, in bytes.
+type MemoryStats struct {
+	Clients      map[cipher.PubKey]int64 `json:"clients"`       // Memory held per client (omitted if none).
+	Total        int64                   `json:"total"`         // Memory held for all clients.
+	Peak         int64                   `json:"peak"`          // Highest memory held for all clients.
+	ClientBudget int64                   `json:"client_budget"` // Budget of a single client (0 for unlimited).
+	TotalBudget  int64                   `json:"total_budget"`  // Budget of all clients (0 for unlimited).
+	Exceeded     uint64                  `json:"exceeded"`      // Number of times a client exceeded it's budget.
+}
+
+// memoryBudget accounts the memory held by a server for each client: frames read from the client, and relayed data
+// which is read from the client's peers but not yet written to the client. A reservation which exceeds the budget of
+// a client is either delayed or refused (see MemoryPolicy). A reservation of a client which holds no granted memory is
+// always granted, so that a budget smaller than a single reservation does not stall the client.
+// Delayed reservations are accounted while they wait (the memory is held by their callers), but they do not count
+// against the budget of other reservations, so that waiting reservations do not block each other.
+// The total budget is not enforced on reservations, but new clients are refused while it is exhausted.
+type memoryBudget struct {
+	perClient int64 // non-positive for unlimited
+	total     int64 // non-positive for unlimited
+	policy    MemoryPolicy
+	onExceed  func(pk cipher.PubKey) // called once a reservation is refused (MemoryDisconnect only)
+
+	usage    map[cipher.PubKey]int64 // granted reservations
+	waiting  map[cipher.PubKey]int64 // delayed reservations
+	sum      int64                   // granted and delayed reservations of all clients
+	peak     int64
+	exceeded uint64
+	released chan struct{} // closed (and replaced) once memory is released
+	mx       sync.Mutex
+}
+
+func newMemoryBudget(perClient, total int64, policy MemoryPolicy, onExceed func(pk cipher.PubKey)) *memoryBudget {
+	return &memoryBudget{
+		perClient: perClient,
+		total:     total,
+		policy:    policy,
+		onExceed:  onExceed,
+		usage:     make(map[cipher.PubKey]int64),
+		waiting:   make(map[cipher.PubKey]int64),
+		released:  make(chan struct{}),
+	}
+}
+
+// reserve reserves n bytes for the given client. If the client's budget would be exceeded, it either waits for memory
+// of the client to be released (or for done to close), or refuses the reservation (depending on the policy).
+// It returns false if the reservation is not granted.
+func (mb *memoryBudget) reserve(pk cipher.PubKey, n int, done <-chan struct{}) bool {
+	mb.mx.Lock()
+	if !mb.fits(pk, n) {
+		mb.exceeded++
+		if mb.policy == MemoryDisconnect {
+			mb.mx.Unlock()
+			if mb.onExceed != nil {
+				mb.onExceed(pk)
+			}
+			return false
+		}
+		mb.waiting[pk] += int64(n)
+		mb.add(int64(n))
+		for !mb.fits(pk, n) {
+			released := mb.released
+			mb.mx.Unlock()
+
+			select {
+			case <-released:
+			case <-done:
+				mb.mx.Lock()
+				mb.unwait(pk, n)
+				mb.add(-int64(n))
+				mb.mx.Unlock()
+				return false
+			}
+			mb.mx.Lock()
+		}
+		mb.unwait(pk, n)
+		mb.add(-int64(n))
+	}
+	mb.usage[pk] += int64(n)
+	mb.add(int64(n))
+	mb.mx.Unlock()
+	return true
+}
+
+// fits returns true if a reservation of n bytes for the given client is within it's budget.
+func (mb *memoryBudget) fits(pk cipher.PubKey, n int) bool {
+	used := mb.usage[pk]
+	return mb.perClient <= 0 || used == 0 || used+int64(n) <= mb.perClient
+}
+
+func (mb *memoryBudget) unwait(pk cipher.PubKey, n int) {
+	if mb.waiting[pk] -= int64(n); mb.waiting[pk] <= 0 {
+		delete(mb.waiting, pk)
+	}
+}
+
+// add adds n bytes to the memory held for all clients.
+func (mb *memoryBudget) add(n int64) {
+	if mb.sum += n; mb.sum > mb.peak {
+		mb.peak = mb.sum
+	}
+}
+
+// release releases n bytes reserved for the given client.
+func (mb *memoryBudget) release(pk cipher.PubKey, n int) {
+	if n <= 0 {
+		return
+	}
+	mb.mx.Lock()
+	if mb.usage[pk] -= int64(n); mb.usage[pk] <= 0 {
+		delete(mb.usage, pk)
+	}
+	mb.sum -= int64(n)
+	close(mb.released)
+	mb.released = make(chan struct{})
+	mb.mx.Unlock()
+}
+
+// exhausted returns true if the memory held for all clients reaches the total budget.
+func (mb *memoryBudget) exhausted() bool {
+	mb.mx.Lock()
+	defer mb.mx.Unlock()
+	return mb.total > 0 && mb.sum >= mb.total
+}
+
+func (mb *memoryBudget) stats() MemoryStats {
+	mb.mx.Lock()
+	defer mb.mx.Unlock()
+
+	clients := make(map[cipher.PubKey]int64, len(mb.usage))
+	for pk, n := range mb.usage {
+		clients[pk] = n
+	}
+	for pk, n := range mb.waiting {
+		clients[pk] += n
+	}
+	return MemoryStats{
+		Clients:      clients,
+		Total:        mb.sum,
+		Peak:         mb.peak,
+		ClientBudget: mb.perClient,
+		TotalBudget:  mb.total,
+		Exceeded:     mb.exceeded,
+	}
+}
+
+// budgetedConn accounts the data read from a relayed stream against the budget of the client which it is relayed to.
+// The data is held until it is written to the client, which is once the next read begins (as relays copy the data of
+// each direction sequentially), or the conn is closed. A read returns once the data is granted, so that no further data
+// is read from the stream in the meantime.
+type budgetedConn struct {
+	io.ReadWriteCloser
+	mb   *memoryBudget
+	peer cipher.PubKey // client which the read data is relayed to
+	held int64         // atomic, bytes read which are not yet released
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newBudgetedConn(rwc io.ReadWriteCloser, mb *memoryBudget, peer cipher.PubKey) *budgetedConn {
+	return &budgetedConn{ReadWriteCloser: rwc, mb: mb, peer: peer, done: make(chan struct{})}
+}
+
+func (bc *budgetedConn) Read(p []byte) (int, error) {
+	bc.mb.release(bc.peer, int(atomic.SwapInt64(&bc.held, 0)))
+	n, err := bc.ReadWriteCloser.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+	if !bc.mb.reserve(bc.peer, n, bc.done) {
+		return 0, ErrClientOverBudget
+	}
+	atomic.StoreInt64(&bc.held, int64(n))
+	// Data read concurrently with Close is released here.
+	if isClosed(bc.done) {
+		bc.mb.release(bc.peer, int(atomic.SwapInt64(&bc.held, 0)))
+	}
+	return n, err
+}
+
+func (bc *budgetedConn) Close() error {
+	bc.once.Do(func() {
+		close(bc.done)
+		bc.mb.release(bc.peer, int(atomic.SwapInt64(&bc.held, 0)))
+	})
+	return bc.ReadWriteCloser.Close()
+}
@@ -0,0 +1,230 @@
+package dmsg
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/servermetrics"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	pkX, _ := GenKeyPair(t, "x")
+	pkY, _ := GenKeyPair(t, "y")
+
+	// The first reservation of a client is granted regardless of the budget.
+	mb := newMemoryBudget(100, 150, MemoryBackpressure, nil)
+	require.True(t, mb.reserve(pkX, 200, nil))
+	require.True(t, mb.exhausted())
+	mb.release(pkX, 200)
+	require.False(t, mb.exhausted())
+
+	// Reservations exceeding the budget wait for memory of the client to be released.
+	require.True(t, mb.reserve(pkX, 60, nil))
+	require.True(t, mb.reserve(pkY, 60, nil))
+	granted := make(chan bool, 1)
+	go func() { granted <- mb.reserve(pkX, 60, nil) }()
+	waitFor(t, time.Second, func() bool { return mb.stats().Exceeded == 1 })
+	mb.release(pkY, 60)
+	select {
+	case <-granted:
+		t.Fatal("reservation is granted by memory of another client")
+	case <-time.After(time.Millisecond * 50):
+	}
+	mb.release(pkX, 60)
+	require.True(t, <-granted)
+
+	// Waiting is aborted once done.
+	done := make(chan struct{})
+	close(done)
+	require.False(t, mb.reserve(pkX, 60, done))
+
+	stats := mb.stats()
+	require.Equal(t, map[cipher.PubKey]int64{pkX: 60}, stats.Clients)
+	require.EqualValues(t, 60, stats.Total)
+	require.EqualValues(t, 200, stats.Peak)
+	require.EqualValues(t, 100, stats.ClientBudget)
+	require.EqualValues(t, 150, stats.TotalBudget)
+	require.EqualValues(t, 2, stats.Exceeded)
+
+	// Reservations exceeding the budget are refused with the disconnect policy.
+	var exceeded []cipher.PubKey
+	mb = newMemoryBudget(100, 0, MemoryDisconnect, func(pk cipher.PubKey) { exceeded = append(exceeded, pk) })
+	require.True(t, mb.reserve(pkX, 60, nil))
+	require.False(t, mb.reserve(pkX, 60, nil))
+	require.True(t, mb.reserve(pkY, 60, nil))
+	require.Equal(t, []cipher.PubKey{pkX}, exceeded)
+	require.False(t, mb.exhausted())
+}
+
+func TestServer_MemoryBudget(t *testing.T) {
+	// Data which two relayed streams hold at once exceeds the budget, regardless of how the data is read in chunks (a
+	// client's first reservation is granted regardless of the budget).
+	const budget = 1
+	const size = 1 << 20
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.ClientMemoryBudget = budget
+	srvConf.TotalMemoryBudget = 1
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	var connsA, connsB []*Stream
+	for i := 0; i < 2; i++ {
+		connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		connB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		connsA, connsB = append(connsA, connA), append(connsB, connB)
+	}
+
+	// Client B does not read, so the data relayed to it is held back by it's budget: a single read (of up to a relay
+	// buffer) is held, and the read of the other stream waits.
+	for _, connA := range connsA {
+		go func(connA *Stream) { _, _ = connA.Write(make([]byte, size)) }(connA) //nolint:errcheck
+	}
+	waitFor(t, time.Second*10, func() bool { return srv.MemoryStats().Exceeded > 0 })
+	stats := srv.MemoryStats()
+	require.LessOrEqual(t, stats.Clients[clientB.LocalPK()], int64(2*relayBufferSize))
+	require.Equal(t, stats.Clients[clientB.LocalPK()], stats.Total)
+
+	// New clients are rejected while the total budget is exhausted.
+	clientC := newClient("client_C")
+	waitFor(t, time.Second*5, func() bool { return atomic.LoadInt64(&m.budgetRejected) > 0 })
+	require.NoError(t, clientC.Close())
+
+	// The held data is relayed once client B reads.
+	errCh := make(chan error, len(connsB))
+	for _, connB := range connsB {
+		go func(connB *Stream) {
+			_, err := io.ReadFull(connB, make([]byte, size))
+			errCh <- err
+		}(connB)
+	}
+	for range connsB {
+		require.NoError(t, <-errCh)
+	}
+
+	// Memory is released once the streams are closed.
+	for i := range connsA {
+		require.NoError(t, connsA[i].Close())
+		require.NoError(t, connsB[i].Close())
+	}
+	waitFor(t, time.Second*5, func() bool { return srv.MemoryStats().Total == 0 })
+	require.Empty(t, srv.MemoryStats().Clients)
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_MemoryDisconnect(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.ClientMemoryBudget = 1 // exceeded by data which two relayed streams hold at once
+	srvConf.MemoryPolicy = MemoryDisconnect
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+	sesB, ok := clientB.Session(pkSrv)
+	require.True(t, ok)
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	var conns []*Stream
+	for i := 0; i < 2; i++ {
+		connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		connB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		conns = append(conns, connA, connB)
+	}
+
+	// Client B does not read, so it exceeds it's budget and is disconnected with the reason.
+	for i := 0; i < len(conns); i += 2 {
+		go func(connA *Stream) { _, _ = connA.Write(make([]byte, 1<<20)) }(conns[i]) //nolint:errcheck
+	}
+	select {
+	case <-sesB.goAway:
+		require.Equal(t, ErrClientOverBudget, sesB.goAwayErr)
+	case <-time.After(time.Second * 10):
+		t.Fatal("client exceeding it's budget was not sent a GOAWAY notice")
+	}
+	waitFor(t, time.Second*10, func() bool {
+		_, ok := srv.serverSession(clientB.LocalPK())
+		return !ok
+	})
+	_, ok = srv.serverSession(clientA.LocalPK())
+	require.True(t, ok)
+
+	// Closing logic.
+	for _, conn := range conns {
+		_ = conn.Close() //nolint:errcheck
+	}
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
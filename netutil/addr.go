@@ -0,0 +1,65 @@
+package netutil
+
+import (
+	"net"
+)
+
+// privateNets are the IP ranges reserved for private networks (RFC 1918 and RFC 4193).
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
+// IsPrivateIP returns whether the IP is within a range reserved for private networks.
+func IsPrivateIP(ip net.IP) bool {
+	for _, ipNet := range privateNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicIP picks a global unicast IP of the given interface addresses (as of net.InterfaceAddrs), which can be
+// advertised to remotes. Public IPs are preferred over private ones, and IPv4 over IPv6.
+// False is returned if there are no global unicast IPs.
+func PublicIP(addrs []net.Addr) (net.IP, bool) {
+	var best net.IP
+	rank := func(ip net.IP) int {
+		r := 0
+		if !IsPrivateIP(ip) {
+			r += 2
+		}
+		if ip.To4() != nil {
+			r++
+		}
+		return r
+	}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		default:
+			continue
+		}
+		if !ip.IsGlobalUnicast() {
+			continue
+		}
+		if best == nil || rank(ip) > rank(best) {
+			best = ip
+		}
+	}
+	return best, best != nil
+}
@@ -0,0 +1,36 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicIP(t *testing.T) {
+	ipNet := func(ip string) net.Addr { return &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)} }
+
+	cases := []struct {
+		name  string
+		addrs []net.Addr
+		want  string
+	}{
+		{"none", nil, ""},
+		{"loopback and link-local", []net.Addr{ipNet("127.0.0.1"), ipNet("::1"), ipNet("fe80::1")}, ""},
+		{"private", []net.Addr{ipNet("127.0.0.1"), ipNet("192.168.1.2")}, "192.168.1.2"},
+		{"public over private", []net.Addr{ipNet("10.0.0.2"), ipNet("2001:db8::1"), ipNet("172.16.0.2")}, "2001:db8::1"},
+		{"ipv4 over ipv6", []net.Addr{ipNet("2001:db8::1"), ipNet("203.0.113.5"), ipNet("fd00::1")}, "203.0.113.5"},
+		{"ip addr", []net.Addr{&net.IPAddr{IP: net.ParseIP("198.51.100.7")}}, "198.51.100.7"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, ok := PublicIP(tc.addrs)
+			if tc.want == "" {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tc.want, ip.String())
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package netutil
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DefaultJitter is the default fraction of a backoff which is randomized.
+const DefaultJitter = 0.5
+
+// BackoffConfig configures an exponential backoff with jitter.
+type BackoffConfig struct {
+	Initial time.Duration // Backoff before the first retry.
+	Max     time.Duration // Maximum backoff (before jitter), if 0 the backoff is unbounded.
+	Factor  float64       // Multiplier of the backoff that is applied on every retry.
+	Jitter  float64       // Fraction of each backoff which is randomized, within [0, 1].
+}
+
+// DefaultBackoffConfig returns the default BackoffConfig.
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		Initial: DefaultInitBackoff,
+		Max:     DefaultMaxBackoff,
+		Factor:  DefaultFactor,
+		Jitter:  DefaultJitter,
+	}
+}
+
+// Ensure fills unset fields with default values, and clamps out of range values.
+func (bc *BackoffConfig) Ensure() {
+	if bc.Initial <= 0 {
+		bc.Initial = DefaultInitBackoff
+	}
+	if bc.Max < 0 {
+		bc.Max = 0
+	}
+	if bc.Factor < 1 {
+		bc.Factor = DefaultFactor
+	}
+	if bc.Jitter < 0 {
+		bc.Jitter = 0
+	}
+	if bc.Jitter > 1 {
+		bc.Jitter = 1
+	}
+}
+
+// Backoff produces successive backoff durations of an exponential backoff with jitter.
+// Jitter ensures that independent nodes which started retrying at the same time do not stay synchronized.
+// It is not thread-safe.
+type Backoff struct {
+	conf BackoffConfig
+	cur  time.Duration
+}
+
+// NewBackoff creates a Backoff from the given config.
+func NewBackoff(conf BackoffConfig) *Backoff {
+	conf.Ensure()
+	return &Backoff{conf: conf, cur: conf.Initial}
+}
+
+// Next returns the next backoff duration, which is within [b*(1-Jitter), b] where b is the current backoff.
+func (b *Backoff) Next() time.Duration {
+	d := b.cur
+	if b.cur = time.Duration(float64(b.cur) * b.conf.Factor); b.conf.Max > 0 && b.cur > b.conf.Max {
+		b.cur = b.conf.Max
+	}
+	return Jitter(d, b.conf.Jitter)
+}
+
+// Reset restarts the backoff from the initial duration.
+func (b *Backoff) Reset() {
+	b.cur = b.conf.Initial
+}
+
+// Wait blocks for the next backoff duration, or until the context is done.
+func (b *Backoff) Wait(ctx context.Context) error {
+	t := time.NewTimer(b.Next())
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Jitter returns a random duration within [d*(1-frac), d].
+func Jitter(d time.Duration, frac float64) time.Duration {
+	if spread := int64(float64(d) * frac); spread > 0 {
+		return d - time.Duration(rand.Int63n(spread+1)) // nolint:gosec
+	}
+	return d
+}
@@ -0,0 +1,73 @@
+package netutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitter(t *testing.T) {
+	const d = time.Second
+
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		j := Jitter(d, 0.5)
+		require.True(t, j >= d/2 && j <= d, j)
+		seen[j] = struct{}{}
+	}
+	require.True(t, len(seen) > 1, "jitter should be applied")
+
+	require.Equal(t, d, Jitter(d, 0))
+	require.Equal(t, time.Duration(0), Jitter(0, 0.5))
+}
+
+func TestBackoff(t *testing.T) {
+	conf := BackoffConfig{
+		Initial: time.Millisecond * 100,
+		Max:     time.Millisecond * 500,
+		Factor:  2,
+		Jitter:  0.5,
+	}
+
+	t.Run("intervals_within_bounds", func(t *testing.T) {
+		bo := NewBackoff(conf)
+		for _, max := range []time.Duration{100, 200, 400, 500, 500, 500} {
+			max *= time.Millisecond
+			d := bo.Next()
+			require.True(t, d >= max/2 && d <= max, "expected %s within [%s, %s]", d, max/2, max)
+		}
+
+		bo.Reset()
+		d := bo.Next()
+		require.True(t, d >= conf.Initial/2 && d <= conf.Initial, d)
+	})
+
+	t.Run("no_jitter", func(t *testing.T) {
+		conf := conf
+		conf.Jitter = 0
+		bo := NewBackoff(conf)
+		require.Equal(t, time.Millisecond*100, bo.Next())
+		require.Equal(t, time.Millisecond*200, bo.Next())
+	})
+
+	t.Run("wait_respects_context", func(t *testing.T) {
+		conf := conf
+		conf.Initial = time.Hour
+		bo := NewBackoff(conf)
+
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*50)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, bo.Wait(ctx))
+	})
+
+	t.Run("ensure_defaults", func(t *testing.T) {
+		var conf BackoffConfig
+		conf.Jitter = 2
+		conf.Ensure()
+		require.Equal(t, DefaultInitBackoff, conf.Initial)
+		require.Equal(t, DefaultFactor, conf.Factor)
+		require.Equal(t, float64(1), conf.Jitter)
+	})
+}
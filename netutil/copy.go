@@ -4,6 +4,15 @@ import (
 	"io"
 )
 
+// BufferPool provides the buffers which data is copied through (see CopyReadWriteCloserPooled).
+type BufferPool interface {
+	// Get obtains a buffer.
+	Get() []byte
+	// Put gives back a buffer once the copy through it stops. The error of the write which stopped the copy is given
+	// (nil if the copy stopped on read), as a failed write may still reference the buffer.
+	Put(buf []byte, writeErr error)
+}
+
 // CopyReadWriteCloser copies reads and writes between two connections.
 // It returns when a connection returns an error.
 func CopyReadWriteCloser(conn1, conn2 io.ReadWriteCloser) error {
@@ -21,6 +30,31 @@ func CopyReadWriteCloser(conn1, conn2 io.ReadWriteCloser) error {
 		close(errCh2)
 	}()
 
+	return awaitCopies(conn1, conn2, errCh1, errCh2)
+}
+
+// CopyReadWriteCloserPooled is as CopyReadWriteCloser, but each direction copies through a buffer of the given pool
+// (rather than allocating one).
+func CopyReadWriteCloserPooled(conn1, conn2 io.ReadWriteCloser, pool BufferPool) error {
+	copyPooled := func(dst io.Writer, src io.Reader, errCh chan<- error) {
+		buf := pool.Get()
+		writeErr, err := copyBuffer(dst, src, buf)
+		pool.Put(buf, writeErr)
+		errCh <- err
+		close(errCh)
+	}
+
+	errCh1 := make(chan error, 1)
+	go copyPooled(conn2, conn1, errCh1)
+
+	errCh2 := make(chan error, 1)
+	go copyPooled(conn1, conn2, errCh2)
+
+	return awaitCopies(conn1, conn2, errCh1, errCh2)
+}
+
+// awaitCopies closes both connections once a direction stops, and returns it's error once both directions stop.
+func awaitCopies(conn1, conn2 io.Closer, errCh1, errCh2 <-chan error) error {
 	select {
 	case err := <-errCh1:
 		_ = conn1.Close() //nolint:errcheck
@@ -34,3 +68,26 @@ func CopyReadWriteCloser(conn1, conn2 io.ReadWriteCloser) error {
 		return err
 	}
 }
+
+// copyBuffer copies from src to dst through buf until either fails (as io.CopyBuffer, except that the buffer is always
+// used). It returns nil once src is exhausted, and also returns the error if it is of a write.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (writeErr, err error) {
+	for {
+		nr, rErr := src.Read(buf)
+		if nr > 0 {
+			nw, wErr := dst.Write(buf[:nr])
+			if wErr == nil && nw != nr {
+				wErr = io.ErrShortWrite
+			}
+			if wErr != nil {
+				return wErr, wErr
+			}
+		}
+		if rErr == io.EOF {
+			return nil, nil
+		}
+		if rErr != nil {
+			return nil, rErr
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package netutil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPool records the buffers given back to it.
+type recordingPool struct {
+	gets int
+	puts []error
+	mx   sync.Mutex
+}
+
+func (p *recordingPool) Get() []byte {
+	p.mx.Lock()
+	p.gets++
+	p.mx.Unlock()
+	return make([]byte, 8)
+}
+
+func (p *recordingPool) Put(_ []byte, writeErr error) {
+	p.mx.Lock()
+	p.puts = append(p.puts, writeErr)
+	p.mx.Unlock()
+}
+
+// failingWriteConn fails all writes.
+type failingWriteConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingWriteConn) Write([]byte) (int, error) { return 0, c.err }
+
+func TestCopyReadWriteCloserPooled(t *testing.T) {
+	t.Run("copies through pooled buffers", func(t *testing.T) {
+		a1, a2 := net.Pipe()
+		b1, b2 := net.Pipe()
+		pool := new(recordingPool)
+		errCh := make(chan error, 1)
+		go func() { errCh <- CopyReadWriteCloserPooled(a2, b1, pool) }()
+
+		// The message is larger than the buffers.
+		msg := []byte("hello, pooled world")
+		go func() {
+			_, _ = a1.Write(msg) //nolint:errcheck
+		}()
+		got := make([]byte, len(msg))
+		_, err := io.ReadFull(b2, got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+
+		require.NoError(t, a1.Close())
+		require.NoError(t, <-errCh)
+		require.Equal(t, 2, pool.gets)
+		require.Equal(t, []error{nil, nil}, pool.puts)
+	})
+
+	t.Run("gives back the error of a failed write", func(t *testing.T) {
+		a1, a2 := net.Pipe()
+		b1, _ := net.Pipe()
+		wErr := errors.New("write failed")
+		pool := new(recordingPool)
+		errCh := make(chan error, 1)
+		go func() { errCh <- CopyReadWriteCloserPooled(a2, &failingWriteConn{Conn: b1, err: wErr}, pool) }()
+
+		go func() {
+			_, _ = a1.Write([]byte("hello")) //nolint:errcheck
+		}()
+		require.Equal(t, wErr, <-errCh)
+		require.Len(t, pool.puts, 2)
+		require.Contains(t, pool.puts, wErr)
+		require.Contains(t, pool.puts, nil)
+	})
+}
@@ -26,23 +26,27 @@ type RetryFunc func() error
 
 // Retrier holds a configuration for how retries should be performed
 type Retrier struct {
-	initBO time.Duration      // initial backoff duration
-	maxBO  time.Duration      // maximum backoff duration
-	tries  int64              // number of times the given function is to be retried until success, if 0 it will be retried forever until success
-	factor float64            // multiplier for the backoff duration that is applied on every retry
-	errWl  map[error]struct{} // list of errors which will always trigger retirer to return
-	log    logrus.FieldLogger
+	bo    BackoffConfig      // backoff between retries
+	tries int64              // number of times the given function is to be retried until success (0 to retry forever)
+	errWl map[error]struct{} // list of errors which will always trigger retirer to return
+	log   logrus.FieldLogger
 }
 
-// NewRetrier returns a retrier that is ready to call Do() method
+// NewRetrier returns a retrier that is ready to call Do() method.
+// Backoffs are not jittered, unless enabled with WithJitter.
 func NewRetrier(log logrus.FieldLogger, initBO, maxBO time.Duration, tries int64, factor float64) *Retrier {
+	bo := BackoffConfig{Initial: initBO, Max: maxBO, Factor: factor}
+	return NewBackoffRetrier(log, bo, tries)
+}
+
+// NewBackoffRetrier returns a retrier which backs off between retries as configured by 'bo'.
+func NewBackoffRetrier(log logrus.FieldLogger, bo BackoffConfig, tries int64) *Retrier {
+	bo.Ensure()
 	return &Retrier{
-		initBO: initBO,
-		maxBO:  maxBO,
-		tries:  tries,
-		factor: factor,
-		errWl:  make(map[error]struct{}),
-		log:    log,
+		bo:    bo,
+		tries: tries,
+		errWl: make(map[error]struct{}),
+		log:   log,
 	}
 }
 
@@ -51,8 +55,9 @@ func NewDefaultRetrier(log logrus.FieldLogger) *Retrier {
 	return NewRetrier(log, DefaultInitBackoff, DefaultMaxBackoff, DefaultTries, DefaultFactor)
 }
 
-// WithErrWhitelist sets a list of errors into the retrier, if the RetryFunc provided to Do() fails with one of them it will return inmediatelly with such error. Calling
-// this function is not thread-safe, and is advised to only use it when initializing the Retrier
+// WithErrWhitelist sets a list of errors into the retrier, if the RetryFunc provided to Do() fails with one of them it
+// will return inmediatelly with such error. Calling this function is not thread-safe, and is advised to only use it
+// when initializing the Retrier
 func (r *Retrier) WithErrWhitelist(errors ...error) *Retrier {
 	for _, err := range errors {
 		r.errWl[err] = struct{}{}
@@ -60,33 +65,32 @@ func (r *Retrier) WithErrWhitelist(errors ...error) *Retrier {
 	return r
 }
 
+// WithJitter sets the fraction of each backoff which is randomized (see BackoffConfig.Jitter). Calling this function is
+// not thread-safe, and is advised to only use it when initializing the Retrier
+func (r *Retrier) WithJitter(frac float64) *Retrier {
+	r.bo.Jitter = frac
+	r.bo.Ensure()
+	return r
+}
+
 // Do takes a RetryFunc and attempts to execute it.
 // If it fails with an error it will be retried a maximum of given times with an initBO
 // until it returns nil or an error that is whitelisted
 func (r *Retrier) Do(ctx context.Context, f RetryFunc) error {
-	bo := r.initBO
-
-	t := time.NewTimer(bo)
-	defer t.Stop()
+	bo := NewBackoff(r.bo)
 
 	for i := int64(0); r.tries == 0 || i < r.tries; i++ {
 		if err := f(); err != nil {
 			if _, ok := r.errWl[err]; ok {
 				return err
 			}
-			if newBO := time.Duration(float64(bo) * r.factor); r.maxBO == 0 || newBO <= r.maxBO {
-				bo = newBO
-			}
 			if r.log != nil {
-				r.log.WithError(err).WithField("current_backoff", bo).Debug("Retrying...")
+				r.log.WithError(err).WithField("current_backoff", bo.cur).Debug("Retrying...")
 			}
-			select {
-			case <-t.C:
-				t.Reset(bo)
-				continue
-			case <-ctx.Done():
-				return ctx.Err()
+			if err := bo.Wait(ctx); err != nil {
+				return err
 			}
+			continue
 		}
 		return nil
 	}
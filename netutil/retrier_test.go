@@ -61,3 +61,14 @@ func TestRetrier_Do(t *testing.T) {
 		require.Equal(t, threshold, c)
 	})
 }
+
+func TestRetrier_WithJitter(t *testing.T) {
+	r := NewRetrier(logrus.New(), time.Millisecond*100, 0, 3, 2)
+	require.Zero(t, r.bo.Jitter)
+
+	r.WithJitter(DefaultJitter)
+	require.Equal(t, DefaultJitter, r.bo.Jitter)
+
+	r.WithJitter(2)
+	require.Equal(t, float64(1), r.bo.Jitter)
+}
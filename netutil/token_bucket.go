@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the rate of a quantity (such as bytes), while allowing bursts.
+// Tokens are consumed in advance, so a large quantity is delayed rather than refused.
+// A nil TokenBucket imposes no limit. It is safe for concurrent use.
+type TokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64 // maximum number of tokens
+
+	tokens float64 // may be negative (when consumed in advance)
+	last   time.Time
+	mx     sync.Mutex
+}
+
+// NewTokenBucket returns a bucket which refills 'rate' tokens per second, up to 'burst' tokens.
+// If 'burst' is not positive, it is set to 'rate'. If 'rate' is not positive, nil (no limit) is returned.
+func NewTokenBucket(rate, burst int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Reserve consumes n tokens, and returns the duration to wait before the tokens are available.
+func (b *TokenBucket) Reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Allow consumes n tokens if they are available, and returns whether they are (tokens are not consumed in advance).
+func (b *TokenBucket) Allow(n int) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Full returns true if the bucket has refilled up to it's burst, in which case it imposes the same limit as a new
+// bucket.
+func (b *TokenBucket) Full() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// refill adds the tokens accumulated since the last refill, up to the burst. The lock should be held by the caller.
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
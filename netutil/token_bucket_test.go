@@ -0,0 +1,66 @@
+package netutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	t.Run("no_limit", func(t *testing.T) {
+		var b *TokenBucket
+		require.Nil(t, NewTokenBucket(0, 100))
+		require.Zero(t, b.Reserve(1<<30))
+	})
+
+	t.Run("burst_then_rate", func(t *testing.T) {
+		b := NewTokenBucket(1000, 500)
+
+		// The burst is available immediately.
+		require.Zero(t, b.Reserve(500))
+
+		// Further tokens are consumed in advance, at the rate.
+		d := b.Reserve(1000)
+		require.True(t, d > time.Millisecond*900 && d <= time.Second, d)
+		d = b.Reserve(500)
+		require.True(t, d > time.Millisecond*1400 && d <= time.Millisecond*1500, d)
+	})
+
+	t.Run("refills_up_to_burst", func(t *testing.T) {
+		b := NewTokenBucket(10000, 100)
+		require.Zero(t, b.Reserve(100))
+		time.Sleep(time.Millisecond * 50) // refills 500 tokens, capped at 100
+
+		require.Zero(t, b.Reserve(100))
+		require.True(t, b.Reserve(100) > 0)
+	})
+}
+
+func TestTokenBucket_Allow(t *testing.T) {
+	var b *TokenBucket
+	require.True(t, b.Allow(1<<30))
+
+	b = NewTokenBucket(100, 2)
+	require.True(t, b.Allow(1))
+	require.True(t, b.Allow(1))
+	for i := 0; i < 10; i++ {
+		require.False(t, b.Allow(1))
+	}
+
+	// Refused tokens are not consumed in advance.
+	time.Sleep(time.Millisecond * 15) // refills 1.5 tokens
+	require.True(t, b.Allow(1))
+}
+
+func TestTokenBucket_Full(t *testing.T) {
+	var b *TokenBucket
+	require.True(t, b.Full())
+
+	b = NewTokenBucket(100, 2)
+	require.True(t, b.Full())
+	require.True(t, b.Allow(1))
+	require.False(t, b.Full())
+	time.Sleep(time.Millisecond * 15) // refills 1.5 tokens, capped at 2
+	require.True(t, b.Full())
+}
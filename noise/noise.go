@@ -17,15 +17,48 @@ var noiseLogger = logging.MustGetLogger("noise") // TODO: initialize properly or
 // ErrInvalidCipherText occurs when a ciphertext is received which is too short in size.
 var ErrInvalidCipherText = errors.New("noise decrypt unsafe: ciphertext cannot be less than 8 bytes")
 
+// Errors of frames which are received out of sequence (see Config.StrictSequence).
+var (
+	ErrFrameGap       = errors.New("noise decrypt unsafe: frame sequence has a gap")
+	ErrFrameReordered = errors.New("noise decrypt unsafe: frame is reordered")
+)
+
+// Errors of close frames (see ReadWriter.WriteClose).
+var (
+	ErrWriteClosed     = errors.New("noise write: close frame is sent")
+	ErrPayloadTooLarge = errors.New("noise write: close frame payload is too large")
+)
+
 // nonceSize is the noise cipher state's nonce size in bytes.
 const nonceSize = 8
 
+// rekeyFlag is set in the nonce of a rekey frame, after which the sender's key is rotated (see EncryptRekeyUnsafe).
+const rekeyFlag = uint64(1) << 63
+
+// closeFlag is set in the nonce of a close frame, which is the last frame of the sender (see EncryptCloseUnsafe).
+const closeFlag = uint64(1) << 62
+
+// CloseError is returned when decrypting a close frame (see EncryptCloseUnsafe), and contains the frame's payload.
+type CloseError struct {
+	Payload []byte
+}
+
+// Error implements error
+func (e *CloseError) Error() string {
+	return "connection closed by remote"
+}
+
 // Config hold noise parameters.
 type Config struct {
 	LocalPK   cipher.PubKey // Local instance static public key.
 	LocalSK   cipher.SecKey // Local instance static secret key.
 	RemotePK  cipher.PubKey // Remote instance static public key.
 	Initiator bool          // Whether the local instance initiates the connection.
+
+	// StrictSequence requires received frames to have consecutive nonces, which are the frames' sequence numbers.
+	// This detects frames which are lost or reordered (i.e. across a change of the underlying link). Otherwise, only
+	// repeated and reordered frames are detected, and gaps are silently skipped.
+	StrictSequence bool
 }
 
 // Noise handles the handshake and the frame's cryptography.
@@ -42,6 +75,8 @@ type Noise struct {
 
 	encNonce uint64 // increment after encryption
 	decNonce uint64 // expect increment with each subsequent packet
+
+	strictSeq bool // whether decNonce must increment by exactly one
 }
 
 // New creates a new Noise with:
@@ -67,11 +102,12 @@ func New(pattern noise.HandshakePattern, config Config) (*Noise, error) {
 		return nil, err
 	}
 	return &Noise{
-		pk:      config.LocalPK,
-		sk:      config.LocalSK,
-		init:    config.Initiator,
-		pattern: pattern,
-		hs:      hs,
+		pk:        config.LocalPK,
+		sk:        config.LocalSK,
+		init:      config.Initiator,
+		pattern:   pattern,
+		hs:        hs,
+		strictSeq: config.StrictSequence,
 	}, nil
 }
 
@@ -116,6 +152,16 @@ func (ns *Noise) HandshakeFinished() bool {
 	return ns.hs.MessageIndex() == len(ns.pattern.Messages)
 }
 
+// Pattern returns the name of the handshake pattern (i.e. "XK").
+func (ns *Noise) Pattern() string {
+	return ns.pattern.Name
+}
+
+// Initiator returns whether the local party initiates the handshake.
+func (ns *Noise) Initiator() bool {
+	return ns.init
+}
+
 // LocalStatic returns the local static public key.
 func (ns *Noise) LocalStatic() cipher.PubKey {
 	return ns.pk
@@ -139,18 +185,58 @@ func (ns *Noise) EncryptUnsafe(plaintext []byte) []byte {
 	return append(buf, ns.enc.Cipher().Encrypt(nil, ns.encNonce, nil, plaintext)...)
 }
 
+// EncryptRekeyUnsafe makes a rekey frame, and rotates the encryption key. Frames encrypted afterwards are only
+// decrypted by the remote once it has decrypted the rekey frame (which rotates the remote's decryption key), so frames
+// should be delivered in order. This should only be used with external lock.
+func (ns *Noise) EncryptRekeyUnsafe() []byte {
+	ns.encNonce++
+	buf := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(buf, ns.encNonce|rekeyFlag)
+	frame := append(buf, ns.enc.Cipher().Encrypt(nil, ns.encNonce, nil, nil)...)
+	ns.enc.Rekey()
+	return frame
+}
+
+// EncryptCloseUnsafe makes a close frame carrying the given payload, which the remote decrypts to a *CloseError. No
+// frames should be encrypted afterwards. This should only be used with external lock.
+func (ns *Noise) EncryptCloseUnsafe(payload []byte) []byte {
+	ns.encNonce++
+	buf := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(buf, ns.encNonce|closeFlag)
+	return append(buf, ns.enc.Cipher().Encrypt(nil, ns.encNonce, nil, payload)...)
+}
+
 // DecryptUnsafe decrypts ciphertext without interlocking, should only
 // be used with external lock.
+// A rekey frame (see EncryptRekeyUnsafe) rotates the decryption key, and is decrypted to an empty plaintext.
+// A close frame (see EncryptCloseUnsafe) is decrypted to a *CloseError.
 func (ns *Noise) DecryptUnsafe(ciphertext []byte) ([]byte, error) {
 	if len(ciphertext) < nonceSize {
 		return nil, ErrInvalidCipherText
 	}
 	recvSeq := binary.BigEndian.Uint64(ciphertext[:nonceSize])
+	rekey := recvSeq&rekeyFlag != 0
+	closing := recvSeq&closeFlag != 0
+	recvSeq &^= rekeyFlag | closeFlag
+	if ns.strictSeq && recvSeq > ns.decNonce+1 {
+		return nil, fmt.Errorf("%w: received nonce (%d), expected (%d)", ErrFrameGap, recvSeq, ns.decNonce+1)
+	}
 	if recvSeq <= ns.decNonce {
+		if ns.strictSeq {
+			return nil, fmt.Errorf("%w: received nonce (%d), expected (%d)", ErrFrameReordered, recvSeq, ns.decNonce+1)
+		}
 		return nil, fmt.Errorf("received decryption nonce (%d) is not larger than previous (%d)", recvSeq, ns.decNonce)
 	}
 	ns.decNonce = recvSeq
-	return ns.dec.Cipher().Decrypt(nil, recvSeq, nil, ciphertext[nonceSize:])
+	plaintext, err := ns.dec.Cipher().Decrypt(nil, recvSeq, nil, ciphertext[nonceSize:])
+	if err == nil && closing {
+		return nil, &CloseError{Payload: plaintext}
+	}
+	if err != nil || !rekey {
+		return plaintext, err
+	}
+	ns.dec.Rekey()
+	return nil, nil
 }
 
 // NonceMap is a map of used nonces.
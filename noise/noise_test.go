@@ -66,6 +66,11 @@ func TestKKAndSecp256k1(t *testing.T) {
 	require.True(t, nI.HandshakeFinished())
 	require.True(t, nR.HandshakeFinished())
 
+	assert.Equal(t, "KK", nI.Pattern())
+	assert.Equal(t, "KK", nR.Pattern())
+	assert.True(t, nI.Initiator())
+	assert.False(t, nR.Initiator())
+
 	encrypted := nI.EncryptUnsafe([]byte("foo"))
 	decrypted, err := nR.DecryptUnsafe(encrypted)
 	require.NoError(t, err)
@@ -123,6 +128,11 @@ func TestXKAndSecp256k1(t *testing.T) {
 	require.True(t, nI.HandshakeFinished())
 	require.True(t, nR.HandshakeFinished())
 
+	assert.Equal(t, "XK", nI.Pattern())
+	assert.Equal(t, "XK", nR.Pattern())
+	assert.True(t, nI.Initiator())
+	assert.False(t, nR.Initiator())
+
 	encrypted := nI.EncryptUnsafe([]byte("foo"))
 	decrypted, err := nR.DecryptUnsafe(encrypted)
 	require.NoError(t, err)
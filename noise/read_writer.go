@@ -42,6 +42,7 @@ type netError struct {
 func (e *netError) Error() string   { return e.err.Error() }
 func (e *netError) Timeout() bool   { return e.timeout }
 func (e *netError) Temporary() bool { return e.temp }
+func (e *netError) Unwrap() error   { return e.err }
 
 // ReadWriter implements noise encrypted read writer.
 type ReadWriter struct {
@@ -99,9 +100,14 @@ func (rw *ReadWriter) Read(p []byte) (int, error) {
 }
 
 // processReadError processes error before returning.
-// * Ensure error implements net.Error
+// * Ensure error implements net.Error (except for io.EOF, which is returned as is to match net.Conn semantics)
 // * If error is non-temporary, save error in state so further reads will fail.
+// * A *CloseError (of a close frame) is also returned as is.
 func (rw *ReadWriter) processReadError(err error) error {
+	if _, ok := err.(*CloseError); ok || err == io.EOF {
+		rw.rErr = err
+		return err
+	}
 	if nErr, ok := err.(net.Error); ok {
 		if !nErr.Temporary() {
 			rw.rErr = err
@@ -143,11 +149,12 @@ func (rw *ReadWriter) Write(p []byte) (n int, err error) {
 		wb, err := WriteRawFrame(rw.origin, rw.ns.EncryptUnsafe(p[:wn]))
 		if err != nil {
 			// when a short write occurs, it is hard to recover from so we
-			// consider it a permanent error
+			// consider it a permanent error (which is still a timeout if the
+			// write deadline was reached mid-frame, as with net.Conn)
 			if len(wb) != 0 {
 				err = &netError{
 					err:     fmt.Errorf("%v: %w", io.ErrShortWrite, err),
-					timeout: false,
+					timeout: isTimeout(err),
 					temp:    false,
 				}
 			}
@@ -168,6 +175,50 @@ func (rw *ReadWriter) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Rekey rotates the keys of the encrypted connection in-band, without interrupting it. A rekey frame is sent (in order
+// with the data frames), after which frames are encrypted with the rotated key. The remote rotates it's decryption key
+// once it reads the rekey frame, so no frame is lost across the key switch. Both sides may rekey independently.
+func (rw *ReadWriter) Rekey() error {
+	rw.wMx.Lock()
+	defer rw.wMx.Unlock()
+
+	if rw.wErr != nil {
+		return rw.wErr
+	}
+	if _, err := WriteRawFrame(rw.origin, rw.ns.EncryptRekeyUnsafe()); err != nil {
+		// The key is already rotated, so further writes would not be decrypted by the remote.
+		rw.wErr = err
+		return err
+	}
+	return nil
+}
+
+// WriteClose sends a close frame carrying the given payload (in order with the data frames), which the remote's reads
+// return as a *CloseError once the preceding data is read. Further writes fail with ErrWriteClosed.
+func (rw *ReadWriter) WriteClose(payload []byte) error {
+	rw.wMx.Lock()
+	defer rw.wMx.Unlock()
+
+	if rw.wErr != nil {
+		return rw.wErr
+	}
+	if len(payload) > maxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	if _, err := WriteRawFrame(rw.origin, rw.ns.EncryptCloseUnsafe(payload)); err != nil {
+		rw.wErr = err
+		return err
+	}
+	rw.wErr = ErrWriteClosed
+	return nil
+}
+
+// MTU returns the payload capacity of a single frame (after accounting for noise overhead).
+// Writes of up to MTU bytes are sent as a single frame, and larger writes are fragmented into multiple frames.
+func (rw *ReadWriter) MTU() int {
+	return maxPayloadSize
+}
+
 // Handshake performs a Noise handshake using the provided io.ReadWriter.
 func (rw *ReadWriter) Handshake(hsTimeout time.Duration) error {
 	errCh := make(chan error, 1)
@@ -291,6 +342,13 @@ func ReadRawFrame(r *bufio.Reader) (p []byte, err error) {
 	return b[prefixSize:], nil
 }
 
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
 func isTemp(err error) bool {
 	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 		return true
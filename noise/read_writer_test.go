@@ -1,7 +1,11 @@
 package noise
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -214,3 +218,355 @@ func TestReadWriterXKPattern(t *testing.T) {
 	assert.Equal(t, 3, n)
 	assert.Equal(t, []byte("bar"), buf)
 }
+
+func TestReadWriterStrictSequence(t *testing.T) {
+	// prepare returns handshaked noise instances of an initiator and a responder.
+	prepare := func(t *testing.T, strict bool) (*Noise, *Noise) {
+		pkI, skI := cipher.GenerateKeyPair()
+		pkR, skR := cipher.GenerateKeyPair()
+
+		nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+		require.NoError(t, err)
+		nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI, StrictSequence: strict})
+		require.NoError(t, err)
+
+		connI, connR := net.Pipe()
+		defer func() {
+			require.NoError(t, connI.Close())
+			require.NoError(t, connR.Close())
+		}()
+
+		errCh := make(chan error)
+		go func() { errCh <- NewReadWriter(connR, nR).Handshake(time.Second) }()
+		require.NoError(t, NewReadWriter(connI, nI).Handshake(time.Second))
+		require.NoError(t, <-errCh)
+		return nI, nR
+	}
+
+	// migrate writes the messages as frames, and returns a link which delivers the frames in the given order
+	// (as if the frames are reordered while the underlying link is migrated).
+	migrate := func(t *testing.T, nI *Noise, msgs []string, order []int) io.ReadWriter {
+		var oldLink bytes.Buffer
+		rwI := NewReadWriter(&oldLink, nI)
+		for _, msg := range msgs {
+			_, err := rwI.Write([]byte(msg))
+			require.NoError(t, err)
+		}
+
+		r := bufio.NewReader(&oldLink)
+		frames := make([][]byte, len(msgs))
+		for i := range frames {
+			frame, err := ReadRawFrame(r)
+			require.NoError(t, err)
+			frames[i] = append([]byte(nil), frame...)
+		}
+
+		var newLink bytes.Buffer
+		for _, i := range order {
+			_, err := WriteRawFrame(&newLink, frames[i])
+			require.NoError(t, err)
+		}
+		return &newLink
+	}
+
+	msgs := []string{"foo", "bar", "baz"}
+
+	t.Run("in_sequence", func(t *testing.T) {
+		nI, nR := prepare(t, true)
+		rwR := NewReadWriter(migrate(t, nI, msgs, []int{0, 1, 2}), nR)
+
+		for _, msg := range msgs {
+			buf := make([]byte, 3)
+			_, err := io.ReadFull(rwR, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, string(buf))
+		}
+	})
+
+	t.Run("strict_reordered", func(t *testing.T) {
+		nI, nR := prepare(t, true)
+		rwR := NewReadWriter(migrate(t, nI, msgs, []int{0, 2, 1}), nR)
+
+		buf := make([]byte, 3)
+		_, err := io.ReadFull(rwR, buf)
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(buf))
+
+		// The frame following the gap is not delivered, and the error persists.
+		_, err = rwR.Read(buf)
+		require.True(t, errors.Is(err, ErrFrameGap), err)
+		_, err = rwR.Read(buf)
+		require.True(t, errors.Is(err, ErrFrameGap), err)
+	})
+
+	t.Run("strict_lost", func(t *testing.T) {
+		nI, nR := prepare(t, true)
+		rwR := NewReadWriter(migrate(t, nI, msgs, []int{1, 2}), nR)
+
+		_, err := rwR.Read(make([]byte, 3))
+		require.True(t, errors.Is(err, ErrFrameGap), err)
+	})
+
+	t.Run("non_strict_reordered", func(t *testing.T) {
+		nI, nR := prepare(t, false)
+		rwR := NewReadWriter(migrate(t, nI, msgs, []int{0, 2, 1}), nR)
+
+		// Data following the gap is delivered, and only the late frame is detected.
+		buf := make([]byte, 3)
+		for _, msg := range []string{"foo", "baz"} {
+			_, err := io.ReadFull(rwR, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, string(buf))
+		}
+		_, err := rwR.Read(buf)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrFrameGap))
+	})
+}
+
+func TestReadWriterMTU(t *testing.T) {
+	pkI, skI := cipher.GenerateKeyPair()
+	pkR, skR := cipher.GenerateKeyPair()
+
+	nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+	require.NoError(t, err)
+	nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI})
+	require.NoError(t, err)
+
+	connI, connR := net.Pipe()
+	errCh := make(chan error)
+	go func() { errCh <- NewReadWriter(connR, nR).Handshake(time.Second) }()
+	require.NoError(t, NewReadWriter(connI, nI).Handshake(time.Second))
+	require.NoError(t, <-errCh)
+	require.NoError(t, connI.Close())
+	require.NoError(t, connR.Close())
+
+	var link bytes.Buffer
+	rwI := NewReadWriter(&link, nI)
+	rwR := NewReadWriter(&link, nR)
+	require.Equal(t, MaxWriteSize, rwI.MTU())
+
+	// countFrames writes the data, and returns the number of frames written to the link.
+	countFrames := func(data []byte) int {
+		_, err := rwI.Write(data)
+		require.NoError(t, err)
+
+		r := bufio.NewReader(bytes.NewReader(link.Bytes()))
+		frames := 0
+		for {
+			_, err := ReadRawFrame(r)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			frames++
+		}
+
+		// The data is received intact.
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(rwR, got)
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+		return frames
+	}
+
+	require.Equal(t, 1, countFrames(cipher.RandByte(rwI.MTU())))
+	require.Equal(t, 2, countFrames(cipher.RandByte(rwI.MTU()+1)))
+}
+
+func TestReadWriterRekey(t *testing.T) {
+	pkI, skI := cipher.GenerateKeyPair()
+	pkR, skR := cipher.GenerateKeyPair()
+
+	nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+	require.NoError(t, err)
+	nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI, StrictSequence: true})
+	require.NoError(t, err)
+
+	connI, connR := net.Pipe()
+	defer func() {
+		require.NoError(t, connI.Close())
+		require.NoError(t, connR.Close())
+	}()
+
+	rwI := NewReadWriter(connI, nI)
+	rwR := NewReadWriter(connR, nR)
+	errCh := make(chan error)
+	go func() { errCh <- rwR.Handshake(time.Second) }()
+	require.NoError(t, rwI.Handshake(time.Second))
+	require.NoError(t, <-errCh)
+
+	const rounds = 5
+	data := cipher.RandByte(MaxWriteSize*rounds + 100)
+
+	// The initiator rekeys in between writes, while the responder reads.
+	go func() {
+		for i := 0; i < rounds; i++ {
+			chunk := data[i*MaxWriteSize : (i+1)*MaxWriteSize]
+			if _, err := rwI.Write(chunk); err != nil {
+				errCh <- err
+				return
+			}
+			if err := rwI.Rekey(); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		_, err := rwI.Write(data[rounds*MaxWriteSize:])
+		errCh <- err
+	}()
+
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(rwR, got)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.Equal(t, data, got)
+
+	// The responder rekeys independently.
+	go func() {
+		if err := rwR.Rekey(); err != nil {
+			errCh <- err
+			return
+		}
+		_, err := rwR.Write([]byte("reply"))
+		errCh <- err
+	}()
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(rwI, reply)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.Equal(t, "reply", string(reply))
+}
+
+func TestReadWriterWriteClose(t *testing.T) {
+	pkI, skI := cipher.GenerateKeyPair()
+	pkR, skR := cipher.GenerateKeyPair()
+
+	nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+	require.NoError(t, err)
+	nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI, StrictSequence: true})
+	require.NoError(t, err)
+
+	connI, connR := net.Pipe()
+	defer func() {
+		require.NoError(t, connI.Close())
+		require.NoError(t, connR.Close())
+	}()
+
+	rwI := NewReadWriter(connI, nI)
+	rwR := NewReadWriter(connR, nR)
+	errCh := make(chan error)
+	go func() { errCh <- rwR.Handshake(time.Second) }()
+	require.NoError(t, rwI.Handshake(time.Second))
+	require.NoError(t, <-errCh)
+
+	require.Equal(t, ErrPayloadTooLarge, rwI.WriteClose(make([]byte, MaxWriteSize+1)))
+
+	// Data written before the close frame is read before the close error.
+	go func() {
+		if _, err := rwI.Write([]byte("data")); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- rwI.WriteClose([]byte("bye"))
+	}()
+
+	got := make([]byte, 4)
+	_, err = io.ReadFull(rwR, got)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(got))
+
+	for i := 0; i < 2; i++ {
+		_, err = rwR.Read(got)
+		var cErr *CloseError
+		require.True(t, errors.As(err, &cErr))
+		require.Equal(t, "bye", string(cErr.Payload))
+	}
+	require.NoError(t, <-errCh)
+
+	_, err = rwI.Write([]byte("more"))
+	require.Equal(t, ErrWriteClosed, err)
+	require.Equal(t, ErrWriteClosed, rwI.WriteClose(nil))
+}
+
+func TestNoiseRekey(t *testing.T) {
+	pkI, skI := cipher.GenerateKeyPair()
+	pkR, skR := cipher.GenerateKeyPair()
+
+	// prepare returns handshaked noise instances of an initiator and a responder.
+	prepare := func() (*Noise, *Noise) {
+		nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+		require.NoError(t, err)
+		nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI})
+		require.NoError(t, err)
+
+		msg, err := nI.MakeHandshakeMessage()
+		require.NoError(t, err)
+		require.NoError(t, nR.ProcessHandshakeMessage(msg))
+		msg, err = nR.MakeHandshakeMessage()
+		require.NoError(t, err)
+		require.NoError(t, nI.ProcessHandshakeMessage(msg))
+		return nI, nR
+	}
+
+	// Frames after a rekey frame are decrypted once the rekey frame is.
+	nI, nR := prepare()
+	frames := [][]byte{nI.EncryptUnsafe([]byte("before")), nI.EncryptRekeyUnsafe(), nI.EncryptUnsafe([]byte("after"))}
+	for i, want := range []string{"before", "", "after"} {
+		got, err := nR.DecryptUnsafe(frames[i])
+		require.NoError(t, err)
+		require.Equal(t, want, string(got))
+	}
+
+	// Frames after a rekey frame are not decrypted with the old key.
+	nI, nR = prepare()
+	frames = [][]byte{nI.EncryptUnsafe([]byte("before")), nI.EncryptRekeyUnsafe(), nI.EncryptUnsafe([]byte("after"))}
+	_, err := nR.DecryptUnsafe(frames[0])
+	require.NoError(t, err)
+	_, err = nR.DecryptUnsafe(frames[2])
+	require.Error(t, err)
+}
+
+// deadlineWriter accepts writes up to it's capacity, after which it fails as if the write deadline was reached.
+type deadlineWriter struct {
+	io.Reader
+	capacity int
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.capacity {
+		w.capacity -= len(p)
+		return len(p), nil
+	}
+	n := w.capacity
+	w.capacity = 0
+	return n, &netError{err: errors.New("i/o deadline reached"), timeout: true, temp: true}
+}
+
+func TestReadWriterWriteDeadline(t *testing.T) {
+	pkI, skI := cipher.GenerateKeyPair()
+	pkR, skR := cipher.GenerateKeyPair()
+
+	nI, err := KKAndSecp256k1(Config{LocalPK: pkI, LocalSK: skI, RemotePK: pkR, Initiator: true})
+	require.NoError(t, err)
+	nR, err := KKAndSecp256k1(Config{LocalPK: pkR, LocalSK: skR, RemotePK: pkI})
+	require.NoError(t, err)
+
+	connI, connR := net.Pipe()
+	errCh := make(chan error)
+	go func() { errCh <- NewReadWriter(connR, nR).Handshake(time.Second) }()
+	require.NoError(t, NewReadWriter(connI, nI).Handshake(time.Second))
+	require.NoError(t, <-errCh)
+	require.NoError(t, connI.Close())
+	require.NoError(t, connR.Close())
+
+	// A write which times out mid-frame is still a timeout, and it fails further writes.
+	rw := NewReadWriter(&deadlineWriter{capacity: 100}, nI)
+	_, err = rw.Write(make([]byte, 1000))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+	require.False(t, netErr.Temporary())
+	_, err = rw.Write([]byte("foo"))
+	require.Equal(t, netErr, err)
+}
@@ -0,0 +1,89 @@
+package dmsg
+
+import (
+	"sync"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// peerAllowlist is a list of peers which are allowed to initiate streams.
+// It allows all peers until a list is set. It is safe for concurrent use.
+type peerAllowlist struct {
+	pks map[cipher.PubKey]struct{} // nil allows all peers
+	mx  sync.RWMutex
+}
+
+func newPeerAllowlist() *peerAllowlist {
+	return new(peerAllowlist)
+}
+
+// allowed returns true if the peer of the given public key is allowed to initiate streams.
+func (l *peerAllowlist) allowed(pk cipher.PubKey) bool {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	if l.pks == nil {
+		return true
+	}
+	_, ok := l.pks[pk]
+	return ok
+}
+
+// list returns the allowed peers, and whether all peers are allowed.
+func (l *peerAllowlist) list() ([]cipher.PubKey, bool) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	if l.pks == nil {
+		return nil, true
+	}
+	pks := make([]cipher.PubKey, 0, len(l.pks))
+	for pk := range l.pks {
+		pks = append(pks, pk)
+	}
+	return pks, false
+}
+
+// set replaces the list with the given peers.
+func (l *peerAllowlist) set(pks []cipher.PubKey) {
+	m := make(map[cipher.PubKey]struct{}, len(pks))
+	for _, pk := range pks {
+		m[pk] = struct{}{}
+	}
+
+	l.mx.Lock()
+	l.pks = m
+	l.mx.Unlock()
+}
+
+// add adds the given peers to the list.
+// If all peers are allowed, only the given peers are allowed afterwards.
+func (l *peerAllowlist) add(pks []cipher.PubKey) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.pks == nil {
+		l.pks = make(map[cipher.PubKey]struct{}, len(pks))
+	}
+	for _, pk := range pks {
+		l.pks[pk] = struct{}{}
+	}
+}
+
+// remove removes the given peers from the list.
+// If all peers are allowed, this is a no-op.
+func (l *peerAllowlist) remove(pks []cipher.PubKey) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	for _, pk := range pks {
+		delete(l.pks, pk)
+	}
+}
+
+// allowAll clears the list, so that all peers are allowed.
+func (l *peerAllowlist) allowAll() {
+	l.mx.Lock()
+	l.pks = nil
+	l.mx.Unlock()
+}
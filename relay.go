@@ -0,0 +1,169 @@
+package dmsg
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/yamux"
+)
+
+// relayBufferSize is the size of the buffers which relayed data is copied through (the buffer size of io.Copy).
+const relayBufferSize = 32 * 1024
+
+// relayBuffers pools the buffers which relayed data is copied through, so that they are not allocated per stream.
+var relayBuffers = &relayBufferPool{pool: sync.Pool{New: func() interface{} {
+	buf := make([]byte, relayBufferSize)
+	return &buf
+}}}
+
+// relayBufferPool implements netutil.BufferPool for relays.
+type relayBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *relayBufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns the buffer to the pool, unless the write to the client failed in a way which may leave the data queued
+// in the session (the write timed out, or the session was torn down before the data was sent). Such buffers are left
+// to be collected, as the session may still read them.
+func (p *relayBufferPool) Put(buf []byte, writeErr error) {
+	if writeErr == yamux.ErrConnectionWriteTimeout || writeErr == yamux.ErrSessionShutdown {
+		return
+	}
+	p.pool.Put(&buf)
+}
+
+// relay is a stream relayed by a server between the sessions of two clients.
+type relay struct {
+	fwd, bwd   uint64 // atomic, bytes relayed from the initiating client and from the responding client
+	lastActive int64  // atomic, unix nano time in which data was last relayed (in either direction)
+
+	src, dst       *SessionCommon // sessions of the initiating and responding clients
+	srcStr, dstStr *yamux.Stream
+	since          time.Time
+	once           sync.Once
+}
+
+func newRelay(src *SessionCommon, srcStr *yamux.Stream, dst *SessionCommon, dstStr *yamux.Stream) *relay {
+	r := &relay{src: src, dst: dst, srcStr: srcStr, dstStr: dstStr, since: time.Now()}
+	r.lastActive = r.since.UnixNano()
+	src.addRelay(r)
+	dst.addRelay(r)
+	return r
+}
+
+// close closes both streams of the relay.
+// If the session of one client is torn down, the other client is notified that it's peer disconnected (see
+// sendStreamNotice) before it's stream is closed. It is safe to call close multiple times and concurrently.
+func (r *relay) close() {
+	r.once.Do(func() {
+		srcGone, dstGone := r.src.ys.IsClosed(), r.dst.ys.IsClosed()
+		switch {
+		case srcGone && !dstGone:
+			r.notify(r.dst, r.dstStr, ErrPeerDisconnected)
+		case dstGone && !srcGone:
+			r.notify(r.src, r.srcStr, ErrPeerDisconnected)
+		}
+		r.closeStreams()
+	})
+}
+
+// reap closes both streams of the relay as it is idle, after notifying both clients of ErrStreamIdle (so that their
+// streams fail with the reason, rather than with io.EOF). It is a no-op if the relay is already closed.
+func (r *relay) reap() {
+	r.once.Do(func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); r.notify(r.src, r.srcStr, ErrStreamIdle) }()
+		go func() { defer wg.Done(); r.notify(r.dst, r.dstStr, ErrStreamIdle) }()
+		wg.Wait()
+		r.closeStreams()
+	})
+}
+
+func (r *relay) closeStreams() {
+	_ = r.srcStr.Close() //nolint:errcheck
+	_ = r.dstStr.Close() //nolint:errcheck
+	r.src.delRelay(r)
+	r.dst.delRelay(r)
+}
+
+func (r *relay) notify(ses *SessionCommon, yStr *yamux.Stream, reason Error) {
+	log := ses.log.WithField("yamux_id", yStr.StreamID()).WithField("reason", reason.msg)
+	if err := ses.sendStreamNotice(yStr.StreamID(), reason); err != nil {
+		log.WithError(err).Debug("Failed to notify client that it's stream is closed.")
+		return
+	}
+	log.Debug("Notified client that it's stream is closed.")
+}
+
+// idleFor returns the duration since data was last relayed (in either direction).
+func (r *relay) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.lastActive)))
+}
+
+// recordForward records bytes relayed from the initiating client to the responding client.
+func (r *relay) recordForward(n int) {
+	atomic.AddUint64(&r.fwd, uint64(n))
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+	atomic.AddUint64(&r.src.relayedOut, uint64(n))
+	atomic.AddUint64(&r.dst.relayedIn, uint64(n))
+}
+
+// recordBackward records bytes relayed from the responding client to the initiating client.
+func (r *relay) recordBackward(n int) {
+	atomic.AddUint64(&r.bwd, uint64(n))
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+	atomic.AddUint64(&r.dst.relayedOut, uint64(n))
+	atomic.AddUint64(&r.src.relayedIn, uint64(n))
+}
+
+// end returns the given stream of the relay, which closes the relay once closed.
+func (r *relay) end(yStr *yamux.Stream) io.ReadWriteCloser {
+	return &relayEnd{Stream: yStr, r: r}
+}
+
+type relayEnd struct {
+	*yamux.Stream
+	r *relay
+}
+
+func (re *relayEnd) Close() error {
+	re.r.close()
+	return nil
+}
+
+func (sc *SessionCommon) addRelay(r *relay) {
+	sc.relaysMx.Lock()
+	if sc.relays == nil {
+		sc.relays = make(map[*relay]struct{})
+	}
+	sc.relays[r] = struct{}{}
+	sc.relaysMx.Unlock()
+}
+
+func (sc *SessionCommon) delRelay(r *relay) {
+	sc.relaysMx.Lock()
+	delete(sc.relays, r)
+	sc.relaysMx.Unlock()
+}
+
+// closeRelays closes the streams relayed from and to the client of the session, which is torn down. The clients on the
+// other side of the streams are notified concurrently, without holding locks, so that the teardown does not block on
+// them (nor on sessions which are torn down at the same time).
+func (sc *SessionCommon) closeRelays() {
+	sc.relaysMx.Lock()
+	relays := make([]*relay, 0, len(sc.relays))
+	for r := range sc.relays {
+		relays = append(relays, r)
+	}
+	sc.relaysMx.Unlock()
+
+	for _, r := range relays {
+		go r.close()
+	}
+}
@@ -0,0 +1,117 @@
+package dmsg
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/netutil"
+)
+
+// RequestRateLimit limits the rate in which a server relays stream requests of an initiating client, in requests per
+// second. Burst is the number of requests which may be relayed at once (zero selects Rate). Zero Rate imposes no limit.
+type RequestRateLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst"`
+}
+
+// requestLimiter limits the rates of stream requests of clients. Requests which exceed the limit are rejected rather
+// than delayed, as each relayed request costs the responding client a handshake.
+type requestLimiter struct {
+	def       RequestRateLimit
+	overrides map[cipher.PubKey]RequestRateLimit
+
+	buckets map[cipher.PubKey]*netutil.TokenBucket // of recently active clients (see evictRefilled)
+	sweepAt int                                    // number of buckets at which refilled buckets are evicted
+	limited uint64                                 // atomic, total number of rejected requests
+	mx      sync.Mutex
+}
+
+func newRequestLimiter(def RequestRateLimit, overrides map[cipher.PubKey]RequestRateLimit) *requestLimiter {
+	rl := &requestLimiter{
+		def:       def,
+		overrides: make(map[cipher.PubKey]RequestRateLimit, len(overrides)),
+		buckets:   make(map[cipher.PubKey]*netutil.TokenBucket),
+		sweepAt:   minRequestBucketSweep,
+	}
+	for pk, limit := range overrides {
+		rl.overrides[pk] = limit
+	}
+	return rl
+}
+
+// limit returns the limit of the given client.
+func (rl *requestLimiter) limit(pk cipher.PubKey) RequestRateLimit {
+	if limit, ok := rl.overrides[pk]; ok {
+		return limit
+	}
+	return rl.def
+}
+
+// allow returns true if a stream request of the given client is within it's limit (and records it).
+func (rl *requestLimiter) allow(pk cipher.PubKey) bool {
+	rl.mx.Lock()
+	b, ok := rl.buckets[pk]
+	if !ok {
+		if len(rl.buckets) >= rl.sweepAt {
+			rl.evictRefilled()
+		}
+		limit := rl.limit(pk)
+		b = netutil.NewTokenBucket(limit.Rate, limit.Burst)
+		rl.buckets[pk] = b
+	}
+	rl.mx.Unlock()
+
+	if b.Allow(1) {
+		return true
+	}
+	atomic.AddUint64(&rl.limited, 1)
+	return false
+}
+
+// evictRefilled drops the buckets which have refilled, as they impose the same limit as new buckets. Hence, the state
+// of idle clients is bounded, while clients cannot reset their limit (i.e. by reconnecting).
+// Buckets are evicted once their number doubles since the last eviction, so that it is amortized across requests.
+// The lock should be held by the caller.
+func (rl *requestLimiter) evictRefilled() {
+	for pk, b := range rl.buckets {
+		if b.Full() {
+			delete(rl.buckets, pk)
+		}
+	}
+	rl.sweepAt = len(rl.buckets) * 2
+	if rl.sweepAt < minRequestBucketSweep {
+		rl.sweepAt = minRequestBucketSweep
+	}
+}
+
+// setDefault sets the limit of clients without an override.
+func (rl *requestLimiter) setDefault(limit RequestRateLimit) {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+
+	rl.def = limit
+	for pk := range rl.buckets {
+		if _, ok := rl.overrides[pk]; !ok {
+			delete(rl.buckets, pk)
+		}
+	}
+}
+
+// setOverride sets the limit of the given client, or removes it's override if limit is nil.
+func (rl *requestLimiter) setOverride(pk cipher.PubKey, limit *RequestRateLimit) {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+
+	if limit != nil {
+		rl.overrides[pk] = *limit
+	} else {
+		delete(rl.overrides, pk)
+	}
+	delete(rl.buckets, pk)
+}
+
+// limitedCount returns the total number of rejected requests.
+func (rl *requestLimiter) limitedCount() uint64 {
+	return atomic.LoadUint64(&rl.limited)
+}
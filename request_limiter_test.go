@@ -0,0 +1,34 @@
+package dmsg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+func TestRequestLimiter_EvictRefilled(t *testing.T) {
+	pkX, _ := GenKeyPair(t, "x")
+	pkY, _ := GenKeyPair(t, "y")
+	pks := make([]cipher.PubKey, minRequestBucketSweep-1)
+	for i := range pks {
+		pks[i], _ = cipher.GenerateKeyPair()
+	}
+	rl := newRequestLimiter(RequestRateLimit{Rate: 100, Burst: 1}, map[cipher.PubKey]RequestRateLimit{pkX: {Rate: 1}})
+
+	// Buckets are kept until they are needed to be evicted.
+	for _, pk := range pks {
+		require.True(t, rl.allow(pk))
+	}
+	require.True(t, rl.allow(pkX))
+	require.False(t, rl.allow(pkX))
+	time.Sleep(time.Millisecond * 50)
+	require.Len(t, rl.buckets, minRequestBucketSweep)
+
+	// Refilled buckets are evicted once a new bucket is needed, while the limit of other clients is kept.
+	require.True(t, rl.allow(pkY))
+	require.Len(t, rl.buckets, 2)
+	require.False(t, rl.allow(pkX))
+}
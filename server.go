@@ -1,9 +1,14 @@
 package dmsg
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,14 +16,150 @@ import (
 
 	"github.com/skycoin/dmsg/cipher"
 	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/netutil"
+	"github.com/skycoin/dmsg/noise"
 	"github.com/skycoin/dmsg/servermetrics"
 )
 
 // ServerConfig configues the Server
 type ServerConfig struct {
 	MaxSessions    int
-	UpdateInterval time.Duration
+	MaxClients     int           // Maximum number of connected clients, 0 for unlimited (see Server.SetMaxClients).
+	UpdateInterval time.Duration // Duration between re-publications of the server's discovery entry.
+	DiscTimeout    time.Duration // Timeout of a single discovery call attempt.
+	DiscTries      int           // Maximum attempts of a discovery call which fails with a transient error.
+	DiscOpTimeout  time.Duration // Timeout of a whole discovery operation (including retries).
+
+	// PublicAddress is advertised in the server's discovery entry (unless an address is given to Serve), and may differ
+	// from the addresses listened on (i.e. behind NAT). If it is empty and AutoDetectPublicAddress is set, a global
+	// unicast IP of the host's interfaces is advertised with the port of the (first) listener. Otherwise, the address
+	// of the listener is advertised.
+	PublicAddress           string
+	AutoDetectPublicAddress bool
+
+	// SelfCheck checks that the advertised address reaches the server once it is serving (see
+	// Server.CheckAdvertisedAddr), and logs a prominent error if it does not.
+	SelfCheck bool
+
+	// Backoff between retries of failed discovery entry publications (see Server.EntryHealthy).
+	Backoff netutil.BackoffConfig
+
+	// Sessions of clients which have gone (without closing the connection) are detected and closed, along with the
+	// streams they relay. A session without received data for IdleTimeout is pinged, and closed if the ping is not
+	// responded to within ProbeTimeout. Zero values select DefaultIdleTimeout and DefaultProbeTimeout.
+	IdleTimeout  time.Duration
+	ProbeTimeout time.Duration
+
+	// SlowClientTimeout is the duration in which writes to the connection of a client may be blocked (as the client does
+	// not keep up with receiving data of it's session) before the client is disconnected with a GOAWAY notice of
+	// ErrClientTooSlow. Zero selects DefaultSlowClientTimeout, and a negative value disables disconnecting slow clients.
+	// It can be adjusted at runtime with Server.SetSlowClientTimeout.
+	SlowClientTimeout time.Duration
+
+	// RelayIdleTimeout is the duration after which a relayed stream without data in either direction is reaped: both
+	// clients are notified with ErrStreamIdle, and the stream is closed. Only streams of which a client is not heard
+	// from (no data is received on it's session, including responses to idle probes) for the longer of
+	// RelayIdleTimeout and IdleTimeout+ProbeTimeout are reaped, as streams of clients which are alive may merely be
+	// quiet. ReapQuietRelays reaps idle streams regardless. Zero disables reaping.
+	RelayIdleTimeout time.Duration
+	ReapQuietRelays  bool
+
+	// MaxStreamsPerClient is the maximum number of streams relayed at once for a single initiating client.
+	// Zero selects DefaultMaxStreamsPerClient, and a negative value imposes no limit (see
+	// Server.SetMaxStreamsPerClient).
+	MaxStreamsPerClient int
+
+	// Bandwidth limits the rates in which data of each client is relayed, and BandwidthOverrides overrides it for
+	// specific clients. Data exceeding the limits is delayed rather than dropped. Both can be adjusted at runtime (see
+	// Server.SetBandwidth and Server.SetClientBandwidth).
+	Bandwidth          BandwidthLimit
+	BandwidthOverrides map[cipher.PubKey]BandwidthLimit
+
+	// RequestRate limits the rate of stream requests which are relayed for each initiating client, and
+	// RequestRateOverrides overrides it for specific clients. Requests exceeding the limits are rejected with
+	// ErrReqRateLimited, without reaching the responding client. Both can be adjusted at runtime (see
+	// Server.SetRequestRate and Server.SetClientRequestRate).
+	RequestRate          RequestRateLimit
+	RequestRateOverrides map[cipher.PubKey]RequestRateLimit
+
+	// MaxTrafficPairs bounds the pairs of clients of which relayed traffic is accounted (see Server.TrafficStats).
+	// Zero selects DefaultMaxTrafficPairs, and a negative value disables accounting.
+	// If TrafficLogInterval is positive, the TrafficLogTopN pairs with the most traffic are logged in the interval
+	// (zero TrafficLogTopN selects DefaultTrafficLogTopN).
+	MaxTrafficPairs    int
+	TrafficLogInterval time.Duration
+	TrafficLogTopN     int
+
+	// MaxFrameSize is the largest frame of stream requests and responses which is read from clients. Streams of which
+	// the clients declare larger frames are closed, before the frames are allocated. Relays with small memory budgets
+	// may lower it, but not below the size of stream requests. Zero selects DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// MaxProtocolViolations is the number of protocol violations tolerated per client, such as frames which open
+	// streams with the IDs of open streams, or frames of streams which were never opened. Such frames are dropped (the
+	// client's other streams are unaffected), and clients which exceed the limit are disconnected with a GOAWAY notice
+	// of ErrProtocolViolation. Zero selects DefaultMaxProtocolViolations, and a negative value imposes no limit.
+	MaxProtocolViolations int
+
+	// StreamBufferSize bounds the data received on a stream of a client which is buffered until it is relayed, in
+	// bytes. Once the buffer is full, the client is held back by the flow control of the stream, so that the memory
+	// held for a relayed stream is bounded regardless of how slow the responding client reads. Clients which send data
+	// beyond the flow control (overflowing the buffer) are disconnected with a GOAWAY notice of
+	// ErrStreamBufferOverflow. Zero selects DefaultStreamBufferSize, and smaller values than MinStreamBufferSize are
+	// raised to it.
+	StreamBufferSize int
+
+	// ClientMemoryBudget bounds the memory held for a single client, in bytes: frames read from the client (stream
+	// requests and responses), and relayed data which is read from the client's peers but not yet written to the
+	// client. MemoryPolicy determines the handling of clients which exceed it (backpressure by default).
+	// TotalMemoryBudget bounds the memory held for all clients: while it is exhausted, sessions of new clients are
+	// rejected with a GOAWAY notice of ErrServerFull. Zero values impose no limit, and the usage is reported by
+	// Server.MemoryStats either way.
+	ClientMemoryBudget int64
+	TotalMemoryBudget  int64
+	MemoryPolicy       MemoryPolicy
+
+	// StreamLogSampling keeps debug logs of 1 in every StreamLogSampling relayed streams, so that busy servers can log
+	// at debug level (clients can be debugged in full via Server.SetClientDebugLogging). Zero selects
+	// DefaultStreamLogSampling, and a negative value keeps all logs.
+	StreamLogSampling int
+
+	// AllowedClients are the only clients which are served, if it is non-nil. BlockedClients are never served.
+	// Disallowed clients are disconnected right after the session handshake with a GOAWAY notice of ErrAccessDenied,
+	// and streams to them are rejected. Both lists can be adjusted at runtime (see Server.SetAllowedClients and
+	// Server.BlockClients).
+	AllowedClients []cipher.PubKey
+	BlockedClients []cipher.PubKey
+
+	// Metadata contains optional labels (such as region) advertised in the server's discovery entry.
+	Metadata map[string]string
+
+	// AltAddresses are advertised in the server's discovery entry alongside the primary address, for the server's other
+	// listeners (i.e. a TLS listener, see NewTLSListener, which serves alongside a TCP listener). The scheme of each
+	// address selects the transport which clients dial it by: tls:// for TLS, ws:// or wss:// for WebSocket, and none
+	// for TCP. Clients fall back to them in order if the primary address is unreachable.
+	AltAddresses []string
+
+	// Signer optionally signs the server's discovery entries in place of the secret key (see Config.Signer).
+	Signer disc.Signer
+
+	// CloseTimeout bounds waiting for Serve and the sessions to stop once the server is closed, after which Close
+	// returns ErrCloseTimeout rather than hanging (i.e. on a listener of which Accept is not unblocked by Close).
+	// Zero selects DefaultCloseTimeout, and a negative value waits indefinitely.
+	CloseTimeout time.Duration
+
+	// MaxPendingHandshakes bounds the connections which are in the session handshake at once, before their clients are
+	// authenticated. Once it is reached, the oldest pending handshake is dropped in favour of the new connection, so
+	// that connections which stall their handshakes cannot keep legitimate clients out. SessionHandshakeTimeout bounds
+	// the session handshake, after which the connection is dropped. Dropped connections are counted apart from the
+	// sessions of clients (see Server.DroppedHandshakes). Zero values select DefaultMaxPendingHandshakes and
+	// DefaultSessionHandshakeTimeout, and negative values impose no limit.
+	MaxPendingHandshakes    int
+	SessionHandshakeTimeout time.Duration
+
+	HandshakeMetrics handshakemetrics.Metrics // Optional metrics of session handshakes.
+	SlowHandshake    time.Duration            // Duration after which a handshake is logged as slow (negative to disable).
 }
 
 // DefaultServerConfig returns the default server config.
@@ -26,6 +167,12 @@ func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
 		MaxSessions:    DefaultMaxSessions,
 		UpdateInterval: DefaultUpdateInterval,
+		DiscTimeout:    DefaultDiscTimeout,
+		DiscTries:      DefaultDiscTries,
+		DiscOpTimeout:  DefaultDiscOpTimeout,
+		IdleTimeout:    DefaultIdleTimeout,
+		ProbeTimeout:   DefaultProbeTimeout,
+		SlowHandshake:  DefaultSlowHandshake,
 	}
 }
 
@@ -33,7 +180,7 @@ func DefaultServerConfig() *ServerConfig {
 type Server struct {
 	EntityCommon
 
-	m servermetrics.Metrics
+	m servermetrics.ExtendedMetrics // extended metrics are only recorded if supported by the given metrics
 
 	ready     chan struct{} // Closed once dmsg.Server is serving.
 	readyOnce sync.Once
@@ -42,12 +189,58 @@ type Server struct {
 	once sync.Once
 	wg   sync.WaitGroup
 
+	shutdown     chan struct{} // Closed once the server starts shutting down (see Shutdown).
+	shutdownOnce sync.Once
+
 	// Public TCP address which the dmsg server advertises itself as.
-	// This should only be set once. Once set, addrDone closes.
-	addr     string
-	addrDone chan struct{}
+	// This should only be set once. Once set, addrDone closes. It may be updated afterwards via UpdateAdvertisedAddr,
+	// which signals entryUpdate.
+	addr        string
+	addrMx      sync.RWMutex
+	addrDone    chan struct{}
+	entryUpdate chan struct{} // signals that the discovery entry is to be re-published immediately
+
+	publicAddr     string // configured public address
+	autoDetectAddr bool   // whether to auto-detect the public address if none is configured
+	selfCheck      bool   // whether to check the advertised address once serving
+
+	backoff      netutil.BackoffConfig
+	entryHealthy int32 // atomic, 1 if the last publication of the discovery entry succeeded
+	clients      int64 // atomic, number of sessions as of the last session change (see Readiness)
+
+	listenerErr   error // error of the first listener which failed (see Healthy)
+	listenerErrMx sync.Mutex
 
 	maxSessions int
+	maxClients  int64 // atomic
+	draining    int32 // atomic, 1 if the server is draining (see SetDraining)
+	metadata    map[string]string
+	altAddrs    []string
+
+	idleTimeout       time.Duration
+	probeTimeout      time.Duration
+	slowClientTimeout int64 // atomic, time.Duration (see SetSlowClientTimeout)
+	relayIdleTimeout  time.Duration
+	closeTimeout      time.Duration
+	closeErr          error // result of Close
+	reapQuietRelays   bool
+	handshakeTimeout  time.Duration
+
+	streams *streamCounter    // streams relayed per initiating client
+	bw      *bandwidthLimiter // bandwidth of clients with relayed streams
+	reqs    *requestLimiter   // rates of stream requests of clients
+	traffic *trafficTable     // traffic relayed between pairs of clients (nil if disabled)
+
+	handshakes *handshakeLimiter // connections in the session handshake
+
+	trafficLogInterval time.Duration
+	trafficLogTopN     int
+
+	logs *sessionLogs // logging of sessions
+	acl  *clientACL   // clients which are served
+
+	overBudget sync.Map // sessions (*SessionCommon) of clients being disconnected as they exceed their memory budget
+	denied     sync.Map // sessions (*SessionCommon) of clients being disconnected as they are denied access
 }
 
 // NewServer creates a new dmsg server entity.
@@ -60,40 +253,732 @@ func NewServer(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, conf *Serv
 	}
 	log := logging.MustGetLogger("dmsg_server")
 
+	dc = disc.NewRetrying(dc, disc.RetryConfig{
+		Timeout:   conf.DiscTimeout,
+		Tries:     conf.DiscTries,
+		OpTimeout: conf.DiscOpTimeout,
+	})
+
 	s := new(Server)
 	s.EntityCommon.init(pk, sk, dc, log, conf.UpdateInterval)
-	s.m = m
+	s.m = servermetrics.Extend(m)
 	s.ready = make(chan struct{})
 	s.done = make(chan struct{})
+	s.shutdown = make(chan struct{})
 	s.addrDone = make(chan struct{})
+	s.entryUpdate = make(chan struct{}, 1)
+	s.publicAddr = conf.PublicAddress
+	s.autoDetectAddr = conf.AutoDetectPublicAddress
+	s.selfCheck = conf.SelfCheck
+	s.backoff = conf.Backoff
+	if s.backoff == (netutil.BackoffConfig{}) {
+		s.backoff = DefaultBackoffConfig()
+	}
 	s.maxSessions = conf.MaxSessions
+	s.maxClients = int64(conf.MaxClients)
+	s.idleTimeout = conf.IdleTimeout
+	if s.idleTimeout == 0 {
+		s.idleTimeout = DefaultIdleTimeout
+	}
+	s.probeTimeout = conf.ProbeTimeout
+	if s.probeTimeout == 0 {
+		s.probeTimeout = DefaultProbeTimeout
+	}
+	s.slowClientTimeout = int64(conf.SlowClientTimeout)
+	if s.slowClientTimeout == 0 {
+		s.slowClientTimeout = int64(DefaultSlowClientTimeout)
+	}
+	s.relayIdleTimeout = conf.RelayIdleTimeout
+	s.closeTimeout = conf.CloseTimeout
+	if s.closeTimeout == 0 {
+		s.closeTimeout = DefaultCloseTimeout
+	}
+	s.reapQuietRelays = conf.ReapQuietRelays
+	s.handshakeTimeout = conf.SessionHandshakeTimeout
+	if s.handshakeTimeout == 0 {
+		s.handshakeTimeout = DefaultSessionHandshakeTimeout
+	}
+	maxHandshakes := conf.MaxPendingHandshakes
+	if maxHandshakes == 0 {
+		maxHandshakes = DefaultMaxPendingHandshakes
+	}
+	s.handshakes = newHandshakeLimiter(maxHandshakes)
+	s.metadata = conf.Metadata
+	s.altAddrs = conf.AltAddresses
+	s.maxFrameSize = conf.MaxFrameSize
+	if s.maxFrameSize == 0 {
+		s.maxFrameSize = DefaultMaxFrameSize
+	}
+	s.streamWindow = streamWindow(conf.StreamBufferSize)
+	s.maxViolations = conf.MaxProtocolViolations
+	if s.maxViolations == 0 {
+		s.maxViolations = DefaultMaxProtocolViolations
+	}
+	maxStreams := conf.MaxStreamsPerClient
+	if maxStreams == 0 {
+		maxStreams = DefaultMaxStreamsPerClient
+	}
+	s.streams = newStreamCounter(maxStreams)
+	s.bw = newBandwidthLimiter(conf.Bandwidth, conf.BandwidthOverrides)
+	s.reqs = newRequestLimiter(conf.RequestRate, conf.RequestRateOverrides)
+	maxPairs := conf.MaxTrafficPairs
+	if maxPairs == 0 {
+		maxPairs = DefaultMaxTrafficPairs
+	}
+	if maxPairs > 0 {
+		s.traffic = newTrafficTable(maxPairs)
+	}
+	s.trafficLogInterval = conf.TrafficLogInterval
+	s.trafficLogTopN = conf.TrafficLogTopN
+	if s.trafficLogTopN <= 0 {
+		s.trafficLogTopN = DefaultTrafficLogTopN
+	}
+	logSampling := conf.StreamLogSampling
+	if logSampling == 0 {
+		logSampling = DefaultStreamLogSampling
+	}
+	s.logs = newSessionLogs(logSampling)
+	s.acl = newClientACL()
+	if conf.AllowedClients != nil {
+		s.acl.allow.set(conf.AllowedClients)
+	}
+	s.acl.addBlocked(conf.BlockedClients)
+	s.mem = newMemoryBudget(conf.ClientMemoryBudget, conf.TotalMemoryBudget, conf.MemoryPolicy, s.disconnectOverBudget)
+	s.signer = conf.Signer
+	if conf.HandshakeMetrics != nil {
+		s.hsMetrics = conf.HandshakeMetrics
+	}
+	s.slowHandshake = conf.SlowHandshake
+	if s.slowHandshake == 0 {
+		s.slowHandshake = DefaultSlowHandshake
+	}
+	// Session callbacks are called with sessionsMx held, so the entry is published by updateEntryLoop instead.
 	s.setSessionCallback = func(ctx context.Context, sessionCount int) error {
-		return s.updateServerEntry(ctx, s.AdvertisedAddr(), s.maxSessions)
+		atomic.StoreInt64(&s.clients, int64(sessionCount))
+		s.updateEntry()
+		return nil
 	}
 	s.delSessionCallback = func(ctx context.Context, sessionCount int) error {
-		return s.updateServerEntry(ctx, s.AdvertisedAddr(), s.maxSessions)
+		atomic.StoreInt64(&s.clients, int64(sessionCount))
+		s.updateEntry()
+		return nil
 	}
 	return s
 }
 
 // Close implements io.Closer
+// If Serve or the sessions do not stop within ServerConfig.CloseTimeout, ErrCloseTimeout is returned (and they are
+// left to stop in the background).
 func (s *Server) Close() error {
 	if s == nil {
 		return nil
 	}
 	s.once.Do(func() {
 		close(s.done)
-		s.wg.Wait()
+		s.closeErr = s.waitStopped()
 	})
+	return s.closeErr
+}
+
+// waitStopped waits for Serve and the sessions to stop, for at most the close timeout.
+func (s *Server) waitStopped() error {
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	if s.closeTimeout < 0 {
+		<-stopped
+		return nil
+	}
+
+	t := time.NewTimer(s.closeTimeout)
+	defer t.Stop()
+	select {
+	case <-stopped:
+		return nil
+	case <-t.C:
+		s.log.WithField("close_timeout", s.closeTimeout).
+			Warn("Serve or sessions did not stop in time, closed server without waiting for them.")
+		return ErrCloseTimeout
+	}
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting sessions, and sends a GOAWAY notice to all clients so
+// that they move to other servers. Once all sessions are closed by the clients (or the context is done), the server is
+// closed, which closes the remaining sessions along with the streams they relay.
+// The context error is returned if sessions remain when the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+
+	s.sessionsMx.Lock()
+	sessions := make([]*SessionCommon, 0, len(s.sessions))
+	for _, ses := range s.sessions {
+		sessions = append(sessions, ses)
+	}
+	s.sessionsMx.Unlock()
+
+	s.log.WithField("sessions", len(sessions)).Info("Shutting down server...")
+	for _, ses := range sessions {
+		go s.sendGoAway(s.log.WithField("remote_pk", ses.RemotePK()), ses, ErrServerGoAway)
+	}
+
+	err := s.waitSessions(ctx)
+	if err != nil {
+		s.log.WithError(err).WithField("sessions", s.SessionCount()).Warn("Sessions did not close before shutdown deadline.")
+	}
+	if cErr := s.Close(); cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// SetMaxClients sets the maximum number of connected clients, 0 for unlimited.
+// Sessions of existing clients are unaffected when the maximum is lowered.
+func (s *Server) SetMaxClients(n int) {
+	atomic.StoreInt64(&s.maxClients, int64(n))
+}
+
+// MaxClients returns the maximum number of connected clients, 0 for unlimited.
+func (s *Server) MaxClients() int {
+	return int(atomic.LoadInt64(&s.maxClients))
+}
+
+// SetAllowedClients sets the clients which are served, replacing previously allowed clients. Connected clients which
+// are no longer allowed are disconnected with ErrAccessDenied. By default, all clients are allowed.
+func (s *Server) SetAllowedClients(pks []cipher.PubKey) {
+	s.acl.allow.set(pks)
+	s.enforceACL()
+}
+
+// AllowClients adds the given clients to the allowed clients.
+// If all clients were allowed, only the given clients are allowed afterwards.
+func (s *Server) AllowClients(pks ...cipher.PubKey) {
+	s.acl.allow.add(pks)
+	s.enforceACL()
+}
+
+// DisallowClients removes the given clients from the allowed clients, and disconnects them.
+// It has no effect if all clients are allowed.
+func (s *Server) DisallowClients(pks ...cipher.PubKey) {
+	s.acl.allow.remove(pks)
+	s.enforceACL()
+}
+
+// AllowAllClients allows all clients (which are not blocked) to be served.
+func (s *Server) AllowAllClients() { s.acl.allow.allowAll() }
+
+// AllowedClients returns the clients which are served, and whether all clients are allowed.
+func (s *Server) AllowedClients() (pks []cipher.PubKey, all bool) { return s.acl.allow.list() }
+
+// BlockClients blocks the given clients, regardless of the allowed clients. Connected clients which are blocked are
+// disconnected with ErrAccessDenied.
+func (s *Server) BlockClients(pks ...cipher.PubKey) {
+	s.acl.addBlocked(pks)
+	s.enforceACL()
+}
+
+// UnblockClients removes the given clients from the blocked clients.
+func (s *Server) UnblockClients(pks ...cipher.PubKey) { s.acl.removeBlocked(pks) }
+
+// BlockedClients returns the blocked clients.
+func (s *Server) BlockedClients() []cipher.PubKey { return s.acl.blockList() }
+
+// SetMaxStreamsPerClient sets the maximum number of streams relayed at once for a single initiating client, a
+// non-positive value for no limit. Streams which are already relayed are unaffected when the maximum is lowered.
+func (s *Server) SetMaxStreamsPerClient(n int) {
+	s.streams.setMax(n)
+}
+
+// MaxStreamsPerClient returns the maximum number of streams relayed at once for a single initiating client, a
+// non-positive value for no limit.
+func (s *Server) MaxStreamsPerClient() int {
+	return s.streams.getMax()
+}
+
+// SetBandwidth sets the bandwidth limit of clients without an override (see SetClientBandwidth).
+// It applies to data relayed from now on, including over existing streams.
+func (s *Server) SetBandwidth(limit BandwidthLimit) {
+	s.bw.setDefault(limit)
+}
+
+// SetClientBandwidth overrides the bandwidth limit of the given client.
+// It applies to data relayed from now on, including over existing streams.
+func (s *Server) SetClientBandwidth(pk cipher.PubKey, limit BandwidthLimit) {
+	s.bw.setOverride(pk, &limit)
+}
+
+// ClearClientBandwidth removes the override of the bandwidth limit of the given client (see SetClientBandwidth).
+func (s *Server) ClearClientBandwidth(pk cipher.PubKey) {
+	s.bw.setOverride(pk, nil)
+}
+
+// SetRequestRate sets the rate limit of stream requests of clients without an override (see SetClientRequestRate).
+// It applies to requests from now on.
+func (s *Server) SetRequestRate(limit RequestRateLimit) {
+	s.reqs.setDefault(limit)
+}
+
+// SetClientRequestRate overrides the rate limit of stream requests of the given client.
+// It applies to requests from now on.
+func (s *Server) SetClientRequestRate(pk cipher.PubKey, limit RequestRateLimit) {
+	s.reqs.setOverride(pk, &limit)
+}
+
+// ClearClientRequestRate removes the override of the rate limit of stream requests of the given client (see
+// SetClientRequestRate).
+func (s *Server) ClearClientRequestRate(pk cipher.PubKey) {
+	s.reqs.setOverride(pk, nil)
+}
+
+// RateLimitedRequests returns the total number of stream requests which are rejected as their initiating clients
+// exceed their rate limits.
+func (s *Server) RateLimitedRequests() uint64 {
+	return s.reqs.limitedCount()
+}
+
+// PendingHandshakes returns the number of connections which are in the session handshake.
+func (s *Server) PendingHandshakes() int {
+	return s.handshakes.count()
+}
+
+// DroppedHandshakes returns the total number of connections which are dropped during the session handshake, as they
+// time out or are evicted by newer connections (see ServerConfig.MaxPendingHandshakes).
+func (s *Server) DroppedHandshakes() uint64 {
+	return s.handshakes.droppedCount()
+}
+
+// SetSlowClientTimeout sets the duration in which writes to a client may be blocked before the client is disconnected,
+// a non-positive value to disable disconnecting slow clients (see ServerConfig.SlowClientTimeout).
+// Existing sessions pick up the new timeout on their next check.
+func (s *Server) SetSlowClientTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&s.slowClientTimeout, int64(timeout))
+}
+
+// SlowClientTimeout returns the duration in which writes to a client may be blocked before the client is disconnected,
+// a non-positive value if slow clients are not disconnected.
+func (s *Server) SlowClientTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.slowClientTimeout))
+}
+
+// SetDraining sets whether the server is draining, i.e. to be taken out of rotation gradually.
+// A draining server refuses sessions of new clients (with a GOAWAY notice of ErrServerDraining), and advertises no
+// available sessions in discovery so that new clients do not pick it. Existing sessions, and the streams they relay,
+// are served as usual. Once SessionCount drops to zero, the server can be stopped without affecting clients.
+func (s *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.draining, v) == v {
+		return
+	}
+	s.log.WithField("draining", draining).WithField("sessions", s.SessionCount()).Info("Updated draining state.")
+	s.updateEntry()
+}
+
+// Draining returns whether the server is draining (see SetDraining).
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// entryMaxSessions returns the maximum number of sessions advertised in discovery (none while draining).
+func (s *Server) entryMaxSessions() int {
+	if s.Draining() {
+		return 0
+	}
+	return s.maxSessions
+}
+
+// SetClientDebugLogging enables (or disables) debug logging of the sessions and streams of the given client at runtime,
+// regardless of the server's log level and sampling (see ServerConfig.StreamLogSampling). Existing sessions of the
+// client are affected from their next stream.
+func (s *Server) SetClientDebugLogging(pk cipher.PubKey, enabled bool) {
+	s.logs.setDebug(pk, enabled)
+	s.log.WithField("client_pk", pk).WithField("enabled", enabled).Info("Updated debug logging of client.")
+}
+
+// ClientStreams returns the number of streams currently relayed per initiating client (of clients with streams).
+func (s *Server) ClientStreams() map[cipher.PubKey]int {
+	return s.streams.all()
+}
+
+// ClientBandwidth returns the bandwidth usage per client (of clients with relayed streams).
+func (s *Server) ClientBandwidth() map[cipher.PubKey]BandwidthStats {
+	return s.bw.all()
+}
+
+// MemoryStats returns the memory held for clients (see ServerConfig.ClientMemoryBudget).
+func (s *Server) MemoryStats() MemoryStats {
+	return s.mem.stats()
+}
+
+// TrafficStats returns a snapshot of the traffic relayed between pairs of clients, ordered by bytes (most first).
+// Only the ServerConfig.MaxTrafficPairs most recently used pairs are kept.
+func (s *Server) TrafficStats() []PairTraffic {
+	return s.traffic.all()
+}
+
+// logTrafficLoop logs the pairs of clients with the most relayed traffic in intervals, until the context is done.
+func (s *Server) logTrafficLoop(ctx context.Context) {
+	t := time.NewTicker(s.trafficLogInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			stats := s.TrafficStats()
+			if len(stats) > s.trafficLogTopN {
+				stats = stats[:s.trafficLogTopN]
+			}
+			for i, pt := range stats {
+				s.log.WithField("rank", i+1).
+					WithField("src_pk", pt.Src).
+					WithField("dst_pk", pt.Dst).
+					WithField("bytes", pt.Bytes).
+					WithField("frames", pt.Frames).
+					Info("Top traffic pair.")
+			}
+		}
+	}
+}
+
+// evictSession closes the given session, which is replaced by a newer session of the same client. The peers of the
+// streams it relays are notified that the client disconnected (see relay.close) once it is closed.
+// A client which migrates to a new address of the server keeps using the replaced session for it's existing streams,
+// so if the session has streams and is still alive (responds to a probe), it is only closed once the streams are
+// closed (or after replacedSessionTimeout). Otherwise (i.e. the client crashed and reconnected), it is closed at once.
+func (s *Server) evictSession(ses *SessionCommon) {
+	log := ses.log.WithField("func", "evictSession")
+	hasRelays := func() bool {
+		ses.relaysMx.Lock()
+		defer ses.relaysMx.Unlock()
+		return len(ses.relays) > 0
+	}
+
+	if hasRelays() {
+		if err := ses.probe(s.probeTimeout); err != nil {
+			log.WithError(err).Debug("Replaced session failed probe.")
+		} else {
+			t := time.NewTicker(drainPollInterval)
+			timeout := time.NewTimer(replacedSessionTimeout)
+		Wait:
+			for hasRelays() {
+				select {
+				case <-t.C:
+				case <-timeout.C:
+					break Wait
+				case <-ses.ys.CloseChan():
+					break Wait
+				case <-s.done:
+					break Wait
+				}
+			}
+			t.Stop()
+			timeout.Stop()
+		}
+	}
+	log.WithError(ses.Close()).Info("Closed replaced session of client.")
+}
+
+// reapIdleRelaysLoop reaps idle relayed streams in intervals (see ServerConfig.RelayIdleTimeout), until the context is
+// done.
+func (s *Server) reapIdleRelaysLoop(ctx context.Context) {
+	t := time.NewTicker(s.relayIdleTimeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.reapIdleRelays()
+		}
+	}
+}
+
+// reapIdleRelays reaps the relayed streams which are idle for ServerConfig.RelayIdleTimeout. Unless quiet relays are
+// reaped, a client of the relay must not be heard from for the longer of the timeout and the idle probe interval.
+func (s *Server) reapIdleRelays() {
+	aliveWindow := s.idleTimeout + s.probeTimeout
+	if aliveWindow < s.relayIdleTimeout {
+		aliveWindow = s.relayIdleTimeout
+	}
+	alive := func(ses *SessionCommon) bool {
+		return !ses.ys.IsClosed() && ses.idleFor() < aliveWindow
+	}
+
+	s.sessionsMx.Lock()
+	sessions := make([]*SessionCommon, 0, len(s.sessions))
+	for _, ses := range s.sessions {
+		sessions = append(sessions, ses)
+	}
+	s.sessionsMx.Unlock()
+
+	idle := make(map[*relay]struct{})
+	for _, ses := range sessions {
+		ses.relaysMx.Lock()
+		for r := range ses.relays {
+			if r.idleFor() >= s.relayIdleTimeout && (s.reapQuietRelays || !alive(r.src) || !alive(r.dst)) {
+				idle[r] = struct{}{}
+			}
+		}
+		ses.relaysMx.Unlock()
+	}
+
+	for r := range idle {
+		s.log.WithField("src_pk", r.src.RemotePK()).
+			WithField("dst_pk", r.dst.RemotePK()).
+			WithField("idle_for", r.idleFor()).
+			Info("Reaping idle relayed stream.")
+		go r.reap()
+	}
+}
+
+func (s *Server) sendGoAway(log logrus.FieldLogger, ses *SessionCommon, reason Error) {
+	if err := ses.sendGoAway(reason); err != nil {
+		log.WithError(err).Warn("Failed to send GOAWAY notice.")
+	}
+}
+
+// rejectSession notifies the client of the session that the server is full (or draining), and waits for the client to
+// close the session (or for rejectTimeout), so that the notice is received before the session is closed.
+// The cause is the servermetrics reason of the rejection.
+func (s *Server) rejectSession(log logrus.FieldLogger, dSes ServerSession, reason Error, cause string) {
+	switch cause {
+	case servermetrics.ReasonServerDraining:
+		log.Info("Server is draining, rejecting session.")
+	case servermetrics.ReasonMemoryBudget:
+		log.WithField("total_memory_budget", s.mem.total).Info("Memory budget of server is exhausted, rejecting session.")
+	case servermetrics.ReasonAccessDenied:
+		log.Info("Client is denied access, rejecting session.")
+	default:
+		log.WithField("max_clients", s.MaxClients()).Info("Server is full, rejecting session.")
+	}
+	s.m.RecordSessionRejected(cause)
+	s.sendGoAway(log, dSes.SessionCommon, reason)
+
+	t := time.NewTimer(rejectTimeout)
+	defer t.Stop()
+
+	select {
+	case <-dSes.ys.CloseChan():
+	case <-t.C:
+	case <-s.done:
+	}
+}
+
+// detectSlowClient disconnects the client of the session once writes to it's connection are blocked for the slow client
+// timeout, as it does not keep up with receiving data of the session. A client which does not read a single stream is
+// not disconnected, as only the stream is held back (by it's flow control window). The client is notified with a
+// GOAWAY notice (if it can be sent in time), and the streams relayed for the client are closed along with the session
+// (once the client closes it, or slowClientGoAwayTimeout passes).
+// The timeout is checked in quarters of it's current value (see SetSlowClientTimeout), and polled while disabled.
+// It returns when the session is closed.
+func (s *Server) detectSlowClient(log logrus.FieldLogger, dSes ServerSession) {
+	t := time.NewTimer(slowClientCheckInterval(s.SlowClientTimeout()))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-dSes.ys.CloseChan():
+			return
+		case <-t.C:
+		}
+
+		timeout := s.SlowClientTimeout()
+		t.Reset(slowClientCheckInterval(timeout))
+		if timeout <= 0 {
+			continue
+		}
+		blocked := dSes.writeBlockedFor()
+		if blocked < timeout {
+			continue
+		}
+
+		log.WithField("blocked_for", blocked).Warn("Client is too slow, disconnecting.")
+		s.m.RecordSlowClient()
+
+		go s.sendGoAway(log, dSes.SessionCommon, ErrClientTooSlow)
+		goAwayT := time.NewTimer(slowClientGoAwayTimeout)
+		select {
+		case <-dSes.ys.CloseChan():
+		case <-goAwayT.C:
+		case <-s.done:
+		}
+		goAwayT.Stop()
+
+		log.WithError(dSes.Close()).Info("Closed session of slow client.")
+		return
+	}
+}
+
+// disconnectOverBudget disconnects the client of the given public key, which exceeds it's memory budget (with the
+// MemoryDisconnect policy). As with slow clients, the client is notified with a GOAWAY notice before it's session is
+// closed. Further calls while the client is being disconnected are ignored.
+func (s *Server) disconnectOverBudget(pk cipher.PubKey) {
+	ses, ok := s.serverSession(pk)
+	if !ok {
+		return
+	}
+	if _, busy := s.overBudget.LoadOrStore(ses.SessionCommon, struct{}{}); busy {
+		return
+	}
+	log := ses.log.WithField("client_memory_budget", s.mem.perClient)
+	log.Warn("Client exceeds it's memory budget, disconnecting.")
+
+	go func() {
+		defer s.overBudget.Delete(ses.SessionCommon)
+
+		go s.sendGoAway(log, ses.SessionCommon, ErrClientOverBudget)
+		t := time.NewTimer(slowClientGoAwayTimeout)
+		defer t.Stop()
+		select {
+		case <-ses.ys.CloseChan():
+		case <-t.C:
+		case <-s.done:
+		}
+		log.WithError(ses.Close()).Info("Closed session of client which exceeds it's memory budget.")
+	}()
+}
+
+// enforceACL disconnects the connected clients which are denied access (after the access lists are changed).
+func (s *Server) enforceACL() {
+	s.sessionsMx.Lock()
+	var denied []*SessionCommon
+	for pk, ses := range s.sessions {
+		if !s.acl.permits(pk) {
+			denied = append(denied, ses)
+		}
+	}
+	s.sessionsMx.Unlock()
+
+	for _, ses := range denied {
+		s.disconnectDenied(ses)
+	}
+}
+
+// disconnectDenied disconnects the client of the given session, which is denied access. As with slow clients, the
+// client is notified with a GOAWAY notice before it's session is closed. Further calls while the client is being
+// disconnected are ignored.
+func (s *Server) disconnectDenied(ses *SessionCommon) {
+	if _, busy := s.denied.LoadOrStore(ses, struct{}{}); busy {
+		return
+	}
+	log := ses.log
+	log.Warn("Client is denied access, disconnecting.")
+	s.m.RecordSessionRejected(servermetrics.ReasonAccessDenied)
+
+	go func() {
+		defer s.denied.Delete(ses)
+
+		go s.sendGoAway(log, ses, ErrAccessDenied)
+		t := time.NewTimer(slowClientGoAwayTimeout)
+		defer t.Stop()
+		select {
+		case <-ses.ys.CloseChan():
+		case <-t.C:
+		case <-s.done:
+		}
+		log.WithError(ses.Close()).Info("Closed session of client which is denied access.")
+	}()
+}
+
+// notifyViolations notifies the client of the given session of frames of it's streams which are dropped as they are
+// duplicate or unknown (see frameGuard), until the session is closed. Notices are not sent once the client is being
+// disconnected for it's violations.
+func (s *Server) notifyViolations(log logrus.FieldLogger, ses *SessionCommon) {
+	for {
+		select {
+		case id := <-ses.guard.notices:
+			if err := ses.sendStreamNotice(id, ErrStreamFramesDropped); err != nil {
+				log.WithError(err).WithField("yamux_id", id).Debug("Failed to send notice of dropped stream frames.")
+			}
+		case <-ses.guard.exceeded:
+			return
+		case <-ses.ys.CloseChan():
+			return
+		}
+	}
+}
+
+// disconnectOnViolations disconnects the client of the given session once it exceeds the tolerated protocol
+// violations, or overflows the receive buffer of a stream (see frameGuard). As with clients which are denied access,
+// the client is notified with a GOAWAY notice before it's session is closed.
+func (s *Server) disconnectOnViolations(log logrus.FieldLogger, ses *SessionCommon) {
+	select {
+	case <-ses.guard.exceeded:
+	case <-ses.ys.CloseChan():
+		return
+	}
+	n, kind := ses.guard.count()
+	log = log.WithField("violations", n).WithField("last_violation", kind)
+	reason, cause := ErrProtocolViolation, servermetrics.ReasonViolation
+	if kind == violationBufferOverflow {
+		reason, cause = ErrStreamBufferOverflow, servermetrics.ReasonBufferOverflow
+	}
+	log.WithError(reason).Warn("Client exceeds the tolerated protocol violations, disconnecting.")
+	s.m.RecordSessionRejected(cause)
+
+	go s.sendGoAway(log, ses, reason)
+	t := time.NewTimer(slowClientGoAwayTimeout)
+	defer t.Stop()
+	select {
+	case <-ses.ys.CloseChan():
+	case <-t.C:
+	case <-s.done:
+	}
+	log.WithError(ses.Close()).Info("Closed session of client which violates the protocol.")
+}
+
+// slowClientCheckInterval returns the interval in which a session is checked for a slow client.
+func slowClientCheckInterval(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return slowClientPollInterval
+	}
+	return timeout / 4
+}
+
+// waitSessions waits until there are no sessions, or the context is done.
+func (s *Server) waitSessions(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+
+	for s.SessionCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
 	return nil
 }
 
-// Serve serves the server.
+// Serve serves the server on a single listener (see ServeListeners).
 func (s *Server) Serve(lis net.Listener, addr string) error {
-	s.SetAdvertisedAddr(lis, &addr)
+	return s.ServeListeners([]net.Listener{lis}, addr)
+}
+
+// ServeListeners serves the server on multiple listeners (i.e. of IPv4 and IPv6, or of an internal interface for
+// co-located clients), all of which feed the same sessions. The server is advertised by 'addr', which may differ from
+// the addresses of the listeners (the address of the first listener is used if empty).
+// All listeners are closed once the server is closed. If a listener fails, the rest keep accepting sessions, and the
+// errors of the listeners are returned as ListenerErrors (a single error is returned as is).
+func (s *Server) ServeListeners(liss []net.Listener, addr string) error {
+	if len(liss) == 0 {
+		return errors.New("no listeners to serve")
+	}
+	s.SetAdvertisedAddr(liss[0], &addr)
 
+	lisAddrs := make([]string, len(liss))
+	for i, lis := range liss {
+		lisAddrs[i] = lis.Addr().String()
+	}
 	log := s.log.
 		WithField("advertised_addr", addr).
+		WithField("listen_addrs", lisAddrs).
 		WithField("local_pk", s.pk)
 
 	log.Info("Serving server.")
@@ -103,11 +988,28 @@ func (s *Server) Serve(lis net.Listener, addr string) error {
 		s.wg.Done()
 	}()
 
+	var closeErrs ListenerErrors
+	closed := make(chan struct{}) // closed once all listeners are closed
+	closeListeners := func() error {
+		for _, lis := range liss {
+			if err := lis.Close(); err != nil {
+				closeErrs = append(closeErrs, err)
+			}
+		}
+		close(closed)
+		return closeErrs.errOrNil()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		<-s.done
+		select {
+		case <-s.done:
+			log.WithError(closeListeners()).Info("Stopping server...")
+		case <-s.shutdown:
+			log.WithError(closeListeners()).Info("Stopped accepting sessions.")
+			<-s.done
+		}
 		cancel()
-		log.WithError(lis.Close()).Info("Stopping server...")
 	}()
 
 	if err := s.startUpdateEntryLoop(ctx); err != nil {
@@ -116,11 +1018,61 @@ func (s *Server) Serve(lis net.Listener, addr string) error {
 
 	log.Info("Accepting sessions...")
 	s.readyOnce.Do(func() { close(s.ready) })
+
+	if s.traffic != nil && s.trafficLogInterval > 0 {
+		go s.logTrafficLoop(ctx)
+	}
+	if s.relayIdleTimeout > 0 {
+		go s.reapIdleRelaysLoop(ctx)
+	}
+	if s.selfCheck {
+		go func() {
+			if err := s.CheckAdvertisedAddr(ctx); err != nil {
+				log.WithError(err).
+					Error("SELF-CHECK FAILED: The advertised address does not reach this server, so clients cannot connect. " +
+						"Check the configured public address.")
+				return
+			}
+			log.Info("Self-check passed, the advertised address reaches this server.")
+		}()
+	}
+
+	acceptErrs := make([]error, len(liss))
+	var wg sync.WaitGroup
+	wg.Add(len(liss))
+	for i, lis := range liss {
+		go func(i int, lis net.Listener) {
+			defer wg.Done()
+			if acceptErrs[i] = s.acceptSessions(lis); acceptErrs[i] != nil {
+				s.setListenerErr(acceptErrs[i])
+				log.WithError(acceptErrs[i]).
+					WithField("listen_addr", lisAddrs[i]).
+					Error("Listener failed.")
+			}
+		}(i, lis)
+	}
+	wg.Wait()
+
+	var errs ListenerErrors
+	for _, err := range acceptErrs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if isClosed(s.done) || isClosed(s.shutdown) {
+		<-closed
+		errs = append(errs, closeErrs...)
+	}
+	return errs.errOrNil()
+}
+
+// acceptSessions accepts sessions on the listener until it is closed.
+func (s *Server) acceptSessions(lis net.Listener) error {
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			// If server is closed, there is no error to report.
-			if isClosed(s.done) {
+			// If server is closed (or shutting down), there is no error to report.
+			if isClosed(s.done) || isClosed(s.shutdown) {
 				return nil
 			}
 			return err
@@ -142,36 +1094,294 @@ func (s *Server) Serve(lis net.Listener, addr string) error {
 	}
 }
 
+// handshake performs the session handshake of the given connection, bounded by the handshake timeout and the limit of
+// pending handshakes (see ServerConfig.MaxPendingHandshakes).
+func (s *Server) handshake(log logrus.FieldLogger, conn net.Conn) (ServerSession, error) {
+	if s.handshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(s.handshakeTimeout)); err != nil {
+			return ServerSession{}, err
+		}
+	}
+
+	ph := s.handshakes.begin(conn)
+	dSes, err := makeServerSession(s.m, &s.EntityCommon, s.streams, s.bw, s.reqs, s.traffic, s.logs, s.acl, conn)
+	if s.handshakes.end(ph) {
+		if err == nil {
+			_ = dSes.Close() //nolint:errcheck
+		}
+		s.handshakes.drop()
+		s.m.RecordHandshakeDropped(servermetrics.ReasonHandshakeEvicted)
+		log.Debug("Dropped the oldest pending session handshake in favour of a newer connection.")
+		return ServerSession{}, errHandshakeEvicted
+	}
+	if err != nil {
+		s.m.RecordHandshake(servermetrics.HandshakeFailure)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		s.handshakes.drop()
+		s.m.RecordHandshakeDropped(servermetrics.ReasonHandshakeTimeout)
+		return ServerSession{}, err
+	}
+	if err != nil {
+		return ServerSession{}, err
+	}
+	s.m.RecordHandshake(servermetrics.HandshakeSuccess)
+
+	if s.handshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			_ = dSes.Close() //nolint:errcheck
+			return ServerSession{}, err
+		}
+	}
+	return dSes, nil
+}
+
+// ListenerErrors aggregates the errors of multiple listeners of a server.
+type ListenerErrors []error
+
+// Error implements error.
+func (errs ListenerErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d listener errors: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// errOrNil returns nil if there are no errors, the error itself if there is one, and errs otherwise.
+func (errs ListenerErrors) errOrNil() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
 func (s *Server) startUpdateEntryLoop(ctx context.Context) error {
 	err := netutil.NewDefaultRetrier(s.log).Do(ctx, func() error {
-		return s.updateServerEntry(ctx, s.AdvertisedAddr(), s.maxSessions)
+		return s.updateServerEntry(ctx, s.AdvertisedAddr(), s.altAddrs, s.entryMaxSessions(), s.metadata)
 	})
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt32(&s.entryHealthy, 1)
+
+	go s.updateEntryLoop(ctx)
+	return nil
+}
+
+// updateEntryLoop re-publishes the server's discovery entry every update interval (so that the entry is restored if
+// discovery loses it or it expires), and immediately once the advertised address, the draining state or the number of
+// sessions is updated (updates signaled during a publication are coalesced).
+// Failed publications are retried with backoff, and are reflected by EntryHealthy.
+func (s *Server) updateEntryLoop(ctx context.Context) {
+	backoff := netutil.NewBackoff(s.backoff)
+
+	t := time.NewTimer(s.updateInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.entryUpdate:
+			if !t.Stop() {
+				<-t.C
+			}
+
+		case <-t.C:
+			if lastUpdate, due := s.updateIsDue(); !due && s.EntryHealthy() {
+				t.Reset(s.updateInterval - time.Since(lastUpdate))
+				continue
+			}
+		}
+
+		err := s.updateServerEntry(ctx, s.AdvertisedAddr(), s.altAddrs, s.entryMaxSessions(), s.metadata)
+
+		if err != nil {
+			if atomic.SwapInt32(&s.entryHealthy, 0) == 1 {
+				s.log.WithError(err).Warn("Failed to update discovery entry, retrying with backoff.")
+			}
+			t.Reset(backoff.Next())
+			continue
+		}
+		if atomic.SwapInt32(&s.entryHealthy, 1) == 0 {
+			s.log.Info("Recovered updating discovery entry.")
+		}
+		backoff.Reset()
+
+		// Ensure we trigger another update within given 'updateInterval'.
+		t.Reset(s.updateInterval)
+	}
+}
+
+// EntryHealthy returns whether the last publication of the server's discovery entry succeeded.
+// While false, the publication is retried with backoff (see ServerConfig.Backoff).
+func (s *Server) EntryHealthy() bool {
+	return atomic.LoadInt32(&s.entryHealthy) == 1
+}
+
+// LastEntryPublished returns the time in which the server's discovery entry was last published (or confirmed to be
+// current) successfully, a zero time if it is yet to be published.
+func (s *Server) LastEntryPublished() time.Time {
+	lastUpdate := atomic.LoadInt64(&s.lastUpdate)
+	if lastUpdate == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastUpdate)
+}
+
+// Healthy returns nil if the server is serving, i.e. for liveness checks of the hosting process. Otherwise,
+// ErrServerNotServing is returned, wrapping the error of a failed listener (if any) or ErrEntityClosed once the server
+// is closed. It is cheap to call, and does not block.
+func (s *Server) Healthy() error {
+	switch {
+	case isClosed(s.done):
+		return ErrServerNotServing.Wrap(ErrEntityClosed)
+	case isClosed(s.shutdown) || !isClosed(s.ready):
+		return ErrServerNotServing
+	}
+	s.listenerErrMx.Lock()
+	err := s.listenerErr
+	s.listenerErrMx.Unlock()
+	if err != nil {
+		return ErrServerNotServing.Wrap(err)
+	}
+	return nil
+}
 
-	go s.updateServerEntryLoop(ctx, s.AdvertisedAddr(), s.maxSessions)
+// Readiness returns nil if the server is ready to accept sessions of new clients, i.e. for readiness checks of load
+// balancers (it is not named Ready, which returns a chan that closes once the server begins serving). The server is
+// ready while it is healthy (see Healthy), is not draining (ErrServerDraining), has less clients than MaxClients
+// (ErrServerFull), and it's discovery entry was published within the last two update intervals (ErrEntryStale).
+// It is cheap to call, and does not block.
+func (s *Server) Readiness() error {
+	if err := s.Healthy(); err != nil {
+		return err
+	}
+	if s.Draining() {
+		return ErrServerDraining
+	}
+	if max := s.MaxClients(); max > 0 && atomic.LoadInt64(&s.clients) >= int64(max) {
+		return ErrServerFull
+	}
+	if published := s.LastEntryPublished(); time.Since(published) > 2*s.updateInterval {
+		return ErrEntryStale
+	}
 	return nil
 }
 
+// setListenerErr records the error of a failed listener, unless one is already recorded.
+func (s *Server) setListenerErr(err error) {
+	s.listenerErrMx.Lock()
+	if s.listenerErr == nil {
+		s.listenerErr = err
+	}
+	s.listenerErrMx.Unlock()
+}
+
 // AdvertisedAddr returns the TCP address in which the dmsg server is advertised by.
 // This is the TCP address that should be contained within the dmsg discovery entry of this server.
 func (s *Server) AdvertisedAddr() string {
 	<-s.addrDone
+	s.addrMx.RLock()
+	defer s.addrMx.RUnlock()
 	return s.addr
 }
 
 // SetAdvertisedAddr sets the advertised TCP address in which the dmsg server is advertised by.
+// If 'addr' is empty, the configured public address is used (which is auto-detected if configured so), or the address
+// of the listener as a last resort.
 // This should only be called once.
 func (s *Server) SetAdvertisedAddr(lis net.Listener, addr *string) {
+	if *addr == "" {
+		*addr = s.publicAddr
+	}
+	if *addr == "" && s.autoDetectAddr {
+		detected, err := detectPublicAddr(lis.Addr())
+		if err != nil {
+			s.log.WithError(err).Warn("Failed to auto-detect public address.")
+		} else {
+			s.log.WithField("addr", detected).Info("Auto-detected public address.")
+			*addr = detected
+		}
+	}
 	if *addr == "" {
 		s.log.Warn("We are using a local addr as the advertised addr. This should only be done in a local test env.")
 		*addr = lis.Addr().String()
 	}
+	s.addrMx.Lock()
 	s.addr = *addr
+	s.addrMx.Unlock()
 	close(s.addrDone)
 }
 
+// detectPublicAddr returns a global unicast IP of the host's interfaces, with the port of the given listening address.
+func detectPublicAddr(lisAddr net.Addr) (string, error) {
+	_, port, err := net.SplitHostPort(lisAddr.String())
+	if err != nil {
+		return "", err
+	}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	ip, ok := netutil.PublicIP(ifAddrs)
+	if !ok {
+		return "", errors.New("no global unicast address of interfaces")
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// CheckAdvertisedAddr dials the advertised address, and performs a session handshake with the server (as an ephemeral
+// client). An error is returned if the address is not dialable, or reaches another server.
+func (s *Server) CheckAdvertisedAddr(ctx context.Context) error {
+	dialCtx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	conn, err := dialServer(dialCtx, s.AdvertisedAddr(), nil, AddrFamilyAuto)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }() //nolint:errcheck
+	if err := conn.SetDeadline(time.Now().Add(selfCheckTimeout)); err != nil {
+		return err
+	}
+
+	pk, sk := cipher.GenerateKeyPair()
+	ns, err := noise.New(noise.HandshakeXK, noise.Config{
+		LocalPK:   pk,
+		LocalSK:   sk,
+		RemotePK:  s.pk,
+		Initiator: true,
+	})
+	if err != nil {
+		return err
+	}
+	return noise.InitiatorHandshake(ns, bufio.NewReader(conn), conn)
+}
+
+// UpdateAdvertisedAddr updates the TCP address in which the dmsg server is advertised by (i.e. when the configured
+// public address changes), and re-publishes the server's discovery entry.
+// This should only be called once the server is serving.
+func (s *Server) UpdateAdvertisedAddr(addr string) {
+	s.addrMx.Lock()
+	s.addr = addr
+	s.addrMx.Unlock()
+	s.updateEntry()
+}
+
+// updateEntry triggers re-publishing the server's discovery entry (see updateEntryLoop).
+func (s *Server) updateEntry() {
+	select {
+	case s.entryUpdate <- struct{}{}:
+	default:
+	}
+}
+
 // Ready returns a chan which blocks until the server begins serving.
 func (s *Server) Ready() <-chan struct{} {
 	return s.ready
@@ -179,17 +1389,24 @@ func (s *Server) Ready() <-chan struct{} {
 
 func (s *Server) handleSession(conn net.Conn) {
 	log := logrus.FieldLogger(s.log.WithField("remote_tcp", conn.RemoteAddr()))
+	log.Info("Accepted connection.")
 
-	dSes, err := makeServerSession(s.m, &s.EntityCommon, conn)
+	dSes, err := s.handshake(log, conn)
 	if err != nil {
+		log.WithError(err).Info("Session handshake failed.")
 		if err := conn.Close(); err != nil {
 			log.WithError(err).Debug("On handleSession() failure, close connection resulted in error.")
 		}
 		return
 	}
 
-	log = log.WithField("remote_pk", dSes.RemotePK())
-	log.Info("Started session.")
+	// All logs of the session carry the client's PK and the ID of the session.
+	dSes.log = dSes.log.
+		WithField("session_id", s.logs.nextID()).
+		WithField("remote_tcp", conn.RemoteAddr())
+	dSes.levels = newLevelLoggers(dSes.log)
+	log = s.logs.sessionLogger(dSes.levels, dSes.RemotePK())
+	log.Info("Session handshake completed.")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
@@ -197,10 +1414,49 @@ func (s *Server) handleSession(conn net.Conn) {
 		log.WithError(dSes.Close()).Info("Stopped session.")
 	}()
 
-	if s.setSession(ctx, dSes.SessionCommon) {
-		dSes.Serve()
+	// A newer session of the same client replaces the current one, which is evicted (see evictSession).
+	// While draining, only clients with existing sessions are served.
+	// The same applies while the total memory budget is exhausted. Clients which are denied access are never served.
+	reason, cause := ErrServerFull, servermetrics.ReasonServerFull
+	var old *SessionCommon
+	var ok bool
+	switch {
+	case !s.acl.permits(dSes.RemotePK()):
+		reason, cause = ErrAccessDenied, servermetrics.ReasonAccessDenied
+	case s.Draining():
+		reason, cause = ErrServerDraining, servermetrics.ReasonServerDraining
+		old, ok = s.replaceSession(dSes.SessionCommon)
+	case s.mem.exhausted():
+		cause = servermetrics.ReasonMemoryBudget
+		old, ok = s.replaceSession(dSes.SessionCommon)
+	default:
+		old, ok = s.setOrReplaceSession(ctx, dSes.SessionCommon, s.MaxClients())
+	}
+	if !ok {
+		s.rejectSession(log, dSes, reason, cause)
+		cancel()
+		return
+	}
+	if old != nil {
+		log.Info("Replaced existing session of client.")
+		go s.evictSession(old)
+	}
+	// The access lists may have changed since the session is checked.
+	if !s.acl.permits(dSes.RemotePK()) {
+		s.disconnectDenied(dSes.SessionCommon)
+	}
+	// Sessions established while shutting down may have missed the GOAWAY notice.
+	if isClosed(s.shutdown) {
+		go s.sendGoAway(log, dSes.SessionCommon, ErrServerGoAway)
 	}
+	go dSes.probeIdle(s.idleTimeout, s.probeTimeout)
+	go s.detectSlowClient(log, dSes)
+	go s.notifyViolations(log, dSes.SessionCommon)
+	go s.disconnectOnViolations(log, dSes.SessionCommon)
+	err = dSes.serve()
+	log.WithField("reason", err).Info("Session disconnected.")
 
-	s.delSession(ctx, dSes.RemotePK())
+	dSes.closeRelays()
+	s.delSessionIfCurrent(ctx, dSes.SessionCommon)
 	cancel()
 }
@@ -0,0 +1,69 @@
+package dmsg
+
+import (
+	"sync"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// clientACL controls the clients which a server serves: a client must be allowed (all clients are allowed until a list
+// is set), and not blocked. It is safe for concurrent use.
+type clientACL struct {
+	allow *peerAllowlist
+
+	block map[cipher.PubKey]struct{}
+	mx    sync.RWMutex
+}
+
+func newClientACL() *clientACL {
+	return &clientACL{
+		allow: newPeerAllowlist(),
+		block: make(map[cipher.PubKey]struct{}),
+	}
+}
+
+// permits returns true if the client of the given public key may be served.
+func (a *clientACL) permits(pk cipher.PubKey) bool {
+	return a.allow.allowed(pk) && !a.blocked(pk)
+}
+
+// blocked returns true if the client of the given public key is blocked.
+func (a *clientACL) blocked(pk cipher.PubKey) bool {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+
+	_, ok := a.block[pk]
+	return ok
+}
+
+// blockList returns the blocked clients.
+func (a *clientACL) blockList() []cipher.PubKey {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+
+	pks := make([]cipher.PubKey, 0, len(a.block))
+	for pk := range a.block {
+		pks = append(pks, pk)
+	}
+	return pks
+}
+
+// addBlocked adds the given clients to the blocked clients.
+func (a *clientACL) addBlocked(pks []cipher.PubKey) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for _, pk := range pks {
+		a.block[pk] = struct{}{}
+	}
+}
+
+// removeBlocked removes the given clients from the blocked clients.
+func (a *clientACL) removeBlocked(pks []cipher.PubKey) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for _, pk := range pks {
+		delete(a.block, pk)
+	}
+}
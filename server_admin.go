@@ -0,0 +1,100 @@
+package dmsg
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// ClientInfo describes a client which is connected to a server.
+type ClientInfo struct {
+	PK             cipher.PubKey `json:"pk"`
+	RemoteAddr     string        `json:"remote_addr"`
+	ConnectedSince time.Time     `json:"connected_since"`
+	Channels       int           `json:"channels"`       // Streams relayed from or to the client.
+	BytesSent      uint64        `json:"bytes_sent"`     // Bytes relayed from the client to it's peers.
+	BytesReceived  uint64        `json:"bytes_received"` // Bytes relayed from the client's peers to the client.
+	QueueDepth     int           `json:"queue_depth"`    // Writes to the client which are pending (i.e. blocked on it).
+
+	ProtocolViolations uint64        `json:"protocol_violations"` // Dropped frames (see ServerConfig.MaxProtocolViolations).
+	Handshake          HandshakeInfo `json:"handshake"`           // Noise handshake which established the session.
+}
+
+// ChannelInfo describes a stream which a server relays from or to a client.
+type ChannelInfo struct {
+	PeerPK        cipher.PubKey `json:"peer_pk"`
+	ID            uint32        `json:"id"`             // ID of the stream within the session of the client.
+	Initiator     bool          `json:"initiator"`      // Whether the client initiated the stream.
+	Age           time.Duration `json:"age"`            // Duration since the stream was established.
+	BytesSent     uint64        `json:"bytes_sent"`     // Bytes relayed from the client to the peer.
+	BytesReceived uint64        `json:"bytes_received"` // Bytes relayed from the peer to the client.
+}
+
+// Clients returns a snapshot of the connected clients, ordered by the time they connected (oldest first).
+// Only the counters of the relays are read, so relaying is not stalled by the call.
+func (s *Server) Clients() []ClientInfo {
+	s.sessionsMx.Lock()
+	sessions := make([]*SessionCommon, 0, len(s.sessions))
+	for _, ses := range s.sessions {
+		sessions = append(sessions, ses)
+	}
+	s.sessionsMx.Unlock()
+
+	infos := make([]ClientInfo, len(sessions))
+	for i, ses := range sessions {
+		ses.relaysMx.Lock()
+		channels := len(ses.relays)
+		ses.relaysMx.Unlock()
+		violations, _ := ses.guard.count()
+
+		infos[i] = ClientInfo{
+			PK:             ses.RemotePK(),
+			RemoteAddr:     ses.RemoteTCPAddr().String(),
+			ConnectedSince: ses.since,
+			Channels:       channels,
+			BytesSent:      atomic.LoadUint64(&ses.relayedOut),
+			BytesReceived:  atomic.LoadUint64(&ses.relayedIn),
+			QueueDepth:     ses.writes.count(),
+
+			ProtocolViolations: violations,
+			Handshake:          ses.HandshakeInfo(),
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedSince.Before(infos[j].ConnectedSince) })
+	return infos
+}
+
+// Channels returns a snapshot of the streams relayed from or to the connected client of the given public key, ordered
+// by age (oldest first). It returns nil if the client is not connected.
+func (s *Server) Channels(clientPK cipher.PubKey) []ChannelInfo {
+	ses, ok := s.session(clientPK)
+	if !ok {
+		return nil
+	}
+
+	ses.relaysMx.Lock()
+	relays := make([]*relay, 0, len(ses.relays))
+	for r := range ses.relays {
+		relays = append(relays, r)
+	}
+	ses.relaysMx.Unlock()
+
+	now := time.Now()
+	infos := make([]ChannelInfo, len(relays))
+	for i, r := range relays {
+		fwd, bwd := atomic.LoadUint64(&r.fwd), atomic.LoadUint64(&r.bwd)
+		info := ChannelInfo{Age: now.Sub(r.since)}
+		if r.src == ses {
+			info.PeerPK, info.ID, info.Initiator = r.dst.RemotePK(), r.srcStr.StreamID(), true
+			info.BytesSent, info.BytesReceived = fwd, bwd
+		} else {
+			info.PeerPK, info.ID = r.src.RemotePK(), r.dstStr.StreamID()
+			info.BytesSent, info.BytesReceived = bwd, fwd
+		}
+		infos[i] = info
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Age > infos[j].Age })
+	return infos
+}
@@ -3,6 +3,7 @@ package dmsg
 import (
 	"io"
 	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/skycoin/yamux"
@@ -15,10 +16,19 @@ import (
 // ServerSession represents a session from the perspective of a dmsg server.
 type ServerSession struct {
 	*SessionCommon
-	m servermetrics.Metrics
+	m       servermetrics.ExtendedMetrics
+	streams *streamCounter    // streams relayed per initiating client (shared by the server's sessions)
+	bw      *bandwidthLimiter // bandwidth of clients (shared by the server's sessions)
+	reqs    *requestLimiter   // rates of stream requests of clients (shared by the server's sessions)
+	traffic *trafficTable     // traffic relayed between clients (shared by the server's sessions)
+	logs    *sessionLogs      // logging of sessions (shared by the server's sessions)
+	levels  *levelLoggers     // loggers of the session at other levels (set once the session's logger is complete)
+	acl     *clientACL        // clients which are served (shared by the server's sessions)
 }
 
-func makeServerSession(m servermetrics.Metrics, entity *EntityCommon, conn net.Conn) (ServerSession, error) {
+func makeServerSession(m servermetrics.ExtendedMetrics, entity *EntityCommon, streams *streamCounter,
+	bw *bandwidthLimiter, reqs *requestLimiter, traffic *trafficTable, logs *sessionLogs, acl *clientACL,
+	conn net.Conn) (ServerSession, error) {
 	var sSes ServerSession
 	sSes.SessionCommon = new(SessionCommon)
 	sSes.nMap = make(noise.NonceMap)
@@ -27,6 +37,12 @@ func makeServerSession(m servermetrics.Metrics, entity *EntityCommon, conn net.C
 		return sSes, err
 	}
 	sSes.m = m
+	sSes.streams = streams
+	sSes.bw = bw
+	sSes.reqs = reqs
+	sSes.traffic = traffic
+	sSes.logs = logs
+	sSes.acl = acl
 	return sSes, nil
 }
 
@@ -40,27 +56,31 @@ func (ss *ServerSession) Close() error {
 
 // Serve serves the session.
 func (ss *ServerSession) Serve() {
+	switch err := ss.serve(); err {
+	case yamux.ErrSessionShutdown, io.EOF:
+		ss.log.WithError(err).Info("Stopping session...")
+	default:
+		ss.log.WithError(err).Warn("Failed to accept stream, stopping session...")
+	}
+}
+
+// serve serves the session until it is closed, and returns the reason.
+func (ss *ServerSession) serve() error {
 	ss.m.RecordSession(servermetrics.DeltaConnect)          // record successful connection
 	defer ss.m.RecordSession(servermetrics.DeltaDisconnect) // record disconnection
 
 	for {
 		yStr, err := ss.ys.AcceptStream()
 		if err != nil {
-			switch err {
-			case yamux.ErrSessionShutdown, io.EOF:
-				ss.log.WithError(err).Info("Stopping session...")
-			default:
-				ss.log.WithError(err).Warn("Failed to accept stream, stopping session...")
-			}
-			return
+			return err
 		}
 
-		log := ss.log.WithField("yamux_id", yStr.StreamID())
-		log.Info("Initiating stream.")
+		log := ss.logs.streamLogger(ss.levels, ss.rPK).WithField("yamux_id", yStr.StreamID())
+		log.Debug("Initiating stream.")
 
 		go func(yStr *yamux.Stream) {
 			err := ss.serveStream(log, yStr)
-			log.WithError(err).Info("Stopped stream.")
+			log.WithError(err).Debug("Stopped stream.")
 		}(yStr)
 	}
 }
@@ -89,27 +109,93 @@ func (ss *ServerSession) serveStream(log logrus.FieldLogger, yStr *yamux.Stream)
 	req, err := readRequest()
 	if err != nil {
 		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		if err == ErrFrameTooLarge {
+			ss.m.RecordStreamRejected(servermetrics.ReasonFrameTooLarge)
+			log.WithError(yStr.Close()).
+				WithField("max_frame_size", ss.entity.maxFrameSize).
+				Warn("Client declared a frame which is too large, closed stream.")
+		}
 		return err
 	}
 
+	if ss.logs.isDebug(req.DstAddr.PK) {
+		log = ss.levels.withLevel(logrus.DebugLevel).WithField("yamux_id", yStr.StreamID())
+	}
 	log = log.
 		WithField("src_addr", req.SrcAddr).
 		WithField("dst_addr", req.DstAddr)
 
 	log.Debug("Read stream request from initiating side.")
 
+	// Neither side may be denied access (the initiating side may be denied after it's session is established).
+	if !ss.acl.permits(req.SrcAddr.PK) || !ss.acl.permits(req.DstAddr.PK) {
+		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		ss.m.RecordStreamRejected(servermetrics.ReasonAccessDenied)
+		log.Info("Client is denied access, rejecting stream.")
+		if wErr := ss.writeObject(yStr, ss.makeRejection(req, ErrReqAccessDenied)); wErr != nil {
+			log.WithError(wErr).Debug("Failed to write stream rejection.")
+		}
+		return ErrReqAccessDenied
+	}
+
+	// Limit the rate of requests of the initiating client. The responding side is not involved on rejection.
+	if !ss.reqs.allow(req.SrcAddr.PK) {
+		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		ss.m.RecordStreamRejected(servermetrics.ReasonRateLimited)
+		log.Debug("Client exceeds it's rate limit of requests, rejecting stream.")
+		if wErr := ss.writeObject(yStr, ss.makeRejection(req, ErrReqRateLimited)); wErr != nil {
+			log.WithError(wErr).Debug("Failed to write stream rejection.")
+		}
+		return ErrReqRateLimited
+	}
+
+	// Limit the streams relayed for the initiating client. The responding side is not involved on rejection.
+	release, ok := ss.streams.acquire(req.SrcAddr.PK)
+	if !ok {
+		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		ss.m.RecordStreamRejected(servermetrics.ReasonTooManyStreams)
+		log.WithField("max_streams", ss.streams.getMax()).Warn("Client has too many relayed streams, rejecting stream.")
+		if wErr := ss.writeObject(yStr, ss.makeRejection(req, ErrReqTooManyStreams)); wErr != nil {
+			log.WithError(wErr).Debug("Failed to write stream rejection.")
+		}
+		return ErrReqTooManyStreams
+	}
+	defer release()
+
 	// Obtain next session.
 	ss2, ok := ss.entity.serverSession(req.DstAddr.PK)
 	if !ok {
 		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		ss.m.RecordStreamRejected(servermetrics.ReasonNoNextSession)
+		if wErr := ss.writeObject(yStr, ss.makeRejection(req, ErrReqNoNextSession)); wErr != nil {
+			log.WithError(wErr).Debug("Failed to write stream rejection.")
+		}
 		return ErrReqNoNextSession
 	}
 	log.Debug("Obtained next session.")
 
 	// Forward request and obtain/check response.
+	start := time.Now()
 	yStr2, resp, err := ss2.forwardRequest(req)
+	if err == nil || resp != nil { // the request is relayed once the responding side responds to it
+		ss.m.RecordRelayedFrame(servermetrics.DirectionForward, servermetrics.FrameRequest)
+	}
 	if err != nil {
 		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
+		if err == ErrFrameTooLarge {
+			ss.m.RecordStreamRejected(servermetrics.ReasonFrameTooLarge)
+			log.WithError(yStr.Close()).
+				WithField("max_frame_size", ss.entity.maxFrameSize).
+				Warn("Responding client declared a frame which is too large, closed streams.")
+		}
+		// Forward the rejection of the responding side, so that the initiating side learns the reason.
+		if resp != nil {
+			if wErr := ss.writeObject(yStr, resp); wErr != nil {
+				log.WithError(wErr).Debug("Failed to forward stream rejection.")
+			} else {
+				ss.m.RecordRelayedFrame(servermetrics.DirectionBackward, servermetrics.FrameResponse)
+			}
+		}
 		return err
 	}
 	log.Debug("Forwarded stream request.")
@@ -119,13 +205,56 @@ func (ss *ServerSession) serveStream(log logrus.FieldLogger, yStr *yamux.Stream)
 		ss.m.RecordStream(servermetrics.DeltaFailed) // record failed stream
 		return err
 	}
+	ss.m.RecordRelayedFrame(servermetrics.DirectionBackward, servermetrics.FrameResponse)
 	log.Debug("Forwarded stream response.")
+	ss.m.RecordRequestRelay(time.Since(start))
 
 	// Serve stream.
-	log.Info("Serving stream.")
+	log.Debug("Serving stream.")
 	ss.m.RecordStream(servermetrics.DeltaConnect)          // record successful stream
 	defer ss.m.RecordStream(servermetrics.DeltaDisconnect) // record disconnection
-	return netutil.CopyReadWriteCloser(yStr, yStr2)
+
+	// Shape the bandwidth of both clients.
+	// Relaying does not block on the source client: each relayed yamux stream has it's own flow control window, and each
+	// session writes to it's client via it's own bounded send queue. Hence, a slow client only applies backpressure to
+	// the streams destined to it.
+	srcBW, srcRelease := ss.bw.acquire(req.SrcAddr.PK)
+	defer srcRelease()
+	dstBW, dstRelease := ss.bw.acquire(req.DstAddr.PK)
+	defer dstRelease()
+	// Account the traffic of both directions.
+	fwd, fwdRelease := ss.traffic.acquire(req.SrcAddr.PK, req.DstAddr.PK)
+	defer fwdRelease()
+	bwd, bwdRelease := ss.traffic.acquire(req.DstAddr.PK, req.SrcAddr.PK)
+	defer bwdRelease()
+	// Once the session of a client is torn down, the other client is notified before it's stream is closed.
+	r := newRelay(ss.SessionCommon, yStr, ss2.SessionCommon, yStr2)
+	// Writes to both clients are tracked for the admin API (excluding the delay of shaping).
+	// Data is held against the memory budget of the client which it is relayed to, and copied through pooled buffers.
+	return netutil.CopyReadWriteCloserPooled(
+		newBudgetedConn(newThrottledConn(ss.trackWrites(r.end(yStr)), srcBW, req.DstAddr.PK, func(n int) {
+			ss.m.RecordRelayedBytes(servermetrics.DirectionForward, n)
+			ss.m.RecordRelayedFrame(servermetrics.DirectionForward, servermetrics.FrameData)
+			fwd.record(n)
+			r.recordForward(n)
+		}), ss.entity.mem, req.DstAddr.PK),
+		newBudgetedConn(newThrottledConn(ss2.trackWrites(r.end(yStr2)), dstBW, req.SrcAddr.PK, func(n int) {
+			ss.m.RecordRelayedBytes(servermetrics.DirectionBackward, n)
+			ss.m.RecordRelayedFrame(servermetrics.DirectionBackward, servermetrics.FrameData)
+			bwd.record(n)
+			r.recordBackward(n)
+		}), ss.entity.mem, req.SrcAddr.PK),
+		relayBuffers)
+}
+
+// makeRejection makes a rejection of the stream request, signed by the server (rather than the responding client).
+func (ss *ServerSession) makeRejection(req StreamRequest, reason Error) SignedObject {
+	resp := StreamResponse{
+		ReqHash:  req.raw.Hash(),
+		Accepted: false,
+		ErrCode:  reason.code,
+	}
+	return MakeSignedStreamResponse(&resp, ss.localSK())
 }
 
 func (ss *ServerSession) forwardRequest(req StreamRequest) (yStr *yamux.Stream, respObj SignedObject, err error) {
@@ -141,17 +270,22 @@ func (ss *ServerSession) forwardRequest(req StreamRequest) (yStr *yamux.Stream,
 		return nil, nil, err
 	}
 	if err = ss.writeObject(yStr, req.raw); err != nil {
-		return nil, nil, err
+		return yStr, nil, err
 	}
 	if respObj, err = ss.readObject(yStr); err != nil {
-		return nil, nil, err
+		return yStr, nil, err
 	}
 	var resp StreamResponse
 	if resp, err = respObj.ObtainStreamResponse(); err != nil {
-		return nil, nil, err
+		return yStr, nil, err
 	}
 	if err = resp.Verify(req); err != nil {
-		return nil, nil, err
+		// A valid rejection is still returned, so that it can be forwarded to the initiating side.
+		if rErr, ok := err.(Error); ok && !resp.Accepted &&
+			rErr.code != ErrDialRespInvalidHash.code && rErr.code != ErrDialRespInvalidSig.code {
+			return yStr, respObj, err
+		}
+		return yStr, nil, err
 	}
 	return yStr, respObj, nil
 }
@@ -0,0 +1,2355 @@
+package dmsg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+	"github.com/skycoin/dmsg/netutil"
+	"github.com/skycoin/dmsg/servermetrics"
+)
+
+// rejectMetrics is a servermetrics.ExtendedMetrics which counts rejected sessions and streams.
+type rejectMetrics struct {
+	servermetrics.ExtendedMetrics
+	rejected        int64
+	rejectedStreams int64
+	slowClients     int64
+	framesTooLarge  int64
+	drainRejected   int64
+	budgetRejected  int64
+	deniedSessions  int64
+	deniedStreams   int64
+	rateLimited     int64
+	violations      int64
+	overflows       int64
+	hsEvicted       int64
+	hsTimedOut      int64
+	hsSucceeded     int64
+	hsFailed        int64
+}
+
+func (m *rejectMetrics) RecordHandshake(result string) {
+	switch result {
+	case servermetrics.HandshakeSuccess:
+		atomic.AddInt64(&m.hsSucceeded, 1)
+	case servermetrics.HandshakeFailure:
+		atomic.AddInt64(&m.hsFailed, 1)
+	}
+}
+
+func (m *rejectMetrics) RecordSlowClient() {
+	atomic.AddInt64(&m.slowClients, 1)
+}
+
+func (m *rejectMetrics) RecordHandshakeDropped(reason string) {
+	switch reason {
+	case servermetrics.ReasonHandshakeEvicted:
+		atomic.AddInt64(&m.hsEvicted, 1)
+	case servermetrics.ReasonHandshakeTimeout:
+		atomic.AddInt64(&m.hsTimedOut, 1)
+	}
+}
+
+func (m *rejectMetrics) RecordSessionRejected(reason string) {
+	switch reason {
+	case servermetrics.ReasonServerFull:
+		atomic.AddInt64(&m.rejected, 1)
+	case servermetrics.ReasonServerDraining:
+		atomic.AddInt64(&m.drainRejected, 1)
+	case servermetrics.ReasonMemoryBudget:
+		atomic.AddInt64(&m.budgetRejected, 1)
+	case servermetrics.ReasonAccessDenied:
+		atomic.AddInt64(&m.deniedSessions, 1)
+	case servermetrics.ReasonViolation:
+		atomic.AddInt64(&m.violations, 1)
+	case servermetrics.ReasonBufferOverflow:
+		atomic.AddInt64(&m.overflows, 1)
+	}
+}
+
+func (m *rejectMetrics) RecordStreamRejected(reason string) {
+	switch reason {
+	case servermetrics.ReasonTooManyStreams:
+		atomic.AddInt64(&m.rejectedStreams, 1)
+	case servermetrics.ReasonFrameTooLarge:
+		atomic.AddInt64(&m.framesTooLarge, 1)
+	case servermetrics.ReasonAccessDenied:
+		atomic.AddInt64(&m.deniedStreams, 1)
+	case servermetrics.ReasonRateLimited:
+		atomic.AddInt64(&m.rateLimited, 1)
+	}
+}
+
+func TestServer_MaxClients(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server which serves a single client.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxClients = 1
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, conf)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, conf)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+
+	require.NoError(t, clientA.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 1 })
+
+	// Further clients are notified that the server is full, and move away from the server.
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return clientB.SessionCount() == 0 })
+	require.Contains(t, clientB.FailedServers(), pkSrv)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.rejected))
+
+	// The existing client is unaffected.
+	require.Equal(t, 1, clientA.SessionCount())
+	require.Equal(t, 1, srv.SessionCount())
+
+	// Raising the limit at runtime admits further clients.
+	srv.SetMaxClients(2)
+	clientB.ClearServerFailure(pkSrv)
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// Lowering the limit keeps existing clients.
+	srv.SetMaxClients(1)
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 2, srv.SessionCount())
+	require.Equal(t, 1, clientB.SessionCount())
+
+	// Closing logic.
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// frameMetrics is a servermetrics.ExtendedMetrics which counts relayed frames by direction and type.
+type frameMetrics struct {
+	servermetrics.ExtendedMetrics
+	mx     sync.Mutex
+	frames map[string]int
+}
+
+func (m *frameMetrics) RecordRelayedFrame(direction, frameType string) {
+	m.mx.Lock()
+	m.frames[direction+"/"+frameType]++
+	m.mx.Unlock()
+}
+
+func (m *frameMetrics) count(direction, frameType string) int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.frames[direction+"/"+frameType]
+}
+
+func TestServer_RelayedFrameMetrics(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	m := &frameMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty()), frames: make(map[string]int)}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, nil)
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, nil)
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// The request and response of a stream are relayed.
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool {
+		return m.count(servermetrics.DirectionForward, servermetrics.FrameRequest) == 1 &&
+			m.count(servermetrics.DirectionBackward, servermetrics.FrameResponse) == 1
+	})
+
+	// Data of both directions is relayed.
+	_, err = connB.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(connA, make([]byte, 4))
+	require.NoError(t, err)
+	_, err = connA.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(connB, make([]byte, 4))
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool {
+		return m.count(servermetrics.DirectionForward, servermetrics.FrameData) > 0 &&
+			m.count(servermetrics.DirectionBackward, servermetrics.FrameData) > 0
+	})
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_AccessControl(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+	pkC, skC := GenKeyPair(t, "client C")
+
+	// Prepare and serve dmsg server which only serves clients A and B.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.AllowedClients = []cipher.PubKey{pkA, pkB, pkC}
+	srvConf.BlockedClients = []cipher.PubKey{pkC}
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	newClient := func(name string, pk cipher.PubKey, sk cipher.SecKey) *Client {
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		return c
+	}
+	clientA := newClient("client_A", pkA, skA)
+	clientB := newClient("client_B", pkB, skB)
+	clientC := newClient("client_C", pkC, skC)
+
+	require.NoError(t, clientA.ensureSession(context.TODO(), entry))
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// The blocked client is disconnected right after the session handshake, although it is allowed.
+	require.NoError(t, clientC.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return clientC.SessionCount() == 0 })
+	require.Contains(t, clientC.FailedServers(), pkSrv)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.deniedSessions))
+	require.Equal(t, 2, srv.SessionCount())
+
+	// Allowed clients relay to each other.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	dial := func() (*Stream, error) {
+		return clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+	}
+	strA, err := dial()
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+
+	// Streams to a denied client are rejected, even while it is still connected (as it is being disconnected).
+	srv.acl.addBlocked([]cipher.PubKey{pkB})
+	_, err = dial()
+	require.Equal(t, ErrReqAccessDenied, err)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.deniedStreams))
+
+	// Changing the lists at runtime disconnects the clients which are denied access.
+	srv.UnblockClients(pkB)
+	srv.DisallowClients(pkB)
+	waitFor(t, time.Second*5, func() bool { return clientB.SessionCount() == 0 })
+	require.Equal(t, 1, srv.SessionCount())
+	require.EqualValues(t, 2, atomic.LoadInt64(&m.deniedSessions))
+	pks, all := srv.AllowedClients()
+	require.False(t, all)
+	require.ElementsMatch(t, []cipher.PubKey{pkA, pkC}, pks)
+
+	// Unblocking admits the client again.
+	srv.UnblockClients(pkC)
+	require.Empty(t, srv.BlockedClients())
+	clientC.ClearServerFailure(pkSrv)
+	require.NoError(t, clientC.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, clientC.SessionCount())
+
+	// Closing logic.
+	require.NoError(t, lisB.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// stuckListener is a listener of which Accept is not unblocked by Close.
+type stuckListener struct {
+	net.Listener
+	release chan struct{}
+}
+
+func (l *stuckListener) Accept() (net.Conn, error) {
+	<-l.release
+	return nil, errors.New("listener released")
+}
+
+func (l *stuckListener) Close() error { return nil }
+
+func TestServer_CloseTimeout(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lisSrv.Close()) }()
+	lis := &stuckListener{Listener: lisSrv, release: make(chan struct{})}
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	conf := DefaultServerConfig()
+	conf.CloseTimeout = time.Millisecond * 200
+	srv := NewServer(pkSrv, skSrv, dc, conf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lis, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Serve is stuck on Accept, so Close returns once the timeout passes.
+	start := time.Now()
+	require.True(t, errors.Is(srv.Close(), ErrCloseTimeout))
+	require.Less(t, int64(time.Since(start)), int64(time.Second*2))
+	require.True(t, errors.Is(srv.Close(), ErrCloseTimeout))
+
+	// Serve stops once the listener is released.
+	close(lis.release)
+	select {
+	case <-chSrv:
+	case <-time.After(time.Second * 5):
+		t.Fatal("serve did not stop")
+	}
+}
+
+func TestServer_Draining(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxSessions = 10
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+	availableSessions := func() int {
+		entry, err := dc.Entry(context.TODO(), pkSrv)
+		require.NoError(t, err)
+		return entry.Server.AvailableSessions
+	}
+
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		return c
+	}
+	clientA, clientB, clientC := newClient("client_A"), newClient("client_B"), newClient("client_C")
+
+	// Clients A and B have a stream relayed by the server.
+	require.NoError(t, clientA.ensureSession(context.TODO(), entry))
+	require.NoError(t, clientB.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// A draining server advertises no available sessions.
+	require.False(t, srv.Draining())
+	srv.SetDraining(true)
+	require.True(t, srv.Draining())
+	waitFor(t, time.Second*5, func() bool { return availableSessions() == 0 })
+
+	// New clients are notified that the server is draining, and move away from the server.
+	require.NoError(t, clientC.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return clientC.SessionCount() == 0 })
+	require.Contains(t, clientC.FailedServers(), pkSrv)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.drainRejected))
+
+	// Existing sessions and streams are unaffected.
+	require.Equal(t, 2, srv.SessionCount())
+	_, err = strA.Write([]byte("foo"))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(strB, buf)
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(buf))
+
+	// Once no longer draining, the server is advertised and admits new clients again.
+	srv.SetDraining(false)
+	waitFor(t, time.Second*5, func() bool { return availableSessions() == 8 })
+	clientC.ClearServerFailure(pkSrv)
+	require.NoError(t, clientC.ensureSession(context.TODO(), entry))
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 3 })
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_MaxFrameSize(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server of which the maximum frame size is lower than the size of stream requests.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxFrameSize = 64
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients A and B.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+
+	// The oversized stream request is refused by closing the stream (well before the handshake timeout).
+	start := time.Now()
+	_, err = clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(HandshakeTimeout))
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.framesTooLarge))
+
+	// The session of the client is unaffected.
+	require.Equal(t, 2, srv.SessionCount())
+	require.Equal(t, 1, clientB.SessionCount())
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_MaxStreamsPerClient(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server which relays two streams per client.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxStreamsPerClient = 2
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+
+	dial := func() (*Stream, error) {
+		return clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+	}
+
+	var strs []*Stream
+	for i := 0; i < 2; i++ {
+		strA, err := dial()
+		require.NoError(t, err)
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		strs = append(strs, strA, strB)
+	}
+	require.Equal(t, map[cipher.PubKey]int{pkA: 2}, srv.ClientStreams())
+
+	// Streams beyond the limit are rejected by the server, without involving the responding client.
+	_, err = dial()
+	require.Equal(t, ErrReqTooManyStreams, err)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.rejectedStreams))
+	require.Len(t, clientB.AllStreams(), 2)
+
+	// The limit is per initiating client.
+	lisA, err := clientA.Listen(80)
+	require.NoError(t, err)
+	strB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80}, WithoutEntryRefresh())
+	require.NoError(t, err)
+	strA, err := lisA.AcceptStream()
+	require.NoError(t, err)
+	strs = append(strs, strA, strB)
+	require.Equal(t, map[cipher.PubKey]int{pkA: 2, pkB: 1}, srv.ClientStreams())
+
+	// Closing a stream frees up the limit.
+	require.NoError(t, strs[0].Close())
+	waitFor(t, time.Second*5, func() bool { return srv.ClientStreams()[pkA] == 1 })
+	strA, err = dial()
+	require.NoError(t, err)
+	strs = append(strs, strA)
+
+	// Closing logic.
+	for _, str := range strs {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, lisA.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_RequestRate(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server which relays bursts of two requests per client.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.RequestRate = RequestRateLimit{Rate: 1, Burst: 2}
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	dial := func() (*Stream, error) {
+		return clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+	}
+
+	var strs []*Stream
+	for i := 0; i < 2; i++ {
+		strA, err := dial()
+		require.NoError(t, err)
+		strB, err := lisB.AcceptStream()
+		require.NoError(t, err)
+		strs = append(strs, strA, strB)
+	}
+
+	// Requests beyond the burst are rejected by the server, without reaching the responding client.
+	_, err = dial()
+	require.Equal(t, ErrReqRateLimited, err)
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.rateLimited))
+	require.EqualValues(t, 1, srv.RateLimitedRequests())
+	require.Len(t, clientB.AllStreams(), 2)
+
+	// The limit is per initiating client.
+	lisA, err := clientA.Listen(80)
+	require.NoError(t, err)
+	strB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80}, WithoutEntryRefresh())
+	require.NoError(t, err)
+	strA, err := lisA.AcceptStream()
+	require.NoError(t, err)
+	strs = append(strs, strA, strB)
+
+	// Overrides apply to requests from now on, and can be cleared.
+	srv.SetClientRequestRate(pkA, RequestRateLimit{Rate: 1000})
+	strA, err = dial()
+	require.NoError(t, err)
+	strB, err = lisB.AcceptStream()
+	require.NoError(t, err)
+	strs = append(strs, strA, strB)
+	srv.ClearClientRequestRate(pkA)
+	srv.SetRequestRate(RequestRateLimit{Rate: 1, Burst: 1})
+	strA, err = dial()
+	require.NoError(t, err)
+	strs = append(strs, strA)
+	_, err = dial()
+	require.Equal(t, ErrReqRateLimited, err)
+	require.EqualValues(t, 2, srv.RateLimitedRequests())
+
+	// Closing logic.
+	for _, str := range strs {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, lisA.Close())
+	require.NoError(t, lisB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_Bandwidth(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	const rate = 64 << 10 // bytes per second
+	const size = rate * 2
+
+	// Prepare and serve dmsg server which limits the ingress of clients, except of client B.
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.Bandwidth = BandwidthLimit{Ingress: rate}
+	srvConf.BandwidthOverrides = map[cipher.PubKey]BandwidthLimit{pkB: {}}
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*10, func() bool {
+		_, ok := srv.serverSession(pkB)
+		return ok
+	})
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	require.NoError(t, err)
+	strB, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// transfer writes 'size' bytes to 'w', and returns the duration until all are read from 'r'.
+	transfer := func(w io.Writer, r io.Reader) time.Duration {
+		start := time.Now()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, size))
+			errCh <- err
+		}()
+		_, err := io.ReadFull(r, make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		return time.Since(start)
+	}
+
+	// Data of client A is delayed (the burst is a second of the rate).
+	d := transfer(strA, strB)
+	require.True(t, d > time.Millisecond*800, d)
+
+	// Data of client B is not limited.
+	d = transfer(strB, strA)
+	require.True(t, d < time.Millisecond*800, d)
+
+	// Usage and throttle events are recorded per client.
+	stats := srv.ClientBandwidth()
+	require.Len(t, stats, 2)
+	require.True(t, stats[pkA].IngressBytes >= size, stats[pkA])
+	require.True(t, stats[pkA].EgressBytes >= size, stats[pkA])
+	require.NotZero(t, stats[pkA].IngressThrottled)
+	require.Zero(t, stats[pkA].EgressThrottled)
+	require.True(t, stats[pkB].IngressBytes >= size, stats[pkB])
+	require.Zero(t, stats[pkB].IngressThrottled)
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	waitFor(t, time.Second*5, func() bool { return len(srv.ClientBandwidth()) == 0 })
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_RuntimeLimits(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	const rate = 64 << 10 // bytes per second
+	const size = rate * 2
+
+	// Prepare and serve dmsg server which relays a single stream per client, without bandwidth limits.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxStreamsPerClient = 1
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+
+	var strs []*Stream
+	dial := func() error {
+		strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+		if err != nil {
+			return err
+		}
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		strs = append(strs, strA, strB)
+		return nil
+	}
+
+	// transfer writes 'size' bytes to 'w', and returns the duration until all are read from 'r'.
+	transfer := func(w io.Writer, r io.Reader) time.Duration {
+		start := time.Now()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, size))
+			errCh <- err
+		}()
+		_, err := io.ReadFull(r, make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		return time.Since(start)
+	}
+
+	t.Run("max_streams_per_client", func(t *testing.T) {
+		require.NoError(t, dial())
+		require.Equal(t, ErrReqTooManyStreams, dial())
+
+		// Raising the limit admits further streams.
+		srv.SetMaxStreamsPerClient(3)
+		require.Equal(t, 3, srv.MaxStreamsPerClient())
+		require.NoError(t, dial())
+		require.NoError(t, dial())
+		require.Equal(t, ErrReqTooManyStreams, dial())
+
+		// Lowering the limit only gates new streams, existing streams are still relayed.
+		srv.SetMaxStreamsPerClient(1)
+		require.Equal(t, ErrReqTooManyStreams, dial())
+		require.Equal(t, map[cipher.PubKey]int{pkA: 3}, srv.ClientStreams())
+		for i := 0; i < len(strs); i += 2 {
+			_, err := strs[i].Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(strs[i+1], buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+		}
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		strA, strB := strs[0], strs[1]
+
+		// Data of client B is not limited.
+		d := transfer(strB, strA)
+		require.True(t, d < time.Millisecond*800, d)
+
+		// Limiting client B applies to it's existing stream.
+		srv.SetClientBandwidth(pkB, BandwidthLimit{Ingress: rate})
+		d = transfer(strB, strA)
+		require.True(t, d > time.Millisecond*800, d)
+		require.NotZero(t, srv.ClientBandwidth()[pkB].IngressThrottled)
+
+		// The override takes precedence over the default limit, until it is cleared.
+		srv.SetBandwidth(BandwidthLimit{})
+		d = transfer(strB, strA)
+		require.True(t, d > time.Millisecond*800, d)
+		srv.ClearClientBandwidth(pkB)
+		d = transfer(strB, strA)
+		require.True(t, d < time.Millisecond*800, d)
+
+		// The default limit applies to clients without an override.
+		srv.SetBandwidth(BandwidthLimit{Egress: rate})
+		d = transfer(strB, strA)
+		require.True(t, d > time.Millisecond*800, d)
+		srv.SetBandwidth(BandwidthLimit{})
+	})
+
+	t.Run("slow_client_timeout", func(t *testing.T) {
+		require.Equal(t, DefaultSlowClientTimeout, srv.SlowClientTimeout())
+		srv.SetSlowClientTimeout(-1)
+		require.Equal(t, time.Duration(-1), srv.SlowClientTimeout())
+		require.Equal(t, slowClientPollInterval, slowClientCheckInterval(srv.SlowClientTimeout()))
+		srv.SetSlowClientTimeout(time.Second)
+		require.Equal(t, time.Second/4, slowClientCheckInterval(srv.SlowClientTimeout()))
+	})
+
+	// Closing logic.
+	for _, str := range strs {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_FairEgress(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	const rate = 256 << 10 // bytes per second
+	const aggressiveStreams = 3
+
+	// Prepare and serve dmsg server which limits the egress of client B.
+	pkA, skA := GenKeyPair(t, "client A")
+	pkB, skB := GenKeyPair(t, "client B")
+	pkC, skC := GenKeyPair(t, "client C")
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.BandwidthOverrides = map[cipher.PubKey]BandwidthLimit{pkB: {Egress: rate}}
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	newClient := func(pk cipher.PubKey, sk cipher.SecKey, name string) *Client {
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient(pkA, skA, "client_A")
+	clientB := newClient(pkB, skB, "client_B")
+	clientC := newClient(pkC, skC, "client_C")
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+
+	// Client A (aggressive) sends to client B over several streams, and client C (modest) over a single stream.
+	var received [2]int64
+	var strs []*Stream
+	send := func(c *Client, idx int) {
+		strC, err := c.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+		require.NoError(t, err)
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		strs = append(strs, strC, strB)
+
+		go func() {
+			buf := make([]byte, 32<<10)
+			for {
+				if _, err := strC.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := strB.Read(buf)
+				atomic.AddInt64(&received[idx], int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < aggressiveStreams; i++ {
+		send(clientA, 0)
+	}
+	send(clientC, 1)
+
+	// Once saturated, the modest sender gets about half of client B's egress, rather than a share per stream.
+	time.Sleep(time.Second)
+	a0, c0 := atomic.LoadInt64(&received[0]), atomic.LoadInt64(&received[1])
+	time.Sleep(time.Second * 2)
+	a, c := atomic.LoadInt64(&received[0])-a0, atomic.LoadInt64(&received[1])-c0
+	share := float64(c) / float64(a+c)
+	t.Logf("aggressive: %d bytes, modest: %d bytes, modest share: %.2f", a, c, share)
+	require.True(t, share > 0.4, share)
+
+	// Closing logic.
+	for _, str := range strs {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_TrafficStats(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.TrafficLogInterval = time.Millisecond * 100
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients A and B.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+	require.NoError(t, err)
+	strB, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// Client A sends more data than client B.
+	const sizeA, sizeB = 64 << 10, 1 << 10
+	transfer := func(w io.Writer, r io.Reader, size int) {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, size))
+			errCh <- err
+		}()
+		_, err := io.ReadFull(r, make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+	}
+	transfer(strA, strB, sizeA)
+	transfer(strB, strA, sizeB)
+
+	// The traffic of both directions is accounted, with the most traffic first.
+	stats := srv.TrafficStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, pkA, stats[0].Src)
+	require.Equal(t, pkB, stats[0].Dst)
+	require.True(t, stats[0].Bytes >= sizeA, stats[0])
+	require.NotZero(t, stats[0].Frames)
+	require.Equal(t, pkB, stats[1].Src)
+	require.Equal(t, pkA, stats[1].Dst)
+	require.True(t, stats[1].Bytes >= sizeB && stats[1].Bytes < sizeA, stats[1])
+	require.NotZero(t, stats[1].Frames)
+
+	// Stats outlive the stream.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	time.Sleep(time.Millisecond * 200)
+	require.Len(t, srv.TrafficStats(), 2)
+
+	// Closing logic.
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_EntryRefresh(t *testing.T) {
+	// Entries are dropped by discovery unless they are updated.
+	dc := disc.NewMockClient(time.Millisecond * 300)
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.UpdateInterval = time.Millisecond * 100
+	srvConf.Backoff = netutil.BackoffConfig{Initial: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2}
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+	require.True(t, srv.EntryHealthy())
+
+	// The entry outlives the discovery timeout as it is re-published.
+	time.Sleep(time.Second)
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+	require.Equal(t, lisSrv.Addr().String(), entry.Server.Address)
+
+	// Failed publications are reflected by the health flag, which recovers once discovery does.
+	dc.SetError(disc.ErrUnexpected)
+	waitFor(t, time.Second*5, func() bool { return !srv.EntryHealthy() })
+	dc.SetError(nil)
+	waitFor(t, time.Second*5, srv.EntryHealthy)
+	_, err = dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	// An updated advertised address is published.
+	const newAddr = "127.0.0.1:1"
+	srv.UpdateAdvertisedAddr(newAddr)
+	require.Equal(t, newAddr, srv.AdvertisedAddr())
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkSrv)
+		return err == nil && entry.Server.Address == newAddr
+	})
+
+	// Closing logic.
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_ServeListeners(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server on two listeners, advertised by the first.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lis1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lis2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.ServeListeners([]net.Listener{lis1, lis2}, "") }() //nolint:errcheck
+	<-srv.Ready()
+	require.Equal(t, lis1.Addr().String(), srv.AdvertisedAddr())
+
+	// Client A connects via the first listener.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+	waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pkA); return ok })
+
+	// Client B connects via the second listener, once it is advertised.
+	srv.UpdateAdvertisedAddr(lis2.Addr().String())
+	waitFor(t, time.Second*5, func() bool {
+		entry, err := dc.Entry(context.TODO(), pkSrv)
+		return err == nil && entry.Server.Address == lis2.Addr().String()
+	})
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pkB); return ok })
+
+	// Sessions of both listeners are relayed to each other.
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+	strB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	strA, err := lis.Accept()
+	require.NoError(t, err)
+	_, err = strB.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(strA, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// Closing logic closes all listeners.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+	for _, lis := range []net.Listener{lis1, lis2} {
+		_, err := net.Dial("tcp", lis.Addr().String())
+		require.Error(t, err)
+	}
+}
+
+func TestServer_CheckAdvertisedAddr(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	serve := func(name string, conf *ServerConfig) (*Server, chan error) {
+		pk, sk := GenKeyPair(t, name)
+		srv := NewServer(pk, sk, dc, conf, nil)
+		srv.SetLogger(logging.MustGetLogger(name))
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ch := make(chan error, 1)
+		go func() { ch <- srv.Serve(lis, "") }() //nolint:errcheck
+		<-srv.Ready()
+		return srv, ch
+	}
+
+	// The listening address reaches the server.
+	srvConf := DefaultServerConfig()
+	srvConf.SelfCheck = true
+	srvA, chA := serve("server A", srvConf)
+	require.NoError(t, srvA.CheckAdvertisedAddr(context.TODO()))
+
+	// The configured public address is advertised, and fails the check if it reaches another server.
+	srvConf = DefaultServerConfig()
+	srvConf.PublicAddress = srvA.AdvertisedAddr()
+	srvB, chB := serve("server B", srvConf)
+	require.Equal(t, srvA.AdvertisedAddr(), srvB.AdvertisedAddr())
+	entry, err := dc.Entry(context.TODO(), srvB.LocalPK())
+	require.NoError(t, err)
+	require.Equal(t, srvA.AdvertisedAddr(), entry.Server.Address)
+	require.Error(t, srvB.CheckAdvertisedAddr(context.TODO()))
+
+	// A public address which is not dialable fails the check.
+	srvB.UpdateAdvertisedAddr("127.0.0.1:1")
+	require.Error(t, srvB.CheckAdvertisedAddr(context.TODO()))
+
+	// Closing logic.
+	require.NoError(t, srvB.Close())
+	require.NoError(t, <-chB)
+	require.NoError(t, srvA.Close())
+	require.NoError(t, <-chA)
+}
+
+func TestListenerErrors(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	require.NoError(t, ListenerErrors(nil).errOrNil())
+	require.Equal(t, errA, ListenerErrors{errA}.errOrNil())
+	require.EqualError(t, ListenerErrors{errA, errB}.errOrNil(), "2 listener errors: a; b")
+}
+
+// blackholeProxy relays TCP connections to a target until they are blackholed, after which data of the connection is
+// silently dropped in both directions (as with a client which has gone without closing the connection).
+type blackholeProxy struct {
+	holes []*int32 // per accepted connection, 1 if blackholed
+	mx    sync.Mutex
+}
+
+func (p *blackholeProxy) serve(lis net.Listener, target string) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		hole := new(int32)
+		p.mx.Lock()
+		p.holes = append(p.holes, hole)
+		p.mx.Unlock()
+
+		go func() {
+			tConn, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close() //nolint:errcheck
+				return
+			}
+			relay := func(dst, src net.Conn) {
+				b := make([]byte, 4096)
+				for {
+					n, err := src.Read(b)
+					if err != nil {
+						_ = dst.Close() //nolint:errcheck
+						return
+					}
+					if atomic.LoadInt32(hole) == 1 {
+						continue
+					}
+					if _, err := dst.Write(b[:n]); err != nil {
+						return
+					}
+				}
+			}
+			go relay(tConn, conn)
+			relay(conn, tConn)
+		}()
+	}
+}
+
+// blackhole blackholes the i-th accepted connection.
+func (p *blackholeProxy) blackhole(i int) {
+	p.mx.Lock()
+	atomic.StoreInt32(p.holes[i], 1)
+	p.mx.Unlock()
+}
+
+func TestServer_DeadClient(t *testing.T) {
+	const timeout = time.Millisecond * 300
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server, which is advertised via a proxy which can blackhole sessions.
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := new(blackholeProxy)
+	go proxy.serve(lisProxy, lisSrv.Addr().String())
+	defer func() { require.NoError(t, lisProxy.Close()) }()
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.IdleTimeout = timeout
+	srvConf.ProbeTimeout = timeout
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, lisProxy.Addr().String()) }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients, client B's session being the first.
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 1 })
+
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// Client B goes away without closing it's connection.
+	proxy.blackhole(0)
+
+	// The server closes the session of client B, and the streams it relays.
+	waitFor(t, time.Second*5, func() bool {
+		_, ok := srv.serverSession(pkB)
+		return !ok
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := connA.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream relayed for lost client was not closed")
+	}
+
+	// The idle client A responds to probes, and keeps it's session.
+	time.Sleep(timeout * 4)
+	_, ok := srv.serverSession(pkA)
+	require.True(t, ok)
+
+	// Closing logic.
+	require.NoError(t, connB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_ReplaceSession(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server, which is advertised via a proxy which can blackhole sessions.
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := new(blackholeProxy)
+	go proxy.serve(lisProxy, lisSrv.Addr().String())
+	defer func() { require.NoError(t, lisProxy.Close()) }()
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.ProbeTimeout = time.Millisecond * 300
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, lisProxy.Addr().String()) }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare dmsg clients, client B's session being the first.
+	pkB, skB := GenKeyPair(t, "client B")
+	newClient := func(pk cipher.PubKey, sk cipher.SecKey, name string) *Client {
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		_, err := c.EnsureAndObtainSession(context.TODO(), pkSrv)
+		require.NoError(t, err)
+		waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pk); return ok })
+		waitFor(t, time.Second*5, func() bool {
+			entry, err := dc.Entry(context.TODO(), pk)
+			return err == nil && len(entry.Client.DelegatedServers) == 1
+		})
+		return c
+	}
+	clientB := newClient(pkB, skB, "client_B")
+	oldSes, ok := srv.serverSession(pkB)
+	require.True(t, ok)
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := newClient(pkA, skA, "client_A")
+
+	lis, err := clientA.Listen(80)
+	require.NoError(t, err)
+	connB, err := clientB.DialStream(context.TODO(), Addr{PK: pkA, Port: 80})
+	require.NoError(t, err)
+	connA, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// Client B crashes without closing it's connection, and reconnects at once.
+	proxy.blackhole(0)
+	clientB2 := newClient(pkB, skB, "client_B2")
+	waitFor(t, time.Second*5, func() bool {
+		ses, ok := srv.serverSession(pkB)
+		return ok && ses.SessionCommon != oldSes.SessionCommon
+	})
+
+	// The old session is closed, and the peer of it's stream is notified.
+	waitFor(t, time.Second*5, func() bool { return oldSes.ys.IsClosed() })
+	_, err = connA.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, ErrPeerDisconnected), err)
+	waitFor(t, time.Second*5, func() bool {
+		oldSes.relaysMx.Lock()
+		defer oldSes.relaysMx.Unlock()
+		return len(oldSes.relays) == 0
+	})
+	require.Equal(t, 2, srv.SessionCount())
+
+	// The new session works.
+	lisB2, err := clientB2.Listen(81)
+	require.NoError(t, err)
+	connA2, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 81})
+	require.NoError(t, err)
+	connB2, err := lisB2.AcceptStream()
+	require.NoError(t, err)
+	_, err = connA2.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(connB2, b)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(b))
+
+	// Closing logic.
+	require.NoError(t, connA2.Close())
+	require.NoError(t, connB2.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, lisB2.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientB2.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_SlowClient(t *testing.T) {
+	const size = 8 << 20
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server. Client C is connected via a proxy which is slow towards C.
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go serveSlowProxy(lisProxy, lisSrv.Addr().String(), 1024, time.Millisecond*10)
+	defer func() { require.NoError(t, lisProxy.Close()) }()
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	newClient := func(name string, addr string) *Client {
+		// Advertise the address of the server which the client should connect to.
+		e := *entry
+		e.Server = &disc.Server{Address: addr, AvailableSessions: entry.Server.AvailableSessions}
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		require.NoError(t, c.ensureSession(context.TODO(), &e))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A", lisSrv.Addr().String())
+	clientB := newClient("client_B", lisSrv.Addr().String())
+	clientC := newClient("client_C", lisProxy.Addr().String())
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	lisC, err := clientC.Listen(80)
+	require.NoError(t, err)
+
+	// transfer transfers data from A to B, returning the duration.
+	transfer := func() time.Duration {
+		connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		connB, err := lisB.AcceptStream()
+		require.NoError(t, err)
+
+		start := time.Now()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := connA.Write(make([]byte, size))
+			errCh <- err
+		}()
+		n, err := io.ReadFull(connB, make([]byte, size))
+		require.NoError(t, err)
+		require.Equal(t, size, n)
+		require.NoError(t, <-errCh)
+		dur := time.Since(start)
+
+		require.NoError(t, connA.Close())
+		require.NoError(t, connB.Close())
+		return dur
+	}
+	baseline := transfer()
+
+	// A also sends to the slow client C, which is unable to keep up.
+	connAC, err := clientA.DialStream(context.TODO(), Addr{PK: clientC.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	connC, err := lisC.AcceptStream()
+	require.NoError(t, err)
+	slowDone := make(chan struct{})
+	go func() {
+		_, _ = connAC.Write(make([]byte, size)) //nolint:errcheck
+		close(slowDone)
+	}()
+	go func() { _, _ = io.Copy(ioutil.Discard, connC) }() //nolint:errcheck
+	time.Sleep(time.Millisecond * 200)
+
+	// Transfers between A and B are unaffected.
+	dur := transfer()
+	t.Logf("baseline: %v, with slow client: %v", baseline, dur)
+	require.Less(t, int64(dur), int64(baseline*4+time.Second))
+	require.False(t, isClosed(slowDone), "transfer to slow client should still be pending")
+
+	// Closing logic.
+	require.NoError(t, connAC.Close())
+	require.NoError(t, connC.Close())
+	require.NoError(t, lisC.Close())
+	require.NoError(t, lisB.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_SlowClientDisconnect(t *testing.T) {
+	const timeout = time.Millisecond * 500
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.SlowClientTimeout = timeout
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisTCP, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lisSrv := &stallingListener{Listener: lisTCP}
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	conf := DefaultConfig()
+	conf.FailureCooldown = time.Hour
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A")
+	clientC := newClient("client_C")
+
+	lis, err := clientC.Listen(80)
+	require.NoError(t, err)
+	connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientC.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	connC, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// Client C does not read the stream, so relaying data to it blocks. This only holds back the stream, so client C
+	// is not disconnected.
+	go func() { _, _ = connA.Write(make([]byte, 4<<20)) }() //nolint:errcheck
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := connA.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	time.Sleep(timeout * 3)
+	_, ok := srv.serverSession(clientC.LocalPK())
+	require.True(t, ok)
+	require.Zero(t, atomic.LoadInt64(&m.slowClients))
+
+	// Client C no longer receives data of it's session (once it reads the stream, relaying resumes), so writes to it's
+	// connection block.
+	lisSrv.conn(1).stall()
+	go func() { _, _ = io.Copy(io.Discard, connC) }() //nolint:errcheck
+
+	// The server disconnects client C (the GOAWAY notice cannot be sent, as writes to client C are stalled).
+	waitFor(t, time.Second*10, func() bool {
+		_, ok := srv.serverSession(clientC.LocalPK())
+		return !ok
+	})
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.slowClients))
+
+	// The stream of the peer is closed with the reason, while the peer itself stays connected.
+	select {
+	case err := <-errCh:
+		require.Equal(t, ErrPeerDisconnected, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream relayed to slow client was not closed")
+	}
+	_, ok = srv.serverSession(clientA.LocalPK())
+	require.True(t, ok)
+
+	// Closing logic.
+	lisSrv.conn(1).unstall()
+	require.NoError(t, connC.Close())
+	require.NoError(t, connA.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientC.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// stallingListener records the connections which it accepts, in order, so that writes to them can be stalled.
+type stallingListener struct {
+	net.Listener
+	conns []*stallingConn
+	mx    sync.Mutex
+}
+
+func (l *stallingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &stallingConn{Conn: conn, stalled: make(chan struct{})}
+	close(sc.stalled)
+	l.mx.Lock()
+	l.conns = append(l.conns, sc)
+	l.mx.Unlock()
+	return sc, nil
+}
+
+func (l *stallingListener) conn(i int) *stallingConn {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.conns[i]
+}
+
+// stallingConn is a net.Conn of which writes block while it is stalled.
+type stallingConn struct {
+	net.Conn
+	stalled chan struct{} // open while stalled
+	mx      sync.Mutex
+}
+
+func (c *stallingConn) stall() {
+	c.mx.Lock()
+	c.stalled = make(chan struct{})
+	c.mx.Unlock()
+}
+
+func (c *stallingConn) unstall() {
+	c.mx.Lock()
+	select {
+	case <-c.stalled:
+	default:
+		close(c.stalled)
+	}
+	c.mx.Unlock()
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	stalled := c.stalled
+	c.mx.Unlock()
+	<-stalled
+	return c.Conn.Write(b)
+}
+
+func TestServer_PeerDisconnected(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		_, err := c.EnsureAndObtainSession(context.TODO(), pkSrv)
+		require.NoError(t, err)
+		waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pk); return ok })
+		return c
+	}
+
+	// dial establishes a stream from the initiating client to the responding client.
+	dial := func(init, resp *Client, port uint16) (initStr, respStr *Stream) {
+		lis, err := resp.Listen(port)
+		require.NoError(t, err)
+		initStr, err = init.DialStream(context.TODO(), Addr{PK: resp.LocalPK(), Port: port})
+		require.NoError(t, err)
+		respStr, err = lis.AcceptStream()
+		require.NoError(t, err)
+		return initStr, respStr
+	}
+
+	t.Run("peer_disconnects", func(t *testing.T) {
+		clientA, clientB := newClient("client A"), newClient("client B")
+		strA, strB := dial(clientA, clientB, 80)
+		strB2, strA2 := dial(clientB, clientA, 81)
+
+		readErrs := make(chan error, 2)
+		for _, str := range []*Stream{strB, strB2} {
+			go func(str *Stream) {
+				_, err := str.Read(make([]byte, 1))
+				readErrs <- err
+			}(str)
+		}
+
+		// Both streams of B fail with the reason once A disconnects.
+		require.NoError(t, clientA.Close())
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-readErrs:
+				require.True(t, errors.Is(err, ErrPeerDisconnected), err)
+			case <-time.After(time.Second * 5):
+				t.Fatal("read did not fail")
+			}
+		}
+		require.NoError(t, strA.Close())
+		require.NoError(t, strA2.Close())
+		require.NoError(t, strB.Close())
+		require.NoError(t, strB2.Close())
+		require.NoError(t, clientB.Close())
+	})
+
+	t.Run("simultaneous_disconnect", func(t *testing.T) {
+		clientA, clientB := newClient("client A"), newClient("client B")
+		for port := uint16(80); port < 85; port++ {
+			dial(clientA, clientB, port)
+			dial(clientB, clientA, port+10)
+		}
+
+		sesA, ok := srv.session(clientA.LocalPK())
+		require.True(t, ok)
+		sesB, ok := srv.session(clientB.LocalPK())
+		require.True(t, ok)
+
+		var wg sync.WaitGroup
+		for _, c := range []*Client{clientA, clientB} {
+			wg.Add(1)
+			go func(c *Client) {
+				defer wg.Done()
+				require.NoError(t, c.Close())
+			}(c)
+		}
+		wg.Wait()
+
+		// The server tears down both sessions, and closes all relayed streams.
+		waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 0 })
+		waitFor(t, time.Second*5, func() bool {
+			sesA.relaysMx.Lock()
+			defer sesA.relaysMx.Unlock()
+			sesB.relaysMx.Lock()
+			defer sesB.relaysMx.Unlock()
+			return len(sesA.relays) == 0 && len(sesB.relays) == 0
+		})
+	})
+
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// BenchmarkServer_Relay measures the throughput of streams relayed by a local server between pairs of clients: in each
+// operation, each pair opens a stream, echoes a message over it, and closes it.
+func BenchmarkServer_Relay(b *testing.B) {
+	for _, pairs := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("pairs=%d", pairs), func(b *testing.B) {
+			benchmarkRelay(b, pairs, 16*1024)
+		})
+	}
+}
+
+func benchmarkRelay(b *testing.B, pairs, msgSize int) {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+
+	dc := disc.NewMock(0)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	pkSrv, skSrv := cipher.GenerateKeyPair()
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(log)
+	go func() { _ = srv.Serve(lis, "") }() //nolint:errcheck
+	defer func() { require.NoError(b, srv.Close()) }()
+	<-srv.Ready()
+
+	newClient := func() *Client {
+		pk, sk := cipher.GenerateKeyPair()
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(log)
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	type pair struct {
+		dialer    *Client
+		responder cipher.PubKey
+	}
+	ps := make([]pair, pairs)
+	for i := range ps {
+		responder, dialer := newClient(), newClient()
+		defer func() { require.NoError(b, responder.Close()) }()
+		defer func() { require.NoError(b, dialer.Close()) }()
+
+		lis, err := responder.Listen(80)
+		require.NoError(b, err)
+		go func() {
+			for {
+				dStr, err := lis.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(dStr, dStr) //nolint:errcheck
+					_ = dStr.Close()           //nolint:errcheck
+				}()
+			}
+		}()
+		ps[i] = pair{dialer: dialer, responder: responder.LocalPK()}
+	}
+	waitFor(b, time.Second*10, func() bool { return srv.SessionCount() == 2*pairs })
+
+	msg := cipher.RandByte(msgSize)
+	echo := func(p pair) error {
+		dStr, err := p.dialer.DialStream(context.Background(), Addr{PK: p.responder, Port: 80})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = dStr.Close() }() //nolint:errcheck
+		if _, err := dStr.Write(msg); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(dStr, make([]byte, msgSize))
+		return err
+	}
+
+	b.SetBytes(int64(2 * pairs * msgSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		errs := make(chan error, pairs)
+		for _, p := range ps {
+			go func(p pair) { errs <- echo(p) }(p)
+		}
+		for range ps {
+			if err := <-errs; err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestServer_StreamBufferOverflow(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, DefaultServerConfig(), m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+	require.NoError(t, err)
+	_, err = lisB.AcceptStream()
+	require.NoError(t, err)
+
+	// Client A sends data beyond the receive window of it's stream, disregarding flow control.
+	sesA, ok := clientA.Session(pkSrv)
+	require.True(t, ok)
+	frame := yamuxFrame(yamuxTypeData, 0, strA.yStr.StreamID(), make([]byte, DefaultStreamBufferSize+1))
+	_, err = sesA.netConn.Write(frame)
+	require.NoError(t, err)
+
+	// The client is disconnected with a GOAWAY notice which tells why.
+	select {
+	case <-sesA.goAway:
+		require.Equal(t, ErrStreamBufferOverflow, sesA.goAwayErr)
+	case <-time.After(time.Second * 5):
+		t.Fatal("GOAWAY notice is not received")
+	}
+	waitFor(t, time.Second*5, func() bool { return atomic.LoadInt64(&m.overflows) == 1 })
+	require.Zero(t, atomic.LoadInt64(&m.violations))
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_ProtocolViolations(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server which tolerates three violations per client.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxProtocolViolations = 3
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	go clientA.Serve(context.Background())
+	<-clientA.Ready()
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80}, WithoutEntryRefresh())
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+
+	// Client A misbehaves: it re-opens it's open stream, and sends data of a stream which was never opened.
+	sesA, ok := clientA.Session(pkSrv)
+	require.True(t, ok)
+	srvSesA, ok := srv.serverSession(pkA)
+	require.True(t, ok)
+	_, err = sesA.netConn.Write(yamuxFrame(yamuxTypeWindowUpdate, yamuxFlagSYN, strA.yStr.StreamID(), nil))
+	require.NoError(t, err)
+	_, err = sesA.netConn.Write(yamuxFrame(yamuxTypeData, 0, 1001, []byte("garbage")))
+	require.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool {
+		for _, info := range srv.Clients() {
+			if info.PK == pkA {
+				return info.ProtocolViolations == 2
+			}
+		}
+		return false
+	})
+
+	// The frames are dropped, and client A is notified of both.
+	waitFor(t, time.Second*5, func() bool { return atomic.LoadUint64(&sesA.framesDropped) == 2 })
+	require.NoError(t, sesA.serverClosed(strA.yStr.StreamID()))
+
+	// The open stream is preserved.
+	for _, pair := range [][2]*Stream{{strA, strB}, {strB, strA}} {
+		_, err = pair[0].Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(pair[1], buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	}
+	require.False(t, srvSesA.ys.IsClosed())
+
+	// Violations beyond the limit disconnect the client.
+	for i := 0; i < 2; i++ {
+		_, err = sesA.netConn.Write(yamuxFrame(yamuxTypeWindowUpdate, 0, 2001, nil))
+		require.NoError(t, err)
+	}
+	waitFor(t, time.Second*5, func() bool { return srvSesA.ys.IsClosed() })
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.violations))
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_Clients(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	srvEntry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		require.NoError(t, c.ensureSession(context.TODO(), srvEntry))
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	clients := srv.Clients()
+	require.Len(t, clients, 2)
+	require.Equal(t, clientA.LocalPK(), clients[0].PK)
+	require.Equal(t, clientB.LocalPK(), clients[1].PK)
+	sesA, ok := clientA.Session(pkSrv)
+	require.True(t, ok)
+	require.Equal(t, sesA.LocalTCPAddr().String(), clients[0].RemoteAddr)
+	require.False(t, clients[0].ConnectedSince.After(clients[1].ConnectedSince))
+	require.Zero(t, clients[0].Channels)
+	require.Empty(t, srv.Channels(clientA.LocalPK()))
+
+	// Relay data in both directions.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	_, err = strA.Write(make([]byte, 1000))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strB, make([]byte, 1000))
+	require.NoError(t, err)
+	_, err = strB.Write(make([]byte, 300))
+	require.NoError(t, err)
+	_, err = io.ReadFull(strA, make([]byte, 300))
+	require.NoError(t, err)
+
+	// Relayed bytes include the overhead of the stream encryption.
+	clients = srv.Clients()
+	require.Equal(t, 1, clients[0].Channels)
+	require.Equal(t, 1, clients[1].Channels)
+	require.True(t, clients[0].BytesSent >= 1000 && clients[0].BytesReceived >= 300, clients[0])
+	require.Equal(t, clients[0].BytesSent, clients[1].BytesReceived)
+	require.Equal(t, clients[0].BytesReceived, clients[1].BytesSent)
+
+	chA := srv.Channels(clientA.LocalPK())
+	require.Len(t, chA, 1)
+	require.Equal(t, clientB.LocalPK(), chA[0].PeerPK)
+	require.True(t, chA[0].Initiator)
+	require.Equal(t, clients[0].BytesSent, chA[0].BytesSent)
+	require.Equal(t, clients[0].BytesReceived, chA[0].BytesReceived)
+	require.True(t, chA[0].Age > 0)
+	chB := srv.Channels(clientB.LocalPK())
+	require.Len(t, chB, 1)
+	require.Equal(t, clientA.LocalPK(), chB[0].PeerPK)
+	require.False(t, chB[0].Initiator)
+	require.Equal(t, chA[0].BytesSent, chB[0].BytesReceived)
+
+	// Closed channels are no longer listed, but their bytes remain accounted to the clients.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	waitFor(t, time.Second*5, func() bool { return len(srv.Channels(clientA.LocalPK())) == 0 })
+	require.Equal(t, chA[0].BytesSent, srv.Clients()[0].BytesSent)
+	pkUnknown, _ := GenKeyPair(t, "unknown")
+	require.Nil(t, srv.Channels(pkUnknown))
+
+	// Closing logic.
+	require.NoError(t, lisB.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_RelayIdleTimeout(t *testing.T) {
+	const idleTimeout = time.Millisecond * 200
+
+	// serve prepares and serves a dmsg server which reaps idle relayed streams.
+	serve := func(t *testing.T, dc disc.APIClient, reapQuiet bool) (*Server, func()) {
+		pkSrv, skSrv := GenKeyPair(t, "server")
+		conf := DefaultServerConfig()
+		conf.RelayIdleTimeout = idleTimeout
+		conf.ReapQuietRelays = reapQuiet
+		srv := NewServer(pkSrv, skSrv, dc, conf, nil)
+		srv.SetLogger(logging.MustGetLogger("server"))
+		lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		chSrv := make(chan error, 1)
+		go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+		<-srv.Ready()
+		return srv, func() {
+			require.NoError(t, srv.Close())
+			require.NoError(t, <-chSrv)
+		}
+	}
+
+	// dial establishes a stream between two new clients of the server.
+	dial := func(t *testing.T, dc disc.APIClient, srv *Server) (clientA, clientB *Client, strA, strB *Stream) {
+		newClient := func(name string) *Client {
+			pk, sk := GenKeyPair(t, name)
+			c := NewClient(pk, sk, dc, DefaultConfig())
+			c.SetLogger(logging.MustGetLogger(name))
+			_, err := c.EnsureAndObtainSession(context.TODO(), srv.LocalPK())
+			require.NoError(t, err)
+			waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pk); return ok })
+			return c
+		}
+		clientA, clientB = newClient("client A"), newClient("client B")
+		lis, err := clientB.Listen(80)
+		require.NoError(t, err)
+		strA, err = clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		strB, err = lis.AcceptStream()
+		require.NoError(t, err)
+		return clientA, clientB, strA, strB
+	}
+
+	// requireReaped checks that both streams fail with ErrStreamIdle.
+	requireReaped := func(t *testing.T, strs ...*Stream) {
+		for _, str := range strs {
+			require.NoError(t, str.SetReadDeadline(time.Now().Add(time.Second*5)))
+			_, err := str.Read(make([]byte, 1))
+			require.True(t, errors.Is(err, ErrStreamIdle), err)
+		}
+	}
+
+	t.Run("quiet_streams_of_alive_clients_are_kept", func(t *testing.T) {
+		dc := disc.NewMock(0)
+		srv, stop := serve(t, dc, false)
+		defer stop()
+		clientA, clientB, strA, strB := dial(t, dc, srv)
+
+		time.Sleep(idleTimeout * 3)
+		_, err := strA.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(strB, make([]byte, 4))
+		require.NoError(t, err)
+
+		// Once a client is not heard from, the idle stream is reaped.
+		ses, ok := srv.session(clientB.LocalPK())
+		require.True(t, ok)
+		time.Sleep(idleTimeout * 2)
+		atomic.StoreInt64(&ses.lastRead, time.Now().Add(-time.Hour).UnixNano())
+		srv.reapIdleRelays()
+		requireReaped(t, strA, strB)
+		waitFor(t, time.Second*5, func() bool { return len(srv.Channels(clientA.LocalPK())) == 0 })
+
+		require.NoError(t, clientA.Close())
+		require.NoError(t, clientB.Close())
+	})
+
+	t.Run("reap_quiet_streams", func(t *testing.T) {
+		dc := disc.NewMock(0)
+		srv, stop := serve(t, dc, true)
+		defer stop()
+		clientA, clientB, strA, strB := dial(t, dc, srv)
+
+		requireReaped(t, strA, strB)
+		_, err := strA.Write([]byte("ping"))
+		require.True(t, errors.Is(err, ErrStreamIdle), err)
+
+		require.NoError(t, clientA.Close())
+		require.NoError(t, clientB.Close())
+	})
+}
+
+func TestServer_PendingHandshakes(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server which bounds pending session handshakes.
+	m := &rejectMetrics{ExtendedMetrics: servermetrics.Extend(servermetrics.NewEmpty())}
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srvConf := DefaultServerConfig()
+	srvConf.MaxPendingHandshakes = 2
+	srvConf.SessionHandshakeTimeout = time.Second
+	srv := NewServer(pkSrv, skSrv, dc, srvConf, m)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Connections which stall their handshakes.
+	stall := func() net.Conn {
+		conn, err := net.Dial("tcp", lisSrv.Addr().String())
+		require.NoError(t, err)
+		return conn
+	}
+	dropped := func(conn net.Conn) bool {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+	conn1 := stall()
+	waitFor(t, time.Second*5, func() bool { return srv.PendingHandshakes() == 1 })
+	conn2 := stall()
+	waitFor(t, time.Second*5, func() bool { return srv.PendingHandshakes() == 2 })
+
+	// The oldest pending handshake is dropped in favour of a new connection.
+	conn3 := stall()
+	require.True(t, dropped(conn1))
+	require.EqualValues(t, 1, srv.DroppedHandshakes())
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.hsEvicted))
+	require.Equal(t, 2, srv.PendingHandshakes())
+
+	// Legitimate clients still get through.
+	pk, sk := GenKeyPair(t, "client")
+	client := NewClient(pk, sk, dc, DefaultConfig())
+	client.SetLogger(logging.MustGetLogger("client"))
+	go client.Serve(context.Background())
+	<-client.Ready()
+	require.True(t, dropped(conn2))
+
+	// Stalled handshakes time out.
+	require.True(t, dropped(conn3))
+	waitFor(t, time.Second*5, func() bool { return srv.PendingHandshakes() == 0 })
+	require.EqualValues(t, 3, srv.DroppedHandshakes())
+	require.EqualValues(t, 2, atomic.LoadInt64(&m.hsEvicted))
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.hsTimedOut))
+	require.Equal(t, 1, srv.SessionCount())
+
+	// Only the handshake of the client succeeded, and only the stalled handshake which timed out failed.
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.hsSucceeded))
+	require.EqualValues(t, 1, atomic.LoadInt64(&m.hsFailed))
+
+	// Closing logic.
+	for _, conn := range []net.Conn{conn1, conn2, conn3} {
+		require.NoError(t, conn.Close())
+	}
+	require.NoError(t, client.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestServer_HealthAndReadiness(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, DefaultServerConfig(), nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	require.True(t, errors.Is(srv.Healthy(), ErrServerNotServing))
+	require.True(t, srv.LastEntryPublished().IsZero())
+
+	// Serve the server on two listeners, so that one can fail.
+	lis1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lis2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.ServeListeners([]net.Listener{lis1, lis2}, "") }() //nolint:errcheck
+	<-srv.Ready()
+	require.NoError(t, srv.Healthy())
+	require.NoError(t, srv.Readiness())
+	require.WithinDuration(t, time.Now(), srv.LastEntryPublished(), time.Second*5)
+
+	pk, sk := GenKeyPair(t, "client")
+	client := NewClient(pk, sk, dc, DefaultConfig())
+	client.SetLogger(logging.MustGetLogger("client"))
+	go client.Serve(context.Background())
+	<-client.Ready()
+
+	// The server is not ready while it is full.
+	srv.SetMaxClients(1)
+	waitFor(t, time.Second*5, func() bool { return errors.Is(srv.Readiness(), ErrServerFull) })
+	srv.SetMaxClients(0)
+	require.NoError(t, srv.Readiness())
+
+	// The server is not ready while it is draining.
+	srv.SetDraining(true)
+	require.True(t, errors.Is(srv.Readiness(), ErrServerDraining))
+	srv.SetDraining(false)
+	require.NoError(t, srv.Readiness())
+
+	// The server is not ready while it's discovery entry is stale.
+	atomic.StoreInt64(&srv.lastUpdate, time.Now().Add(-3*srv.updateInterval).UnixNano())
+	require.True(t, errors.Is(srv.Readiness(), ErrEntryStale))
+	require.NoError(t, srv.Healthy())
+	srv.recordUpdate()
+	require.NoError(t, srv.Readiness())
+
+	// The server is not healthy once a listener fails.
+	require.NoError(t, lis2.Close())
+	waitFor(t, time.Second*5, func() bool { return srv.Healthy() != nil })
+	require.True(t, errors.Is(srv.Healthy(), ErrServerNotServing))
+	require.True(t, errors.Is(srv.Readiness(), ErrServerNotServing))
+
+	// Closing logic.
+	require.NoError(t, client.Close())
+	require.NoError(t, srv.Close())
+	require.Error(t, <-chSrv)
+	require.True(t, errors.Is(srv.Healthy(), ErrEntityClosed))
+}
@@ -2,18 +2,31 @@ package servermetrics
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// NewEmpty implements Metrics, but does nothing.
+// NewEmpty implements Metrics (and ExtendedMetrics), but does nothing.
 func NewEmpty() Metrics {
 	return empty{}
 }
 
-type empty struct{}
+type empty struct{ noExtension }
 
 func (empty) Collectors() []prometheus.Collector            { return nil }
 func (empty) RecordSession(_ DeltaType)                     {}
 func (empty) RecordStream(_ DeltaType)                      {}
 func (empty) HandleDisc(next http.Handler) http.HandlerFunc { return next.ServeHTTP }
+
+// noExtension implements the methods which ExtendedMetrics adds to Metrics, but does nothing.
+type noExtension struct{}
+
+func (noExtension) RecordSessionRejected(_ string)     {}
+func (noExtension) RecordStreamRejected(_ string)      {}
+func (noExtension) RecordRelayedBytes(_ string, _ int) {}
+func (noExtension) RecordRelayedFrame(_, _ string)     {}
+func (noExtension) RecordRequestRelay(_ time.Duration) {}
+func (noExtension) RecordSlowClient()                  {}
+func (noExtension) RecordHandshake(_ string)           {}
+func (noExtension) RecordHandshakeDropped(_ string)    {}
@@ -2,10 +2,50 @@ package servermetrics
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Reasons of rejected sessions and streams.
+const (
+	ReasonServerFull     = "server_full"      // session rejected as the server is full
+	ReasonServerDraining = "server_draining"  // session rejected as the server is draining
+	ReasonTooManyStreams = "too_many_streams" // stream rejected as the initiating client has too many streams
+	ReasonNoNextSession  = "no_next_session"  // stream rejected as the responding client is not connected
+	ReasonFrameTooLarge  = "frame_too_large"  // stream closed as a client declared a frame larger than the maximum
+	ReasonMemoryBudget   = "memory_budget"    // session rejected as the total memory budget of the server is exhausted
+	ReasonAccessDenied   = "access_denied"    // session or stream rejected as a client is not allowed, or is blocked
+	ReasonRateLimited    = "rate_limited"     // stream rejected as the initiating client exceeds it's request rate limit
+	ReasonViolation      = "violation"        // session closed as the client exceeds it's tolerated protocol violations
+	ReasonBufferOverflow = "buffer_overflow"  // session closed as the client overflows the receive buffer of a stream
+)
+
+// Reasons of connections dropped during the session handshake, before the clients are authenticated.
+const (
+	ReasonHandshakeTimeout = "handshake_timeout" // handshake did not complete within the timeout
+	ReasonHandshakeEvicted = "handshake_evicted" // oldest pending handshake dropped in favour of a new connection
+)
+
+// Directions of relayed stream data.
+const (
+	DirectionForward  = "forward"  // from the initiating client to the responding client
+	DirectionBackward = "backward" // from the responding client to the initiating client
+)
+
+// Types of relayed frames.
+const (
+	FrameRequest  = "request"  // stream request, relayed forward
+	FrameResponse = "response" // stream response (accepting or rejecting the request), relayed backward
+	FrameData     = "data"     // stream data
+)
+
+// Results of session handshakes.
+const (
+	HandshakeSuccess = "success"
+	HandshakeFailure = "failure"
+)
+
 // Metrics collects metrics for prometheus.
 type Metrics interface {
 	Collectors() []prometheus.Collector
@@ -13,6 +53,35 @@ type Metrics interface {
 	RecordStream(delta DeltaType)
 }
 
+// ExtendedMetrics is an optional extension of Metrics, which also collects metrics of rejections, relaying and
+// handshakes. These are only recorded by the server if it's Metrics implement ExtendedMetrics (see Extend).
+type ExtendedMetrics interface {
+	Metrics
+	RecordSessionRejected(reason string)
+	RecordStreamRejected(reason string)
+	RecordRelayedBytes(direction string, n int)
+	RecordRelayedFrame(direction, frameType string)
+	RecordRequestRelay(duration time.Duration)
+	RecordSlowClient()
+	RecordHandshake(result string)
+	RecordHandshakeDropped(reason string)
+}
+
+// Extend returns the given Metrics as ExtendedMetrics. If they do not implement ExtendedMetrics, the extended metrics
+// are not recorded.
+func Extend(m Metrics) ExtendedMetrics {
+	if xm, ok := m.(ExtendedMetrics); ok {
+		return xm
+	}
+	return extended{Metrics: m}
+}
+
+// extended implements ExtendedMetrics for Metrics which do not.
+type extended struct {
+	Metrics
+	noExtension
+}
+
 // New returns the default implementation of Metrics.
 func New(namespace string) Metrics {
 	activeSessions := prometheus.NewGauge(prometheus.GaugeOpts{
@@ -30,6 +99,11 @@ func New(namespace string) Metrics {
 		Name:      "session_fail_total",
 		Help:      "Total number of failed session dials.",
 	})
+	rejectedSessions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "session_rejected_total",
+		Help:      "Total number of rejected sessions.",
+	}, []string{"reason"})
 	activeStreams := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "active_streams_count",
@@ -45,25 +119,90 @@ func New(namespace string) Metrics {
 		Name:      "stream_fail_total",
 		Help:      "Total number of failed stream dials.",
 	})
+	rejectedStreams := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_rejected_total",
+		Help:      "Total number of stream requests rejected by the server.",
+	}, []string{"reason"})
+	relayedBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relayed_bytes_total",
+		Help:      "Total number of bytes relayed over streams.",
+	}, []string{"direction"})
+	requestRelays := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_request_relay_duration_seconds",
+		Help:      "Duration of relaying stream requests to the responding client until the response is relayed back.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	slowClients := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_client_disconnect_total",
+		Help:      "Total number of clients disconnected as they are too slow to receive relayed data.",
+	})
+	relayedFrames := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relayed_frames_total",
+		Help:      "Total number of frames relayed over streams.",
+	}, []string{"direction", "type"})
+	handshakes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshake_total",
+		Help:      "Total number of session handshakes.",
+	}, []string{"result"})
+	droppedHandshakes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshake_dropped_total",
+		Help:      "Total number of connections dropped during the session handshake, before authentication.",
+	}, []string{"reason"})
 
 	return &metrics{
 		activeSessions:     activeSessions,
 		successfulSessions: successfulSessions,
 		failedSessions:     failedSessions,
+		rejectedSessions:   rejectedSessions,
 		activeStreams:      activeStreams,
 		successfulStreams:  successfulStreams,
 		failedStreams:      failedStreams,
+		rejectedStreams:    rejectedStreams,
+		relayedBytes:       relayedBytes,
+		relayedFrames:      relayedFrames,
+		requestRelays:      requestRelays,
+		slowClients:        slowClients,
+		handshakes:         handshakes,
+		droppedHandshakes:  droppedHandshakes,
+	}
+}
+
+// Register registers the collectors of the metrics to the registerer (such as the registry which backs the hosting
+// binary's '/metrics' endpoint).
+func Register(reg prometheus.Registerer, m Metrics) error {
+	for _, c := range m.Collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 type metrics struct {
 	activeSessions     prometheus.Gauge
 	successfulSessions prometheus.Counter
 	failedSessions     prometheus.Counter
+	rejectedSessions   *prometheus.CounterVec
 
 	activeStreams     prometheus.Gauge
 	successfulStreams prometheus.Counter
 	failedStreams     prometheus.Counter
+	rejectedStreams   *prometheus.CounterVec
+
+	relayedBytes  *prometheus.CounterVec
+	relayedFrames *prometheus.CounterVec
+	requestRelays prometheus.Histogram
+	slowClients   prometheus.Counter
+
+	handshakes        *prometheus.CounterVec
+	droppedHandshakes *prometheus.CounterVec
 }
 
 func (m *metrics) Collectors() []prometheus.Collector {
@@ -71,9 +210,17 @@ func (m *metrics) Collectors() []prometheus.Collector {
 		m.activeSessions,
 		m.successfulSessions,
 		m.failedSessions,
+		m.rejectedSessions,
 		m.activeStreams,
 		m.successfulStreams,
 		m.failedStreams,
+		m.rejectedStreams,
+		m.relayedBytes,
+		m.relayedFrames,
+		m.requestRelays,
+		m.slowClients,
+		m.handshakes,
+		m.droppedHandshakes,
 	}
 }
 
@@ -91,6 +238,14 @@ func (m *metrics) RecordSession(delta DeltaType) {
 	}
 }
 
+func (m *metrics) RecordSessionRejected(reason string) {
+	m.rejectedSessions.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) RecordStreamRejected(reason string) {
+	m.rejectedStreams.WithLabelValues(reason).Inc()
+}
+
 func (m *metrics) RecordStream(delta DeltaType) {
 	switch delta {
 	case 0:
@@ -104,3 +259,27 @@ func (m *metrics) RecordStream(delta DeltaType) {
 		panic(fmt.Errorf("invalid delta: %d", delta))
 	}
 }
+
+func (m *metrics) RecordRelayedBytes(direction string, n int) {
+	m.relayedBytes.WithLabelValues(direction).Add(float64(n))
+}
+
+func (m *metrics) RecordRelayedFrame(direction, frameType string) {
+	m.relayedFrames.WithLabelValues(direction, frameType).Inc()
+}
+
+func (m *metrics) RecordRequestRelay(duration time.Duration) {
+	m.requestRelays.Observe(duration.Seconds())
+}
+
+func (m *metrics) RecordSlowClient() {
+	m.slowClients.Inc()
+}
+
+func (m *metrics) RecordHandshake(result string) {
+	m.handshakes.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) RecordHandshakeDropped(reason string) {
+	m.droppedHandshakes.WithLabelValues(reason).Inc()
+}
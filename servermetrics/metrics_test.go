@@ -0,0 +1,99 @@
+package servermetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := New("dmsg")
+	require.NoError(t, Register(reg, m))
+
+	// Registering the same metrics twice fails.
+	require.Error(t, Register(reg, m))
+
+	// The default implementation is extended.
+	xm, ok := m.(ExtendedMetrics)
+	require.True(t, ok)
+
+	xm.RecordSession(DeltaConnect)
+	xm.RecordStream(DeltaConnect)
+	xm.RecordSessionRejected(ReasonServerFull)
+	xm.RecordStreamRejected(ReasonTooManyStreams)
+	xm.RecordStreamRejected(ReasonTooManyStreams)
+	xm.RecordRelayedBytes(DirectionForward, 100)
+	xm.RecordRelayedBytes(DirectionBackward, 20)
+	xm.RecordRelayedFrame(DirectionForward, FrameRequest)
+	xm.RecordRelayedFrame(DirectionBackward, FrameResponse)
+	xm.RecordRelayedFrame(DirectionForward, FrameData)
+	xm.RecordRelayedFrame(DirectionForward, FrameData)
+	xm.RecordRequestRelay(time.Millisecond)
+	xm.RecordSlowClient()
+	xm.RecordHandshake(HandshakeSuccess)
+	xm.RecordHandshake(HandshakeFailure)
+	xm.RecordHandshakeDropped(ReasonHandshakeTimeout)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range metric.GetLabel() {
+				name += "/" + l.GetValue()
+			}
+			// Only one of these is set, the rest are zero. Histograms are represented by their sample count.
+			values[name] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue() +
+				float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+
+	require.Equal(t, map[string]float64{
+		"dmsg_active_sessions_count":                     1,
+		"dmsg_session_success_total":                     1,
+		"dmsg_session_fail_total":                        0,
+		"dmsg_session_rejected_total/server_full":        1,
+		"dmsg_active_streams_count":                      1,
+		"dmsg_stream_success_total":                      1,
+		"dmsg_stream_fail_total":                         0,
+		"dmsg_stream_rejected_total/too_many_streams":    2,
+		"dmsg_relayed_bytes_total/forward":               100,
+		"dmsg_relayed_bytes_total/backward":              20,
+		"dmsg_relayed_frames_total/forward/request":      1,
+		"dmsg_relayed_frames_total/backward/response":    1,
+		"dmsg_relayed_frames_total/forward/data":         2,
+		"dmsg_stream_request_relay_duration_seconds":     1,
+		"dmsg_slow_client_disconnect_total":              1,
+		"dmsg_handshake_total/success":                   1,
+		"dmsg_handshake_total/failure":                   1,
+		"dmsg_handshake_dropped_total/handshake_timeout": 1,
+	}, values)
+}
+
+// baseMetrics implements Metrics only.
+type baseMetrics struct {
+	sessions int
+}
+
+func (m *baseMetrics) Collectors() []prometheus.Collector { return nil }
+func (m *baseMetrics) RecordSession(_ DeltaType)          { m.sessions++ }
+func (m *baseMetrics) RecordStream(_ DeltaType)           {}
+
+func TestExtend(t *testing.T) {
+	// Extended metrics are returned as they are.
+	m := New("dmsg")
+	require.Equal(t, m, Extend(m))
+
+	// Metrics which are not extended still record the base metrics.
+	bm := new(baseMetrics)
+	xm := Extend(bm)
+	xm.RecordSession(DeltaConnect)
+	xm.RecordSessionRejected(ReasonServerFull)
+	xm.RecordHandshake(HandshakeSuccess)
+	require.Equal(t, 1, bm.sessions)
+}
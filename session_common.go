@@ -4,29 +4,64 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/skycoin/yamux"
 
 	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
+	"github.com/skycoin/dmsg/handshakemetrics"
 	"github.com/skycoin/dmsg/noise"
 )
 
 // SessionCommon contains the common fields and methods used by a session, whether it be it from the client or server
 // perspective.
 type SessionCommon struct {
+	// atomic requires 64-bit alignment for struct field access
+	lastRead   int64  // unix nano time of the last read from the underlying net.Conn
+	connWrite  int64  // unix nano start time of the pending write to the underlying net.Conn (0 if there is none)
+	relayedOut uint64 // bytes relayed from the client to it's peers (server sessions only)
+	relayedIn  uint64 // bytes relayed from the client's peers to the client (server sessions only)
+
 	entity *EntityCommon // back reference
 	rPK    cipher.PubKey // remote pk
 
-	netConn net.Conn // underlying net.Conn (TCP connection to the dmsg server)
-	ys      *yamux.Session
-	ns      *noise.Noise
-	nMap    noise.NonceMap
-	rMx     sync.Mutex
-	wMx     sync.Mutex
+	netConn  net.Conn // underlying net.Conn (TCP connection to the dmsg server)
+	dialAddr string   // advertised address which the session was dialed at (client sessions only)
+	ys       *yamux.Session
+	ns       *noise.Noise
+	nMap     noise.NonceMap
+	rMx      sync.Mutex
+	wMx      sync.Mutex
+
+	windowSize uint32    // receive window of yamux streams
+	since      time.Time // time in which the session is established
+	release    func()    // releases the connection limiter slot held by the session (if any)
+
+	writes pendingWrites    // pending writes to the remote (see ClientInfo.QueueDepth)
+	egress *egressScheduler // schedules writes of streams across their priorities (client sessions only)
+
+	rFrames *frameCounter // frames read from the net.Conn
+	wFrames *frameCounter // frames written to the net.Conn
+	guard   *frameGuard   // drops frames of the client which violate the protocol (server sessions only)
+
+	goAway     chan struct{} // closed once the server sends a GOAWAY notice (client sessions only)
+	goAwayErr  error         // reason of the GOAWAY notice, set before goAway is closed
+	goAwayOnce sync.Once
+
+	linkFailed  chan struct{} // closed once a write to the underlying net.Conn fails
+	linkErrOnce sync.Once
+
+	relays    map[*relay]struct{} // streams relayed from or to the client (server sessions only)
+	relaysMx  sync.Mutex
+	srvClosed sync.Map // yamux IDs of streams which the server closes, to the reasons (client sessions only)
+
+	framesDropped uint64 // atomic, notices of frames of streams which the server dropped (client sessions only)
 
 	log logrus.FieldLogger
 }
@@ -36,6 +71,19 @@ func (sc *SessionCommon) GetConn() net.Conn {
 	return sc.netConn
 }
 
+// streamWindow returns the receive window of yamux streams for the given size of stream buffers (see
+// Config.StreamBufferSize).
+func streamWindow(size int) uint32 {
+	switch {
+	case size == 0:
+		return DefaultStreamBufferSize
+	case size < MinStreamBufferSize:
+		return MinStreamBufferSize
+	default:
+		return uint32(size)
+	}
+}
+
 func (sc *SessionCommon) initClient(entity *EntityCommon, conn net.Conn, rPK cipher.PubKey) error {
 	ns, err := noise.New(noise.HandshakeXK, noise.Config{
 		LocalPK:   entity.pk,
@@ -47,26 +95,31 @@ func (sc *SessionCommon) initClient(entity *EntityCommon, conn net.Conn, rPK cip
 		return err
 	}
 
+	start := time.Now()
 	r := bufio.NewReader(conn)
 	if err := noise.InitiatorHandshake(ns, r, conn); err != nil {
 		return err
 	}
-	if r.Buffered() > 0 {
-		return ErrSessionHandshakeExtraBytes
-	}
+	conn = handshakeConn(conn, r)
 
-	ySes, err := yamux.Client(conn, yamux.DefaultConfig())
+	yConf := yamux.DefaultConfig()
+	yConf.MaxStreamWindowSize = entity.streamWindow
+	ySes, err := yamux.Client(sc.track(conn, entity.cm), yConf)
 	if err != nil {
 		return err
 	}
 
 	sc.entity = entity
 	sc.rPK = rPK
+	sc.goAway = make(chan struct{})
+	sc.egress = newEgressScheduler(egressMaxTurn)
 	sc.netConn = conn
 	sc.ys = ySes
+	sc.windowSize = yConf.MaxStreamWindowSize
 	sc.ns = ns
 	sc.nMap = make(noise.NonceMap)
-	sc.log = entity.log.WithField("session", ns.RemoteStatic())
+	sc.log = entity.log.WithField("server_pk", ns.RemoteStatic()) // as the loggers of the session's streams
+	entity.recordHandshake(sc.log, handshakemetrics.KindSession, start)
 	return nil
 }
 
@@ -80,15 +133,17 @@ func (sc *SessionCommon) initServer(entity *EntityCommon, conn net.Conn) error {
 		return err
 	}
 
+	start := time.Now()
 	r := bufio.NewReader(conn)
 	if err := noise.ResponderHandshake(ns, r, conn); err != nil {
 		return err
 	}
-	if r.Buffered() > 0 {
-		return ErrSessionHandshakeExtraBytes
-	}
+	conn = handshakeConn(conn, r)
 
-	ySes, err := yamux.Server(conn, yamux.DefaultConfig())
+	yConf := yamux.DefaultConfig()
+	yConf.MaxStreamWindowSize = entity.streamWindow
+	sc.guard = newFrameGuard(entity.maxViolations)
+	ySes, err := yamux.Server(sc.track(sc.guard.wrap(conn), nil), yConf)
 	if err != nil {
 		return err
 	}
@@ -97,12 +152,273 @@ func (sc *SessionCommon) initServer(entity *EntityCommon, conn net.Conn) error {
 	sc.rPK = ns.RemoteStatic()
 	sc.netConn = conn
 	sc.ys = ySes
+	sc.windowSize = yConf.MaxStreamWindowSize
 	sc.ns = ns
 	sc.nMap = make(noise.NonceMap)
-	sc.log = entity.log.WithField("session", ns.RemoteStatic())
+	sc.log = entity.log.WithField("remote_pk", ns.RemoteStatic())
+	entity.recordHandshake(sc.log, handshakemetrics.KindSession, start)
 	return nil
 }
 
+// setGoAway records that the server sent a GOAWAY notice of the given reason.
+func (sc *SessionCommon) setGoAway(reason error) {
+	sc.goAwayOnce.Do(func() {
+		sc.goAwayErr = reason
+		close(sc.goAway)
+	})
+}
+
+// sendGoAway sends a GOAWAY notice of the given reason to the client of the session.
+func (sc *SessionCommon) sendGoAway(reason Error) error {
+	yStr, err := sc.ys.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = yStr.Close() }() //nolint:errcheck
+
+	if err := yStr.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+	return sc.writeObject(yStr, makeSignedGoAway(sc.LocalPK(), sc.rPK, sc.localSK(), reason))
+}
+
+// sendStreamNotice notifies the client of the session that the relayed stream of the given yamux ID is closed for the
+// given reason (see makeSignedStreamNotice). It returns once the client acknowledges the notice (by closing it's
+// stream), so that the relayed stream is closed after the client has processed the notice.
+func (sc *SessionCommon) sendStreamNotice(streamID uint32, reason Error) error {
+	yStr, err := sc.ys.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = yStr.Close() }() //nolint:errcheck
+
+	if err := yStr.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+	notice := makeSignedStreamNotice(sc.LocalPK(), sc.rPK, sc.localSK(), reason, streamID)
+	if err := sc.writeObject(yStr, notice); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, yStr)
+	return err
+}
+
+// serverClosed returns why the server closed the stream of the given yamux ID (nil if it did not notify so).
+func (sc *SessionCommon) serverClosed(streamID uint32) error {
+	reason, ok := sc.srvClosed.Load(streamID)
+	if !ok {
+		return nil
+	}
+	return reason.(error)
+}
+
+// track wraps the given conn so that reads update the session's last read time, and write failures are reported
+// (see setLinkErr). The traffic is recorded to the given metrics, unless nil.
+func (sc *SessionCommon) track(conn net.Conn, m clientmetrics.Metrics) net.Conn {
+	sc.since = time.Now()
+	atomic.StoreInt64(&sc.lastRead, sc.since.UnixNano())
+	sc.linkFailed = make(chan struct{})
+	sc.rFrames, sc.wFrames = new(frameCounter), new(frameCounter)
+	return &trackingConn{
+		Conn:       conn,
+		lastRead:   &sc.lastRead,
+		connWrite:  &sc.connWrite,
+		writes:     &sc.writes,
+		rFrames:    sc.rFrames,
+		wFrames:    sc.wFrames,
+		m:          m,
+		onWriteErr: sc.setLinkErr,
+	}
+}
+
+// FrameStats returns the frames of the session, counted by type.
+func (sc *SessionCommon) FrameStats() FrameStats {
+	return FrameStats{Read: sc.rFrames.get(), Written: sc.wFrames.get()}
+}
+
+// HandshakeInfo describes the noise handshake which established a session or stream.
+type HandshakeInfo struct {
+	Pattern   string `json:"pattern"`   // Handshake pattern ("XK" for sessions, "KK" for streams).
+	Initiator bool   `json:"initiator"` // Whether the local entity initiated the handshake.
+}
+
+func handshakeInfo(ns *noise.Noise) HandshakeInfo {
+	return HandshakeInfo{Pattern: ns.Pattern(), Initiator: ns.Initiator()}
+}
+
+// HandshakeInfo returns the noise handshake which established the session.
+func (sc *SessionCommon) HandshakeInfo() HandshakeInfo {
+	return handshakeInfo(sc.ns)
+}
+
+// setLinkErr records that writing to the underlying net.Conn failed.
+// As the net.Conn is shared by all streams of the session, the session (and so all it's streams) is closed, after
+// which the streams fail with ErrLinkError.
+func (sc *SessionCommon) setLinkErr(err error) {
+	sc.linkErrOnce.Do(func() {
+		close(sc.linkFailed)
+		sc.log.WithError(err).Warn("Session connection failed on write, closing all streams.")
+	})
+}
+
+// linkError returns ErrLinkError in place of the given stream error if the underlying net.Conn failed on write.
+func (sc *SessionCommon) linkError(err error) error {
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-sc.linkFailed:
+		return ErrLinkError
+	default:
+		return err
+	}
+}
+
+// idleFor returns the duration since data was last received on the session.
+func (sc *SessionCommon) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sc.lastRead)))
+}
+
+// writeBlockedFor returns the duration in which the pending write to the underlying net.Conn is blocked (0 if there is
+// no pending write). Writes to the net.Conn block once the remote does not keep up with receiving data of the session.
+// Writes to single streams are not accounted, as they also block once the remote does not read the stream (which
+// holds back only the writes of the stream, by it's flow control window).
+func (sc *SessionCommon) writeBlockedFor() time.Duration {
+	start := atomic.LoadInt64(&sc.connWrite)
+	if start == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, start))
+}
+
+// trackWrites wraps the given stream of the session, so that it's pending writes are tracked (see
+// ClientInfo.QueueDepth).
+func (sc *SessionCommon) trackWrites(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &writeTrackingRWC{ReadWriteCloser: rwc, writes: &sc.writes}
+}
+
+// pendingWrites tracks the start times of pending writes.
+type pendingWrites struct {
+	starts map[uint64]time.Time
+	next   uint64
+	mx     sync.Mutex
+}
+
+// begin records the start of a write, and returns a function to be called once the write ends.
+func (pw *pendingWrites) begin() (end func()) {
+	pw.mx.Lock()
+	if pw.starts == nil {
+		pw.starts = make(map[uint64]time.Time)
+	}
+	id := pw.next
+	pw.next++
+	pw.starts[id] = time.Now()
+	pw.mx.Unlock()
+
+	return func() {
+		pw.mx.Lock()
+		delete(pw.starts, id)
+		pw.mx.Unlock()
+	}
+}
+
+// count returns the number of pending writes.
+func (pw *pendingWrites) count() int {
+	pw.mx.Lock()
+	defer pw.mx.Unlock()
+
+	return len(pw.starts)
+}
+
+// oldest returns the duration since the start of the oldest pending write (0 if there is no pending write).
+func (pw *pendingWrites) oldest() time.Duration {
+	pw.mx.Lock()
+	defer pw.mx.Unlock()
+
+	var d time.Duration
+	for _, start := range pw.starts {
+		if since := time.Since(start); since > d {
+			d = since
+		}
+	}
+	return d
+}
+
+// writeTrackingRWC tracks pending writes.
+type writeTrackingRWC struct {
+	io.ReadWriteCloser
+	writes *pendingWrites
+}
+
+func (c *writeTrackingRWC) Write(p []byte) (int, error) {
+	defer c.writes.begin()()
+	return c.ReadWriteCloser.Write(p)
+}
+
+// trackingConn records the time of the last successful read and pending writes, counts the frames read and written
+// (and records the traffic to the client's metrics, if any), and reports failed writes (after which it is closed, so
+// that blocked reads of the session return promptly).
+// Reads and writes are each done by a single goroutine of the yamux session.
+type trackingConn struct {
+	net.Conn
+	lastRead   *int64
+	connWrite  *int64
+	writes     *pendingWrites
+	rFrames    *frameCounter
+	wFrames    *frameCounter
+	m          clientmetrics.Metrics // nil if not collected
+	onWriteErr func(err error)
+}
+
+func (c *trackingConn) Write(b []byte) (int, error) {
+	end := c.writes.begin()
+	atomic.StoreInt64(c.connWrite, time.Now().UnixNano())
+	n, err := c.Conn.Write(b)
+	atomic.StoreInt64(c.connWrite, 0)
+	end()
+	frames := c.wFrames.count(b[:n])
+	if c.m != nil && n > 0 {
+		c.m.RecordTraffic(clientmetrics.DirectionOut, n, frames)
+	}
+	if err != nil {
+		c.onWriteErr(err)
+		_ = c.Conn.Close() //nolint:errcheck
+	}
+	return n, err
+}
+
+func (c *trackingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(c.lastRead, time.Now().UnixNano())
+		frames := c.rFrames.count(b[:n])
+		if c.m != nil {
+			c.m.RecordTraffic(clientmetrics.DirectionIn, n, frames)
+		}
+	}
+	return n, err
+}
+
+// handshakeConn returns the conn which a session reads from after the handshake was read through 'r'.
+// Either side may use the session as soon as it's handshake completes: the client (i.e. to dial a stream) right after
+// sending it's last handshake message, and the server right after reading it. So data which follows the handshake may
+// already be buffered by 'r', and it is read by the session before the rest of the conn (rather than failing the
+// session with ErrSessionHandshakeExtraBytes, which discarded the data).
+func handshakeConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+// bufferedConn reads from the reader which buffers the start of the conn's data.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
 // writeEncryptedGob encrypts with noise and prefixed with uint16 (2 additional bytes).
 func (sc *SessionCommon) writeObject(w io.Writer, obj SignedObject) error {
 	sc.wMx.Lock()
@@ -119,7 +435,18 @@ func (sc *SessionCommon) readObject(r io.Reader) (SignedObject, error) {
 	if _, err := io.ReadFull(r, lb); err != nil {
 		return nil, err
 	}
-	pb := make([]byte, binary.BigEndian.Uint16(lb))
+	// The declared size is checked before the frame is allocated.
+	n := int(binary.BigEndian.Uint16(lb))
+	if max := sc.entity.maxFrameSize; max > 0 && n > max {
+		return nil, ErrFrameTooLarge
+	}
+	if mb := sc.entity.mem; mb != nil {
+		if !mb.reserve(sc.rPK, n, sc.ys.CloseChan()) {
+			return nil, ErrClientOverBudget
+		}
+		defer mb.release(sc.rPK, n)
+	}
+	pb := make([]byte, n)
 	if _, err := io.ReadFull(r, pb); err != nil {
 		return nil, err
 	}
@@ -158,8 +485,62 @@ func (sc *SessionCommon) Close() error {
 		return nil
 	}
 	err := sc.ys.Close()
+	if sc.release != nil {
+		sc.release()
+	}
 	sc.rMx.Lock()
 	sc.nMap = nil
 	sc.rMx.Unlock()
 	return err
 }
+
+// probeIdle closes the session if it is found to be dead.
+// Once no data is received for 'idleTimeout', the session is pinged. If the ping is not responded to within
+// 'probeTimeout', the session is closed (which triggers reconnection of clients, and closes the streams relayed by
+// servers). Pings are responded to by idle remotes, so only remotes which are gone are affected.
+// It returns when the session is closed.
+func (sc *SessionCommon) probeIdle(idleTimeout, probeTimeout time.Duration) {
+	t := time.NewTimer(idleTimeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-sc.ys.CloseChan():
+			return
+		case <-t.C:
+		}
+
+		if idle := sc.idleFor(); idle < idleTimeout {
+			t.Reset(idleTimeout - idle)
+			continue
+		}
+
+		if err := sc.probe(probeTimeout); err != nil {
+			sc.log.WithError(err).Warn("Idle session failed probe, closing.")
+			if err := sc.Close(); err != nil {
+				sc.log.WithError(err).Debug("On (*SessionCommon).probeIdle() failure, close session resulted in error.")
+			}
+			return
+		}
+		t.Reset(idleTimeout)
+	}
+}
+
+// probe pings the session, failing if the ping is not responded to within the timeout.
+func (sc *SessionCommon) probe(timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := sc.Ping()
+		errCh <- err
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-t.C:
+		return ErrSessionProbeTimeout
+	}
+}
@@ -0,0 +1,95 @@
+package dmsg
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestSession_FrameStats(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srvPK, srvSK := GenKeyPair(t, "server")
+	srv := NewServer(srvPK, srvSK, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	srvCh := make(chan error, 1)
+	go func() { srvCh <- srv.Serve(lis, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		waitFor(t, time.Second*10, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A")
+	clientB := newClient("client_B")
+	sesA, ok := clientA.Session(srvPK)
+	require.True(t, ok)
+	before := sesA.FrameStats()
+
+	// Request: dial a stream.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	connB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	afterDial := sesA.FrameStats()
+	require.Greater(t, afterDial.Written.Request, before.Written.Request)
+	require.Greater(t, afterDial.Read.Request, before.Read.Request)
+	require.Greater(t, afterDial.Written.Data, before.Written.Data) // stream request
+	require.Greater(t, afterDial.Read.Data, before.Read.Data)       // stream response
+
+	// Data: write to the stream.
+	_, err = connA.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(connB, make([]byte, 5))
+	require.NoError(t, err)
+	afterData := sesA.FrameStats()
+	require.Equal(t, afterDial.Written.Data+1, afterData.Written.Data)
+	require.Equal(t, afterDial.Written.Request, afterData.Written.Request)
+
+	// Ping: probe the session.
+	_, err = sesA.Ping()
+	require.NoError(t, err)
+	afterPing := sesA.FrameStats()
+	require.Equal(t, afterData.Written.Ping+1, afterPing.Written.Ping)
+	require.Equal(t, afterData.Read.Ping+1, afterPing.Read.Ping)
+
+	// Close: close the stream from both sides.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	waitFor(t, time.Second*5, func() bool {
+		s := sesA.FrameStats()
+		return s.Written.Close > afterPing.Written.Close && s.Read.Close > afterPing.Read.Close
+	})
+
+	// The server counts the frames of the same link in the opposite direction.
+	srvSesA, ok := srv.serverSession(clientA.LocalPK())
+	require.True(t, ok)
+	waitFor(t, time.Second*5, func() bool {
+		s := srvSesA.FrameStats()
+		return s.Read.Ping > 0 && s.Read.Data > 0 && s.Read.Close > 0 && s.Written.Request > 0
+	})
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-srvCh)
+}
@@ -0,0 +1,133 @@
+package dmsg
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// sessionLogs determines the logging of a server's sessions.
+// Debug logs of relayed streams are only kept for a sample of streams, except for clients of which debug logging is
+// enabled at runtime (see Server.SetClientDebugLogging), which are logged in full regardless of the server's level.
+type sessionLogs struct {
+	sampling uint64 // debug logs are kept for 1 in 'sampling' streams
+	streams  uint64 // atomic, number of streams (for sampling)
+	lastID   uint64 // atomic, ID of the last session
+
+	debug   map[cipher.PubKey]struct{} // clients of which debug logging is enabled
+	debugMx sync.RWMutex
+}
+
+func newSessionLogs(sampling int) *sessionLogs {
+	if sampling < 1 {
+		sampling = 1
+	}
+	return &sessionLogs{
+		sampling: uint64(sampling),
+		debug:    make(map[cipher.PubKey]struct{}),
+	}
+}
+
+// nextID returns the ID of a new session.
+func (sl *sessionLogs) nextID() uint64 {
+	return atomic.AddUint64(&sl.lastID, 1)
+}
+
+func (sl *sessionLogs) setDebug(pk cipher.PubKey, enabled bool) {
+	sl.debugMx.Lock()
+	if enabled {
+		sl.debug[pk] = struct{}{}
+	} else {
+		delete(sl.debug, pk)
+	}
+	sl.debugMx.Unlock()
+}
+
+func (sl *sessionLogs) isDebug(pk cipher.PubKey) bool {
+	if sl == nil {
+		return false
+	}
+	sl.debugMx.RLock()
+	_, ok := sl.debug[pk]
+	sl.debugMx.RUnlock()
+	return ok
+}
+
+// sessionLogger returns the logger of lifecycle events of the session of the given client.
+func (sl *sessionLogs) sessionLogger(ll *levelLoggers, pk cipher.PubKey) logrus.FieldLogger {
+	if sl.isDebug(pk) {
+		return ll.withLevel(logrus.DebugLevel)
+	}
+	return ll.log
+}
+
+// streamLogger returns the logger of a stream initiated by the given client. Debug logs are dropped for streams which
+// are not sampled (a nil sessionLogs keeps all logs).
+func (sl *sessionLogs) streamLogger(ll *levelLoggers, pk cipher.PubKey) logrus.FieldLogger {
+	if sl == nil {
+		return ll.log
+	}
+	if sl.isDebug(pk) {
+		return ll.withLevel(logrus.DebugLevel)
+	}
+	if atomic.AddUint64(&sl.streams, 1)%sl.sampling == 0 {
+		return ll.log
+	}
+	if ll.level() > logrus.InfoLevel {
+		return ll.withLevel(logrus.InfoLevel)
+	}
+	return ll.log
+}
+
+// levelLoggers holds the logger of a session, and caches loggers of the same fields and output which log at other
+// levels. Hence, these are created once per session rather than once per stream.
+type levelLoggers struct {
+	log    logrus.FieldLogger
+	levels map[logrus.Level]logrus.FieldLogger
+	mx     sync.Mutex
+}
+
+func newLevelLoggers(log logrus.FieldLogger) *levelLoggers {
+	return &levelLoggers{
+		log:    log,
+		levels: make(map[logrus.Level]logrus.FieldLogger),
+	}
+}
+
+// level returns the level of the session's logger.
+func (ll *levelLoggers) level() logrus.Level {
+	return ll.log.WithFields(logrus.Fields{}).Logger.GetLevel()
+}
+
+// withLevel returns the session's logger if it logs at the given level, or otherwise the cached logger which does.
+func (ll *levelLoggers) withLevel(level logrus.Level) logrus.FieldLogger {
+	if ll.level() == level {
+		return ll.log
+	}
+	ll.mx.Lock()
+	defer ll.mx.Unlock()
+	log, ok := ll.levels[level]
+	if !ok {
+		log = withLevel(ll.log, level)
+		ll.levels[level] = log
+	}
+	return log
+}
+
+// withLevel returns a logger of the same fields and output as the given logger, which logs at the given level.
+func withLevel(log logrus.FieldLogger, level logrus.Level) logrus.FieldLogger {
+	e := log.WithFields(logrus.Fields{})
+	if e.Logger.GetLevel() == level {
+		return e
+	}
+	l := logrus.New()
+	l.Out = e.Logger.Out
+	l.Hooks = e.Logger.Hooks
+	l.Formatter = e.Logger.Formatter
+	l.ReportCaller = e.Logger.ReportCaller
+	l.SetLevel(level)
+	return l.WithFields(e.Data)
+}
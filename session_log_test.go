@@ -0,0 +1,57 @@
+package dmsg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+func TestSessionLogs(t *testing.T) {
+	var buf bytes.Buffer
+	base := logrus.New()
+	base.Out = &buf
+	base.Formatter = &logrus.JSONFormatter{}
+	ll := newLevelLoggers(base.WithField("session_id", 1))
+
+	pkA, _ := GenKeyPair(t, "client A")
+	pkB, _ := GenKeyPair(t, "client B")
+	sl := newSessionLogs(3)
+
+	// countDebug logs a debug line for each of 'n' streams of the client, and returns the number of lines written.
+	countDebug := func(pk cipher.PubKey, n int) int {
+		buf.Reset()
+		for i := 0; i < n; i++ {
+			sl.streamLogger(ll, pk).Debug("Stream debug log.")
+		}
+		return bytes.Count(buf.Bytes(), []byte("\n"))
+	}
+
+	// Debug logs are sampled at debug level, and dropped otherwise.
+	base.SetLevel(logrus.DebugLevel)
+	require.Equal(t, 2, countDebug(pkA, 6))
+	require.Contains(t, buf.String(), `"session_id":1`)
+	base.SetLevel(logrus.InfoLevel)
+	require.Equal(t, 0, countDebug(pkA, 6))
+
+	// Debug logs of clients with debug logging are kept in full, regardless of the level.
+	sl.setDebug(pkA, true)
+	require.Equal(t, 6, countDebug(pkA, 6))
+	require.Equal(t, 0, countDebug(pkB, 6))
+	buf.Reset()
+	sl.sessionLogger(ll, pkA).Debug("Session debug log.")
+	require.Contains(t, buf.String(), `"session_id":1`)
+
+	// The loggers at other levels are created once per session.
+	require.True(t, sl.sessionLogger(ll, pkA) == sl.streamLogger(ll, pkA))
+	require.Len(t, ll.levels, 2)
+
+	sl.setDebug(pkA, false)
+	require.Equal(t, 0, countDebug(pkA, 6))
+
+	// Session IDs are unique.
+	require.NotEqual(t, sl.nextID(), sl.nextID())
+}
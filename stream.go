@@ -2,28 +2,76 @@ package dmsg
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/skycoin/yamux"
 
 	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/clientmetrics"
+	"github.com/skycoin/dmsg/disc"
 	"github.com/skycoin/dmsg/noise"
 )
 
 // Stream represents a dmsg connection between two dmsg clients.
 type Stream struct {
+	bytesRead    uint64 // atomic, first for 64-bit alignment
+	bytesWritten uint64 // atomic
+	priority     int32  // atomic, Priority of the stream's writes (see SetPriority)
+
 	ses  *ClientSession // back reference
 	yStr *yamux.Stream
 
 	// The following fields are to be filled after handshake.
-	lAddr  Addr
-	rAddr  Addr
-	ns     *noise.Noise
-	nsConn *noise.ReadWriter
-	close  func() // to be called when closing
-	log    logrus.FieldLogger
+	lAddr   Addr
+	rAddr   Addr
+	ns      *noise.Noise
+	nsConn  *noise.ReadWriter
+	close   func() // frees the reserved port when closing (guarded by valuesMx, see setClose)
+	release func() // releases the connection limiter slot held by the stream (if any)
+	counted int32  // atomic, 1 while the stream is counted as active by the client's metrics, 2 once closed
+	log     logrus.FieldLogger
+
+	staleEntry bool // whether the stream was dialed using a stale discovery entry of the remote
+	initiator  bool // whether the stream was dialed by the client (rather than accepted)
+
+	remoteCaps   *disc.Capabilities // capabilities advertised by the remote (see remoteFeature)
+	remoteCapsOK bool               // whether remoteCaps is known
+	capsMx       sync.Mutex
+
+	values   map[interface{}]interface{} // values attached by the application (see SetValue)
+	closed   bool                        // whether values were cleared on close (the stream is closing)
+	valuesMx sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+
+	remoteClose atomic.Value // *StreamCloseError, set once the remote's close frame is read (see CloseWithCode)
+
+	writeMx sync.Mutex // keeps writes from interleaving, as they are scheduled in chunks (see write)
+
+	readDeadline  time.Time // set by the application (restored after ReadContext is cancelled)
+	writeDeadline time.Time // set by the application (restored after WriteContext is cancelled)
+	deadlineMx    sync.Mutex
+}
+
+// StreamInfo describes the parameters and usage of an established stream.
+type StreamInfo struct {
+	ID             uint32        // ID of the stream within it's session.
+	LocalAddr      Addr          // Address of the local client.
+	RemoteAddr     Addr          // Address of the remote client.
+	ServerPK       cipher.PubKey // PK of the server relaying the stream.
+	MaxWriteSize   int           // Largest payload of a single encrypted frame.
+	WindowSize     uint32        // Receive window of the underlying session.
+	StaleDiscovery bool          // Whether the stream was dialed using stale discovery data.
+	BytesRead      uint64        // Total payload bytes read from the stream.
+	BytesWritten   uint64        // Total payload bytes written to the stream.
+	Handshake      HandshakeInfo // Noise handshake which established the stream.
 }
 
 func newInitiatingStream(cSes *ClientSession) (*Stream, error) {
@@ -31,7 +79,7 @@ func newInitiatingStream(cSes *ClientSession) (*Stream, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Stream{ses: cSes, yStr: yStr}, nil
+	return &Stream{ses: cSes, yStr: yStr, log: streamLogger(cSes, yStr)}, nil
 }
 
 func newRespondingStream(cSes *ClientSession) (*Stream, error) {
@@ -39,18 +87,171 @@ func newRespondingStream(cSes *ClientSession) (*Stream, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Stream{ses: cSes, yStr: yStr}, nil
+	return &Stream{ses: cSes, yStr: yStr, log: streamLogger(cSes, yStr)}, nil
+}
+
+// streamLogger returns the logger of a stream of the given session, which identifies the stream by the server which
+// relays it and it's ID within the session. The remote and ports are added once they are known (see prepareFields).
+func streamLogger(cSes *ClientSession, yStr *yamux.Stream) logrus.FieldLogger {
+	return cSes.entity.log.WithField("server_pk", cSes.RemotePK()).WithField("tp_id", yStr.StreamID())
 }
 
 // Close closes the dmsg stream.
+// It is safe to call Close multiple times and concurrently: the stream is closed once (with at most one close frame
+// sent to the remote), and all calls return the result of doing so.
 func (s *Stream) Close() error {
 	if s == nil {
 		return nil
 	}
-	if s.close != nil {
-		s.close()
+	s.closeOnce.Do(func() {
+		s.valuesMx.Lock()
+		closePort := s.close
+		s.values = nil
+		s.closed = true
+		s.valuesMx.Unlock()
+		if closePort != nil {
+			closePort()
+		}
+		if s.release != nil {
+			s.release()
+		}
+		if atomic.SwapInt32(&s.counted, 2) == 1 {
+			s.ses.entity.cm.RecordStreamClosed()
+		}
+		s.closeErr = s.yStr.Close()
+		s.ses.srvClosed.Delete(s.yStr.StreamID())
+	})
+	return s.closeErr
+}
+
+// CloseWithCode sends a close frame with the given application error code and message to the remote, and closes the
+// stream. Data written beforehand is read by the remote first, after which it's reads and writes fail with a
+// *StreamCloseError which carries the code and message. The message is limited to MaxCloseMessageSize bytes.
+// The remote must advertise FeatureCloseCode in it's discovery entry, as older clients cannot decode close frames.
+// Otherwise (or if the remote's entry is not yet known, see remoteFeature), the stream is closed as Close does, without
+// the code.
+func (s *Stream) CloseWithCode(code uint16, msg string) error {
+	if len(msg) > MaxCloseMessageSize {
+		return ErrCloseMessageTooLarge
+	}
+	if !s.remoteFeature(FeatureCloseCode) {
+		s.log.Debug("Remote does not support close codes, closing stream without code.")
+		return s.Close()
+	}
+	payload := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, code)
+	copy(payload[2:], msg)
+
+	err := s.streamError(s.nsConn.WriteClose(payload))
+	if cErr := s.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// abortOnDone aborts pending reads and writes of the stream once the context is done (by expiring the deadline).
+// The returned function stops this, and is safe to call multiple times.
+func (s *Stream) abortOnDone(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = s.yStr.SetDeadline(time.Now()) //nolint:errcheck
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
+
+// SetValue attaches a value of the given key to the stream, so that application state (such as an auth principal)
+// travels with the stream. A nil value removes the key. Values are cleared when the stream is closed, after which
+// SetValue is a no-op. Keys should be comparable, and are best of an unexported type (as with context.WithValue).
+// It is safe for concurrent use.
+func (s *Stream) SetValue(key, value interface{}) {
+	s.valuesMx.Lock()
+	defer s.valuesMx.Unlock()
+
+	if s.closed {
+		return
+	}
+	if value == nil {
+		delete(s.values, key)
+		return
+	}
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = value
+}
+
+// Value returns the value attached to the stream of the given key, or nil if there is none.
+// It is safe for concurrent use.
+func (s *Stream) Value(key interface{}) interface{} {
+	s.valuesMx.Lock()
+	defer s.valuesMx.Unlock()
+	return s.values[key]
+}
+
+// recordOpened records the established stream of the given kind to the client's metrics (if any). The stream is
+// counted as active until it is closed, unless it is already closed.
+func (s *Stream) recordOpened(kind string) {
+	m := s.ses.entity.cm
+	if m == nil {
+		return
+	}
+	m.RecordStreamOpened(kind)
+	if !atomic.CompareAndSwapInt32(&s.counted, 0, 1) {
+		m.RecordStreamClosed()
+	}
+}
+
+// recordFailed records the stream of the given kind, which failed to be established, to the client's metrics (if
+// any).
+func (s *Stream) recordFailed(kind string, err error) {
+	if m := s.ses.entity.cm; m != nil {
+		m.RecordStreamFailed(kind, streamFailReason(err))
+	}
+}
+
+// streamFailReason returns the reason of a stream which failed to be established with the given error, as recorded
+// to the client's metrics.
+func streamFailReason(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return clientmetrics.ReasonCanceled
+	case errors.Is(err, ErrHandshakeTimeout), errors.Is(err, context.DeadlineExceeded):
+		return clientmetrics.ReasonTimeout
+	case isRejectionErr(err):
+		return clientmetrics.ReasonRejected
+	default:
+		return clientmetrics.ReasonError
+	}
+}
+
+// isRejectionErr returns true if the error is of a stream request which is rejected (by the remote client, or the
+// server), i.e. an error for dial request/response.
+func isRejectionErr(err error) bool {
+	var dErr Error
+	return errors.As(err, &dErr) && dErr.code >= 300 && dErr.code < 400
+}
+
+// acquireSlot acquires a slot of the client's connection limiter for the stream.
+func (s *Stream) acquireSlot() error {
+	release, ok := s.ses.entity.limiter.acquire()
+	if !ok {
+		return ErrResourceLimit
 	}
-	return s.yStr.Close()
+	s.release = release
+	return nil
 }
 
 // Logger returns the internal logrus.FieldLogger instance.
@@ -58,12 +259,32 @@ func (s *Stream) Logger() logrus.FieldLogger {
 	return s.log
 }
 
+// setClose sets the function which frees the reserved port of the stream. The stream may be closed as soon as it is
+// reserved (as the porter closes it's values once the client closes), in which case the port is freed right away and
+// false is returned.
+func (s *Stream) setClose(closePort func()) bool {
+	s.valuesMx.Lock()
+	closed := s.closed
+	if !closed {
+		s.close = closePort
+	}
+	s.valuesMx.Unlock()
+
+	if closed {
+		closePort()
+	}
+	return !closed
+}
+
 func (s *Stream) writeRequest(rAddr Addr) (req StreamRequest, err error) {
 	// Reserve stream in porter.
-	var lPort uint16
-	if lPort, s.close, err = s.ses.porter.ReserveEphemeral(context.Background(), s); err != nil {
+	lPort, closePort, err := s.ses.porter.ReserveEphemeral(context.Background(), s)
+	if err != nil {
 		return
 	}
+	if !s.setClose(closePort) {
+		return req, ErrEntityClosed
+	}
 
 	// Prepare fields.
 	s.prepareFields(true, Addr{PK: s.ses.LocalPK(), Port: lPort}, rAddr)
@@ -94,6 +315,25 @@ func (s *Stream) readRequest() (req StreamRequest, err error) {
 	if req, err = obj.ObtainStreamRequest(); err != nil {
 		return
 	}
+	if req.isGoAway(s.ses.RemotePK()) {
+		if err = req.verifyGoAway(); err != nil {
+			return
+		}
+		if id, reason, ok := req.streamNotice(); ok {
+			if reason == ErrStreamFramesDropped {
+				// The stream (if any) is not closed by the server.
+				atomic.AddUint64(&s.ses.framesDropped, 1)
+				s.log.WithError(reason).WithField("dropped_yamux_id", id).
+					Warn("Server dropped frames of a stream which violate the session protocol.")
+			} else {
+				s.ses.srvClosed.Store(id, reason)
+			}
+			err = reason
+			return
+		}
+		err = req.goAwayReason()
+		return
+	}
 	if err = req.Verify(0); err != nil {
 		return
 	}
@@ -101,6 +341,10 @@ func (s *Stream) readRequest() (req StreamRequest, err error) {
 		err = ErrReqInvalidDstPK
 		return
 	}
+	if s.ses.allowed != nil && !s.ses.allowed.allowed(req.SrcAddr.PK) {
+		err = ErrReqUnauthorized
+		return
+	}
 
 	// Prepare fields.
 	s.prepareFields(false, req.DstAddr, req.SrcAddr)
@@ -121,6 +365,12 @@ func (s *Stream) writeResponse(reqHash cipher.SHA256) error {
 	if !ok {
 		return ErrReqNoListener
 	}
+	if lis.rejects() {
+		if err := s.writeRejection(reqHash, ErrAcceptChanMaxed); err != nil {
+			return err
+		}
+		return ErrAcceptChanMaxed
+	}
 
 	// Prepare and write response.
 	nsMsg, err := s.ns.MakeHandshakeMessage()
@@ -142,6 +392,17 @@ func (s *Stream) writeResponse(reqHash cipher.SHA256) error {
 	return lis.introduceStream(s)
 }
 
+// writeRejection writes a response which rejects the request of the given hash with the given error.
+func (s *Stream) writeRejection(reqHash cipher.SHA256, rErr Error) error {
+	resp := StreamResponse{
+		ReqHash:  reqHash,
+		Accepted: false,
+		ErrCode:  rErr.code,
+	}
+	obj := MakeSignedStreamResponse(&resp, s.ses.localSK())
+	return s.ses.writeObject(s.yStr, obj)
+}
+
 func (s *Stream) readResponse(req StreamRequest) error {
 	obj, err := s.ses.readObject(s.yStr)
 	if err != nil {
@@ -152,6 +413,9 @@ func (s *Stream) readResponse(req StreamRequest) error {
 		return err
 	}
 	if err := resp.Verify(req); err != nil {
+		if ok, sErr := resp.verifyServerRejection(req, s.ses.RemotePK()); ok {
+			return sErr
+		}
 		return err
 	}
 	return s.ns.ProcessHandshakeMessage(resp.NoiseMsg)
@@ -163,6 +427,8 @@ func (s *Stream) prepareFields(init bool, lAddr, rAddr Addr) {
 		LocalSK:   s.ses.localSK(),
 		RemotePK:  rAddr.PK,
 		Initiator: init,
+
+		StrictSequence: s.ses.entity.strictSeq,
 	})
 	if err != nil {
 		s.log.WithError(err).Panic("Failed to prepare stream noise object.")
@@ -170,9 +436,10 @@ func (s *Stream) prepareFields(init bool, lAddr, rAddr Addr) {
 
 	s.lAddr = lAddr
 	s.rAddr = rAddr
+	s.initiator = init
 	s.ns = ns
 	s.nsConn = noise.NewReadWriter(s.yStr, s.ns)
-	s.log = s.ses.log.WithField("stream", s.lAddr.ShortString()+"->"+s.rAddr.ShortString())
+	s.log = s.log.WithField("remote_pk", rAddr.PK).WithField("local_port", lAddr.Port).WithField("remote_port", rAddr.Port)
 }
 
 // LocalAddr returns the local address of the dmsg stream.
@@ -200,32 +467,281 @@ func (s *Stream) ServerPK() cipher.PubKey {
 	return s.ses.RemotePK()
 }
 
+// Info returns the parameters and usage of the stream.
+func (s *Stream) Info() StreamInfo {
+	return StreamInfo{
+		ID:             s.StreamID(),
+		LocalAddr:      s.lAddr,
+		RemoteAddr:     s.rAddr,
+		ServerPK:       s.ServerPK(),
+		MaxWriteSize:   noise.MaxWriteSize,
+		WindowSize:     s.ses.windowSize,
+		StaleDiscovery: s.staleEntry,
+		BytesRead:      atomic.LoadUint64(&s.bytesRead),
+		BytesWritten:   atomic.LoadUint64(&s.bytesWritten),
+		Handshake:      handshakeInfo(s.ns),
+	}
+}
+
 // StreamID returns the stream ID.
 func (s *Stream) StreamID() uint32 {
 	return s.yStr.StreamID()
 }
 
 // Read implements io.Reader
+// If the session's connection fails on write, pending and further reads fail with ErrLinkError. If the remote client
+// disconnects from the server, they fail with ErrPeerDisconnected, and if the server reaps the stream as it is idle,
+// with ErrStreamIdle. If the remote closes the stream with CloseWithCode, they fail with a *StreamCloseError (once the
+// data sent beforehand is read).
 func (s *Stream) Read(b []byte) (int, error) {
-	return s.nsConn.Read(b)
+	n, err := s.nsConn.Read(b)
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+	return n, s.streamError(err)
 }
 
 // Write implements io.Writer
+// If the session's connection fails on write, pending and further writes fail with ErrLinkError. If the remote client
+// disconnects from the server, they fail with ErrPeerDisconnected, and if the server reaps the stream as it is idle,
+// with ErrStreamIdle.
 func (s *Stream) Write(b []byte) (int, error) {
-	return s.nsConn.Write(b)
+	if cErr, ok := s.remoteClose.Load().(*StreamCloseError); ok {
+		return 0, cErr
+	}
+	if reason := s.ses.serverClosed(s.yStr.StreamID()); reason != nil {
+		return 0, reason
+	}
+	n, err := s.write(b)
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+	return n, s.streamError(err)
+}
+
+// write writes to the stream in chunks of up to MTU bytes, each of which takes a turn of the session's egress scheduler
+// so that writes of streams with a higher priority are not queued up behind large writes of others.
+func (s *Stream) write(b []byte) (n int, err error) {
+	sched := s.ses.egress
+	if sched == nil || len(b) == 0 {
+		return s.nsConn.Write(b)
+	}
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+
+	mtu := s.nsConn.MTU()
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > mtu {
+			chunk = chunk[:mtu]
+		}
+		turn := sched.acquire(cipher.PubKey{}, s.Priority(), len(chunk), s.ses.linkFailed)
+		t := time.AfterFunc(sched.maxTurn, turn.release)
+		m, err := s.nsConn.Write(chunk)
+		t.Stop()
+		turn.release()
+		if n += m; err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Priority is the scheduling priority of a stream's writes (see Stream.SetPriority).
+type Priority int32
+
+// Priorities of streams.
+const (
+	PriorityLow    Priority = -1 // bulk transfers
+	PriorityNormal Priority = 0  // default
+	PriorityHigh   Priority = 1  // interactive streams, i.e. control channels
+)
+
+// cost returns the virtual cost of each byte written with the priority. Under contention, the streams of each priority
+// get a share of the session's link in inverse proportion to it (4:2:1 for high, normal and low priority).
+func (p Priority) cost() uint64 {
+	switch {
+	case p > PriorityNormal:
+		return 1
+	case p < PriorityNormal:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// SetPriority sets the priority of the stream's writes, relative to other streams of the same session which contend
+// for the link to the server (streams are of PriorityNormal by default). Writes are scheduled with weighted fair
+// queuing across priorities, so that writes of higher priority streams wait less under contention, while streams of
+// lower priority still get their share of the link. It affects writes made after it returns.
+func (s *Stream) SetPriority(p Priority) {
+	atomic.StoreInt32(&s.priority, int32(p))
+}
+
+// Priority returns the priority of the stream's writes (see SetPriority).
+func (s *Stream) Priority() Priority {
+	return Priority(atomic.LoadInt32(&s.priority))
+}
+
+// ReadContext reads from the stream as Read, and returns ctx.Err() once the context is done before the read completes.
+// Data which is already received is kept for further reads. The read deadline is unaffected.
+func (s *Stream) ReadContext(ctx context.Context, b []byte) (int, error) {
+	return s.withContext(ctx, s.yStr.SetReadDeadline, func() time.Time { return s.readDeadline }, func() (int, error) {
+		return s.Read(b)
+	})
+}
+
+// WriteContext writes to the stream as Write, and returns ctx.Err() once the context is done before the write
+// completes. As with a write deadline, the stream can no longer be written to if the write is cancelled mid-frame.
+// The write deadline is unaffected.
+func (s *Stream) WriteContext(ctx context.Context, b []byte) (int, error) {
+	return s.withContext(ctx, s.yStr.SetWriteDeadline, func() time.Time { return s.writeDeadline }, func() (int, error) {
+		return s.Write(b)
+	})
+}
+
+// withContext performs the read or write which is interrupted once the context is done (by expiring the deadline via
+// 'setDeadline'). The deadline of the application ('deadline') is restored afterwards.
+func (s *Stream) withContext(ctx context.Context, setDeadline func(time.Time) error, deadline func() time.Time,
+	op func() (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ctx.Done() == nil {
+		return op()
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = setDeadline(time.Now()) //nolint:errcheck
+		case <-done:
+		}
+	}()
+	n, err := op()
+	close(done)
+	<-exited
+
+	if ctx.Err() == nil {
+		return n, err
+	}
+	s.deadlineMx.Lock()
+	_ = setDeadline(deadline()) //nolint:errcheck
+	s.deadlineMx.Unlock()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// streamError returns the reason of the given stream error (if known).
+func (s *Stream) streamError(err error) error {
+	if nsErr, ok := err.(*noise.CloseError); ok {
+		cErr := decodeStreamCloseError(nsErr.Payload)
+		s.remoteClose.Store(cErr)
+		return cErr
+	}
+	if err != nil {
+		if reason := s.ses.serverClosed(s.yStr.StreamID()); reason != nil {
+			return reason
+		}
+	}
+	return s.ses.linkError(err)
+}
+
+// Rekey rotates the noise keys of the stream in-band (for forward secrecy of long-lived streams), without
+// interrupting it. The remote rotates it's keys in sequence with the stream's data, which is relayed by the server as
+// is, so the server needs no support for it.
+// The remote must advertise FeatureRekey in it's discovery entry, as older clients cannot decode rekey frames.
+// Otherwise (or if the remote's entry is not yet known, see remoteFeature), ErrRekeyUnsupported is returned and the
+// keys are not rotated.
+func (s *Stream) Rekey() error {
+	if !s.remoteFeature(FeatureRekey) {
+		return ErrRekeyUnsupported
+	}
+	return s.streamError(s.nsConn.Rekey())
+}
+
+// setRemoteCaps sets the capabilities advertised in the discovery entry of the remote.
+func (s *Stream) setRemoteCaps(caps *disc.Capabilities) {
+	s.capsMx.Lock()
+	s.remoteCaps, s.remoteCapsOK = caps, true
+	s.capsMx.Unlock()
+}
+
+// resolveRemoteCaps looks up the entry of the remote of an accepted stream in the background (bounded by
+// HandshakeTimeout), unless it is cached, so that remoteFeature does not wait for discovery.
+func (s *Stream) resolveRemoteCaps() {
+	entries := s.ses.entity.peerEntries
+	if _, ok := entries.getStale(s.rAddr.PK); ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+		defer cancel()
+		entry, err := getClientEntry(ctx, s.ses.entity.dc, s.rAddr.PK)
+		if err != nil {
+			s.log.WithError(err).Debug("Failed to obtain entry of remote, it's capabilities are unknown.")
+			return
+		}
+		entries.put(entry)
+		s.setRemoteCaps(entry.Client.Capabilities)
+	}()
+}
+
+// remoteFeature returns true if the remote advertises the given feature in it's discovery entry. Streams which the
+// client dialed use the entry which they were dialed with, while accepted streams use the cached entry of the remote
+// (see resolveRemoteCaps). Discovery is not called, so the feature is treated as unsupported while the entry is
+// unknown.
+func (s *Stream) remoteFeature(feature string) bool {
+	s.capsMx.Lock()
+	defer s.capsMx.Unlock()
+
+	if !s.remoteCapsOK {
+		entry, ok := s.ses.entity.peerEntries.getStale(s.rAddr.PK)
+		if !ok {
+			return false
+		}
+		s.remoteCaps, s.remoteCapsOK = entry.Client.Capabilities, true
+	}
+	return s.remoteCaps.HasFeature(feature)
+}
+
+// MTU returns the payload capacity of a single encrypted frame of the stream (see StreamInfo.MaxWriteSize).
+// Applications which manage their own buffers can size writes to the MTU to avoid fragmentation.
+func (s *Stream) MTU() int {
+	return s.nsConn.MTU()
+}
+
+// Flush blocks until all data written to the stream is sent over the underlying session.
+// Writes are not buffered or coalesced (every write is sent before it returns), so this is currently a no-op which
+// returns nil. Applications which rely on written data being sent (i.e. before awaiting a response) may call Flush to
+// stay correct once writes are buffered.
+func (s *Stream) Flush() error {
+	return nil
 }
 
 // SetDeadline implements net.Conn
 func (s *Stream) SetDeadline(t time.Time) error {
+	s.deadlineMx.Lock()
+	defer s.deadlineMx.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
 	return s.yStr.SetDeadline(t)
 }
 
 // SetReadDeadline implements net.Conn
 func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.deadlineMx.Lock()
+	defer s.deadlineMx.Unlock()
+	s.readDeadline = t
 	return s.yStr.SetReadDeadline(t)
 }
 
 // SetWriteDeadline implements net.Conn
+// Writes blocked on flow control (i.e. as the remote does not read) fail with a timeout error (a net.Error) once the
+// deadline is reached. If the deadline is reached mid-frame, the stream can no longer be written to.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.deadlineMx.Lock()
+	defer s.deadlineMx.Unlock()
+	s.writeDeadline = t
 	return s.yStr.SetWriteDeadline(t)
 }
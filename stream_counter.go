@@ -0,0 +1,67 @@
+package dmsg
+
+import (
+	"sync"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// streamCounter counts the streams relayed by a server per initiating client, and limits them.
+// A non-positive maximum imposes no limit (but streams are still counted).
+type streamCounter struct {
+	counts map[cipher.PubKey]int
+	max    int
+	mx     sync.Mutex
+}
+
+func newStreamCounter(max int) *streamCounter {
+	return &streamCounter{counts: make(map[cipher.PubKey]int), max: max}
+}
+
+// setMax sets the maximum, which applies to streams acquired from now on.
+func (c *streamCounter) setMax(max int) {
+	c.mx.Lock()
+	c.max = max
+	c.mx.Unlock()
+}
+
+func (c *streamCounter) getMax() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.max
+}
+
+// acquire counts a stream of the given client, returning false if the limit of the client is reached.
+// The returned function releases the stream, and is safe to call multiple times.
+func (c *streamCounter) acquire(pk cipher.PubKey) (release func(), ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.max > 0 && c.counts[pk] >= c.max {
+		return nil, false
+	}
+	c.counts[pk]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mx.Lock()
+			if c.counts[pk]--; c.counts[pk] <= 0 {
+				delete(c.counts, pk)
+			}
+			c.mx.Unlock()
+		})
+	}, true
+}
+
+// all returns a copy of the stream counts of all clients with streams.
+func (c *streamCounter) all() map[cipher.PubKey]int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	out := make(map[cipher.PubKey]int, len(c.counts))
+	for pk, n := range c.counts {
+		out[pk] = n
+	}
+	return out
+}
@@ -2,14 +2,19 @@ package dmsg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/skycoin/yamux"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/nettest"
 
@@ -99,6 +104,422 @@ func TestStream(t *testing.T) {
 		require.NoError(t, lis.Close())
 	})
 
+	t.Run("test_read_after_remote_close", func(t *testing.T) {
+		const port = 8081
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, errA := makePipe()
+		require.NoError(t, errA)
+
+		data := cipher.RandByte(noise.MaxWriteSize * 3)
+
+		// Remote writes, then closes immediately.
+		nA, errA := connA.Write(data)
+		require.NoError(t, errA)
+		require.Equal(t, len(data), nA)
+		require.NoError(t, connA.Close())
+
+		// All buffered data is read before EOF.
+		readB := make([]byte, len(data))
+		nB, errB := io.ReadFull(connB, readB)
+		require.NoError(t, errB)
+		require.Equal(t, len(data), nB)
+		require.Equal(t, data, readB)
+
+		nB, errB = connB.Read(make([]byte, 1))
+		require.Equal(t, 0, nB)
+		require.Equal(t, io.EOF, errB)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_rekey", func(t *testing.T) {
+		const port = 8087
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, errA := makePipe()
+		require.NoError(t, errA)
+
+		data := cipher.RandByte(noise.MaxWriteSize * 3)
+
+		// Both sides rekey mid-stream, while data is in flight.
+		errCh := make(chan error, 1)
+		go func() {
+			for i := 0; i < 3; i++ {
+				if _, err := connA.Write(data[i*noise.MaxWriteSize : (i+1)*noise.MaxWriteSize]); err != nil {
+					errCh <- err
+					return
+				}
+				if err := connA.(*Stream).Rekey(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+		readB := make([]byte, len(data))
+		_, errB := io.ReadFull(connB, readB)
+		require.NoError(t, errB)
+		require.NoError(t, <-errCh)
+		require.Equal(t, data, readB)
+
+		// The accepted stream rekeys once the capabilities of it's remote are resolved.
+		waitFor(t, time.Second*5, func() bool { return connB.(*Stream).remoteFeature(FeatureRekey) })
+		require.NoError(t, connB.(*Stream).Rekey())
+		_, errB = connB.Write(data)
+		require.NoError(t, errB)
+		readA := make([]byte, len(data))
+		_, errA = io.ReadFull(connA, readA)
+		require.NoError(t, errA)
+		require.Equal(t, data, readA)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_close_with_code", func(t *testing.T) {
+		const port = 8092
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, errA := makePipe()
+		require.NoError(t, errA)
+
+		strA, strB := connA.(*Stream), connB.(*Stream)
+		err := strA.CloseWithCode(1, string(make([]byte, MaxCloseMessageSize+1)))
+		require.True(t, errors.Is(err, ErrCloseMessageTooLarge))
+
+		// Data written before the close frame is read first, after which reads and writes fail with the code.
+		data := cipher.RandByte(noise.MaxWriteSize * 2)
+		_, errA = strA.Write(data)
+		require.NoError(t, errA)
+		require.NoError(t, strA.CloseWithCode(42, "going away"))
+
+		readB := make([]byte, len(data))
+		_, errB := io.ReadFull(strB, readB)
+		require.NoError(t, errB)
+		require.Equal(t, data, readB)
+
+		_, errB = strB.Read(make([]byte, 1))
+		var cErr *StreamCloseError
+		require.True(t, errors.As(errB, &cErr), errB)
+		require.Equal(t, uint16(42), cErr.Code)
+		require.Equal(t, "going away", cErr.Msg)
+		_, errB = strB.Write([]byte("late"))
+		require.Equal(t, cErr, errB)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_server_pk", func(t *testing.T) {
+		const port = 8082
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, errA := makePipe()
+		require.NoError(t, errA)
+
+		// Both ends report the server relaying the stream, which is the remote of the underlying session.
+		sesA, ok := clientA.Session(pkSrv)
+		require.True(t, ok)
+		sesB, ok := clientB.Session(pkSrv)
+		require.True(t, ok)
+		require.Equal(t, sesA.RemotePK(), connA.(*Stream).ServerPK())
+		require.Equal(t, sesB.RemotePK(), connB.(*Stream).ServerPK())
+		require.Equal(t, pkSrv, connA.(*Stream).ServerPK())
+
+		// Stream info reports the parameters of both ends.
+		for _, conn := range []net.Conn{connA, connB} {
+			info := conn.(*Stream).Info()
+			require.Equal(t, pkSrv, info.ServerPK)
+			require.Equal(t, noise.MaxWriteSize, info.MaxWriteSize)
+			require.Equal(t, info.MaxWriteSize, conn.(*Stream).MTU())
+			require.Equal(t, yamux.DefaultConfig().MaxStreamWindowSize, info.WindowSize)
+			require.False(t, info.StaleDiscovery)
+		}
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_accept_batch", func(t *testing.T) {
+		const port = 8083
+		const n = 3
+		lis, err := clientB.Listen(port)
+		require.NoError(t, err)
+
+		// Nothing is pending, so the context ends the call.
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*100)
+		_, err = lis.AcceptBatch(ctx, n)
+		cancel()
+		require.Equal(t, context.DeadlineExceeded, err)
+
+		conns := make([]net.Conn, 0, n)
+		for i := 0; i < n; i++ {
+			conn, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: port})
+			require.NoError(t, err)
+			conns = append(conns, conn)
+		}
+		waitFor(t, time.Second*5, func() bool { return len(lis.accept) == n })
+
+		// Batches are bounded by 'max'.
+		batch1, err := lis.AcceptBatch(context.TODO(), n-1)
+		require.NoError(t, err)
+		require.Len(t, batch1, n-1)
+
+		batch2, err := lis.AcceptBatch(context.TODO(), n)
+		require.NoError(t, err)
+		require.Len(t, batch2, 1)
+
+		// Accepted streams are usable.
+		for i, tp := range append(batch1, batch2...) {
+			_, err := conns[i].Write([]byte{byte(i)})
+			require.NoError(t, err)
+			b := make([]byte, 1)
+			_, err = io.ReadFull(tp, b)
+			require.NoError(t, err)
+			require.Equal(t, byte(i), b[0])
+			require.NoError(t, tp.Close())
+		}
+
+		// Closing logic.
+		for _, conn := range conns {
+			require.NoError(t, conn.Close())
+		}
+		require.NoError(t, lis.Close())
+		_, err = lis.AcceptBatch(context.TODO(), n)
+		require.Equal(t, ErrEntityClosed, err)
+	})
+
+	t.Run("test_allowed_peers", func(t *testing.T) {
+		const port = 8084
+		lis, err := clientB.Listen(port)
+		require.NoError(t, err)
+		defer clientB.AllowAllPeers()
+
+		dial := func() error {
+			connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: port})
+			if err != nil {
+				return err
+			}
+			connB, err := lis.AcceptStream()
+			require.NoError(t, err)
+			require.NoError(t, connA.Close())
+			require.NoError(t, connB.Close())
+			return nil
+		}
+
+		// All peers are allowed by default.
+		pks, all := clientB.AllowedPeers()
+		require.True(t, all)
+		require.Empty(t, pks)
+		require.NoError(t, dial())
+
+		// Disallowed initiators are rejected.
+		otherPK, _ := GenKeyPair(t, "other")
+		clientB.SetAllowedPeers([]cipher.PubKey{otherPK})
+		require.Equal(t, ErrReqUnauthorized, dial())
+
+		// Allowed peers can be updated dynamically.
+		clientB.AllowPeers(pkA)
+		require.NoError(t, dial())
+		pks, all = clientB.AllowedPeers()
+		require.False(t, all)
+		require.ElementsMatch(t, []cipher.PubKey{otherPK, pkA}, pks)
+
+		clientB.DisallowPeers(pkA)
+		require.Equal(t, ErrReqUnauthorized, dial())
+
+		clientB.AllowAllPeers()
+		require.NoError(t, dial())
+
+		// Closing logic.
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_values", func(t *testing.T) {
+		const port = 8085
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, _, stop, err := makePipe()
+		require.NoError(t, err)
+		dStr := connA.(*Stream)
+
+		type key int
+		const n = 100
+
+		// Values are set and read concurrently.
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				defer wg.Done()
+				dStr.SetValue(key(i), i)
+				require.Equal(t, i, dStr.Value(key(i)))
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < n; i++ {
+			require.Equal(t, i, dStr.Value(key(i)))
+		}
+
+		// Nil values remove keys.
+		dStr.SetValue(key(0), nil)
+		require.Nil(t, dStr.Value(key(0)))
+		require.Nil(t, dStr.Value("other"))
+
+		// Values are cleared on close.
+		stop()
+		require.Nil(t, dStr.Value(key(1)))
+		dStr.SetValue(key(1), 1)
+		require.Nil(t, dStr.Value(key(1)))
+
+		// Closing logic.
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_flush", func(t *testing.T) {
+		const port = 8086
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, err := makePipe()
+		require.NoError(t, err)
+		dStr := connA.(*Stream)
+
+		// Writes are not buffered, so data is delivered without flushing.
+		_, err = dStr.Write([]byte("foo"))
+		require.NoError(t, err)
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(connB, buf)
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(buf))
+
+		// Flushing is a no-op.
+		require.NoError(t, dStr.Flush())
+		require.NoError(t, dStr.Flush())
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_concurrent_close", func(t *testing.T) {
+		const port = 8088
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, err := makePipe()
+		require.NoError(t, err)
+		dStr := connA.(*Stream)
+
+		// The stream is closed by many callers at once.
+		const n = 50
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() { errs <- dStr.Close() }()
+		}
+		for i := 0; i < n; i++ {
+			require.NoError(t, <-errs)
+		}
+		require.NoError(t, dStr.Close())
+
+		// The resources of the stream are released, and the remote receives the close.
+		_, ok := clientA.porter.PortValue(dStr.RawLocalAddr().Port)
+		require.False(t, ok)
+		_, err = connB.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_write_deadline", func(t *testing.T) {
+		const port = 8089
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, _, stop, err := makePipe()
+		require.NoError(t, err)
+
+		// B does not read, so the flow-control windows fill up and the write blocks until the deadline.
+		require.NoError(t, connA.SetWriteDeadline(time.Now().Add(time.Millisecond*500)))
+		start := time.Now()
+		n, err := connA.Write(make([]byte, 16<<20))
+		require.Error(t, err)
+		require.Less(t, n, 16<<20)
+		require.Less(t, int64(time.Since(start)), int64(time.Second*5))
+		netErr, ok := err.(net.Error)
+		require.True(t, ok, err)
+		require.True(t, netErr.Timeout(), err)
+
+		// Further writes fail with a timeout too.
+		_, err = connA.Write([]byte("foo"))
+		netErr, ok = err.(net.Error)
+		require.True(t, ok, err)
+		require.True(t, netErr.Timeout(), err)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_read_context", func(t *testing.T) {
+		const port = 8090
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, connB, stop, err := makePipe()
+		require.NoError(t, err)
+		dStr := connB.(*Stream)
+
+		// A blocked read is cancelled.
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*200, cancel)
+		_, err = dStr.ReadContext(ctx, make([]byte, 5))
+		require.Equal(t, context.Canceled, err)
+		_, err = dStr.ReadContext(ctx, make([]byte, 5))
+		require.Equal(t, context.Canceled, err)
+
+		// Further reads are unaffected, and no data is lost.
+		_, err = connA.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 2)
+		_, err = dStr.ReadContext(context.Background(), buf)
+		require.NoError(t, err)
+		require.Equal(t, "he", string(buf))
+		buf = make([]byte, 3)
+		_, err = io.ReadFull(dStr, buf)
+		require.NoError(t, err)
+		require.Equal(t, "llo", string(buf))
+
+		// The read deadline of the application is restored.
+		require.NoError(t, dStr.SetReadDeadline(time.Now().Add(time.Millisecond*500)))
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		_, err = dStr.ReadContext(ctx, buf)
+		require.Equal(t, context.Canceled, err)
+		_, err = dStr.Read(buf)
+		netErr, ok := err.(net.Error)
+		require.True(t, ok, err)
+		require.True(t, netErr.Timeout())
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
+	t.Run("test_write_context", func(t *testing.T) {
+		const port = 8091
+		lis, makePipe := makePiper(clientA, clientB, port)
+		connA, _, stop, err := makePipe()
+		require.NoError(t, err)
+		dStr := connA.(*Stream)
+
+		// B does not read, so the write blocks until it is cancelled.
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*500, cancel)
+		n, err := dStr.WriteContext(ctx, make([]byte, 16<<20))
+		require.Equal(t, context.Canceled, err)
+		require.Less(t, n, 16<<20)
+
+		// Closing logic.
+		stop()
+		require.NoError(t, lis.Close())
+	})
+
 	// TODO: The Timeout portions of these tests sometimes fail for currently unknown reasons.
 	// TODO: We need to look into whether nettest.TestConn is even suitable for dmsg.Stream.
 	// TODO: If so, we need to see how to fix the behavior.
@@ -207,6 +628,536 @@ func TestStream(t *testing.T) {
 	require.NoError(t, <-chSrv)
 }
 
+func TestStream_UnsupportedFeatures(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Client B advertises no features of the stream protocol, as older clients do.
+	newClient := func(name string, conf *Config) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A", DefaultConfig())
+	confB := DefaultConfig()
+	confB.EntryBuilder = func(base *disc.Entry) (*disc.Entry, error) {
+		base.Client.Capabilities = &disc.Capabilities{ProtocolVersion: ProtocolVersion}
+		return base, nil
+	}
+	clientB := newClient("client_B", confB)
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lis.AcceptStream()
+	require.NoError(t, err)
+
+	// Streams are not rekeyed towards client B, while client B rekeys towards client A (which advertises the feature)
+	// once the capabilities of client A are resolved.
+	require.Equal(t, ErrRekeyUnsupported, strA.Rekey())
+	waitFor(t, time.Second*5, func() bool { return strB.remoteFeature(FeatureRekey) })
+	require.NoError(t, strB.Rekey())
+	for _, p := range [][2]*Stream{{strA, strB}, {strB, strA}} {
+		_, err = p[0].Write([]byte("hello"))
+		require.NoError(t, err)
+		msg := make([]byte, 5)
+		_, err = io.ReadFull(p[1], msg)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(msg))
+	}
+
+	// Streams to client B are closed without the code.
+	require.NoError(t, strA.CloseWithCode(42, "going away"))
+	_, err = strB.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	// Closing logic.
+	require.NoError(t, strB.Close())
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestStream_RekeyDiscUnavailable(t *testing.T) {
+	dc := disc.NewMockClient(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, DefaultConfig())
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		waitFor(t, time.Second*5, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA, clientB, clientC := newClient("client_A"), newClient("client_B"), newClient("client_C")
+	entry := func(c *Client) *disc.Entry {
+		entry, err := dc.Entry(context.TODO(), c.LocalPK())
+		require.NoError(t, err)
+		return entry
+	}
+
+	// Client B has the entry of client A cached (as if it dialed client A before), but not the entry of client C.
+	// Clients A and C dial client B by it's cached entry once discovery is unavailable.
+	clientB.clientEntries.put(entry(clientA))
+	clientA.clientEntries.put(entry(clientB))
+	clientC.clientEntries.put(entry(clientB))
+	dc.SetError(disc.ErrUnexpected)
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	accept := func(c *Client) *Stream {
+		_, err := c.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+		require.NoError(t, err)
+		str, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return str
+	}
+
+	// Rekeying accepted streams does not wait for discovery: the stream of client A is rekeyed by it's cached entry,
+	// while the capabilities of client C are unknown.
+	strA := accept(clientA)
+	require.NoError(t, strA.Rekey())
+	strC := accept(clientC)
+	start := time.Now()
+	require.Equal(t, ErrRekeyUnsupported, strC.Rekey())
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Closing logic.
+	dc.SetError(nil)
+	require.NoError(t, strA.Close())
+	require.NoError(t, strC.Close())
+	require.NoError(t, lis.Close())
+	for _, c := range []*Client{clientA, clientB, clientC} {
+		require.NoError(t, c.Close())
+	}
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestListener_AcceptPolicy(t *testing.T) {
+	defer func(size int) { AcceptBufferSize = size }(AcceptBufferSize)
+	AcceptBufferSize = 2
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+	entry, err := dc.Entry(context.TODO(), pkSrv)
+	require.NoError(t, err)
+
+	newClient := func(name string, policy AcceptPolicy) *Client {
+		pk, sk := GenKeyPair(t, name)
+		conf := DefaultConfig()
+		conf.AcceptPolicy = policy
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		require.NoError(t, c.ensureSession(context.TODO(), entry))
+		waitFor(t, time.Second*5, func() bool { _, ok := srv.serverSession(pk); return ok })
+		return c
+	}
+	clientA := newClient("client A", AcceptDropNewest)
+
+	// dial dials a stream from client A which announces the given ID.
+	dial := func(dst *Client, id byte) (*Stream, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		str, err := clientA.DialStream(ctx, Addr{PK: dst.LocalPK(), Port: 80})
+		if err != nil {
+			return nil, err
+		}
+		_, _ = str.Write([]byte{id}) //nolint:errcheck
+		return str, nil
+	}
+	// accept accepts a stream, and returns the ID it announces.
+	accept := func(t *testing.T, lis *Listener) byte {
+		str, err := lis.AcceptStream()
+		require.NoError(t, err)
+		id := make([]byte, 1)
+		_, err = io.ReadFull(str, id)
+		require.NoError(t, err)
+		require.NoError(t, str.Close())
+		return id[0]
+	}
+	// requireClosed requires the stream to be closed by the remote.
+	requireClosed := func(t *testing.T, str *Stream) {
+		require.NoError(t, str.SetReadDeadline(time.Now().Add(time.Second*5)))
+		_, err := str.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+	}
+
+	// Client B does not accept streams while the queue fills with streams 0 and 1, and stream 2 is dialed.
+	cases := []struct {
+		policy AcceptPolicy
+		check  func(t *testing.T, clientB *Client, lis *Listener, strs []*Stream, err error)
+	}{
+		{
+			// Stream 2 is closed.
+			policy: AcceptDropNewest,
+			check: func(t *testing.T, _ *Client, lis *Listener, strs []*Stream, err error) {
+				require.NoError(t, err)
+				requireClosed(t, strs[2])
+				require.Equal(t, byte(0), accept(t, lis))
+				require.Equal(t, byte(1), accept(t, lis))
+			},
+		},
+		{
+			// Stream 0 is closed to make room for stream 2.
+			policy: AcceptDropOldest,
+			check: func(t *testing.T, _ *Client, lis *Listener, strs []*Stream, err error) {
+				require.NoError(t, err)
+				requireClosed(t, strs[0])
+				require.Equal(t, byte(1), accept(t, lis))
+				require.Equal(t, byte(2), accept(t, lis))
+			},
+		},
+		{
+			// Stream 2 waits for room, and further streams are not accepted in the meantime.
+			policy: AcceptBlock,
+			check: func(t *testing.T, clientB *Client, lis *Listener, strs []*Stream, err error) {
+				require.NoError(t, err)
+				_, err = dial(clientB, 3)
+				require.Error(t, err)
+				require.Equal(t, byte(0), accept(t, lis))
+				require.Equal(t, byte(1), accept(t, lis))
+				require.Equal(t, byte(2), accept(t, lis))
+			},
+		},
+		{
+			// The dial of stream 2 is rejected.
+			policy: AcceptReject,
+			check: func(t *testing.T, _ *Client, lis *Listener, strs []*Stream, err error) {
+				require.True(t, errors.Is(err, ErrAcceptChanMaxed), err)
+				require.Equal(t, byte(0), accept(t, lis))
+				require.Equal(t, byte(1), accept(t, lis))
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			clientB := newClient("client B "+tc.policy.String(), tc.policy)
+			lis, err := clientB.Listen(80)
+			require.NoError(t, err)
+
+			strs := make([]*Stream, 3)
+			for i := range strs {
+				if strs[i], err = dial(clientB, byte(i)); err != nil && i < 2 {
+					require.NoError(t, err)
+				}
+			}
+			tc.check(t, clientB, lis, strs, err)
+
+			// Closing logic.
+			for _, str := range strs {
+				require.NoError(t, str.Close())
+			}
+			require.NoError(t, lis.Close())
+			require.NoError(t, clientB.Close())
+		})
+	}
+
+	// Closing logic.
+	require.NoError(t, clientA.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+// rateLimitedConn delays writes to the given rate (in bytes per second), so that the link is the bottleneck.
+type rateLimitedConn struct {
+	net.Conn
+	rate int
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(c.rate))
+	return n, err
+}
+
+func TestStream_Priority(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Client A connects to the server over an unbuffered link of 512KB/s, which it's streams contend for.
+	pkA, skA := GenKeyPair(t, "client A")
+	clientA := NewClient(pkA, skA, dc, DefaultConfig())
+	clientA.SetLogger(logging.MustGetLogger("client_A"))
+	connA, connSrv := net.Pipe()
+	go srv.handleSession(connSrv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, clientA.AddServerConn(ctx, pkSrv, &rateLimitedConn{Conn: connA, rate: 512 << 10}))
+
+	pkB, skB := GenKeyPair(t, "client B")
+	clientB := NewClient(pkB, skB, dc, DefaultConfig())
+	clientB.SetLogger(logging.MustGetLogger("client_B"))
+	go clientB.Serve(context.Background())
+	<-clientB.Ready()
+
+	lis, err := clientB.Listen(80)
+	require.NoError(t, err)
+	dial := func(prio Priority) (*Stream, *Stream) {
+		strA, err := clientA.DialStream(context.TODO(), Addr{PK: pkB, Port: 80})
+		require.NoError(t, err)
+		strA.SetPriority(prio)
+		require.Equal(t, prio, strA.Priority())
+		strB, err := lis.AcceptStream()
+		require.NoError(t, err)
+		return strA, strB
+	}
+
+	// Bulk streams (of the default priority) saturate the link of client A.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		strA, strB := dial(PriorityNormal)
+		go func() { _, _ = io.Copy(ioutil.Discard, strB) }() //nolint:errcheck
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := cipher.RandByte(noise.MaxWriteSize)
+			for !isClosed(stop) {
+				if _, err := strA.Write(data); err != nil {
+					return
+				}
+			}
+		}()
+		defer func() { require.NoError(t, strA.Close()) }()
+	}
+
+	// Messages of a high priority stream are relayed with lower latency than those of a normal priority stream.
+	latency := func(strA, strB *Stream) time.Duration {
+		msg := make([]byte, 8)
+		start := time.Now()
+		_, err := strA.Write(msg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(strB, msg)
+		require.NoError(t, err)
+		return time.Since(start)
+	}
+	highA, highB := dial(PriorityHigh)
+	normalA, normalB := dial(PriorityNormal)
+	var high, normal time.Duration
+	for i := 0; i < 10; i++ {
+		high += latency(highA, highB)
+		normal += latency(normalA, normalB)
+	}
+	t.Logf("average latency: high priority %v, normal priority %v", high/10, normal/10)
+	require.Less(t, int64(high), int64(normal/2))
+
+	// Closing logic.
+	close(stop)
+	for _, str := range []*Stream{highA, highB, normalA, normalB} {
+		require.NoError(t, str.Close())
+	}
+	require.NoError(t, lis.Close())
+	require.NoError(t, clientA.Close())
+	wg.Wait()
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestStream_BufferSize(t *testing.T) {
+	const bufSize = 4 * MinStreamBufferSize
+	const total = 4 * bufSize
+
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients, of which client B buffers 'bufSize' bytes per stream.
+	newClient := func(name string, bufSize int) *Client {
+		pk, sk := GenKeyPair(t, name)
+		conf := DefaultConfig()
+		conf.StreamBufferSize = bufSize
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient("client A", 0)
+	clientB := newClient("client B", bufSize)
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+	require.EqualValues(t, DefaultStreamBufferSize, strA.Info().WindowSize)
+	require.EqualValues(t, bufSize, strB.Info().WindowSize)
+
+	// Client A writes while client B does not read.
+	var written int64
+	go func() {
+		chunk := make([]byte, 1024)
+		for n := 0; n < total; n += len(chunk) {
+			for i := range chunk {
+				chunk[i] = byte((n + i) % 251)
+			}
+			if _, err := strA.Write(chunk); err != nil {
+				return
+			}
+			atomic.AddInt64(&written, int64(len(chunk)))
+		}
+	}()
+
+	// The writes of client A block once the buffer of client B (and the buffer of the relay at the server) is full.
+	var last int64 = -1
+	for stalls := 0; stalls < 3; {
+		time.Sleep(time.Millisecond * 100)
+		if n := atomic.LoadInt64(&written); n == last {
+			stalls++
+		} else {
+			last, stalls = n, 0
+		}
+	}
+	require.Greater(t, last, int64(bufSize*3/4))
+	require.Less(t, last, int64(bufSize+2*DefaultStreamBufferSize))
+
+	// Once client B reads, the rest of the data is received intact.
+	buf := make([]byte, total)
+	_, err = io.ReadFull(strB, buf)
+	require.NoError(t, err)
+	for i, b := range buf {
+		if b != byte(i%251) {
+			t.Fatalf("byte %d is %d, expected %d", i, b, byte(i%251))
+		}
+	}
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
+func TestStream_LogFields(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// Prepare and serve dmsg server.
+	pkSrv, skSrv := GenKeyPair(t, "server")
+	srv := NewServer(pkSrv, skSrv, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	lisSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	chSrv := make(chan error, 1)
+	go func() { chSrv <- srv.Serve(lisSrv, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	// Prepare and serve dmsg clients.
+	newClient := func(name string) *Client {
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, nil)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		<-c.Ready()
+		return c
+	}
+	clientA := newClient("client A")
+	clientB := newClient("client B")
+	waitFor(t, time.Second*5, func() bool { return srv.SessionCount() == 2 })
+
+	// The logger of a session identifies it's server.
+	dSes, ok := clientA.clientSession(clientA.porter, pkSrv)
+	require.True(t, ok)
+	require.Equal(t, pkSrv, dSes.log.(*logrus.Entry).Data["server_pk"])
+
+	// The loggers of a stream identify it's server, ID, remote and ports (on both ends).
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	strA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	strB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		str    *Stream
+		remote Addr
+		local  uint16
+	}{
+		{str: strA, remote: Addr{PK: clientB.LocalPK(), Port: 80}, local: strA.lAddr.Port},
+		{str: strB, remote: strA.lAddr, local: 80},
+	} {
+		fields := c.str.Logger().(*logrus.Entry).Data
+		require.Equal(t, pkSrv, fields["server_pk"])
+		require.Equal(t, c.str.yStr.StreamID(), fields["tp_id"])
+		require.Equal(t, c.remote.PK, fields["remote_pk"])
+		require.Equal(t, c.remote.Port, fields["remote_port"])
+		require.Equal(t, c.local, fields["local_port"])
+	}
+
+	// Closing logic.
+	require.NoError(t, strA.Close())
+	require.NoError(t, strB.Close())
+	require.NoError(t, clientA.Close())
+	require.NoError(t, clientB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-chSrv)
+}
+
 func GenKeyPair(t *testing.T, seed string) (cipher.PubKey, cipher.SecKey) {
 	pk, sk, err := cipher.GenerateDeterministicKeyPair([]byte(seed))
 	require.NoError(t, err)
@@ -0,0 +1,63 @@
+package dmsg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+)
+
+// TLSNextProto is the ALPN protocol of dmsg sessions over TLS, which TLS listeners and clients use unless their
+// configs specify other protocols.
+const TLSNextProto = "dmsg"
+
+const tlsScheme = "tls://"
+
+// isTLSAddr returns true if the given server address is a tls:// address, which the server is dialed at over TLS (see
+// NewTLSListener).
+func isTLSAddr(addr string) bool {
+	return strings.HasPrefix(addr, tlsScheme)
+}
+
+// NewTLSListener wraps the given listener, so that it accepts TLS connections with the given config, for clients which
+// can only reach the server over TLS (i.e. behind middleboxes which only pass TLS). The session (and it's noise
+// handshake) runs inside the TLS connection. If the config specifies no ALPN protocols, TLSNextProto is negotiated.
+// The listener is served by the dmsg server (see Server.ServeListeners) alongside or in place of TCP listeners, and is
+// to be advertised by it's tls:// address (see ServerConfig.AltAddresses), so that clients dial it over TLS.
+func NewTLSListener(lis net.Listener, conf *tls.Config) net.Listener {
+	conf = conf.Clone()
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{TLSNextProto}
+	}
+	return tls.NewListener(lis, conf)
+}
+
+// dialTLS dials the dmsg server at the given tls:// address, and performs the TLS handshake. The context only bounds
+// the dial and the handshake.
+// If the config is nil, the certificate of the server is not verified, as the session handshake authenticates the
+// server by it's public key regardless. The ALPN protocols default to TLSNextProto. Host names are dialed by IPs of
+// the given family (see resolveFamily), and verified by the host name.
+func dialTLS(ctx context.Context, addr string, conf *tls.Config, family AddressFamily) (net.Conn, error) {
+	addr = strings.TrimPrefix(addr, tlsScheme)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipAddr, err := resolveFamily(ctx, addr, family, net.DefaultResolver.LookupIPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		conf = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	} else {
+		conf = conf.Clone()
+	}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{TLSNextProto}
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	d := tls.Dialer{Config: conf}
+	return d.DialContext(ctx, "tcp", ipAddr)
+}
@@ -0,0 +1,146 @@
+package dmsg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestServer_TLS(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	cert, pool := genTLSCert(t)
+
+	// The server accepts sessions over TCP and over TLS. The advertised address is unreachable, so clients fall back to
+	// the alternative addresses.
+	deadLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := deadLis.Addr().String()
+	require.NoError(t, deadLis.Close())
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rawTLSLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsLis := NewTLSListener(rawTLSLis, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	conf := DefaultServerConfig()
+	conf.PublicAddress = deadAddr
+	conf.AltAddresses = []string{"tls://" + tlsLis.Addr().String(), tcpLis.Addr().String()}
+	srvPK, srvSK := GenKeyPair(t, "server")
+	srv := NewServer(srvPK, srvSK, dc, conf, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	srvCh := make(chan error, 1)
+	go func() { srvCh <- srv.ServeListeners([]net.Listener{tcpLis, tlsLis}, "") }() //nolint:errcheck
+	<-srv.Ready()
+
+	entry, err := dc.Entry(context.TODO(), srvPK)
+	require.NoError(t, err)
+	require.Equal(t, deadAddr, entry.Server.Address)
+	require.Equal(t, conf.AltAddresses, entry.Server.AltAddresses)
+
+	// The TLS listener negotiates the dmsg protocol.
+	tlsConf := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", NextProtos: []string{TLSNextProto}}
+	tlsConn, err := tls.Dial("tcp", tlsLis.Addr().String(), tlsConf)
+	require.NoError(t, err)
+	require.Equal(t, TLSNextProto, tlsConn.ConnectionState().NegotiatedProtocol)
+	require.NoError(t, tlsConn.Close())
+
+	// Client A trusts the certificate, so it connects over TLS. Client B does not, so it connects over TCP.
+	newClient := func(name string, tlsConf *tls.Config) *Client {
+		conf := DefaultConfig()
+		conf.TLSConfig = tlsConf
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		waitFor(t, time.Second*10, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A", &tls.Config{RootCAs: pool})
+	defer func() { require.NoError(t, clientA.Close()) }()
+	clientB := newClient("client_B", &tls.Config{RootCAs: x509.NewCertPool()})
+	defer func() { require.NoError(t, clientB.Close()) }()
+
+	sesA, ok := clientA.Session(srvPK)
+	require.True(t, ok)
+	require.Equal(t, tlsLis.Addr().String(), sesA.RemoteTCPAddr().String())
+	sesB, ok := clientB.Session(srvPK)
+	require.True(t, ok)
+	require.Equal(t, tcpLis.Addr().String(), sesB.RemoteTCPAddr().String())
+
+	// Sessions record the alternative addresses they were dialed at, so address checks do not migrate them.
+	require.Equal(t, conf.AltAddresses[0], sesA.dialAddr)
+	require.Equal(t, conf.AltAddresses[1], sesB.dialAddr)
+	clientA.checkServerAddrs(context.TODO())
+	sesA2, ok := clientA.Session(srvPK)
+	require.True(t, ok)
+	require.True(t, sesA.SessionCommon == sesA2.SessionCommon)
+
+	// Streams are relayed between both transports.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	connB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+
+	msg := cipher.RandByte(64 * 1024)
+	for _, dir := range [][2]*Stream{{connA, connB}, {connB, connA}} {
+		go func(w *Stream) {
+			_, _ = w.Write(msg) //nolint:errcheck
+		}(dir[0])
+		got := make([]byte, len(msg))
+		_, err := io.ReadFull(dir[1], got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+	}
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-srvCh)
+}
+
+// genTLSCert generates a self-signed certificate for 127.0.0.1, and returns it with a pool which trusts it.
+func genTLSCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dmsg"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -0,0 +1,125 @@
+package dmsg
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/skycoin/dmsg/cipher"
+)
+
+// PairTraffic contains the traffic relayed by a server from a source client to a destination client.
+type PairTraffic struct {
+	Src    cipher.PubKey `json:"src"`
+	Dst    cipher.PubKey `json:"dst"`
+	Bytes  uint64        `json:"bytes"`  // Total bytes relayed from the source to the destination.
+	Frames uint64        `json:"frames"` // Total chunks of data (reads from the source) relayed.
+}
+
+type trafficPair struct {
+	src, dst cipher.PubKey
+}
+
+// pairCounter counts the traffic of a single pair.
+type pairCounter struct {
+	bytes, frames uint64        // atomic
+	refs          int           // number of relayed streams, guarded by trafficTable.mx
+	elem          *list.Element // position in trafficTable.lru, guarded by trafficTable.mx
+}
+
+// trafficTable counts the traffic relayed between pairs of clients.
+// Counters are obtained once per relayed stream and updated atomically, so that accounting does not contend on the
+// table. The table is bounded: once it is full, the least recently used pair without relayed streams is evicted.
+type trafficTable struct {
+	max   int
+	pairs map[trafficPair]*pairCounter
+	lru   *list.List // of trafficPair, most recently used first
+	mx    sync.Mutex
+}
+
+func newTrafficTable(max int) *trafficTable {
+	return &trafficTable{
+		max:   max,
+		pairs: make(map[trafficPair]*pairCounter),
+		lru:   list.New(),
+	}
+}
+
+// acquire returns the counter of the pair, which is shared by all the pair's relayed streams.
+// The returned function releases it once the stream is closed, and is safe to call multiple times.
+// A nil table does not count traffic.
+func (tt *trafficTable) acquire(src, dst cipher.PubKey) (pc *pairCounter, release func()) {
+	if tt == nil {
+		return nil, func() {}
+	}
+	tt.mx.Lock()
+	defer tt.mx.Unlock()
+
+	pair := trafficPair{src: src, dst: dst}
+	pc, ok := tt.pairs[pair]
+	if ok {
+		tt.lru.MoveToFront(pc.elem)
+	} else {
+		tt.evict()
+		pc = &pairCounter{elem: tt.lru.PushFront(pair)}
+		tt.pairs[pair] = pc
+	}
+	pc.refs++
+
+	var once sync.Once
+	return pc, func() {
+		once.Do(func() {
+			tt.mx.Lock()
+			pc.refs--
+			tt.mx.Unlock()
+		})
+	}
+}
+
+// evict makes room for a new pair by evicting the least recently used pair without relayed streams.
+// Pairs with relayed streams are never evicted, so the table may exceed it's maximum while they are relayed.
+func (tt *trafficTable) evict() {
+	if len(tt.pairs) < tt.max {
+		return
+	}
+	for elem := tt.lru.Back(); elem != nil; elem = elem.Prev() {
+		pair := elem.Value.(trafficPair)
+		if tt.pairs[pair].refs > 0 {
+			continue
+		}
+		tt.lru.Remove(elem)
+		delete(tt.pairs, pair)
+		return
+	}
+}
+
+// record records a chunk of relayed data (a nil counter records nothing).
+func (pc *pairCounter) record(n int) {
+	if pc == nil {
+		return
+	}
+	atomic.AddUint64(&pc.bytes, uint64(n))
+	atomic.AddUint64(&pc.frames, 1)
+}
+
+// all returns the traffic of all pairs in the table, ordered by bytes (most first).
+func (tt *trafficTable) all() []PairTraffic {
+	if tt == nil {
+		return nil
+	}
+	tt.mx.Lock()
+	out := make([]PairTraffic, 0, len(tt.pairs))
+	for pair, pc := range tt.pairs {
+		out = append(out, PairTraffic{
+			Src:    pair.src,
+			Dst:    pair.dst,
+			Bytes:  atomic.LoadUint64(&pc.bytes),
+			Frames: atomic.LoadUint64(&pc.frames),
+		})
+	}
+	tt.mx.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	return out
+}
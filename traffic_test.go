@@ -0,0 +1,45 @@
+package dmsg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficTable(t *testing.T) {
+	pkA, _ := GenKeyPair(t, "client A")
+	pkB, _ := GenKeyPair(t, "client B")
+	pkC, _ := GenKeyPair(t, "client C")
+
+	tt := newTrafficTable(2)
+	ab, releaseAB := tt.acquire(pkA, pkB)
+	ab.record(10)
+	ba, releaseBA := tt.acquire(pkB, pkA)
+	ba.record(20)
+	ba.record(20)
+	releaseBA()
+	releaseBA()
+
+	// The least recently used pair without streams is evicted (A->B has a stream).
+	ac, releaseAC := tt.acquire(pkA, pkC)
+	ac.record(5)
+	stats := tt.all()
+	require.Equal(t, []PairTraffic{
+		{Src: pkA, Dst: pkB, Bytes: 10, Frames: 1},
+		{Src: pkA, Dst: pkC, Bytes: 5, Frames: 1},
+	}, stats)
+
+	// Pairs with streams are kept even if the table is full.
+	_, releaseCA := tt.acquire(pkC, pkA)
+	require.Len(t, tt.all(), 3)
+	releaseCA()
+	releaseAC()
+	releaseAB()
+
+	// A nil table accounts nothing.
+	var nilTT *trafficTable
+	pc, release := nilTT.acquire(pkA, pkB)
+	pc.record(1)
+	release()
+	require.Empty(t, nilTT.all())
+}
@@ -0,0 +1,102 @@
+package dmsg
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// AddressFamily selects the IP family of the addresses which a client dials, when the address of a server resolves
+// to addresses of both families (i.e. a host name with A and AAAA records, on a network which only routes one well).
+type AddressFamily int
+
+const (
+	// AddrFamilyAuto dials server addresses as they resolve (the default).
+	AddrFamilyAuto AddressFamily = iota
+	// AddrFamilyIPv4 prefers IPv4 addresses.
+	AddrFamilyIPv4
+	// AddrFamilyIPv6 prefers IPv6 addresses.
+	AddrFamilyIPv6
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AddrFamilyAuto:
+		return "auto"
+	case AddrFamilyIPv4:
+		return "ipv4"
+	case AddrFamilyIPv6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("AddressFamily(%d)", int(f))
+	}
+}
+
+// matches returns true if the given IP is of the family (any IP matches AddrFamilyAuto).
+func (f AddressFamily) matches(ip net.IP) bool {
+	switch f {
+	case AddrFamilyIPv4:
+		return ip.To4() != nil
+	case AddrFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// ipLookup resolves a host name into it's IP addresses (see net.Resolver.LookupIPAddr).
+type ipLookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// resolveFamily resolves the host of the given host:port address, and returns the address of the first IP of the
+// preferred family. The address is returned as is if the family is AddrFamilyAuto, the host is an IP, or it does not
+// resolve to an IP of the family (so that the dial falls back to the other family).
+func resolveFamily(ctx context.Context, addr string, family AddressFamily, lookup ipLookup) (string, error) {
+	if family == AddrFamilyAuto {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if family.matches(ip.IP) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return addr, nil
+}
+
+// familyDialContext returns a dial function which dials addresses of the preferred family (see resolveFamily).
+func familyDialContext(family AddressFamily) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addr, err := resolveFamily(ctx, addr, family, net.DefaultResolver.LookupIPAddr)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// dialServer dials the dmsg server at the given address, by the transport which the scheme of the address selects:
+// TLS for tls:// addresses (with the given config, see dialTLS), WebSocket for ws:// and wss:// URLs, and TCP
+// otherwise. Host names are dialed by IPs of the given family, if they resolve to any. The context only bounds the
+// dial.
+func dialServer(ctx context.Context, addr string, tlsConf *tls.Config, family AddressFamily) (net.Conn, error) {
+	switch {
+	case isTLSAddr(addr):
+		return dialTLS(ctx, addr, tlsConf, family)
+	case isWebSocketAddr(addr):
+		return dialWebSocket(ctx, addr, family)
+	default:
+		return familyDialContext(family)(ctx, "tcp", addr)
+	}
+}
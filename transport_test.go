@@ -0,0 +1,61 @@
+package dmsg
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveFamily(t *testing.T) {
+	// The host resolves to the IPv6 and IPv4 loopback addresses (in that order).
+	dualStack := func(_ context.Context, host string) ([]net.IPAddr, error) {
+		require.Equal(t, "dual.test", host)
+		return []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+	v4Only := func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	cases := []struct {
+		family AddressFamily
+		lookup ipLookup
+		addr   string
+		want   string
+	}{
+		{AddrFamilyAuto, dualStack, "dual.test:8080", "dual.test:8080"},
+		{AddrFamilyIPv4, dualStack, "dual.test:8080", "127.0.0.1:8080"},
+		{AddrFamilyIPv6, dualStack, "dual.test:8080", "[::1]:8080"},
+		{AddrFamilyIPv6, v4Only, "dual.test:8080", "dual.test:8080"}, // falls back to the other family
+		{AddrFamilyIPv4, dualStack, "[::1]:8080", "[::1]:8080"},      // IPs are dialed as is
+	}
+	for _, tc := range cases {
+		got, err := resolveFamily(context.TODO(), tc.addr, tc.family, tc.lookup)
+		require.NoError(t, err, tc.family)
+		require.Equal(t, tc.want, got, tc.family)
+	}
+
+	// The chosen addresses reach a dual-stack listener by the preferred family.
+	lis, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("Dual-stack loopback is not available: %v", err)
+	}
+	defer func() { require.NoError(t, lis.Close()) }()
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+
+	for _, family := range []AddressFamily{AddrFamilyIPv4, AddrFamilyIPv6} {
+		addr, err := resolveFamily(context.TODO(), net.JoinHostPort("dual.test", port), family, dualStack)
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Skipf("Dual-stack loopback is not available: %v", err)
+		}
+		srvConn, err := lis.Accept()
+		require.NoError(t, err)
+		require.True(t, family.matches(srvConn.RemoteAddr().(*net.TCPAddr).IP), family)
+		require.NoError(t, conn.Close())
+		require.NoError(t, srvConn.Close())
+	}
+}
@@ -1,6 +1,7 @@
 package dmsg
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strings"
@@ -16,6 +17,20 @@ const (
 	// HandshakePayloadVersion contains payload version to maintain compatibility with future versions
 	// of HandshakeData format.
 	HandshakePayloadVersion = "2.0"
+
+	// ProtocolVersion is the stream protocol version advertised in client entries.
+	// Clients of different major versions are incompatible.
+	ProtocolVersion = "2.0"
+)
+
+// Features of the stream protocol, which clients advertise in their entries (along with Config.Features). Streams only
+// use a feature if the remote client advertises it, as older clients cannot decode it's frames.
+const (
+	// FeatureRekey is the in-band rekeying of streams (see Stream.Rekey).
+	FeatureRekey = "rekey"
+
+	// FeatureCloseCode is the closing of streams with an application error code (see Stream.CloseWithCode).
+	FeatureCloseCode = "close_code"
 )
 
 var (
@@ -232,6 +247,105 @@ func (resp StreamResponse) Verify(req StreamRequest) error {
 	return nil
 }
 
+// verifyServerRejection verifies that the response is a rejection of the request by the server which relays the stream
+// (such as when the limit of streams relayed for the initiator is reached), returning the reason of the rejection.
+// Such rejections are signed by the server rather than the responding client.
+func (resp StreamResponse) verifyServerRejection(req StreamRequest, srvPK cipher.PubKey) (bool, error) {
+	if resp.Accepted || resp.ReqHash != req.raw.Hash() {
+		return false, nil
+	}
+	if err := cipher.VerifyPubKeySignedPayload(srvPK, resp.raw.Sig(), resp.raw.Object()); err != nil {
+		return false, nil
+	}
+	ok, err := ErrorFromCode(resp.ErrCode)
+	if !ok {
+		err = ErrDialRespNotAccepted
+	}
+	return true, err
+}
+
+// makeSignedGoAway encodes and signs a GOAWAY notice, which a server sends to a client which should move to other
+// servers. The reason is either ErrServerGoAway (the server is shutting down), ErrServerFull, ErrServerDraining,
+// ErrClientTooSlow, or ErrClientOverBudget.
+// The notice is a StreamRequest which originates from the server itself, with zero ports, and the code of the reason in
+// place of the noise message. Such requests are invalid stream requests, so clients which do not understand GOAWAY
+// notices reject them (and close the session).
+func makeSignedGoAway(srvPK, clientPK cipher.PubKey, sk cipher.SecKey, reason Error) SignedObject {
+	code := make([]byte, 2)
+	binary.BigEndian.PutUint16(code, uint16(reason.code))
+	req := StreamRequest{
+		Timestamp: time.Now().UnixNano(),
+		SrcAddr:   Addr{PK: srvPK},
+		DstAddr:   Addr{PK: clientPK},
+		NoiseMsg:  code,
+	}
+	return MakeSignedStreamRequest(&req, sk)
+}
+
+// makeSignedStreamNotice encodes and signs a notice that the server closes a relayed stream for the given reason: as
+// the remote client disconnected from the server (ErrPeerDisconnected), or as the stream is idle (ErrStreamIdle). The
+// server also notifies the client of frames of a stream which it drops (ErrStreamFramesDropped). It is a GOAWAY notice
+// with the code of the reason followed by the yamux ID of the client's stream in place of the noise message.
+func makeSignedStreamNotice(srvPK, clientPK cipher.PubKey, sk cipher.SecKey, reason Error,
+	streamID uint32) SignedObject {
+	msg := make([]byte, 6)
+	binary.BigEndian.PutUint16(msg, uint16(reason.code))
+	binary.BigEndian.PutUint32(msg[2:], streamID)
+	req := StreamRequest{
+		Timestamp: time.Now().UnixNano(),
+		SrcAddr:   Addr{PK: srvPK},
+		DstAddr:   Addr{PK: clientPK},
+		NoiseMsg:  msg,
+	}
+	return MakeSignedStreamRequest(&req, sk)
+}
+
+// streamNotice returns the yamux ID of the stream of a GOAWAY notice which notifies that the server closes the stream,
+// and the reason (false if the notice is not such).
+func (req StreamRequest) streamNotice() (uint32, Error, bool) {
+	if len(req.NoiseMsg) != 6 {
+		return 0, Error{}, false
+	}
+	var reason Error
+	switch errorCode(binary.BigEndian.Uint16(req.NoiseMsg)) {
+	case ErrPeerDisconnected.code:
+		reason = ErrPeerDisconnected
+	case ErrStreamIdle.code:
+		reason = ErrStreamIdle
+	case ErrStreamFramesDropped.code:
+		reason = ErrStreamFramesDropped
+	default:
+		return 0, Error{}, false
+	}
+	return binary.BigEndian.Uint32(req.NoiseMsg[2:]), reason, true
+}
+
+// goAwayReason returns the reason of a GOAWAY notice (ErrServerGoAway if unknown).
+func (req StreamRequest) goAwayReason() error {
+	if len(req.NoiseMsg) != 2 {
+		return ErrServerGoAway
+	}
+	ok, err := ErrorFromCode(errorCode(binary.BigEndian.Uint16(req.NoiseMsg)))
+	if ok && (err == ErrServerFull || err == ErrServerDraining || err == ErrClientTooSlow || err == ErrClientOverBudget ||
+		err == ErrProtocolViolation || err == ErrStreamBufferOverflow) {
+		return err
+	}
+	return ErrServerGoAway
+}
+
+// isGoAway returns true if the request is a GOAWAY notice of the given server.
+func (req StreamRequest) isGoAway(srvPK cipher.PubKey) bool {
+	return req.SrcAddr.PK == srvPK && req.SrcAddr.Port == 0 && req.DstAddr.Port == 0
+}
+
+// verifyGoAway verifies the signature of a GOAWAY notice.
+func (req StreamRequest) verifyGoAway() error {
+	if err := cipher.VerifyPubKeySignedPayload(req.SrcAddr.PK, req.raw.Sig(), req.raw.Object()); err != nil {
+		return ErrReqInvalidSig.Wrap(err)
+	}
+	return nil
+}
+
 // SignBytes signs the provided bytes with the given secret key.
 func SignBytes(b []byte, sk cipher.SecKey) cipher.Sig {
 	sig, err := cipher.SignPayload(b, sk)
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+
+	"github.com/skycoin/dmsg/cipher"
 )
 
 func awaitDone(ctx context.Context, done chan struct{}) {
@@ -22,6 +24,49 @@ func isClosed(done chan struct{}) bool {
 	}
 }
 
+// sameMetadata returns true if both metadata maps contain the same key/value pairs.
+func sameMetadata(m1, m2 map[string]string) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for k, v := range m1 {
+		if v2, ok := m2[k]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStrings returns true if both lists contain the same strings in the same order.
+func sameStrings(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// samePKs returns true if both lists contain the same public keys, regardless of order.
+func samePKs(pks1, pks2 []cipher.PubKey) bool {
+	if len(pks1) != len(pks2) {
+		return false
+	}
+	set := make(map[cipher.PubKey]struct{}, len(pks1))
+	for _, pk := range pks1 {
+		set[pk] = struct{}{}
+	}
+	for _, pk := range pks2 {
+		if _, ok := set[pk]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 /* Gob IO */
 
 func encodeGob(v interface{}) []byte {
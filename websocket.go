@@ -0,0 +1,172 @@
+package dmsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// webSocketReadLimit is the largest WebSocket message which is read. Messages are read as a stream (rather than being
+// buffered), so this only bounds the writes of the remote, which are much smaller (see noise.MaxWriteSize).
+const webSocketReadLimit = 1 << 20
+
+// ErrWebSocketListenerClosed is returned by WebSocketListener.Accept once the listener is closed.
+var ErrWebSocketListenerClosed = errors.New("websocket listener closed")
+
+// isWebSocketAddr returns true if the given server address is a ws:// or wss:// URL, which the server is dialed at over
+// WebSocket (see WebSocketListener).
+func isWebSocketAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// dialWebSocket dials the dmsg server at the given ws:// or wss:// URL. The context only bounds the dial. Host names
+// are dialed by IPs of the given family (see resolveFamily).
+func dialWebSocket(ctx context.Context, addr string, family AddressFamily) (net.Conn, error) {
+	opts := &websocket.DialOptions{
+		CompressionMode: websocket.CompressionDisabled, // the session is encrypted, so it does not compress
+	}
+	if family != AddrFamilyAuto {
+		opts.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: familyDialContext(family),
+		}}
+	}
+	wsConn, _, err := websocket.Dial(ctx, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newWebSocketConn(context.Background(), wsConn, webSocketAddr(""), webSocketAddr(addr)), nil
+}
+
+// WebSocketListener accepts sessions of clients over WebSocket connections, for clients which cannot reach the server
+// over raw TCP (i.e. behind HTTP-only middleboxes).
+// It is an http.Handler, which the operator mounts on an HTTP(S) server, and a net.Listener, which is served by the
+// dmsg server (see Server.ServeListeners) alongside or in place of TCP listeners. The server is to be advertised by the
+// ws:// or wss:// URL of the handler, so that clients dial it over WebSocket.
+// The session is carried as the exact byte stream of the TCP path, split across binary messages. Hence, WebSocket and
+// TCP clients of the same server interoperate.
+type WebSocketListener struct {
+	url   string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewWebSocketListener creates a WebSocketListener, of which 'url' is the ws:// or wss:// URL that the handler is
+// mounted at (returned by Addr, so that it is advertised if the dmsg server is not given an address).
+func NewWebSocketListener(url string) *WebSocketListener {
+	return &WebSocketListener{
+		url:   url,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// ServeHTTP implements http.Handler. It upgrades the request to a WebSocket connection, which is accepted as a session
+// connection, and returns once the connection is closed.
+func (wl *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	if err != nil {
+		return // the response is written by Accept
+	}
+
+	var local net.Addr = webSocketAddr(wl.url)
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+	var remote net.Addr = webSocketAddr(r.RemoteAddr)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	}
+	conn := newWebSocketConn(r.Context(), wsConn, local, remote)
+
+	select {
+	case wl.conns <- conn:
+	case <-wl.done:
+		_ = wsConn.Close(websocket.StatusGoingAway, "server closed") //nolint:errcheck
+		return
+	}
+	// The connection is bound to the request, so the handler stays until the connection is closed.
+	<-conn.closed
+}
+
+// Accept implements net.Listener.
+func (wl *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, ErrWebSocketListenerClosed
+	}
+}
+
+// Close implements net.Listener. Connections which are already accepted are not closed.
+func (wl *WebSocketListener) Close() error {
+	closed := false
+	wl.once.Do(func() {
+		close(wl.done)
+		closed = true
+	})
+	if !closed {
+		return ErrWebSocketListenerClosed
+	}
+	return nil
+}
+
+// Addr implements net.Listener. It returns the URL of the listener.
+func (wl *WebSocketListener) Addr() net.Addr {
+	return webSocketAddr(wl.url)
+}
+
+// webSocketAddr is the address of a WebSocket endpoint (or of it's remote, if it's IP address is unknown).
+type webSocketAddr string
+
+// Network implements net.Addr.
+func (webSocketAddr) Network() string { return "websocket" }
+
+// String implements net.Addr.
+func (a webSocketAddr) String() string { return string(a) }
+
+// webSocketConn is a session connection over WebSocket, which carries the byte stream in binary messages.
+type webSocketConn struct {
+	net.Conn
+	local, remote net.Addr
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newWebSocketConn(ctx context.Context, wsConn *websocket.Conn, local, remote net.Addr) *webSocketConn {
+	wsConn.SetReadLimit(webSocketReadLimit)
+	return &webSocketConn{
+		Conn:   websocket.NetConn(ctx, wsConn, websocket.MessageBinary),
+		local:  local,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr  { return c.local }
+func (c *webSocketConn) RemoteAddr() net.Addr { return c.remote }
+
+// Write writes the data as a single binary message. Empty writes (which noise uses to check for write timeouts) are
+// not sent, as they would be empty messages.
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
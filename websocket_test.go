@@ -0,0 +1,96 @@
+package dmsg
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/util/logging"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/dmsg/cipher"
+	"github.com/skycoin/dmsg/disc"
+)
+
+func TestServer_WebSocket(t *testing.T) {
+	dc := disc.NewMock(0)
+
+	// The server accepts sessions over TCP, and over WebSocket via an HTTP server.
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	wsURL := "ws://" + httpLis.Addr().String() + "/dmsg"
+	wsLis := NewWebSocketListener(wsURL)
+	mux := http.NewServeMux()
+	mux.Handle("/dmsg", wsLis)
+	httpSrv := &http.Server{Handler: mux}
+	go func() { _ = httpSrv.Serve(httpLis) }() //nolint:errcheck
+	defer func() { require.NoError(t, httpSrv.Close()) }()
+
+	srvPK, srvSK := GenKeyPair(t, "server")
+	srv := NewServer(srvPK, srvSK, dc, nil, nil)
+	srv.SetLogger(logging.MustGetLogger("server"))
+	srvCh := make(chan error, 1)
+	go func() { srvCh <- srv.ServeListeners([]net.Listener{wsLis, tcpLis}, "") }() //nolint:errcheck
+	<-srv.Ready()
+	require.Equal(t, wsURL, srv.AdvertisedAddr())
+	require.NoError(t, srv.CheckAdvertisedAddr(context.Background()))
+
+	// Client A dials the advertised URL over WebSocket, and client B dials the TCP listener instead.
+	newClient := func(name string, resolver AddressResolver) *Client {
+		conf := DefaultConfig()
+		conf.AddressResolver = resolver
+		pk, sk := GenKeyPair(t, name)
+		c := NewClient(pk, sk, dc, conf)
+		c.SetLogger(logging.MustGetLogger(name))
+		go c.Serve(context.Background())
+		waitFor(t, time.Second*10, func() bool {
+			_, ok := srv.serverSession(pk)
+			return ok
+		})
+		return c
+	}
+	clientA := newClient("client_A", nil)
+	defer func() { require.NoError(t, clientA.Close()) }()
+	clientB := newClient("client_B", func(cipher.PubKey, string) string { return tcpLis.Addr().String() })
+	defer func() { require.NoError(t, clientB.Close()) }()
+
+	sesA, ok := clientA.Session(srvPK)
+	require.True(t, ok)
+	require.Equal(t, "websocket", sesA.RemoteTCPAddr().Network())
+	sesB, ok := clientB.Session(srvPK)
+	require.True(t, ok)
+	require.Equal(t, "tcp", sesB.RemoteTCPAddr().Network())
+	srvSesA, ok := srv.serverSession(clientA.LocalPK())
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1", srvSesA.RemoteTCPAddr().(*net.TCPAddr).IP.String())
+
+	// Streams are relayed between both transports in both directions, with more data than fits a single message.
+	lisB, err := clientB.Listen(80)
+	require.NoError(t, err)
+	connA, err := clientA.DialStream(context.TODO(), Addr{PK: clientB.LocalPK(), Port: 80})
+	require.NoError(t, err)
+	connB, err := lisB.AcceptStream()
+	require.NoError(t, err)
+
+	msg := cipher.RandByte(256 * 1024)
+	for _, dir := range [][2]*Stream{{connA, connB}, {connB, connA}} {
+		go func(w *Stream) {
+			_, _ = w.Write(msg) //nolint:errcheck
+		}(dir[0])
+		got := make([]byte, len(msg))
+		_, err := io.ReadFull(dir[1], got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+	}
+
+	// Closing logic.
+	require.NoError(t, connA.Close())
+	require.NoError(t, connB.Close())
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-srvCh)
+}